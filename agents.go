@@ -0,0 +1,332 @@
+package main
+// Agent mode - lets one Web Console server (the "coordinator") run Tasks on other machines. An agent is simply this same executable, started with
+// the "--agent" option giving the coordinator's URL. Agents register with the coordinator using the shared agent secret, then poll for work; any
+// Task with a "runner" option set to an agent's name is run on that agent, with output and exit status sent back to the coordinator so the Task
+// appears in the web interface just as if it had run locally.
+
+import (
+	// Standard libraries.
+	"os"
+	"fmt"
+	"sync"
+	"time"
+	"errors"
+	"strings"
+	"net/url"
+	"net/http"
+	"io/ioutil"
+	"encoding/json"
+)
+
+// How long (in seconds) an agent can go without contacting the coordinator before we decide it has gone away.
+const agentTimeout = 60
+// How long (in seconds) a poll request from an agent is held open waiting for work.
+const agentPollTime = 20
+
+// A job for an agent - either run a Task or stop a running one.
+type agentJob struct {
+	Action string `json:"action"`
+	TaskID string `json:"taskID"`
+	RunID string `json:"runID"`
+	Command []string `json:"command,omitempty"`
+}
+
+// A Task currently running on an agent. Output from the agent is passed to runTask on the output channel, the exit status on the exit channel
+// (an empty string for success). Output is sent, and the output channel closed once the run has finished, with outputLock held, so output arriving
+// as the run finishes is never sent on a closed channel.
+type agentRun struct {
+	agentName string
+	runID string
+	output chan taskOutputLine
+	exit chan string
+	outputLock sync.Mutex
+	finished bool
+}
+
+// Coordinator side: the time each agent was last heard from, the tokens issued to agents (mapped to the agent's name), jobs waiting to be
+// collected by each agent, and the Tasks currently running on agents.
+var agentLastSeen = map[string]int64{}
+var agentTokens = map[string]string{}
+var agentJobs = map[string][]agentJob{}
+var agentRuns = map[string]*agentRun{}
+
+// Agent side: the token issued to us by the coordinator.
+var agentToken = ""
+
+// Returns true if the named agent has been in contact recently.
+func agentIsConnected(theAgentName string) bool {
+	return time.Now().Unix() - agentLastSeen[theAgentName] <= agentTimeout
+}
+
+// Start a Task running on the given agent. Returns a channel of output lines and a function that waits for the Task to finish, matching
+// startTaskProcess and exec.Cmd's Wait for locally-run Tasks.
+func startAgentRun(theTaskID string, theRunID string, theAgentName string) (chan taskOutputLine, func() error, error) {
+	if !agentIsConnected(theAgentName) {
+		return nil, nil, errors.New("Agent \"" + theAgentName + "\" isn't connected.")
+	}
+	run := &agentRun{agentName: theAgentName, runID: theRunID, output: make(chan taskOutputLine), exit: make(chan string, 1)}
+	agentRuns[theTaskID] = run
+	agentJobs[theAgentName] = append(agentJobs[theAgentName], agentJob{"run", theTaskID, theRunID, runningTasks[theTaskID].Args})
+	// Keep an eye on the agent - if it stops contacting us part-way through a run, give up on the run rather than leaving it running forever.
+	go func() {
+		for agentRuns[theTaskID] == run {
+			if !agentIsConnected(theAgentName) {
+				finishAgentRun(theTaskID, theRunID, "Lost contact with agent \"" + theAgentName + "\".")
+			}
+			time.Sleep(5 * time.Second)
+		}
+	}()
+	waitForTask := func() error {
+		exitMessage := <-run.exit
+		if exitMessage == "" {
+			return nil
+		}
+		return errors.New(exitMessage)
+	}
+	return run.output, waitForTask, nil
+}
+
+// Mark a Task running on an agent as finished, with the given exit status (blank for success).
+func finishAgentRun(theTaskID string, theRunID string, theExitMessage string) error {
+	run, runFound := agentRuns[theTaskID]
+	if !runFound || run.runID != theRunID {
+		return errors.New("Run " + theRunID + " of Task " + theTaskID + " isn't running on an agent.")
+	}
+	delete(agentRuns, theTaskID)
+	run.outputLock.Lock()
+	run.finished = true
+	close(run.output)
+	run.outputLock.Unlock()
+	run.exit <- theExitMessage
+	return nil
+}
+
+// Ask the agent running the given Task to stop it. Returns false if the Task isn't running on an agent.
+func stopAgentRun(theTaskID string) bool {
+	run, runFound := agentRuns[theTaskID]
+	if !runFound {
+		return false
+	}
+	agentJobs[run.agentName] = append(agentJobs[run.agentName], agentJob{"stop", theTaskID, run.runID, nil})
+	return true
+}
+
+// Returns a list of known agents, one per line, each as tab-separated name, time last seen and the IDs of any Tasks running on that agent.
+func listAgents() []string {
+	var agentList []string
+	for agentName, lastSeen := range agentLastSeen {
+		var agentTaskIDs []string
+		for taskID, run := range agentRuns {
+			if run.agentName == agentName {
+				agentTaskIDs = append(agentTaskIDs, taskID)
+			}
+		}
+		agentList = append(agentList, agentName + "\t" + time.Unix(lastSeen, 0).Format(time.RFC3339) + "\t" + strings.Join(agentTaskIDs, ","))
+	}
+	return agentList
+}
+
+// Handle an API call from an agent. Agents first call "register" with the agent secret to get a token, which is then used for all other calls.
+func handleAgentRequest(theResponseWriter http.ResponseWriter, theRequest *http.Request, theRequestPath string) {
+	if strings.HasPrefix(theRequestPath, "/api/agent/register") {
+		agentName := theRequest.Form.Get("name")
+		if arguments["agentsecret"] == "" || !checkPasswordHash(getRequestCredential(theRequest, "secret", true), arguments["agentsecret"]) {
+			writeAuditLog("", "Failed agent registration from " + getClientIP(theRequest) + ".")
+			writeNotAuthorised(theResponseWriter, theRequest, 0, "incorrect agent secret")
+		} else if agentName == "" {
+			fmt.Fprintf(theResponseWriter, "ERROR: Missing parameter name.")
+		} else if newAgentToken, randomErr := generateSecureRandomString(); randomErr != nil {
+			writeInternalError(theResponseWriter, theRequest, randomErr)
+		} else {
+			agentTokens[newAgentToken] = agentName
+			agentLastSeen[agentName] = time.Now().Unix()
+			saveToken("agent", newAgentToken, agentName, agentLastSeen[agentName])
+			writeAuditLog("", "Agent " + agentName + " registered from " + getClientIP(theRequest) + ".")
+			fmt.Fprint(theResponseWriter, newAgentToken)
+		}
+		return
+	}
+	loadSharedToken("agent", getRequestCredential(theRequest, "token", true))
+	agentName, agentFound := agentTokens[getRequestCredential(theRequest, "token", true)]
+	if !agentFound {
+		writeNotAuthorised(theResponseWriter, theRequest, 0, "invalid or expired agent token")
+		return
+	}
+	agentLastSeen[agentName] = time.Now().Unix()
+	// Save when the token was last used, so it doesn't expire (in the token store, or in Redis for other servers) while the agent is using it.
+	saveToken("agent", getRequestCredential(theRequest, "token", true), agentName, agentLastSeen[agentName])
+	// Returns a JSON list of jobs for the agent, holding the request open for a while if there aren't any yet.
+	if strings.HasPrefix(theRequestPath, "/api/agent/poll") {
+		pollEnd := time.Now().Add(agentPollTime * time.Second)
+		for len(agentJobs[agentName]) == 0 && time.Now().Before(pollEnd) {
+			select {
+				case <-theRequest.Context().Done():
+					return
+				case <-time.After(250 * time.Millisecond):
+			}
+		}
+		agentLastSeen[agentName] = time.Now().Unix()
+		jobsJSON, _ := json.Marshal(agentJobs[agentName])
+		delete(agentJobs, agentName)
+		fmt.Fprint(theResponseWriter, string(jobsJSON))
+	// Output from a Task, as a JSON list of output events in the "events" parameter.
+	} else if strings.HasPrefix(theRequestPath, "/api/agent/output") {
+		run, runFound := agentRuns[theRequest.Form.Get("taskID")]
+		if !runFound || run.agentName != agentName || run.runID != theRequest.Form.Get("runID") {
+			fmt.Fprintf(theResponseWriter, "ERROR: Run isn't running on this agent.")
+			return
+		}
+		var outputEvents []taskOutputEvent
+		if jsonErr := json.Unmarshal([]byte(theRequest.Form.Get("events")), &outputEvents); jsonErr != nil {
+			fmt.Fprintf(theResponseWriter, "ERROR: Can't parse events - %s", jsonErr.Error())
+			return
+		}
+		run.outputLock.Lock()
+		defer run.outputLock.Unlock()
+		if run.finished {
+			fmt.Fprintf(theResponseWriter, "ERROR: Run isn't running on this agent.")
+			return
+		}
+		for _, outputEvent := range outputEvents {
+			eventTime, timeErr := time.Parse(time.RFC3339Nano, outputEvent.Timestamp)
+			if timeErr != nil {
+				eventTime = time.Now()
+			}
+			run.output <- taskOutputLine{eventTime, outputEvent.Stream, outputEvent.Line}
+		}
+		fmt.Fprint(theResponseWriter, "OK")
+	// A Task has finished, with any error message given in the "error" parameter.
+	} else if strings.HasPrefix(theRequestPath, "/api/agent/finish") {
+		run, runFound := agentRuns[theRequest.Form.Get("taskID")]
+		if !runFound || run.agentName != agentName {
+			fmt.Fprintf(theResponseWriter, "ERROR: Run isn't running on this agent.")
+		} else if finishErr := finishAgentRun(theRequest.Form.Get("taskID"), theRequest.Form.Get("runID"), theRequest.Form.Get("error")); finishErr != nil {
+			fmt.Fprintf(theResponseWriter, "ERROR: %s", finishErr.Error())
+		} else {
+			fmt.Fprint(theResponseWriter, "OK")
+		}
+	} else {
+		fmt.Fprintf(theResponseWriter, "ERROR: Unknown API call: %s", theRequestPath)
+	}
+}
+
+// Agent side: make an API call to the coordinator, returning the response.
+func callCoordinator(theFunction string, theValues url.Values, theCredential string) (string, error) {
+	agentRequest, requestErr := http.NewRequest("POST", strings.TrimRight(arguments["agent"], "/") + "/api/agent/" + theFunction, strings.NewReader(theValues.Encode()))
+	if requestErr != nil {
+		return "", requestErr
+	}
+	agentRequest.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	agentRequest.Header.Set("Authorization", "Bearer " + theCredential)
+	agentResponse, responseErr := getHTTPClient("agent").Do(agentRequest)
+	if responseErr != nil {
+		return "", responseErr
+	}
+	defer agentResponse.Body.Close()
+	responseBody, readErr := ioutil.ReadAll(agentResponse.Body)
+	if readErr != nil {
+		return "", readErr
+	}
+	if strings.HasPrefix(string(responseBody), "ERROR: Not authorised") {
+		agentToken = ""
+	}
+	if strings.HasPrefix(string(responseBody), "ERROR") {
+		return "", errors.New(string(responseBody))
+	}
+	return string(responseBody), nil
+}
+
+// Agent side: run a Task as asked by the coordinator, in a folder for that Task under our own Tasks folder, sending output back as it arrives.
+func runAgentJob(theJob agentJob) {
+	exitMessage := ""
+	taskFolder := arguments["taskroot"] + "/" + theJob.TaskID
+	if len(theJob.Command) == 0 {
+		exitMessage = "No command given."
+	} else if mkdirErr := os.MkdirAll(taskFolder, os.ModePerm); mkdirErr != nil {
+		exitMessage = "Can't create Task folder - " + mkdirErr.Error()
+	} else {
+		runningTasks[theJob.TaskID] = newTaskCommand(getPlatformCommand(theJob.Command, taskFolder))
+		runningTasks[theJob.TaskID].Dir = taskFolder
+		outputLines, startErr := startTaskProcess(runningTasks[theJob.TaskID])
+		if startErr != nil {
+			exitMessage = startErr.Error()
+		} else {
+			// Send output in batches, at most every half second, rather than making a request for every line.
+			var outputEvents []taskOutputEvent
+			sendOutput := func() {
+				if len(outputEvents) > 0 {
+					eventsJSON, _ := json.Marshal(outputEvents)
+					if _, sendErr := callCoordinator("output", url.Values{"taskID": {theJob.TaskID}, "runID": {theJob.RunID}, "events": {string(eventsJSON)}}, agentToken); sendErr != nil {
+						fmt.Println("ERROR: Can't send output for Task " + theJob.TaskID + " - " + sendErr.Error())
+					}
+					outputEvents = nil
+				}
+			}
+			sendTicker := time.NewTicker(500 * time.Millisecond)
+			outputFinished := false
+			for !outputFinished {
+				select {
+					case outputLine, outputOK := <-outputLines:
+						if outputOK {
+							outputEvents = append(outputEvents, taskOutputEvent{outputLine.timestamp.Format(time.RFC3339Nano), outputLine.stream, outputLine.line, theJob.RunID})
+						} else {
+							outputFinished = true
+						}
+					case <-sendTicker.C:
+						sendOutput()
+				}
+			}
+			sendTicker.Stop()
+			sendOutput()
+			if waitErr := runningTasks[theJob.TaskID].Wait(); waitErr != nil {
+				exitMessage = waitErr.Error()
+			}
+		}
+		delete(runningTasks, theJob.TaskID)
+	}
+	if _, finishErr := callCoordinator("finish", url.Values{"taskID": {theJob.TaskID}, "runID": {theJob.RunID}, "error": {exitMessage}}, agentToken); finishErr != nil {
+		fmt.Println("ERROR: Can't report Task " + theJob.TaskID + " finishing - " + finishErr.Error())
+	}
+}
+
+// Agent side: the main loop - register with the coordinator, then keep asking it for jobs. If we lose contact we keep trying, re-registering if
+// our token has expired.
+func runAgent() {
+	agentName := arguments["agentname"]
+	if agentName == "" {
+		agentName, _ = os.Hostname()
+	}
+	fmt.Println("Running as agent \"" + agentName + "\" for coordinator " + arguments["agent"])
+	for {
+		if agentToken == "" {
+			newAgentToken, registerErr := callCoordinator("register", url.Values{"name": {agentName}}, arguments["agentsecret"])
+			if registerErr != nil {
+				fmt.Println("ERROR: Can't register with coordinator - " + registerErr.Error())
+				time.Sleep(10 * time.Second)
+				continue
+			}
+			agentToken = newAgentToken
+		}
+		pollResult, pollErr := callCoordinator("poll", url.Values{}, agentToken)
+		if pollErr != nil {
+			fmt.Println("ERROR: Can't contact coordinator - " + pollErr.Error())
+			time.Sleep(5 * time.Second)
+			continue
+		}
+		var jobs []agentJob
+		if jsonErr := json.Unmarshal([]byte(pollResult), &jobs); jsonErr != nil {
+			fmt.Println("ERROR: Can't parse jobs from coordinator - " + jsonErr.Error())
+			time.Sleep(5 * time.Second)
+			continue
+		}
+		for _, job := range jobs {
+			if job.Action == "run" {
+				go runAgentJob(job)
+			} else if job.Action == "stop" {
+				if runningTask, taskFound := runningTasks[job.TaskID]; taskFound {
+					killProcessTree(runningTask)
+				}
+			}
+		}
+	}
+}
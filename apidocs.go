@@ -0,0 +1,335 @@
+package main
+// API documentation - every API call is described in apiEndpoints below, from which an OpenAPI 3 document is generated and served at
+// api/docs/openapi.json, along with a page (apidocs.html in the webroot) that lists the calls and lets you try them out, at api/docs. The list is
+// also what decides which calls exist: a call to a path under /api/ that isn't listed here is refused as unknown before it reaches its handler,
+// so an API call can't be added without being documented.
+
+import (
+	// Standard libraries.
+	"strings"
+	"encoding/json"
+)
+
+// A parameter taken by an API call.
+type apiParameter struct {
+	name string
+	description string
+	required bool
+}
+
+// An API call: its path (with any part of the path that varies given in braces, e.g. "{runID}"), the group it's listed in, a description,
+// how it's authorised ("none", "task", "view" - a Task call a view-only token can make - "admin", "tenantAdmin" - an admin call a tenant's admin
+// secret can make - "callback" or "agent"), the parameters it takes on top of those needed for authorisation and the type of its response.
+type apiEndpoint struct {
+	path string
+	group string
+	description string
+	authorisation string
+	parameters []apiParameter
+	responseType string
+}
+
+// Parameters taken by several calls.
+var listingParameters = []apiParameter{
+	{"limit", "The most items to return.", false},
+	{"offset", "The number of items to skip.", false},
+	{"after", "A cursor - the ID of the last item on the previous page, as given in the X-Next-Cursor header.", false},
+}
+var taskListingParameters = append([]apiParameter{
+	{"tag", "List only Tasks with this tag.", false},
+	{"groupBy", "If \"tag\", group the Tasks by tag.", false},
+	{"q", "List only Tasks whose title or description contains this text (not case-sensitive).", false},
+}, listingParameters...)
+var outputParameters = []apiParameter{
+	{"line", "The line of output to start from.", false},
+	{"runID", "The run being followed - if the Task has been run again since, output is sent from the start of the new run.", false},
+	{"format", "If \"ndjson\", each line is returned as a JSON event.", false},
+	{"timestamps", "If \"true\", each line of plain text output starts with the time it was output and a tab.", false},
+}
+
+// Every API call.
+var apiEndpoints = []apiEndpoint{
+	{"/api/docs", "Documentation", "A page listing the API calls, each of which can be tried out.", "none", nil, "text/html"},
+	{"/api/docs/openapi.json", "Documentation", "An OpenAPI 3 description of the API.", "none", nil, "application/json"},
+	{"/api/docs/webconsole.proto", "Documentation", "The protobuf description of the gRPC service.", "none", nil, "text/plain"},
+	{"/api/getPublicTaskList", "Tasks", "Returns the public Tasks, as a JSON object of titles by Task ID, or grouped by tag as a JSON list of groups.", "none", taskListingParameters, "application/json"},
+	{"/api/getBroadcast", "Tasks", "Returns the current broadcast message, if any, as JSON.", "none", nil, "application/json"},
+	{"/api/getToken", "Tasks", "Returns a token in exchange for the Task's secret.", "view", []apiParameter{
+		{"scope", "If \"view\", returns a new, view-only token.", false},
+	}, "text/plain"},
+	{"/api/getTaskDetails", "Tasks", "Returns the Task's title and description, separated by a newline.", "view", nil, "text/plain"},
+	{"/api/runTask", "Runs", "Runs the Task. Returns \"OK\", or \"PENDING\" if the run needs approval.", "task", []apiParameter{
+		{"preset", "The name of one of the Task's parameter presets to run it with.", false},
+		{"param_name", "The value of a parameter the Task has rules for, e.g. param_server.", false},
+	}, "text/plain"},
+	{"/api/getPresets", "Runs", "Returns the Task's parameter presets as a JSON object, each preset's parameters by name, with secret parameters masked.", "task", nil, "application/json"},
+	{"/api/stopTask", "Runs", "Stops the Task if it's running, or cancels a run waiting for approval or a retry waiting to start.", "task", nil, "text/plain"},
+	{"/api/signalTask", "Runs", "Sends a signal, one of those listed in the Task's \"signals\" option, to the running Task.", "task", []apiParameter{
+		{"signal", "The signal to send, e.g. \"HUP\".", true},
+	}, "text/plain"},
+	{"/api/getTaskRunning", "Runs", "Returns \"YES\" if the Task is running, \"NO\" otherwise.", "view", nil, "text/plain"},
+	{"/api/getTaskStatus", "Runs", "Returns the Task's status as JSON - whether it's running, its resource usage, last run, startup run, next run and service status.", "view", nil, "application/json"},
+	{"/api/taskFreshness", "Runs", "Returns \"OK\" if the Task finished a run successfully within the last maxAge seconds, otherwise an error with a \"503 Service Unavailable\" status.", "view", []apiParameter{
+		{"maxAge", "How many seconds ago the last successful run can have finished.", true},
+	}, "text/plain"},
+	{"/api/getTaskOutput", "Runs", "Returns the Task's output from the given line onwards, ending with \"ERROR: EOF\" once the Task has finished. For a Task with the \"progress\" option set, the estimated percentage complete is given in the \"X-Progress\" header.", "view", outputParameters, "text/plain"},
+	{"/api/streamTaskOutput", "Runs", "As getTaskOutput, but holds the connection open and sends new output as it arrives until the Task finishes.", "view", outputParameters, "text/plain"},
+	{"/api/keepAlive", "Runs", "Keeps the token given alive.", "view", nil, "text/plain"},
+	{"/api/previewTask", "Runs", "Returns what a run of the Task would execute, without running anything.", "task", nil, "text/plain"},
+	{"/api/getRunList", "Run History", "Returns the IDs of previous runs of the Task, one per line.", "view", append([]apiParameter{
+		{"order", "If \"newest\", the newest run comes first.", false},
+		{"details", "If \"true\", each run ID is followed by a tab and who or what triggered the run.", false},
+	}, listingParameters...), "text/plain"},
+	{"/api/getRunTrigger", "Run History", "Returns who or what triggered a run, the client IP address it came from and the parameters it was given, as JSON.", "task", []apiParameter{
+		{"runID", "The run - defaults to the most recent.", false},
+	}, "application/json"},
+	{"/api/searchRuns", "Run History", "Searches the logs of the Task's previous runs, returning matching lines grep-style.", "view", []apiParameter{
+		{"q", "The text to search for (not case-sensitive).", true},
+		{"regex", "If \"true\", q is a regular expression.", false},
+		{"context", "The number of lines (up to 10) to return either side of each match.", false},
+		{"order", "If \"newest\", the newest run comes first.", false},
+	}, "text/plain"},
+	{"/api/downloadTaskOutput", "Run History", "Returns the complete log of a run as a text file.", "view", []apiParameter{
+		{"runID", "The run - defaults to the most recent.", false},
+		{"gzip", "If \"true\", the log is gzip-compressed.", false},
+		{"step", "For a pipeline, return just this step's output.", false},
+	}, "text/plain"},
+	{"/api/getPipelineStatus", "Run History", "Returns the status of each step of a pipeline run, one per line.", "view", []apiParameter{
+		{"runID", "The run - defaults to the most recent.", false},
+	}, "text/plain"},
+	{"/api/uploadFile", "Files", "Uploads a file (as multipart form data) for the Task's next run.", "task", nil, "text/plain"},
+	{"/api/listFiles", "Files", "Lists the files in the Task's folder, one per line.", "view", []apiParameter{
+		{"path", "A sub-folder to list.", false},
+	}, "text/plain"},
+	{"/api/downloadFile", "Files", "Downloads a file from the Task's folder.", "view", []apiParameter{
+		{"path", "The file to download.", true},
+	}, "application/octet-stream"},
+	{"/api/getApprovalReason", "Approvals", "Returns the reason a running Task is waiting for approval, if it is.", "view", nil, "text/plain"},
+	{"/api/approveTask", "Approvals", "Approves the step a running Task is waiting on.", "task", nil, "text/plain"},
+	{"/api/rejectTask", "Approvals", "Rejects the step a running Task is waiting on.", "task", nil, "text/plain"},
+	{"/api/getPendingRun", "Approvals", "Returns a description of the run waiting for approval, if there is one.", "view", nil, "text/plain"},
+	{"/api/approveRun", "Approvals", "Approves the run waiting for approval.", "task", []apiParameter{
+		{"approverSecret", "The Task's approver secret, if it has one.", false},
+	}, "text/plain"},
+	{"/api/rejectRun", "Approvals", "Rejects the run waiting for approval.", "task", []apiParameter{
+		{"approverSecret", "The Task's approver secret, if it has one.", false},
+	}, "text/plain"},
+	{"/api/admin/listTasks", "Admin", "Lists Tasks, one per line, as tab-separated ID, title, tags and public setting.", "tenantAdmin", taskListingParameters, "text/plain"},
+	{"/api/admin/createShareLink", "Admin", "Returns a share link for a Task.", "tenantAdmin", []apiParameter{
+		{"taskID", "The Task to share.", true},
+		{"scope", "\"view\" (the default) or \"run\".", false},
+		{"expires", "The number of seconds the link lasts (default one day).", false},
+	}, "text/plain"},
+	{"/api/admin/listTokens", "Admin", "Lists the active task tokens, with the Task each was issued for, when and to which client IP address.", "tenantAdmin", []apiParameter{
+		{"taskID", "List only this Task's tokens.", false},
+	}, "application/json"},
+	{"/api/admin/revokeToken", "Admin", "Revokes a token or share link.", "tenantAdmin", []apiParameter{
+		{"token", "The token ID (as listed by api/admin/listTokens), the token itself or a share link's token.", true},
+	}, "text/plain"},
+	{"/api/admin/revokeTaskTokens", "Admin", "Revokes every token and share link issued for a Task, returning how many tokens were revoked.", "tenantAdmin", []apiParameter{
+		{"taskID", "The Task whose tokens to revoke.", true},
+	}, "text/plain"},
+	{"/api/admin/getToken", "Admin", "Returns an admin token, to use in place of the admin secret.", "admin", nil, "text/plain"},
+	{"/api/admin/enrolTOTP", "Admin", "Starts setting up two-factor authentication, returning a TOTP secret and otpauth:// URI as JSON.", "admin", []apiParameter{
+		{"taskID", "The Task to set up - if not given, two-factor authentication is set up for admin access.", false},
+	}, "application/json"},
+	{"/api/admin/confirmTOTP", "Admin", "Turns on two-factor authentication, given a code for the secret returned by api/admin/enrolTOTP.", "admin", []apiParameter{
+		{"taskID", "The Task being set up, if any.", false},
+		{"totpCode", "The code shown by the authenticator app.", true},
+	}, "text/plain"},
+	{"/api/admin/removeTOTP", "Admin", "Turns off two-factor authentication.", "admin", []apiParameter{
+		{"taskID", "The Task to turn it off for - if not given, it's turned off for admin access.", false},
+	}, "text/plain"},
+	{"/api/admin/changeTaskSecret", "Admin", "Changes a Task's secret, revoking its tokens and share links, and returns the new secret.", "tenantAdmin", []apiParameter{
+		{"taskID", "The Task whose secret to change.", true},
+		{"newSecret", "The new secret - a random one is generated if not given.", false},
+	}, "text/plain"},
+	{"/api/admin/grantQuota", "Admin", "Lets a Task be run more times than its quotas allow, and returns how many runs past its quotas it now has.", "tenantAdmin", []apiParameter{
+		{"taskID", "The Task to grant runs to.", true},
+		{"runs", "The number of runs to grant - 1 if not given.", false},
+	}, "text/plain"},
+	{"/api/admin/savePreset", "Admin", "Saves a parameter preset for a Task.", "tenantAdmin", []apiParameter{
+		{"taskID", "The Task to save the preset for.", true},
+		{"name", "The preset's name - letters, numbers, dashes and underscores.", true},
+		{"values", "The preset's parameters, as \"NAME=value, NAME=value\" - blank removes the preset.", false},
+	}, "text/plain"},
+	{"/api/admin/bulkUpdate", "Admin", "Changes config values, or rotates secrets, for many Tasks at once.", "tenantAdmin", []apiParameter{
+		{"set", "A config value to change, as \"key=value\" - can be given more than once. A tenant's admin secret can only set some values.", false},
+		{"rotateSecrets", "If \"true\", give every selected Task a new secret.", false},
+		{"tag", "Change only Tasks with this tag.", false},
+		{"taskIDs", "Change only these Tasks (comma-separated).", false},
+		{"apply", "If \"true\", make the changes - otherwise, list what would change.", false},
+	}, "text/plain"},
+	{"/api/admin/cloneTask", "Admin", "Creates a new Task as a copy of an existing one, returning its ID and secret.", "admin", []apiParameter{
+		{"taskID", "The Task to copy.", true},
+		{"newTaskID", "The new Task's ID - a random one is generated if not given.", false},
+		{"copyFiles", "If \"true\", copy the Task's other files as well as its config.", false},
+	}, "text/plain"},
+	{"/api/admin/purgeData", "Admin", "Removes all stored output, run artifacts and audit log entries matching a pattern.", "admin", []apiParameter{
+		{"pattern", "A regular expression.", true},
+	}, "text/plain"},
+	{"/api/admin/setBroadcast", "Admin", "Shows a message as a banner on every page - a blank message removes it.", "admin", []apiParameter{
+		{"message", "The message.", false},
+		{"expires", "The number of minutes until the message is removed.", false},
+	}, "text/plain"},
+	{"/api/admin/getSchedule", "Admin", "Returns upcoming runs (retries and service restarts) and recent runs, as JSON or an iCalendar feed.", "tenantAdmin", []apiParameter{
+		{"days", "How many days of recent runs to return (default 7, up to 90).", false},
+		{"format", "If \"ics\", the schedule is returned as an iCalendar feed.", false},
+	}, "application/json"},
+	{"/api/admin/getHealth", "Admin", "Returns each Task's status, last run, average run length, failure streak and next run, as JSON.", "tenantAdmin", []apiParameter{
+		{"check", "If \"true\", the status is \"503 Service Unavailable\" when any Task's last run failed.", false},
+	}, "application/json"},
+	{"/api/admin/listAgents", "Admin", "Lists the agents registered with this server, one per line.", "admin", nil, "text/plain"},
+	{"/api/admin/selfTest", "Admin", "Tests connectivity to every outbound integration, one line per integration.", "admin", nil, "text/plain"},
+	{"/api/admin/passkeyRegisterBegin", "Admin", "Starts registering a passkey, returning a JSON challenge.", "admin", nil, "application/json"},
+	{"/api/admin/passkeyRegisterFinish", "Admin", "Finishes registering a passkey.", "admin", []apiParameter{
+		{"clientDataJSON", "As returned by the browser (base64url).", true},
+		{"attestationObject", "As returned by the browser (base64url).", true},
+	}, "text/plain"},
+	{"/api/passkeyLoginBegin", "Admin", "Starts a passkey login, returning a JSON challenge.", "none", nil, "application/json"},
+	{"/api/passkeyLoginFinish", "Admin", "Finishes a passkey login, returning an admin token.", "none", []apiParameter{
+		{"credentialID", "As returned by the browser (base64url).", true},
+		{"clientDataJSON", "As returned by the browser (base64url).", true},
+		{"authenticatorData", "As returned by the browser (base64url).", true},
+		{"signature", "As returned by the browser (base64url).", true},
+	}, "text/plain"},
+	{"/api/taskCallback/{runID}", "Callbacks", "Called by a running Task to add an event to its output or set its progress or status.", "callback", []apiParameter{
+		{"taskID", "The ID of the Task the run belongs to.", true},
+		{"event", "A line of text to add to the output as an event.", false},
+		{"progress", "A percentage to show on the progress bar.", false},
+		{"progressLabel", "A label for the progress bar.", false},
+		{"status", "A short status message.", false},
+	}, "text/plain"},
+	{"/api/agent/register", "Agents", "Registers an agent, returning a token for its other calls.", "agent", []apiParameter{
+		{"name", "The agent's name.", true},
+		{"secret", "The server's agent secret.", true},
+	}, "text/plain"},
+	{"/api/agent/poll", "Agents", "Returns a JSON list of jobs for the agent.", "agent", nil, "application/json"},
+	{"/api/agent/output", "Agents", "Sends output from a Task run on the agent.", "agent", []apiParameter{
+		{"taskID", "The Task.", true},
+		{"runID", "The run.", true},
+		{"events", "A JSON list of output events.", true},
+	}, "text/plain"},
+	{"/api/agent/finish", "Agents", "Reports that a Task run on the agent has finished.", "agent", []apiParameter{
+		{"taskID", "The Task.", true},
+		{"runID", "The run.", true},
+		{"error", "Why the run failed, if it did.", false},
+	}, "text/plain"},
+}
+
+// Returns true if the given request path (under /api/) is one of the API calls listed in apiEndpoints.
+func isDocumentedAPICall(theRequestPath string) bool {
+	for _, endpoint := range apiEndpoints {
+		if bracePos := strings.Index(endpoint.path, "{"); bracePos != -1 {
+			if strings.HasPrefix(theRequestPath, endpoint.path[:bracePos]) && len(theRequestPath) > bracePos && !strings.Contains(theRequestPath[bracePos:], "/") {
+				return true
+			}
+		} else if theRequestPath == endpoint.path {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the OpenAPI 3 document describing the API, for a server at the given path.
+func getOpenAPIDocument(theServerPath string) []byte {
+	paths := map[string]interface{}{}
+	for _, endpoint := range apiEndpoints {
+		parameters := endpoint.parameters
+		switch endpoint.authorisation {
+			case "task", "view":
+				parameters = append([]apiParameter{
+					{"taskID", "The Task.", true},
+					{"token", "A token for the Task - or give it in an \"Authorization: Bearer\" header.", false},
+					{"secret", "The Task's secret, in place of a token.", false},
+					{"totp", "A code from an authenticator app, given with the secret if the Task has two-factor authentication.", false},
+				}, parameters...)
+			case "admin", "tenantAdmin":
+				parameters = append([]apiParameter{
+					{"adminSecret", "The admin secret, or an admin token - or give it in an \"Authorization: Bearer\" header.", false},
+					{"totp", "A code from an authenticator app, given with the admin secret if admin access has two-factor authentication.", false},
+				}, parameters...)
+			case "callback":
+				parameters = append([]apiParameter{{"token", "The run's callback token - or give it in an \"Authorization: Bearer\" header.", false}}, parameters...)
+			case "agent":
+				if endpoint.path != "/api/agent/register" {
+					parameters = append([]apiParameter{{"token", "The agent's token - or give it in an \"Authorization: Bearer\" header.", false}}, parameters...)
+				}
+		}
+		description := endpoint.description + " " + map[string]string{
+			"none": "No authorisation needed.",
+			"task": "Needs a token or secret for the Task - view-only tokens and share links can't make this call.",
+			"view": "Needs a token or secret for the Task - view-only tokens and share links can make this call.",
+			"admin": "Needs the server's admin secret.",
+			"tenantAdmin": "Needs the admin secret - the server's, or a tenant's.",
+			"callback": "Needs the run's callback token.",
+			"agent": "Made by agents.",
+		}[endpoint.authorisation]
+		var queryParameters []map[string]interface{}
+		formProperties := map[string]interface{}{}
+		var requiredProperties []string
+		for _, parameter := range parameters {
+			queryParameters = append(queryParameters, map[string]interface{}{"name": parameter.name, "in": "query", "description": parameter.description, "required": parameter.required, "schema": map[string]string{"type": "string"}})
+			formProperties[parameter.name] = map[string]string{"type": "string", "description": parameter.description}
+			if parameter.required {
+				requiredProperties = append(requiredProperties, parameter.name)
+			}
+		}
+		if bracePos := strings.Index(endpoint.path, "{"); bracePos != -1 {
+			pathParameter := strings.Trim(endpoint.path[bracePos:], "{}")
+			queryParameters = append(queryParameters, map[string]interface{}{"name": pathParameter, "in": "path", "required": true, "schema": map[string]string{"type": "string"}})
+		}
+		responses := map[string]interface{}{"200": map[string]interface{}{
+			"description": "The result - errors are returned as plain text starting \"ERROR: \".",
+			"content": map[string]interface{}{endpoint.responseType: map[string]interface{}{}},
+		}}
+		operationID := strings.Replace(strings.Trim(strings.Replace(endpoint.path, "{runID}", "", -1), "/"), "/", "_", -1)
+		getOperation := map[string]interface{}{"operationId": operationID + "_get", "tags": []string{endpoint.group}, "summary": endpoint.description, "description": description, "responses": responses}
+		if len(queryParameters) > 0 {
+			getOperation["parameters"] = queryParameters
+		}
+		// Calls that change something are only accepted as POST requests - see security.go.
+		pathItem := map[string]interface{}{}
+		if !isStateChangingAPICall(endpoint.path) {
+			pathItem["get"] = getOperation
+		}
+		if endpoint.group != "Documentation" {
+			formSchema := map[string]interface{}{"type": "object", "properties": formProperties}
+			if len(requiredProperties) > 0 {
+				formSchema["required"] = requiredProperties
+			}
+			var pathParameters []map[string]interface{}
+			for _, queryParameter := range queryParameters {
+				if queryParameter["in"] == "path" {
+					pathParameters = append(pathParameters, queryParameter)
+				}
+			}
+			postOperation := map[string]interface{}{"operationId": operationID + "_post", "tags": []string{endpoint.group}, "summary": endpoint.description, "description": description, "responses": responses}
+			if len(pathParameters) > 0 {
+				postOperation["parameters"] = pathParameters
+			}
+			if len(formProperties) > 0 {
+				postOperation["requestBody"] = map[string]interface{}{"content": map[string]interface{}{"application/x-www-form-urlencoded": map[string]interface{}{"schema": formSchema}}}
+			}
+			pathItem["post"] = postOperation
+		}
+		paths[endpoint.path] = pathItem
+	}
+	hookDescription := "Starts the Task from a webhook - see \"Webhook Triggers\". Authorised by the Task's webhook token or signature."
+	paths["/hooks/{taskID}"] = map[string]interface{}{"post": map[string]interface{}{
+		"operationId": "hooks_post", "tags": []string{"Tasks"}, "summary": hookDescription,
+		"parameters": []map[string]interface{}{{"name": "taskID", "in": "path", "required": true, "schema": map[string]string{"type": "string"}}},
+		"responses": map[string]interface{}{"200": map[string]interface{}{"description": "The Task was started."}},
+	}}
+	if theServerPath == "" {
+		theServerPath = "/"
+	}
+	openAPIDocument, _ := json.MarshalIndent(map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]string{"title": "Web Console API", "version": "1.0"},
+		"servers": []map[string]string{{"url": theServerPath}},
+		"paths": paths,
+		"components": map[string]interface{}{"securitySchemes": map[string]interface{}{"bearerAuth": map[string]string{"type": "http", "scheme": "bearer"}}},
+	}, "", "  ")
+	return openAPIDocument
+}
@@ -0,0 +1,99 @@
+package main
+// Approval gates - for dangerous Tasks (production deploys and the like), the "approval" option makes a run wait for a second person's go-ahead
+// before anything is executed. With "approval: Y" set, api/runTask doesn't start the Task but records a pending run request, which someone else
+// - using a different token to the one that asked for the run - then approves (api/approveRun, which starts the Task) or rejects
+// (api/rejectRun). Approving or rejecting also needs the Task's "approverSecret" (a hash, like the Task's secret), which has to be set for runs
+// to be approved at all - anyone with access to the Task can get a second token, so a different token alone doesn't show it's someone else. Each
+// request, approval, rejection and cancellation is recorded in the audit log. Runs started via the API, the web interface or a webhook (see
+// hooks.go) are gated - scheduled runs, chained Tasks and dependencies, for instance, start as usual.
+
+import (
+	// Standard libraries.
+	"time"
+	"errors"
+)
+
+// A run request waiting for approval, with who asked for it (see triggers.go) and the parameters the run is to be given.
+type pendingRun struct {
+	requestedBy string
+	requested time.Time
+	parameters map[string]string
+	trigger runTrigger
+}
+
+// Run requests waiting for approval, by Task ID. A Task has at most one.
+var pendingRuns = map[string]pendingRun{}
+
+// Returns true if the given Task's runs need approving before they start.
+func runNeedsApproval(theTaskDetails map[string]string) bool {
+	return theTaskDetails["approval"] == "Y"
+}
+
+// Ask for a run of the given Task, with the given parameters, to be approved by someone else. theToken identifies who asked, theTrigger is
+// the run's trigger. Asking again while a request is pending leaves the original request as it is.
+func requestRun(theTaskID string, theToken string, theParameters map[string]string, theTrigger runTrigger) {
+	if _, pendingFound := pendingRuns[theTaskID]; pendingFound {
+		return
+	}
+	pendingRuns[theTaskID] = pendingRun{requestedBy: theToken, requested: time.Now(), parameters: theParameters, trigger: theTrigger}
+	writeAuditLog(theTaskID, "Run requested, waiting for approval.")
+}
+
+// Returns a description of the given Task's pending run request, or a blank string if there isn't one.
+func getPendingRun(theTaskID string) string {
+	if pending, pendingFound := pendingRuns[theTaskID]; pendingFound {
+		return "Run requested at " + pending.requested.Format("2006-01-02 15:04:05") + ", waiting for approval."
+	}
+	return ""
+}
+
+// Check that the given token (and approver secret, if the Task has one) can approve or reject the given Task's pending run request.
+func checkRunApprover(theTaskID string, theTaskDetails map[string]string, theToken string, theApproverSecret string) error {
+	pending, pendingFound := pendingRuns[theTaskID]
+	if !pendingFound {
+		return errors.New("No run is waiting for approval.")
+	}
+	if pending.requestedBy == theToken {
+		return errors.New("A run has to be approved by someone other than whoever asked for it.")
+	}
+	if theTaskDetails["approversecret"] == "" {
+		return errors.New("Runs of this Task can't be approved until it has an approverSecret.")
+	}
+	if !checkPasswordHash(theApproverSecret, theTaskDetails["approversecret"]) {
+		return errors.New("Incorrect approver secret.")
+	}
+	return nil
+}
+
+// Approve the given Task's pending run request, starting the run.
+func approveRun(theTaskID string, theTaskDetails map[string]string, theToken string, theApproverSecret string) error {
+	if approverErr := checkRunApprover(theTaskID, theTaskDetails, theToken, theApproverSecret); approverErr != nil {
+		return approverErr
+	}
+	approvedRun := pendingRuns[theTaskID]
+	approvedRun.trigger.Source = approvedRun.trigger.Source + ", approved by token " + getTokenID(theToken)
+	delete(pendingRuns, theTaskID)
+	writeAuditLog(theTaskID, "Run request approved.")
+	return startTask(theTaskID, theTaskDetails, approvedRun.parameters, approvedRun.trigger)
+}
+
+// Reject the given Task's pending run request.
+func rejectRun(theTaskID string, theTaskDetails map[string]string, theToken string, theApproverSecret string) error {
+	if approverErr := checkRunApprover(theTaskID, theTaskDetails, theToken, theApproverSecret); approverErr != nil {
+		return approverErr
+	}
+	delete(pendingRuns, theTaskID)
+	writeAuditLog(theTaskID, "Run request rejected.")
+	return nil
+}
+
+// Cancel the given Task's pending run request, if it has one - anyone who could run the Task can change their mind. Returns true if there was
+// a request to cancel.
+func cancelPendingRun(theTaskID string) bool {
+	if _, pendingFound := pendingRuns[theTaskID]; !pendingFound {
+		return false
+	}
+	delete(pendingRuns, theTaskID)
+	writeAuditLog(theTaskID, "Run request cancelled.")
+	return true
+}
@@ -0,0 +1,331 @@
+package main
+// Run archive - to keep the disk space taken by run history down without losing it, each finished run's folder (its logs, pipeline step logs,
+// results and any other files the run left there) can be uploaded to S3, or anything that speaks S3 such as MinIO. The local copies of all
+// but the most recent runs are then removed, leaving a list of the archived files (archived.txt) in the run's folder, and fetched back from
+// the archive when asked for through the API. Set in the main config file:
+//   archive: where to keep runs, as "s3://bucket" or "s3://bucket/prefix". Each run goes under "prefix/taskID/runID/".
+//   archiveendpoint: the S3 server's URL (e.g. https://minio.example.com:9000) - defaults to AWS, at https://s3.<region>.amazonaws.com.
+//   archiveregion: the bucket's region - defaults to us-east-1.
+//   archiveaccesskey, archivesecretkey: the credentials to sign requests with.
+//   archivelocalruns: how many of each Task's most recent runs to keep on local disk as well - defaults to 1, the least allowed.
+// Requests are signed with AWS Signature Version 4 and sent with path-style URLs, which both AWS and MinIO accept. Only the handful of S3 calls
+// we need are implemented, so there's no extra library to install. Run retention (see retention.go) and purging data (see purgeData) apply to
+// archived runs too.
+
+import (
+	// Standard libraries.
+	"io"
+	"os"
+	"fmt"
+	"time"
+	"errors"
+	"strconv"
+	"strings"
+	"net/url"
+	"net/http"
+	"io/ioutil"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"path/filepath"
+)
+
+// The name of the file, kept in an archived run's folder, listing the run's files in the archive.
+const archiveManifest = "archived.txt"
+
+// Runs are archived once they've finished, in the background so they don't hold up anything else.
+func init() {
+	subscribeTaskEvents(eventTaskFinished, func(theEvent taskEvent) {
+		if arguments["archive"] == "" {
+			return
+		}
+		go func() {
+			if archiveErr := archiveRun(theEvent.taskID, theEvent.runID); archiveErr != nil {
+				writeAuditLog(theEvent.taskID, "Archiving run " + theEvent.runID + " failed: " + archiveErr.Error())
+				return
+			}
+			if offloadErr := offloadArchivedRuns(theEvent.taskID); offloadErr != nil {
+				writeAuditLog(theEvent.taskID, "Removing local copies of archived runs failed: " + offloadErr.Error())
+			}
+		}()
+	})
+}
+
+// Returns the archive's bucket and the prefix (blank, or ending in "/") for object keys.
+func getArchiveLocation() (string, string, error) {
+	archiveURL, urlErr := url.Parse(arguments["archive"])
+	if urlErr != nil || archiveURL.Scheme != "s3" || archiveURL.Host == "" {
+		return "", "", errors.New("Invalid archive \"" + arguments["archive"] + "\" - should be \"s3://bucket\" or \"s3://bucket/prefix\".")
+	}
+	archivePrefix := strings.Trim(archiveURL.Path, "/")
+	if archivePrefix != "" {
+		archivePrefix = archivePrefix + "/"
+	}
+	return archiveURL.Host, archivePrefix, nil
+}
+
+// Check the archive settings, returning an error if they can't be used.
+func checkArchiveConfig() error {
+	if _, _, locationErr := getArchiveLocation(); locationErr != nil {
+		return locationErr
+	}
+	if arguments["archiveaccesskey"] == "" || arguments["archivesecretkey"] == "" {
+		return errors.New("The archive needs \"archiveaccesskey\" and \"archivesecretkey\" set.")
+	}
+	if _, localRunsErr := getArchiveLocalRuns(); localRunsErr != nil {
+		return localRunsErr
+	}
+	return nil
+}
+
+// Returns how many of each Task's most recent runs to keep locally as well as in the archive.
+func getArchiveLocalRuns() (int, error) {
+	if arguments["archivelocalruns"] == "" {
+		return 1, nil
+	}
+	localRuns, localRunsErr := strconv.Atoi(arguments["archivelocalruns"])
+	if localRunsErr != nil || localRuns < 1 {
+		return 1, errors.New("Invalid archivelocalruns \"" + arguments["archivelocalruns"] + "\" - should be a whole number, 1 or more.")
+	}
+	return localRuns, nil
+}
+
+// Returns the URL of the archive's S3 server.
+func getArchiveEndpoint() string {
+	if arguments["archiveendpoint"] != "" {
+		return strings.TrimRight(arguments["archiveendpoint"], "/")
+	}
+	return "https://s3." + getArchiveRegion() + ".amazonaws.com"
+}
+
+// Returns the archive bucket's region.
+func getArchiveRegion() string {
+	if arguments["archiveregion"] != "" {
+		return arguments["archiveregion"]
+	}
+	return "us-east-1"
+}
+
+// URI-encode the given object key as S3's signing process expects - everything but unreserved characters and "/" is escaped.
+func encodeArchiveKey(theKey string) string {
+	var encodedKey strings.Builder
+	for _, keyByte := range []byte(theKey) {
+		if (keyByte >= 'A' && keyByte <= 'Z') || (keyByte >= 'a' && keyByte <= 'z') || (keyByte >= '0' && keyByte <= '9') || strings.IndexByte("-._~/", keyByte) >= 0 {
+			encodedKey.WriteByte(keyByte)
+		} else {
+			fmt.Fprintf(&encodedKey, "%%%02X", keyByte)
+		}
+	}
+	return encodedKey.String()
+}
+
+// Returns the HMAC-SHA256 of the given data with the given key.
+func hmacSHA256(theKey []byte, theData string) []byte {
+	keyedHash := hmac.New(sha256.New, theKey)
+	keyedHash.Write([]byte(theData))
+	return keyedHash.Sum(nil)
+}
+
+// Make a request to the archive for the given object, signed with AWS Signature Version 4. The body isn't included in the signature, so it can
+// be streamed rather than read into memory first. The caller closes the response's body.
+func callArchive(theMethod string, theKey string, theBody io.Reader, theLength int64) (*http.Response, error) {
+	archiveBucket, _, locationErr := getArchiveLocation()
+	if locationErr != nil {
+		return nil, locationErr
+	}
+	objectPath := "/" + archiveBucket + "/" + encodeArchiveKey(theKey)
+	archiveRequest, requestErr := http.NewRequest(theMethod, getArchiveEndpoint() + objectPath, theBody)
+	if requestErr != nil {
+		return nil, requestErr
+	}
+	if theBody != nil {
+		archiveRequest.ContentLength = theLength
+	}
+	requestTime := time.Now().UTC()
+	amzDate := requestTime.Format("20060102T150405Z")
+	credentialScope := requestTime.Format("20060102") + "/" + getArchiveRegion() + "/s3/aws4_request"
+	archiveRequest.Header.Set("X-Amz-Date", amzDate)
+	archiveRequest.Header.Set("X-Amz-Content-Sha256", "UNSIGNED-PAYLOAD")
+	canonicalRequest := theMethod + "\n" + objectPath + "\n\n" + "host:" + archiveRequest.URL.Host + "\n" + "x-amz-content-sha256:UNSIGNED-PAYLOAD\n" +
+		"x-amz-date:" + amzDate + "\n\n" + "host;x-amz-content-sha256;x-amz-date\n" + "UNSIGNED-PAYLOAD"
+	canonicalHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + credentialScope + "\n" + hex.EncodeToString(canonicalHash[:])
+	signingKey := hmacSHA256([]byte("AWS4" + arguments["archivesecretkey"]), requestTime.Format("20060102"))
+	for _, scopePart := range []string{getArchiveRegion(), "s3", "aws4_request"} {
+		signingKey = hmacSHA256(signingKey, scopePart)
+	}
+	archiveRequest.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential=" + arguments["archiveaccesskey"] + "/" + credentialScope +
+		", SignedHeaders=host;x-amz-content-sha256;x-amz-date, Signature=" + hex.EncodeToString(hmacSHA256(signingKey, stringToSign)))
+	// Run logs can be large, so archive calls get longer than other outbound calls to finish.
+	archiveClient := getHTTPClient("archive")
+	archiveClient.Timeout = 10 * time.Minute
+	archiveResponse, callErr := archiveClient.Do(archiveRequest)
+	if callErr != nil {
+		return nil, callErr
+	}
+	if archiveResponse.StatusCode >= 300 {
+		archiveResponse.Body.Close()
+		return nil, errors.New(theMethod + " " + theKey + " - " + archiveResponse.Status)
+	}
+	return archiveResponse, nil
+}
+
+// Returns the archive key of the given file of the given run.
+func getArchiveKey(theTaskID string, theRunID string, theFile string) string {
+	_, archivePrefix, _ := getArchiveLocation()
+	return archivePrefix + theTaskID + "/" + theRunID + "/" + theFile
+}
+
+// Returns the files of the given run that are in the archive, or nil if the run hasn't been archived.
+func getArchivedFiles(theTaskID string, theRunID string) []string {
+	manifestContents, readErr := ioutil.ReadFile(arguments["taskroot"] + "/" + theTaskID + "/runs/" + theRunID + "/" + archiveManifest)
+	if readErr != nil {
+		return nil
+	}
+	var archivedFiles []string
+	for _, archivedFile := range strings.Split(string(manifestContents), "\n") {
+		if strings.TrimSpace(archivedFile) != "" {
+			archivedFiles = append(archivedFiles, strings.TrimSpace(archivedFile))
+		}
+	}
+	return archivedFiles
+}
+
+// Upload the given run's files to the archive, writing the list of files archived to the run's folder. Files archived before (for an
+// archived run that's been changed, such as by purgeData) that aren't in the run's folder any more are removed from the archive.
+func archiveRun(theTaskID string, theRunID string) error {
+	runFolder := arguments["taskroot"] + "/" + theTaskID + "/runs/" + theRunID
+	var runFiles []string
+	walkErr := filepath.Walk(runFolder, func(thePath string, theInfo os.FileInfo, theErr error) error {
+		if theErr != nil {
+			return theErr
+		}
+		if relativePath, relErr := filepath.Rel(runFolder, thePath); relErr == nil && !theInfo.IsDir() && relativePath != archiveManifest {
+			runFiles = append(runFiles, filepath.ToSlash(relativePath))
+		}
+		return nil
+	})
+	if walkErr != nil {
+		return errors.New("Can't read the run's folder - " + walkErr.Error())
+	}
+	previousFiles := getArchivedFiles(theTaskID, theRunID)
+	currentFiles := map[string]bool{}
+	for _, runFile := range runFiles {
+		currentFiles[runFile] = true
+		fileInfo, statErr := os.Stat(runFolder + "/" + runFile)
+		fileContents, openErr := os.Open(runFolder + "/" + runFile)
+		if statErr != nil || openErr != nil {
+			return errors.New("Can't read " + runFile + ".")
+		}
+		archiveResponse, uploadErr := callArchive("PUT", getArchiveKey(theTaskID, theRunID, runFile), fileContents, fileInfo.Size())
+		fileContents.Close()
+		if uploadErr != nil {
+			return uploadErr
+		}
+		archiveResponse.Body.Close()
+	}
+	for _, previousFile := range previousFiles {
+		if !currentFiles[previousFile] {
+			if archiveResponse, deleteErr := callArchive("DELETE", getArchiveKey(theTaskID, theRunID, previousFile), nil, 0); deleteErr == nil {
+				archiveResponse.Body.Close()
+			}
+		}
+	}
+	return ioutil.WriteFile(runFolder + "/" + archiveManifest, []byte(strings.Join(runFiles, "\n") + "\n"), 0644)
+}
+
+// Remove the local copies of the given Task's archived runs, other than the most recent ones (see "archivelocalruns"), leaving just the list
+// of archived files in each run's folder.
+func offloadArchivedRuns(theTaskID string) error {
+	localRuns, _ := getArchiveLocalRuns()
+	runList, listErr := getRunList(theTaskID)
+	if listErr != nil {
+		return listErr
+	}
+	if len(runList) <= localRuns {
+		return nil
+	}
+	for _, runID := range runList[:len(runList)-localRuns] {
+		runFolder := arguments["taskroot"] + "/" + theTaskID + "/runs/" + runID
+		archivedFiles := getArchivedFiles(theTaskID, runID)
+		if archivedFiles == nil {
+			continue
+		}
+		folderContents, _ := ioutil.ReadDir(runFolder)
+		for _, folderItem := range folderContents {
+			if folderItem.Name() != archiveManifest {
+				if removeErr := os.RemoveAll(runFolder + "/" + folderItem.Name()); removeErr != nil {
+					return errors.New("Can't remove " + runFolder + "/" + folderItem.Name() + " - " + removeErr.Error())
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Open the given file of the given run - the local copy if there is one, otherwise the copy in the archive.
+func openRunFile(theTaskID string, theRunID string, theFile string) (io.ReadCloser, error) {
+	localFile, openErr := os.Open(arguments["taskroot"] + "/" + theTaskID + "/runs/" + theRunID + "/" + theFile)
+	if openErr == nil || !os.IsNotExist(openErr) || arguments["archive"] == "" {
+		return localFile, openErr
+	}
+	for _, archivedFile := range getArchivedFiles(theTaskID, theRunID) {
+		if archivedFile == theFile {
+			archiveResponse, fetchErr := callArchive("GET", getArchiveKey(theTaskID, theRunID, theFile), nil, 0)
+			if fetchErr != nil {
+				return nil, fetchErr
+			}
+			return archiveResponse.Body, nil
+		}
+	}
+	return nil, openErr
+}
+
+// Read the whole of the given file of the given run, from the local copy or the archive.
+func readRunFile(theTaskID string, theRunID string, theFile string) ([]byte, error) {
+	runFile, openErr := openRunFile(theTaskID, theRunID, theFile)
+	if openErr != nil {
+		return nil, openErr
+	}
+	defer runFile.Close()
+	return ioutil.ReadAll(runFile)
+}
+
+// Fetch any of the given run's files that are only in the archive back to the run's folder, so they can be changed (see purgeData). Returns
+// true if the run has been archived, in which case it should be archived again once the changes are made.
+func restoreArchivedRun(theTaskID string, theRunID string) (bool, error) {
+	archivedFiles := getArchivedFiles(theTaskID, theRunID)
+	if archivedFiles == nil || arguments["archive"] == "" {
+		return false, nil
+	}
+	runFolder := arguments["taskroot"] + "/" + theTaskID + "/runs/" + theRunID
+	for _, archivedFile := range archivedFiles {
+		if _, statErr := os.Stat(runFolder + "/" + archivedFile); !os.IsNotExist(statErr) {
+			continue
+		}
+		fileContents, readErr := readRunFile(theTaskID, theRunID, archivedFile)
+		if readErr != nil {
+			return true, readErr
+		}
+		os.MkdirAll(filepath.Dir(runFolder + "/" + archivedFile), os.ModePerm)
+		if writeErr := ioutil.WriteFile(runFolder + "/" + archivedFile, fileContents, 0644); writeErr != nil {
+			return true, writeErr
+		}
+	}
+	return true, nil
+}
+
+// Remove the given run's files from the archive, if it was archived.
+func deleteArchivedRun(theTaskID string, theRunID string) error {
+	if arguments["archive"] == "" {
+		return nil
+	}
+	for _, archivedFile := range getArchivedFiles(theTaskID, theRunID) {
+		archiveResponse, deleteErr := callArchive("DELETE", getArchiveKey(theTaskID, theRunID, archivedFile), nil, 0)
+		if deleteErr != nil {
+			return deleteErr
+		}
+		archiveResponse.Body.Close()
+	}
+	return nil
+}
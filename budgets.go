@@ -0,0 +1,157 @@
+package main
+// Runtime budgets - a limit on how long a Task can spend running each calendar month, for Tasks that drive metered resources (cloud machines,
+// paid APIs) where the time a Task runs for is what costs money. "budget: 10h" gives the Task ten hours a month. How long each run took is
+// recorded when it finishes, in budget.txt in the Task's folder, along with which notifications have been sent, so a month's total carries on
+// across restarts. When a run finishes with the Task over its budget, a "budget" notification is sent to the Task's notification channels
+// (see notifications.go), once a month; "budgetWarning: 80" sends one when 80% of the budget has been used, too. With "budgetAction: refuse",
+// runs are refused once the budget has been used, until the next month starts - otherwise (the default, "alert") they carry on. "webconsole
+// task quota abc123" shows how much of the budget has been used, and an admin can grant runs past the budget the same way as past a quota
+// (see quotas.go).
+
+import (
+	// Standard libraries.
+	"fmt"
+	"time"
+	"errors"
+	"strconv"
+	"strings"
+	"io/ioutil"
+)
+
+// The file, in each Task's folder, recording this month's runs and budget notifications, one per line, tab-separated: the month ("2006-01"),
+// then "run", a run ID and how many seconds the run took, or "alert" and the notification's level.
+const budgetFile = "budget.txt"
+
+// Each run is recorded once it has finished, and budget notifications are then sent if they're due.
+func init() {
+	subscribeTaskEvents(eventTaskFinished, func(theEvent taskEvent) {
+		if runtimeBudget, _ := getRuntimeBudget(theEvent.taskDetails); runtimeBudget > 0 {
+			if runStart, parseErr := time.ParseInLocation(runIDFormat, theEvent.runID, time.Local); parseErr == nil {
+				addBudgetLine(theEvent.taskID, "run\t" + theEvent.runID + "\t" + strconv.FormatInt(int64(time.Since(runStart).Seconds()), 10))
+			}
+			go checkBudgetAlerts(theEvent.taskID, theEvent.taskDetails, theEvent.runID)
+		}
+	})
+}
+
+// Returns the lines of the given Task's budget file for this month, without the month.
+func getBudgetLines(theTaskID string) []string {
+	monthStart, _ := getBudgetMonth()
+	budgetContents, _ := ioutil.ReadFile(arguments["taskroot"] + "/" + theTaskID + "/" + budgetFile)
+	var budgetLines []string
+	for _, budgetLine := range strings.Split(string(budgetContents), "\n") {
+		if strings.HasPrefix(budgetLine, monthStart.Format("2006-01") + "\t") {
+			budgetLines = append(budgetLines, strings.SplitN(budgetLine, "\t", 2)[1])
+		}
+	}
+	return budgetLines
+}
+
+// Add the given line to the given Task's budget file for this month. Lines from earlier months are removed.
+func addBudgetLine(theTaskID string, theLine string) error {
+	monthStart, _ := getBudgetMonth()
+	budgetContents := ""
+	for _, budgetLine := range append(getBudgetLines(theTaskID), theLine) {
+		budgetContents = budgetContents + monthStart.Format("2006-01") + "\t" + budgetLine + "\n"
+	}
+	writeErr := ioutil.WriteFile(arguments["taskroot"] + "/" + theTaskID + "/" + budgetFile, []byte(budgetContents), 0644)
+	if writeErr != nil {
+		fmt.Println("ERROR: Can't write " + budgetFile + " for Task " + theTaskID + ": " + writeErr.Error())
+	}
+	return writeErr
+}
+
+// Returns the given Task's monthly runtime budget, or 0 if it doesn't have one.
+func getRuntimeBudget(theTaskDetails map[string]string) (time.Duration, error) {
+	if theTaskDetails["budget"] == "" {
+		return 0, nil
+	}
+	runtimeBudget, parseErr := time.ParseDuration(strings.TrimSpace(theTaskDetails["budget"]))
+	if parseErr != nil || runtimeBudget <= 0 {
+		return 0, errors.New("Invalid budget \"" + theTaskDetails["budget"] + "\" - should be a length of time, e.g. \"10h\" or \"90m\".")
+	}
+	return runtimeBudget, nil
+}
+
+// Returns the start of the current month, and of the next one.
+func getBudgetMonth() (time.Time, time.Time) {
+	currentTime := time.Now()
+	monthStart := time.Date(currentTime.Year(), currentTime.Month(), 1, 0, 0, 0, 0, time.Local)
+	return monthStart, monthStart.AddDate(0, 1, 0)
+}
+
+// Returns how long the given Task has spent running so far this month, including any run in progress.
+func getMonthRuntime(theTaskID string) time.Duration {
+	var monthRuntime time.Duration
+	runRecorded := false
+	for _, budgetLine := range getBudgetLines(theTaskID) {
+		if lineFields := strings.Split(budgetLine, "\t"); len(lineFields) == 3 && lineFields[0] == "run" {
+			runSeconds, _ := strconv.ParseInt(lineFields[2], 10, 64)
+			monthRuntime = monthRuntime + time.Duration(runSeconds) * time.Second
+			runRecorded = runRecorded || lineFields[1] == taskRunIDs[theTaskID]
+		}
+	}
+	// A run that has only just finished is still listed as running until its output has been dealt with.
+	if runStart, parseErr := time.ParseInLocation(runIDFormat, taskRunIDs[theTaskID], time.Local); taskIsRunning(theTaskID) && !runRecorded && parseErr == nil {
+		monthRuntime = monthRuntime + time.Since(runStart)
+	}
+	return monthRuntime
+}
+
+// Check the given Task hasn't used up its budget for the month, if it's set to refuse runs once it has. The error returned when it has is a
+// quotaExceededError, saying when the budget starts again.
+func checkRuntimeBudget(theTaskID string, theTaskDetails map[string]string) error {
+	runtimeBudget, budgetErr := getRuntimeBudget(theTaskDetails)
+	if budgetErr != nil || runtimeBudget == 0 || theTaskDetails["budgetaction"] != "refuse" {
+		return budgetErr
+	}
+	monthRuntime := getMonthRuntime(theTaskID)
+	if monthRuntime < runtimeBudget {
+		return nil
+	}
+	_, nextMonth := getBudgetMonth()
+	return quotaExceededError{fmt.Sprintf("Budget exceeded - this Task has run for %s this month, and its budget is %s. Runs can start again on %s.",
+		monthRuntime.Round(time.Second), runtimeBudget, nextMonth.Format("2 January")), time.Until(nextMonth)}
+}
+
+// Returns a description of how much of the given Task's budget has been used this month, e.g. "budget: 2h10m0s of 10h0m0s used this month".
+func describeBudgetUsage(theTaskID string, theTaskDetails map[string]string) (string, error) {
+	runtimeBudget, budgetErr := getRuntimeBudget(theTaskDetails)
+	if budgetErr != nil || runtimeBudget == 0 {
+		return "", budgetErr
+	}
+	return fmt.Sprintf("budget: %s of %s used this month", getMonthRuntime(theTaskID).Round(time.Second), runtimeBudget), nil
+}
+
+// Send a budget notification for the given Task, at the given level ("warning" or "exceeded"), unless one has been sent already this month.
+func sendBudgetAlert(theTaskID string, theTaskDetails map[string]string, theRunID string, theLevel string, theMessage string) {
+	for _, budgetLine := range getBudgetLines(theTaskID) {
+		if budgetLine == "alert\t" + theLevel {
+			return
+		}
+	}
+	if addBudgetLine(theTaskID, "alert\t" + theLevel) != nil {
+		return
+	}
+	writeAuditLog(theTaskID, "Budget " + theLevel + ": " + theMessage)
+	sendRunNotifications(theTaskID, theTaskDetails, theRunID, runTrigger{}, "budget", theMessage, map[string]string{})
+}
+
+// Check how much of the given Task's budget has been used, now the given run has finished, sending any notifications due.
+func checkBudgetAlerts(theTaskID string, theTaskDetails map[string]string, theRunID string) {
+	runtimeBudget, budgetErr := getRuntimeBudget(theTaskDetails)
+	if budgetErr != nil || runtimeBudget == 0 {
+		return
+	}
+	monthRuntime := getMonthRuntime(theTaskID)
+	budgetUsed := fmt.Sprintf("ran for %s of its %s budget this month", monthRuntime.Round(time.Second), runtimeBudget)
+	if monthRuntime >= runtimeBudget {
+		if theTaskDetails["budgetaction"] == "refuse" {
+			sendBudgetAlert(theTaskID, theTaskDetails, theRunID, "exceeded", budgetUsed + " - further runs are refused until next month.")
+		} else {
+			sendBudgetAlert(theTaskID, theTaskDetails, theRunID, "exceeded", budgetUsed + ".")
+		}
+	} else if warningPercent, percentErr := strconv.Atoi(theTaskDetails["budgetwarning"]); percentErr == nil && monthRuntime * 100 >= runtimeBudget * time.Duration(warningPercent) {
+		sendBudgetAlert(theTaskID, theTaskDetails, theRunID, "warning", budgetUsed + ".")
+	}
+}
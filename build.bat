@@ -9,9 +9,12 @@ go get github.com/nfnt/resize
 go get github.com/dennwc/gotrace
 go get github.com/kodeworks/golang-image-ico
 go get golang.org/x/crypto/bcrypt
+go get golang.org/x/crypto/argon2
 go get github.com/360EntSecGroup-Skylar/excelize
+go get modernc.org/sqlite
+go get github.com/dop251/goja
 echo Building...
-go build webconsole.go
+go build -o webconsole.exe .
 
 copy webconsole.exe "C:\Program Files\WebConsole" > nul 2>&1
 xcopy /E /Y www "C:\Program Files\WebConsole\www" > nul 2>&1
@@ -7,8 +7,11 @@ go get github.com/nfnt/resize
 go get github.com/dennwc/gotrace
 go get github.com/kodeworks/golang-image-ico
 go get golang.org/x/crypto/bcrypt
+go get golang.org/x/crypto/argon2
 go get github.com/360EntSecGroup-Skylar/excelize
-go build webconsole.go
+go get modernc.org/sqlite
+go get github.com/dop251/goja
+go build -o webconsole .
 cp webconsole /usr/local/bin
 [ ! -d /etc/webconsole ] && mkdir /etc/webconsole
 cp --recursive www /etc/webconsole
@@ -0,0 +1,180 @@
+package main
+// Export and import of Tasks as a single zip file "bundle", for moving Tasks between servers or keeping them in version control. A bundle holds a
+// folder for each Task, containing the Task's config.txt (taken from the Task store, so this works with any store) and its other files - scripts,
+// description, favicons and so on - but not its logs, run history or uploaded files.
+
+import (
+	// Standard libraries.
+	"io"
+	"os"
+	"sort"
+	"errors"
+	"strings"
+	"io/ioutil"
+	"archive/zip"
+	"path/filepath"
+)
+
+// Returns true if the given config keyword holds a secret (a Task's password, a webhook's secret or token, and so on).
+func isSecretKeyword(theKeyword string) bool {
+	theKeyword = strings.ToLower(strings.TrimSpace(theKeyword))
+	return strings.Contains(theKeyword, "secret") || strings.Contains(theKeyword, "token") || strings.Contains(theKeyword, "password")
+}
+
+// Returns true if the given path (relative to a Task's folder) is one of the Task's logs, run history, uploads or git checkout (see
+// gitcheckout.go), which aren't part of the Task's definition so aren't included in a bundle.
+func isTaskRunFile(theRelativePath string) bool {
+	topLevel := strings.SplitN(filepath.ToSlash(theRelativePath), "/", 2)[0]
+	return topLevel == "runs" || topLevel == "uploads" || topLevel == gitCheckoutFolder || theRelativePath == "log.txt" || theRelativePath == "runTimes.txt" || theRelativePath == budgetFile
+}
+
+// Write all Tasks to a zip bundle at the given path. If theExcludeSecrets is true, any secrets in the Tasks' configs are left out, so the
+// bundle can be shared (or committed to version control) safely - they will need setting again once imported. Returns the IDs of the Tasks
+// exported.
+func exportTasks(thePath string, theExcludeSecrets bool) ([]string, error) {
+	taskIDs, listErr := taskStore.ListTaskIDs()
+	if listErr != nil {
+		return nil, errors.New("Can't list Tasks - " + listErr.Error())
+	}
+	bundleFile, createErr := os.Create(thePath)
+	if createErr != nil {
+		return nil, errors.New("Can't create bundle file " + thePath + ".")
+	}
+	defer bundleFile.Close()
+	bundleWriter := zip.NewWriter(bundleFile)
+	var exportedIDs []string
+	for _, taskID := range taskIDs {
+		configContents, configErr := taskStore.ReadTaskConfig(taskID)
+		if configErr != nil {
+			continue
+		}
+		var configLines []string
+		for _, configLine := range strings.Split(string(configContents), "\n") {
+			if theExcludeSecrets && isSecretKeyword(strings.SplitN(configLine, ":", 2)[0]) {
+				continue
+			}
+			configLines = append(configLines, configLine)
+		}
+		configWriter, writerErr := bundleWriter.Create(taskID + "/config.txt")
+		if writerErr != nil {
+			return exportedIDs, writerErr
+		}
+		configWriter.Write([]byte(strings.Join(configLines, "\n")))
+		taskFolder := arguments["taskroot"] + "/" + taskID
+		walkErr := filepath.Walk(taskFolder, func(thePath string, theInfo os.FileInfo, theErr error) error {
+			if theErr != nil {
+				if os.IsNotExist(theErr) {
+					return nil
+				}
+				return theErr
+			}
+			relativePath, _ := filepath.Rel(taskFolder, thePath)
+			if isTaskRunFile(relativePath) {
+				if theInfo.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if theInfo.IsDir() || relativePath == "config.txt" {
+				return nil
+			}
+			fileHeader, headerErr := zip.FileInfoHeader(theInfo)
+			if headerErr != nil {
+				return headerErr
+			}
+			fileHeader.Name = taskID + "/" + filepath.ToSlash(relativePath)
+			fileHeader.Method = zip.Deflate
+			fileWriter, writerErr := bundleWriter.CreateHeader(fileHeader)
+			if writerErr != nil {
+				return writerErr
+			}
+			sourceFile, openErr := os.Open(thePath)
+			if openErr != nil {
+				return openErr
+			}
+			defer sourceFile.Close()
+			_, copyErr := io.Copy(fileWriter, sourceFile)
+			return copyErr
+		})
+		if walkErr != nil {
+			return exportedIDs, errors.New("Problem exporting Task " + taskID + " - " + walkErr.Error())
+		}
+		exportedIDs = append(exportedIDs, taskID)
+	}
+	if closeErr := bundleWriter.Close(); closeErr != nil {
+		return exportedIDs, closeErr
+	}
+	return exportedIDs, nil
+}
+
+// Load the Tasks in the zip bundle at the given path. Tasks that already exist are skipped, unless theOverwrite is true, in which case their
+// config and files are replaced (their logs, run history and uploads are kept). Returns the IDs of the Tasks imported and of any skipped.
+func importTasks(thePath string, theOverwrite bool) ([]string, []string, error) {
+	bundleReader, openErr := zip.OpenReader(thePath)
+	if openErr != nil {
+		return nil, nil, errors.New("Can't open bundle file " + thePath + " - " + openErr.Error())
+	}
+	defer bundleReader.Close()
+	// Group the bundle's files by Task, checking for anything that would end up outside the Task's folder.
+	taskFiles := map[string][]*zip.File{}
+	for _, bundleFile := range bundleReader.File {
+		if bundleFile.FileInfo().IsDir() {
+			continue
+		}
+		pathSplit := strings.SplitN(bundleFile.Name, "/", 2)
+		if len(pathSplit) < 2 || checkTaskID(pathSplit[0]) != nil || strings.Contains(pathSplit[1], "..") || strings.HasPrefix(pathSplit[1], "/") {
+			return nil, nil, errors.New("Invalid path in bundle: " + bundleFile.Name)
+		}
+		taskFiles[strings.ToLower(pathSplit[0])] = append(taskFiles[strings.ToLower(pathSplit[0])], bundleFile)
+	}
+	for taskID, bundleFiles := range taskFiles {
+		configFound := false
+		for _, bundleFile := range bundleFiles {
+			configFound = configFound || strings.SplitN(bundleFile.Name, "/", 2)[1] == "config.txt"
+		}
+		if !configFound {
+			return nil, nil, errors.New("No config.txt for Task " + taskID + " in bundle.")
+		}
+	}
+	var importedIDs []string
+	var skippedIDs []string
+	for taskID, bundleFiles := range taskFiles {
+		if taskExists(taskID) && !theOverwrite {
+			skippedIDs = append(skippedIDs, taskID)
+			continue
+		}
+		var configContents []byte
+		for _, bundleFile := range bundleFiles {
+			relativePath := strings.SplitN(bundleFile.Name, "/", 2)[1]
+			if isTaskRunFile(relativePath) {
+				continue
+			}
+			fileReader, readerErr := bundleFile.Open()
+			if readerErr != nil {
+				return importedIDs, skippedIDs, errors.New("Can't read " + bundleFile.Name + " from bundle.")
+			}
+			fileContents, readErr := ioutil.ReadAll(fileReader)
+			fileReader.Close()
+			if readErr != nil {
+				return importedIDs, skippedIDs, errors.New("Can't read " + bundleFile.Name + " from bundle.")
+			}
+			if relativePath == "config.txt" {
+				configContents = fileContents
+				continue
+			}
+			destinationPath := filepath.Join(arguments["taskroot"], taskID, filepath.FromSlash(relativePath))
+			os.MkdirAll(filepath.Dir(destinationPath), os.ModePerm)
+			if writeErr := ioutil.WriteFile(destinationPath, fileContents, bundleFile.Mode().Perm() | 0600); writeErr != nil {
+				return importedIDs, skippedIDs, errors.New("Can't write " + destinationPath + ".")
+			}
+		}
+		if writeErr := taskStore.WriteTaskConfig(taskID, configContents); writeErr != nil {
+			return importedIDs, skippedIDs, errors.New("Couldn't write config for Task " + taskID + ".")
+		}
+		writeAuditLog(taskID, "Task imported from " + thePath + ".")
+		importedIDs = append(importedIDs, taskID)
+	}
+	sort.Strings(importedIDs)
+	sort.Strings(skippedIDs)
+	return importedIDs, skippedIDs, nil
+}
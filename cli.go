@@ -0,0 +1,148 @@
+package main
+// Command-line parsing. Webconsole takes a subcommand ("webconsole serve", "webconsole task new", "webconsole task run abc123" and so on)
+// followed by any number of flags, given as "--name value", "--name=value" or just "--name" for a true/false flag (a single dash works too, and
+// any dashes within a name are ignored, so "--install-service" is the same as "--installService"). The
+// older style of giving everything as flags ("webconsole --run abc123") still works. Every flag can also be set with an environment variable -
+// "WEBCONSOLE_" followed by the flag's name in capitals, with or without underscores between words, e.g. WEBCONSOLE_PORT or WEBCONSOLE_TASK_ROOT.
+// Adding "_FILE" to the end of a variable's name reads the setting from the given file instead, which is how container platforms (Docker,
+// Kubernetes and so on) usually pass secrets, e.g. WEBCONSOLE_ADMIN_SECRET_FILE=/run/secrets/adminsecret.
+
+import (
+	// Standard libraries.
+	"os"
+	"errors"
+	"strings"
+	"io/ioutil"
+)
+
+// Each subcommand, and the arguments it sets. The first argument is set to "true" and any words following the subcommand then give the
+// values of the arguments, in order.
+var subcommands = map[string][]string{
+	"serve": {"start"},
+	"check": {"check"},
+	"hash": {"hash"},
+	"agent": {"agent"},
+	"help": {"help"},
+	"install-service": {"installservice"},
+	"uninstall-service": {"uninstallservice"},
+	"task new": {"new"},
+	"task list": {"list"},
+	"task edit": {"edit"},
+	"task secret": {"secret"},
+	"task totp": {"totp"},
+	"task preset": {"presets", "presetname", "presetvalues"},
+	"task quota": {"quota"},
+	"task delete": {"delete"},
+	"task clone": {"clone", "newtaskid"},
+	"task run": {"run"},
+	"task export": {"export"},
+	"task import": {"import"},
+	"task prune": {"prune"},
+	"remote run": {"remoterun"},
+}
+
+// Environment variables set by Web Console for the Tasks it runs (see runTask), or for a new server started by an upgrade (see upgrade.go) -
+// these aren't settings, so are never read as such.
+var taskEnvironmentVariables = []string{"TASK_ID", "RUN_ID", "CALLBACK_URL", "CALLBACK_TOKEN", "PARAM_", "UPGRADE"}
+
+// Parse the given command-line arguments (not including the program's name), returning the arguments they set.
+func parseCommandLine(theArgs []string) (map[string]string, error) {
+	commandLineArguments := map[string]string{}
+	var commandWords []string
+	flagsStarted := false
+	currentArgKey := ""
+	for _, argVal := range theArgs {
+		if strings.HasPrefix(argVal, "-") && len(argVal) > 1 {
+			flagsStarted = true
+			if currentArgKey != "" {
+				commandLineArguments[currentArgKey] = "true"
+			}
+			flagSplit := strings.SplitN(strings.TrimLeft(argVal, "-"), "=", 2)
+			currentArgKey = strings.ToLower(strings.Replace(flagSplit[0], "-", "", -1))
+			if len(flagSplit) == 2 {
+				commandLineArguments[currentArgKey] = flagSplit[1]
+				currentArgKey = ""
+			}
+		} else if currentArgKey != "" {
+			commandLineArguments[currentArgKey] = argVal
+			currentArgKey = ""
+		} else if !flagsStarted {
+			// Words before the first flag are the subcommand. Any stray words after the flags have started are left for the command to deal
+			// with (e.g. the new Task ID in "--clone abc123 def456").
+			commandWords = append(commandWords, argVal)
+		}
+	}
+	if currentArgKey != "" {
+		commandLineArguments[currentArgKey] = "true"
+	}
+	if len(commandWords) == 0 {
+		return commandLineArguments, nil
+	}
+	// Find the longest subcommand matching the words given.
+	for wordCount := len(commandWords); wordCount > 0; wordCount = wordCount - 1 {
+		commandArguments, commandFound := subcommands[strings.ToLower(strings.Join(commandWords[:wordCount], " "))]
+		if !commandFound {
+			continue
+		}
+		commandValues := commandWords[wordCount:]
+		if len(commandValues) > len(commandArguments) {
+			return commandLineArguments, errors.New("Too many values given for \"" + strings.Join(commandWords[:wordCount], " ") + "\" - see \"webconsole help\".")
+		}
+		commandLineArguments[commandArguments[0]] = "true"
+		for valuePos, commandValue := range commandValues {
+			commandLineArguments[commandArguments[valuePos]] = commandValue
+		}
+		return commandLineArguments, nil
+	}
+	if strings.ToLower(commandWords[0]) == "task" {
+		return commandLineArguments, errors.New("Unknown command \"" + strings.Join(commandWords, " ") + "\" - should be \"task\" followed by new, list, edit, secret, totp, preset, delete, clone, run, export, import or prune.")
+	}
+	return commandLineArguments, errors.New("Unknown command \"" + strings.Join(commandWords, " ") + "\" - see \"webconsole help\".")
+}
+
+// Returns the arguments set by WEBCONSOLE_ environment variables. Names are lowercased with any underscores removed, so WEBCONSOLE_TASK_ROOT
+// and WEBCONSOLE_TASKROOT both set "taskroot". Variables ending in "_FILE" give the path of a file to read the value from.
+func getEnvironmentArguments() (map[string]string, error) {
+	environmentArguments := map[string]string{}
+	for _, environmentVariable := range os.Environ() {
+		variableSplit := strings.SplitN(environmentVariable, "=", 2)
+		if len(variableSplit) < 2 || !strings.HasPrefix(variableSplit[0], "WEBCONSOLE_") {
+			continue
+		}
+		variableName := strings.TrimPrefix(variableSplit[0], "WEBCONSOLE_")
+		taskVariable := false
+		for _, taskVariableName := range taskEnvironmentVariables {
+			taskVariable = taskVariable || variableName == taskVariableName || (strings.HasSuffix(taskVariableName, "_") && strings.HasPrefix(variableName, taskVariableName))
+		}
+		if taskVariable || variableName == "" {
+			continue
+		}
+		variableValue := variableSplit[1]
+		if strings.HasSuffix(variableName, "_FILE") {
+			valueContents, readErr := ioutil.ReadFile(variableValue)
+			if readErr != nil {
+				return environmentArguments, errors.New("Can't read " + variableSplit[0] + " file \"" + variableValue + "\".")
+			}
+			variableName = strings.TrimSuffix(variableName, "_FILE")
+			variableValue = strings.TrimSpace(string(valueContents))
+		}
+		environmentArguments[strings.ToLower(strings.Replace(variableName, "_", "", -1))] = variableValue
+	}
+	return environmentArguments, nil
+}
+
+// Apply settings from the environment then the command line over those already set (defaults and the config file), so the command line
+// always wins.
+func applyArgumentOverrides(theCommandLineArguments map[string]string) error {
+	environmentArguments, environmentErr := getEnvironmentArguments()
+	if environmentErr != nil {
+		return environmentErr
+	}
+	for argumentName, argumentValue := range environmentArguments {
+		arguments[argumentName] = argumentValue
+	}
+	for argumentName, argumentValue := range theCommandLineArguments {
+		arguments[argumentName] = argumentValue
+	}
+	return nil
+}
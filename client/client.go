@@ -0,0 +1,428 @@
+// Package client is a Go client for the Web Console API, for other Go programs and services that need to run Tasks on a Web Console server,
+// follow their output and look through their history without making the HTTP calls themselves.
+//
+// A Client is created with the server's base URL (including any path prefix) and a key - the secret of the Tasks it will work with, or a
+// token for them. Tasks with a different secret can be given their own with SetTaskSecret. The Client exchanges secrets for tokens as needed,
+// getting a new token if one expires, and passes tokens in an "Authorization: Bearer" header so they stay out of server access logs.
+//
+//	webConsole := client.New("https://console.example.com", "taskSecret")
+//	result, runErr := webConsole.Run(context.Background(), "backup", func(theLine client.OutputLine) {
+//		fmt.Println(theLine.Line)
+//	})
+package client
+
+import (
+	// Standard libraries.
+	"io"
+	"fmt"
+	"sync"
+	"time"
+	"bufio"
+	"errors"
+	"context"
+	"strings"
+	"strconv"
+	"net/url"
+	"net/http"
+	"encoding/json"
+)
+
+// An error returned by the server - API calls that fail return a plain text message starting "ERROR: ", along with an error code (such as
+// "not_authorised" or "not_found") in the X-Error-Code header.
+type APIError struct {
+	Message string
+	Code string
+}
+
+func (theError *APIError) Error() string {
+	return theError.Message
+}
+
+// Returns true if the call wasn't authorised - the server doesn't say why (the token might have expired, say), so a token is worth renewing.
+// Servers from before error codes were added are recognised by the message.
+func (theError *APIError) notAuthorised() bool {
+	return theError.Code == "not_authorised" || (theError.Code == "" && strings.HasPrefix(theError.Message, "Not authorised"))
+}
+
+// A line of a Task's output: when it was output, which stream it came from ("stdout", "stderr", "system" or "event") and the line itself.
+type OutputLine struct {
+	Time time.Time
+	Stream string
+	Line string
+	RunID string
+}
+
+// How a Task's most recent run went.
+type RunResult struct {
+	RunID string `json:"runID"`
+	Succeeded bool `json:"succeeded"`
+	Error string `json:"error"`
+}
+
+// The resources used by a running Task, as last sampled.
+type ResourceUsage struct {
+	Sampled int64 `json:"sampled"`
+	CPUSeconds float64 `json:"cpuSeconds"`
+	MemoryBytes int64 `json:"memoryBytes"`
+	Processes int `json:"processes"`
+}
+
+// A Task's status, as returned by api/getTaskStatus. Times are Unix timestamps.
+type TaskStatus struct {
+	Running bool `json:"running"`
+	RunID string `json:"runID"`
+	Started int64 `json:"started"`
+	Usage *ResourceUsage `json:"usage"`
+	NextRun int64 `json:"nextRun"`
+	LastRun *RunResult `json:"lastRun"`
+	StartupRun map[string]interface{} `json:"startupRun"`
+	Service map[string]interface{} `json:"service"`
+	Results map[string]string `json:"results"`
+}
+
+// Options for SearchRuns.
+type SearchOptions struct {
+	// Treat the query as a regular expression, rather than plain text.
+	Regexp bool
+	// The number of lines (up to 10) to return either side of each match.
+	Context int
+	// Search the newest runs first.
+	NewestFirst bool
+}
+
+// A client for a Web Console server.
+type Client struct {
+	// The HTTP client used for API calls - http.DefaultClient unless set otherwise. Output is streamed, so it shouldn't have a Timeout;
+	// use a Context to limit how long calls take instead.
+	HTTPClient *http.Client
+	// How long to wait between checks while waiting for a retry to start - one second unless set otherwise.
+	PollInterval time.Duration
+	baseURL string
+	apiKey string
+	lock sync.Mutex
+	taskSecrets map[string]string
+	taskTokens map[string]string
+}
+
+// Returns a new Client for the server at the given base URL (e.g. "https://console.example.com", or "https://example.com/console" if the
+// server has a path prefix), using the given key - a Task secret or token - for every Task without a secret of its own.
+func New(theBaseURL string, theAPIKey string) *Client {
+	return &Client{
+		HTTPClient: http.DefaultClient,
+		PollInterval: time.Second,
+		baseURL: strings.TrimRight(theBaseURL, "/"),
+		apiKey: theAPIKey,
+		taskSecrets: map[string]string{},
+		taskTokens: map[string]string{},
+	}
+}
+
+// Set the secret to use for the given Task, in place of the Client's key.
+func (theClient *Client) SetTaskSecret(theTaskID string, theSecret string) {
+	theClient.lock.Lock()
+	defer theClient.lock.Unlock()
+	theClient.taskSecrets[theTaskID] = theSecret
+	delete(theClient.taskTokens, theTaskID)
+}
+
+// Make an API call, returning the response if it succeeded. Errors returned by the server are returned as an *APIError.
+func (theClient *Client) call(theContext context.Context, thePath string, theToken string, theValues url.Values) (*http.Response, error) {
+	apiRequest, requestErr := http.NewRequestWithContext(theContext, http.MethodPost, theClient.baseURL + thePath, strings.NewReader(theValues.Encode()))
+	if requestErr != nil {
+		return nil, requestErr
+	}
+	apiRequest.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if theToken != "" {
+		apiRequest.Header.Set("Authorization", "Bearer " + theToken)
+	}
+	apiResponse, responseErr := theClient.HTTPClient.Do(apiRequest)
+	if responseErr != nil {
+		return nil, responseErr
+	}
+	// Errors come back as the whole of the response, so a response starting "ERROR: " is read in full to get the message.
+	responseReader := bufio.NewReader(apiResponse.Body)
+	responseStart, _ := responseReader.Peek(len("ERROR: "))
+	if string(responseStart) == "ERROR: " {
+		errorMessage, _ := io.ReadAll(io.LimitReader(responseReader, 64 * 1024))
+		apiResponse.Body.Close()
+		return nil, &APIError{strings.TrimSpace(strings.TrimPrefix(string(errorMessage), "ERROR: ")), apiResponse.Header.Get("X-Error-Code")}
+	}
+	if apiResponse.StatusCode != http.StatusOK {
+		apiResponse.Body.Close()
+		return nil, fmt.Errorf("unexpected response from server: %s", apiResponse.Status)
+	}
+	apiResponse.Body = struct {
+		io.Reader
+		io.Closer
+	}{responseReader, apiResponse.Body}
+	return apiResponse, nil
+}
+
+// Make an API call, returning the whole of the response as a string.
+func (theClient *Client) callString(theContext context.Context, thePath string, theToken string, theValues url.Values) (string, error) {
+	apiResponse, callErr := theClient.call(theContext, thePath, theToken, theValues)
+	if callErr != nil {
+		return "", callErr
+	}
+	defer apiResponse.Body.Close()
+	responseBody, readErr := io.ReadAll(apiResponse.Body)
+	return string(responseBody), readErr
+}
+
+// Returns a token for the given Task, exchanging the Task's secret for one if there isn't one already.
+func (theClient *Client) Token(theContext context.Context, theTaskID string) (string, error) {
+	theClient.lock.Lock()
+	taskToken, tokenFound := theClient.taskTokens[theTaskID]
+	taskSecret, secretFound := theClient.taskSecrets[theTaskID]
+	theClient.lock.Unlock()
+	if tokenFound {
+		return taskToken, nil
+	}
+	if !secretFound {
+		taskSecret = theClient.apiKey
+	}
+	// The key might be a token already - if it isn't accepted as a secret, try it as a token, which getToken returns as it is.
+	taskToken, tokenErr := theClient.callString(theContext, "/api/getToken", "", url.Values{"taskID": {theTaskID}, "secret": {taskSecret}})
+	var apiErr *APIError
+	if errors.As(tokenErr, &apiErr) && apiErr.notAuthorised() && taskSecret != "" {
+		taskToken, tokenErr = theClient.callString(theContext, "/api/getToken", taskSecret, url.Values{"taskID": {theTaskID}})
+	}
+	if tokenErr != nil {
+		return "", tokenErr
+	}
+	taskToken = strings.TrimSpace(taskToken)
+	theClient.lock.Lock()
+	theClient.taskTokens[theTaskID] = taskToken
+	theClient.lock.Unlock()
+	return taskToken, nil
+}
+
+// Make an API call for the given Task, getting a token first if needed, and getting a new one if the token has expired.
+func (theClient *Client) taskCall(theContext context.Context, thePath string, theTaskID string, theValues url.Values) (*http.Response, error) {
+	if theValues == nil {
+		theValues = url.Values{}
+	}
+	theValues.Set("taskID", theTaskID)
+	for attempt := 1; ; attempt = attempt + 1 {
+		taskToken, tokenErr := theClient.Token(theContext, theTaskID)
+		if tokenErr != nil {
+			return nil, tokenErr
+		}
+		apiResponse, callErr := theClient.call(theContext, thePath, taskToken, theValues)
+		var apiErr *APIError
+		if attempt == 1 && errors.As(callErr, &apiErr) && apiErr.notAuthorised() {
+			theClient.lock.Lock()
+			delete(theClient.taskTokens, theTaskID)
+			theClient.lock.Unlock()
+			continue
+		}
+		return apiResponse, callErr
+	}
+}
+
+// As taskCall, returning the whole of the response as a string.
+func (theClient *Client) taskCallString(theContext context.Context, thePath string, theTaskID string, theValues url.Values) (string, error) {
+	apiResponse, callErr := theClient.taskCall(theContext, thePath, theTaskID, theValues)
+	if callErr != nil {
+		return "", callErr
+	}
+	defer apiResponse.Body.Close()
+	responseBody, readErr := io.ReadAll(apiResponse.Body)
+	return string(responseBody), readErr
+}
+
+// Returns the public Tasks, as titles by Task ID.
+func (theClient *Client) PublicTasks(theContext context.Context) (map[string]string, error) {
+	taskListJSON, callErr := theClient.callString(theContext, "/api/getPublicTaskList", "", url.Values{})
+	if callErr != nil {
+		return nil, callErr
+	}
+	taskTitles := map[string]string{}
+	if jsonErr := json.Unmarshal([]byte(taskListJSON), &taskTitles); jsonErr != nil {
+		return nil, jsonErr
+	}
+	return taskTitles, nil
+}
+
+// Start the given Task. Returns true if the run has to be approved by someone before it starts (see "Approval Gates").
+func (theClient *Client) StartTask(theContext context.Context, theTaskID string) (bool, error) {
+	runResponse, callErr := theClient.taskCallString(theContext, "/api/runTask", theTaskID, nil)
+	return strings.TrimSpace(runResponse) == "PENDING", callErr
+}
+
+// Stop the given Task, if it's running.
+func (theClient *Client) StopTask(theContext context.Context, theTaskID string) error {
+	_, callErr := theClient.taskCallString(theContext, "/api/stopTask", theTaskID, nil)
+	return callErr
+}
+
+// Returns the given Task's status.
+func (theClient *Client) TaskStatus(theContext context.Context, theTaskID string) (*TaskStatus, error) {
+	statusJSON, callErr := theClient.taskCallString(theContext, "/api/getTaskStatus", theTaskID, nil)
+	if callErr != nil {
+		return nil, callErr
+	}
+	taskStatus := &TaskStatus{}
+	if jsonErr := json.Unmarshal([]byte(statusJSON), taskStatus); jsonErr != nil {
+		return nil, jsonErr
+	}
+	return taskStatus, nil
+}
+
+// Follow the output of the given run of the given Task, from the given line onwards, calling the given function with each line until the run
+// finishes. If no run ID is given, the current run is followed. If the Task has been run again since the given run, the new run's output is
+// followed from its start. If the connection is lost, it's made again, carrying on where it left off. Returns the ID of the run followed and
+// the number of lines received.
+func (theClient *Client) StreamOutput(theContext context.Context, theTaskID string, theRunID string, theFromLine int, theLineHandler func(OutputLine)) (string, int, error) {
+	runID := theRunID
+	lineNumber := theFromLine
+	for {
+		streamResponse, callErr := theClient.taskCall(theContext, "/api/streamTaskOutput", theTaskID, url.Values{"format": {"ndjson"}, "line": {strconv.Itoa(lineNumber)}, "runID": {runID}})
+		var apiErr *APIError
+		if callErr != nil && (errors.As(callErr, &apiErr) || theContext.Err() != nil) {
+			return runID, lineNumber, callErr
+		}
+		if callErr == nil {
+			// If the Task has been run again since the run we were following, the server starts again from the new run's first line.
+			if newRunID := streamResponse.Header.Get("X-Run-ID"); runID != "" && newRunID != runID {
+				lineNumber = 0
+			}
+			runID = streamResponse.Header.Get("X-Run-ID")
+			outputScanner := bufio.NewScanner(streamResponse.Body)
+			outputScanner.Buffer(make([]byte, 64 * 1024), 16 * 1024 * 1024)
+			for outputScanner.Scan() {
+				var outputEvent struct {
+					Timestamp string `json:"ts"`
+					Stream string `json:"stream"`
+					Line string `json:"line"`
+					RunID string `json:"runID"`
+				}
+				if json.Unmarshal(outputScanner.Bytes(), &outputEvent) != nil {
+					continue
+				}
+				if outputEvent.Stream == "eof" {
+					streamResponse.Body.Close()
+					return runID, lineNumber, nil
+				}
+				outputTime, _ := time.Parse(time.RFC3339Nano, outputEvent.Timestamp)
+				theLineHandler(OutputLine{outputTime, outputEvent.Stream, outputEvent.Line, outputEvent.RunID})
+				lineNumber = lineNumber + 1
+			}
+			streamResponse.Body.Close()
+		}
+		// The connection was lost - wait a moment, then carry on from where we got to.
+		select {
+			case <-theContext.Done():
+				return runID, lineNumber, theContext.Err()
+			case <-time.After(theClient.PollInterval):
+		}
+	}
+}
+
+// Run the given Task and follow its output until it finishes, calling the given function (if not nil) with each line of output. If a failed
+// run is retried (see "Retries"), the retries are followed too. Returns how the (last) run went - an error is only returned if the Task
+// couldn't be run or followed, a failed run is reported in the result. If the Context is cancelled, the Task is left running.
+func (theClient *Client) Run(theContext context.Context, theTaskID string, theLineHandler func(OutputLine)) (*RunResult, error) {
+	if theLineHandler == nil {
+		theLineHandler = func(OutputLine) {}
+	}
+	// Note the run before this one, so the new run can be told apart from it - until the new run gets going, the Task's output is still the
+	// last run's.
+	taskStatus, statusErr := theClient.TaskStatus(theContext, theTaskID)
+	if statusErr != nil {
+		return nil, statusErr
+	}
+	runID := taskStatus.RunID
+	if taskStatus.LastRun != nil {
+		runID = taskStatus.LastRun.RunID
+	}
+	runPending, startErr := theClient.StartTask(theContext, theTaskID)
+	if startErr != nil {
+		return nil, startErr
+	}
+	if runPending {
+		return nil, errors.New("the run needs approval before it starts")
+	}
+	for {
+		// Wait for the next run - the one just started, or a retry - to start, or find that there isn't going to be one.
+		previousRunID := runID
+		for runID == previousRunID {
+			taskStatus, statusErr = theClient.TaskStatus(theContext, theTaskID)
+			if statusErr != nil {
+				return nil, statusErr
+			}
+			if taskStatus.Running && taskStatus.RunID != "" {
+				runID = taskStatus.RunID
+			} else if !taskStatus.Running && taskStatus.LastRun != nil && taskStatus.LastRun.RunID != previousRunID {
+				runID = taskStatus.LastRun.RunID
+			} else if !taskStatus.Running && taskStatus.NextRun == 0 && previousRunID != "" && taskStatus.LastRun != nil {
+				return taskStatus.LastRun, nil
+			}
+			if runID == previousRunID {
+				select {
+					case <-theContext.Done():
+						return nil, theContext.Err()
+					case <-time.After(theClient.PollInterval):
+				}
+			}
+		}
+		if _, _, streamErr := theClient.StreamOutput(theContext, theTaskID, runID, 0, theLineHandler); streamErr != nil {
+			return nil, streamErr
+		}
+	}
+}
+
+// Returns the IDs of the given Task's previous runs, oldest first (or newest first, if asked for).
+func (theClient *Client) RunList(theContext context.Context, theTaskID string, theNewestFirst bool) ([]string, error) {
+	runValues := url.Values{}
+	if theNewestFirst {
+		runValues.Set("order", "newest")
+	}
+	runList, callErr := theClient.taskCallString(theContext, "/api/getRunList", theTaskID, runValues)
+	if callErr != nil {
+		return nil, callErr
+	}
+	var runIDs []string
+	for _, runID := range strings.Split(runList, "\n") {
+		if strings.TrimSpace(runID) != "" {
+			runIDs = append(runIDs, strings.TrimSpace(runID))
+		}
+	}
+	return runIDs, nil
+}
+
+// Returns the complete log of the given run of the given Task - the most recent run if no run ID is given.
+func (theClient *Client) RunLog(theContext context.Context, theTaskID string, theRunID string) (string, error) {
+	runValues := url.Values{}
+	if theRunID != "" {
+		runValues.Set("runID", theRunID)
+	}
+	return theClient.taskCallString(theContext, "/api/downloadTaskOutput", theTaskID, runValues)
+}
+
+// Search the logs of the given Task's previous runs for the given text, returning matching lines grep-style ("runID:line:text", with context
+// lines as "runID-line-text" and "--" between groups). Also returns true if there were more matches than the server returns.
+func (theClient *Client) SearchRuns(theContext context.Context, theTaskID string, theQuery string, theOptions SearchOptions) ([]string, bool, error) {
+	searchValues := url.Values{"q": {theQuery}}
+	if theOptions.Regexp {
+		searchValues.Set("regex", "true")
+	}
+	if theOptions.Context > 0 {
+		searchValues.Set("context", strconv.Itoa(theOptions.Context))
+	}
+	if theOptions.NewestFirst {
+		searchValues.Set("order", "newest")
+	}
+	searchResponse, callErr := theClient.taskCall(theContext, "/api/searchRuns", theTaskID, searchValues)
+	if callErr != nil {
+		return nil, false, callErr
+	}
+	defer searchResponse.Body.Close()
+	var searchResults []string
+	resultScanner := bufio.NewScanner(searchResponse.Body)
+	resultScanner.Buffer(make([]byte, 64 * 1024), 16 * 1024 * 1024)
+	for resultScanner.Scan() {
+		searchResults = append(searchResults, resultScanner.Text())
+	}
+	return searchResults, searchResponse.Header.Get("X-Search-Truncated") == "true", resultScanner.Err()
+}
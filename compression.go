@@ -0,0 +1,183 @@
+package main
+// Response compression and caching, to save bandwidth (mostly Task output, which can be large) over slow links. Text responses - API calls,
+// Task output (polled or streamed), pages, scripts and stylesheets - are gzip or deflate compressed for clients that accept it (as every
+// browser does), unless they're too short to be worth it. Set "compression" to "false" in the main config file to turn this off, e.g. if a
+// reverse proxy compresses responses itself. Files from the webroot get an ETag (alongside the Last-Modified header Go's file server already
+// sends), so browsers can check whether their copy is still current, and a Cache-Control header: the third-party libraries, which are kept in
+// a folder per version, can be cached for good, while anything else is checked with the server each time it's used.
+
+import (
+	// Standard libraries.
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"net/http"
+	"compress/gzip"
+	"compress/zlib"
+)
+
+// Responses shorter than this (in bytes) aren't worth compressing.
+const compressionMinSize = 1024
+
+// Folders in the webroot holding third-party libraries - a new version of a library goes in a new folder, so their files never change.
+var versionedWebrootFolders = []string{"/jquery/", "/bootstrap/", "/bootstrap-icons/", "/popper/"}
+
+// The gzip and zlib (deflate) writers both buffer output, so need flushing when a response is streamed.
+type flushingWriteCloser interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// A ResponseWriter that compresses the response with the given encoding. The first part of the response is held back until it's clear the
+// response is long enough to compress (or the handler flushes it or finishes), then the response is either compressed or passed on as it is.
+type compressingResponseWriter struct {
+	http.ResponseWriter
+	encoding string
+	compressor flushingWriteCloser
+	heldBack []byte
+	statusCode int
+	decided bool
+}
+
+// Returns the compression (either "gzip" or "deflate") the given request accepts, preferring gzip, or "" if it accepts neither.
+func getAcceptedEncoding(theRequest *http.Request) string {
+	acceptedEncodings := map[string]bool{}
+	for _, encodingItem := range strings.Split(theRequest.Header.Get("Accept-Encoding"), ",") {
+		encodingFields := strings.Split(encodingItem, ";")
+		encodingQuality := 1.0
+		for _, encodingParameter := range encodingFields[1:] {
+			encodingParameter = strings.TrimSpace(encodingParameter)
+			if strings.HasPrefix(encodingParameter, "q=") {
+				encodingQuality, _ = strconv.ParseFloat(encodingParameter[2:], 64)
+			}
+		}
+		acceptedEncodings[strings.ToLower(strings.TrimSpace(encodingFields[0]))] = encodingQuality > 0
+	}
+	for _, encodingName := range []string{"gzip", "deflate"} {
+		if acceptedEncodings[encodingName] {
+			return encodingName
+		}
+	}
+	return ""
+}
+
+// Returns true for the content types worth compressing - text of any kind. Images (other than SVG) and archives are compressed already.
+func isCompressibleType(theContentType string) bool {
+	theContentType = strings.ToLower(theContentType)
+	return strings.HasPrefix(theContentType, "text/") || strings.Contains(theContentType, "json") || strings.Contains(theContentType, "javascript") || strings.Contains(theContentType, "xml")
+}
+
+// Returns the given ResponseWriter wrapped to compress the response, or nil if the client doesn't accept compressed responses or compression
+// is turned off. The wrapped writer needs closing once the response is written.
+func newCompressingResponseWriter(theResponseWriter http.ResponseWriter, theRequest *http.Request) *compressingResponseWriter {
+	if arguments["compression"] == "false" {
+		return nil
+	}
+	acceptedEncoding := getAcceptedEncoding(theRequest)
+	if acceptedEncoding == "" {
+		return nil
+	}
+	return &compressingResponseWriter{ResponseWriter: theResponseWriter, encoding: acceptedEncoding}
+}
+
+// Decide whether to compress the response - it's compressed if asked to and it's a full (status 200) response of a compressible type that
+// isn't already encoded - then send the headers and anything held back.
+func (theWriter *compressingResponseWriter) decide(theCompress bool) {
+	theWriter.decided = true
+	responseHeaders := theWriter.Header()
+	if responseHeaders.Get("Content-Type") == "" && len(theWriter.heldBack) > 0 {
+		responseHeaders.Set("Content-Type", http.DetectContentType(theWriter.heldBack))
+	}
+	if theCompress && (theWriter.statusCode == 0 || theWriter.statusCode == http.StatusOK) && responseHeaders.Get("Content-Encoding") == "" &&
+		responseHeaders.Get("Content-Range") == "" && isCompressibleType(responseHeaders.Get("Content-Type")) {
+		responseHeaders.Set("Content-Encoding", theWriter.encoding)
+		responseHeaders.Add("Vary", "Accept-Encoding")
+		responseHeaders.Del("Content-Length")
+		// The compressed response isn't byte-for-byte the same as the file, so its ETag can only be a weak one.
+		if entityTag := responseHeaders.Get("ETag"); strings.HasPrefix(entityTag, "\"") {
+			responseHeaders.Set("ETag", "W/" + entityTag)
+		}
+		if theWriter.encoding == "gzip" {
+			theWriter.compressor = gzip.NewWriter(theWriter.ResponseWriter)
+		} else {
+			theWriter.compressor = zlib.NewWriter(theWriter.ResponseWriter)
+		}
+	}
+	if theWriter.statusCode != 0 {
+		theWriter.ResponseWriter.WriteHeader(theWriter.statusCode)
+	}
+	if len(theWriter.heldBack) > 0 {
+		heldBack := theWriter.heldBack
+		theWriter.heldBack = nil
+		theWriter.Write(heldBack)
+	}
+}
+
+// Anything other than a full response (a redirect, a "304 Not Modified", a partial response, an error) is sent as it is.
+func (theWriter *compressingResponseWriter) WriteHeader(theStatusCode int) {
+	if theWriter.decided || theWriter.statusCode != 0 {
+		return
+	}
+	theWriter.statusCode = theStatusCode
+	if theStatusCode != http.StatusOK {
+		theWriter.decide(false)
+	}
+}
+
+func (theWriter *compressingResponseWriter) Write(theData []byte) (int, error) {
+	if !theWriter.decided {
+		theWriter.heldBack = append(theWriter.heldBack, theData...)
+		if len(theWriter.heldBack) >= compressionMinSize {
+			theWriter.decide(true)
+		}
+		return len(theData), nil
+	}
+	if theWriter.compressor != nil {
+		return theWriter.compressor.Write(theData)
+	}
+	return theWriter.ResponseWriter.Write(theData)
+}
+
+// Streamed output (e.g. api/streamTaskOutput) is compressed however short it is, as there's no telling how long it will be.
+func (theWriter *compressingResponseWriter) Flush() {
+	if !theWriter.decided {
+		theWriter.decide(true)
+	}
+	if theWriter.compressor != nil {
+		theWriter.compressor.Flush()
+	}
+	if outputFlusher, flusherOK := theWriter.ResponseWriter.(http.Flusher); flusherOK {
+		outputFlusher.Flush()
+	}
+}
+
+// Lets http.ResponseController reach the underlying ResponseWriter.
+func (theWriter *compressingResponseWriter) Unwrap() http.ResponseWriter {
+	return theWriter.ResponseWriter
+}
+
+// Finish the response - anything still held back is too short to compress, so is sent as it is.
+func (theWriter *compressingResponseWriter) Close() {
+	if !theWriter.decided && (theWriter.statusCode != 0 || len(theWriter.heldBack) > 0) {
+		theWriter.decide(false)
+	}
+	if theWriter.compressor != nil {
+		theWriter.compressor.Close()
+	}
+}
+
+// Serve the given file from the webroot, with an ETag (made from the file's size and modification time) and a Cache-Control header.
+func serveWebrootFile(theResponseWriter http.ResponseWriter, theRequest *http.Request, theRequestPath string, theFilePath string) {
+	if fileInfo, statErr := os.Stat(theFilePath); statErr == nil && !fileInfo.IsDir() {
+		theResponseWriter.Header().Set("ETag", "\"" + strconv.FormatInt(fileInfo.ModTime().UnixNano(), 36) + "-" + strconv.FormatInt(fileInfo.Size(), 36) + "\"")
+		cacheControl := "no-cache"
+		for _, versionedFolder := range versionedWebrootFolders {
+			if strings.HasPrefix(theRequestPath, versionedFolder) {
+				cacheControl = "public, max-age=31536000, immutable"
+			}
+		}
+		theResponseWriter.Header().Set("Cache-Control", cacheControl)
+	}
+	http.ServeFile(theResponseWriter, theRequest, theFilePath)
+}
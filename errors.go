@@ -0,0 +1,73 @@
+package main
+// Error responses. API calls that fail return a plain text message starting "ERROR: " (for the web interface's sake, usually with a "200 OK"
+// status), along with an "X-Error-Code" header giving a code that doesn't change between versions or languages (see locale.go), so scripts
+// can act on it rather than on the message. Requests that aren't authorised are refused with the same "Not authorised." message whatever the
+// reason - an unknown Task, a wrong secret, an expired token, a client IP that isn't allowed - so a client can't use the message to find out
+// which Tasks exist or whether a token was ever valid. The one exception is a Task that needs a two-factor code (see totp.go): once the secret
+// has been accepted, a missing or wrong code is reported as such, so the client knows to ask for one. The reason is logged on the server (and passed
+// on to plugins as an "authFailed" event) instead. Unexpected errors (reading files, parsing data and so on) are logged in full on the server, the
+// client being given a reference to quote rather than the details, which might include paths or other internals.
+
+import (
+	// Standard libraries.
+	"fmt"
+	"errors"
+	"net/http"
+)
+
+// The error codes sent in the X-Error-Code header.
+const errorCodeNotAuthorised = "not_authorised"
+const errorCodeForbidden = "forbidden"
+const errorCodeTOTPRequired = "totp_required"
+const errorCodeInvalidRequest = "invalid_request"
+const errorCodeInvalidParameters = "invalid_parameters"
+const errorCodeNotFound = "not_found"
+const errorCodeTooLarge = "too_large"
+const errorCodeTooManyRequests = "too_many_requests"
+const errorCodeQuotaExceeded = "quota_exceeded"
+const errorCodeStale = "stale"
+const errorCodeInternal = "internal_error"
+
+// An error returned by an API call, with the code from its X-Error-Code header - the message may have been translated (see locale.go), the
+// code never is.
+type apiCallError struct {
+	code string
+	message string
+}
+
+func (theError *apiCallError) Error() string {
+	return theError.message
+}
+
+// Returns the X-Error-Code of the given API call error, or "" if it isn't one or came without a code.
+func getAPIErrorCode(theError error) string {
+	var callErr *apiCallError
+	if errors.As(theError, &callErr) {
+		return callErr.code
+	}
+	return ""
+}
+
+// Write an error response with the given HTTP status (0 for "200 OK", as most API calls use), error code and message.
+func writeErrorResponse(theResponseWriter http.ResponseWriter, theStatusCode int, theErrorCode string, theMessage string) {
+	theResponseWriter.Header().Set("X-Error-Code", theErrorCode)
+	theResponseWriter.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if theStatusCode != 0 {
+		theResponseWriter.WriteHeader(theStatusCode)
+	}
+	fmt.Fprint(theResponseWriter, "ERROR: " + theMessage)
+}
+
+// Refuse a request that isn't authorised for the given reason, which is logged but not passed on to the client.
+func writeNotAuthorised(theResponseWriter http.ResponseWriter, theRequest *http.Request, theStatusCode int, theReason string) {
+	fmt.Println("Not authorised: " + theRequest.URL.Path + " from " + getClientIP(theRequest) + " - " + theReason + ".")
+	recordAuthFailure(getClientIP(theRequest))
+	writeErrorResponse(theResponseWriter, theStatusCode, errorCodeNotAuthorised, "Not authorised.")
+}
+
+// Respond to an unexpected error with a reference the client can quote, logging the error itself under that reference.
+func writeInternalError(theResponseWriter http.ResponseWriter, theRequest *http.Request, theErr error) {
+	errorReference := generateRandomString()[:8]
+	fmt.Println("ERROR: [" + errorReference + "] " + theRequest.URL.Path + " - " + theErr.Error())
+	writeErrorResponse(theResponseWriter, 0, errorCodeInternal, "Internal error (reference " + errorReference + ").")
+}
@@ -0,0 +1,116 @@
+package main
+// The event bus - things that happen to Tasks (a run starting, each line of output, a run finishing, a failed attempt to authorise) are
+// published as events, and features that want to act on them (notifications, metrics, uploading a run's files and so on) subscribe to the
+// events they need, rather than being called from runTask one by one. Features subscribe with subscribeTaskEvents, usually from an init
+// function in their own file. Subscribers are called in the order they subscribed, on the goroutine publishing the event, so they should
+// return quickly - anything slow (such as a network call) should be done in a goroutine of its own. Output lines are published after any
+// secrets have been masked (see redact.go), so subscribers see the same output users do.
+// Events can also be handled by Go plugins, listed (comma-separated) in the "plugins" option and loaded at startup - see "Plugins" in the README.
+
+import (
+	// Standard libraries.
+	"fmt"
+	"sync"
+	"time"
+	"errors"
+	"plugin"
+	"strings"
+)
+
+// Event types.
+const eventTaskStarted = "taskStarted"
+const eventOutputLine = "outputLine"
+const eventTaskFinished = "taskFinished"
+const eventAuthFailed = "authFailed"
+
+// Something that happened to a Task. Which fields are set depends on the event type.
+type taskEvent struct {
+	eventType string
+	taskID string
+	runID string
+	time time.Time
+	// taskStarted and taskFinished: the Task's config, and who or what started the run (see triggers.go).
+	taskDetails map[string]string
+	trigger runTrigger
+	// outputLine: the line output.
+	outputLine taskOutputLine
+	// taskFinished: why the run failed (blank if it succeeded), and whether it's going to be retried.
+	runError string
+	retryScheduled bool
+	// authFailed: who failed to authorise, what they asked for and why they were refused.
+	clientIP string
+	requestPath string
+	reason string
+}
+
+// Subscribers to each event type.
+var eventSubscribers = map[string][]func(taskEvent){}
+var eventSubscribersLock sync.RWMutex
+
+// Call the given function with every event of the given type.
+func subscribeTaskEvents(theEventType string, theSubscriber func(taskEvent)) {
+	eventSubscribersLock.Lock()
+	defer eventSubscribersLock.Unlock()
+	eventSubscribers[theEventType] = append(eventSubscribers[theEventType], theSubscriber)
+}
+
+// Pass the given event to everything subscribed to its type.
+func publishTaskEvent(theEvent taskEvent) {
+	if theEvent.time.IsZero() {
+		theEvent.time = time.Now()
+	}
+	eventSubscribersLock.RLock()
+	subscribers := eventSubscribers[theEvent.eventType]
+	eventSubscribersLock.RUnlock()
+	for _, subscriber := range subscribers {
+		subscriber(theEvent)
+	}
+}
+
+// Returns the given event as a plain map of strings, as passed to plugins (which can't see our own types).
+func getEventValues(theEvent taskEvent) map[string]string {
+	eventValues := map[string]string{"event": theEvent.eventType, "taskID": theEvent.taskID, "runID": theEvent.runID, "time": theEvent.time.Format(time.RFC3339Nano)}
+	switch theEvent.eventType {
+		case eventOutputLine:
+			eventValues["stream"] = theEvent.outputLine.stream
+			eventValues["line"] = theEvent.outputLine.line
+		case eventTaskFinished:
+			eventValues["error"] = theEvent.runError
+			eventValues["retryScheduled"] = fmt.Sprint(theEvent.retryScheduled)
+		case eventAuthFailed:
+			eventValues["clientIP"] = theEvent.clientIP
+			eventValues["path"] = theEvent.requestPath
+			eventValues["reason"] = theEvent.reason
+	}
+	return eventValues
+}
+
+// Load the Go plugins listed in the "plugins" option. Each plugin has a "Subscribe" function, which is called with a function it can use to
+// subscribe to events by type - events are given to plugins as maps of strings (see getEventValues). Returns the plugins loaded.
+func loadPlugins() ([]string, error) {
+	var pluginPaths []string
+	for _, pluginPath := range strings.Split(arguments["plugins"], ",") {
+		if pluginPath = strings.TrimSpace(pluginPath); pluginPath == "" {
+			continue
+		}
+		loadedPlugin, openErr := plugin.Open(pluginPath)
+		if openErr != nil {
+			return pluginPaths, errors.New("Can't load plugin \"" + pluginPath + "\" - " + openErr.Error())
+		}
+		subscribeSymbol, lookupErr := loadedPlugin.Lookup("Subscribe")
+		if lookupErr != nil {
+			return pluginPaths, errors.New("Plugin \"" + pluginPath + "\" has no Subscribe function.")
+		}
+		pluginSubscribe, subscribeOK := subscribeSymbol.(func(func(string, func(map[string]string))))
+		if !subscribeOK {
+			return pluginPaths, errors.New("Plugin \"" + pluginPath + "\" has a Subscribe function of the wrong type - see \"Plugins\" in the README.")
+		}
+		pluginSubscribe(func(theEventType string, theHandler func(map[string]string)) {
+			subscribeTaskEvents(theEventType, func(theEvent taskEvent) {
+				theHandler(getEventValues(theEvent))
+			})
+		})
+		pluginPaths = append(pluginPaths, pluginPath)
+	}
+	return pluginPaths, nil
+}
@@ -0,0 +1,168 @@
+package main
+// Git checkouts - a Task can run the latest version of a script straight from version control. With "gitRepo" set to a repository's URL, the
+// repository is cloned into the Task's working folder before the Task's first run, and brought up to date before each run after that:
+//   gitRepo: the repository to check out, e.g. https://github.com/example/scripts.git or git@github.com:example/scripts.git.
+//   gitRef: the branch, tag or commit to check out - defaults to the repository's default branch.
+//   gitKey: a deploy key (the full path of an SSH private key file, kept outside the Task root) to use for an SSH repository URL. The key
+//   can't be kept in a Task's folder, where the file browser, share links and exported bundles could give it away.
+// The working folder is the Task's "workdir" if set, otherwise a "checkout" folder in the Task's own folder (so the checkout doesn't get mixed up
+// with the Task's config and run history). Each run checks out the given ref as it is on the remote, discarding any changes made to tracked
+// files by earlier runs. The commit checked out is noted in the Task's output and passed to the Task as WEBCONSOLE_GIT_COMMIT. Checkouts are
+// done with the "git" command, which needs to be installed on the server - Tasks run on an agent aren't checked out by the server.
+
+import (
+	// Standard libraries.
+	"os"
+	"time"
+	"bytes"
+	"errors"
+	"context"
+	"strings"
+	"net/url"
+	"os/exec"
+	"io/ioutil"
+	"path/filepath"
+)
+
+// How long each git command can take before it's stopped.
+const gitCommandTimeout = 10 * time.Minute
+
+// The folder, within a Task's own folder, a Task with a "gitRepo" is checked out into if it doesn't have a "workdir".
+const gitCheckoutFolder = "checkout"
+
+// Returns true if the given Task is checked out from a git repository before it runs here.
+func taskUsesGit(theTaskDetails map[string]string) bool {
+	return strings.TrimSpace(theTaskDetails["gitrepo"]) != "" && theTaskDetails["runner"] == ""
+}
+
+// Returns the given repository URL with any password or token in it masked, for showing in output.
+func getRedactedRepoURL(theRepo string) string {
+	if repoURL, urlErr := url.Parse(theRepo); urlErr == nil && repoURL.User != nil {
+		return repoURL.Redacted()
+	}
+	return theRepo
+}
+
+// Returns the full path of the given Task's deploy key, or an error if the key isn't a full path or is within the Task root.
+func getTaskGitKeyPath(theTaskDetails map[string]string) (string, error) {
+	gitKey := strings.TrimSpace(theTaskDetails["gitkey"])
+	if !filepath.IsAbs(gitKey) {
+		return "", errors.New("Deploy key \"" + gitKey + "\" has to be given as a full path, outside the Task root.")
+	}
+	keyPath := filepath.Clean(gitKey)
+	if linkedPath, linkErr := filepath.EvalSymlinks(keyPath); linkErr == nil {
+		keyPath = linkedPath
+	}
+	taskRoot, rootErr := filepath.Abs(arguments["taskroot"])
+	if rootErr == nil {
+		if linkedRoot, linkErr := filepath.EvalSymlinks(taskRoot); linkErr == nil {
+			taskRoot = linkedRoot
+		}
+	}
+	relativePath, relativeErr := filepath.Rel(taskRoot, keyPath)
+	if rootErr != nil || relativeErr != nil || !(relativePath == ".." || strings.HasPrefix(relativePath, ".." + string(filepath.Separator))) {
+		return "", errors.New("Deploy key \"" + gitKey + "\" has to be kept outside the Task root.")
+	}
+	return keyPath, nil
+}
+
+// Run a git command in the given folder with the given environment, returning its output, or an error giving the last line git printed.
+func runGitCommand(theFolder string, theEnvironment []string, theArguments ...string) (string, error) {
+	gitContext, cancelGit := context.WithTimeout(context.Background(), gitCommandTimeout)
+	defer cancelGit()
+	gitCommand := exec.CommandContext(gitContext, "git", theArguments...)
+	gitCommand.Dir = theFolder
+	gitCommand.Env = theEnvironment
+	var gitOutput bytes.Buffer
+	gitCommand.Stdout = &gitOutput
+	gitCommand.Stderr = &gitOutput
+	if gitErr := gitCommand.Run(); gitErr != nil {
+		gitLines := strings.Split(strings.TrimSpace(gitOutput.String()), "\n")
+		if gitLines[len(gitLines)-1] != "" {
+			return gitOutput.String(), errors.New(strings.TrimSpace(gitLines[len(gitLines)-1]))
+		}
+		return gitOutput.String(), gitErr
+	}
+	return gitOutput.String(), nil
+}
+
+// Clone or update the given Task's repository in its working folder and check out its "gitRef", reporting progress with the given function.
+// Returns the commit checked out.
+func checkoutTaskRepo(theTaskID string, theTaskDetails map[string]string, theRecordOutput func(string, string)) (string, error) {
+	gitRepo := strings.TrimSpace(theTaskDetails["gitrepo"])
+	gitRef := strings.TrimSpace(theTaskDetails["gitref"])
+	workDir := getTaskWorkDir(theTaskID, theTaskDetails)
+	// Git is never to stop and ask for a password, and uses the Task's deploy key, if it has one, for SSH.
+	gitEnvironment := append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	if strings.TrimSpace(theTaskDetails["gitkey"]) != "" {
+		keyPath, keyErr := getTaskGitKeyPath(theTaskDetails)
+		if keyErr != nil {
+			return "", keyErr
+		}
+		gitEnvironment = append(gitEnvironment, "GIT_SSH_COMMAND=ssh -i \"" + filepath.ToSlash(keyPath) + "\" -o IdentitiesOnly=yes -o StrictHostKeyChecking=accept-new -o BatchMode=yes")
+	}
+	if _, statErr := os.Stat(filepath.Join(workDir, ".git")); os.IsNotExist(statErr) {
+		if folderContents, _ := ioutil.ReadDir(workDir); len(folderContents) > 0 {
+			return "", errors.New("Can't clone " + getRedactedRepoURL(gitRepo) + " - working folder \"" + workDir + "\" isn't empty.")
+		}
+		if mkdirErr := os.MkdirAll(workDir, os.ModePerm); mkdirErr != nil {
+			return "", errors.New("Can't create working folder \"" + workDir + "\" - " + mkdirErr.Error())
+		}
+		theRecordOutput("system", "Cloning " + getRedactedRepoURL(gitRepo) + "...")
+		if _, cloneErr := runGitCommand(workDir, gitEnvironment, "clone", "--no-checkout", "--", gitRepo, "."); cloneErr != nil {
+			return "", errors.New("Can't clone " + getRedactedRepoURL(gitRepo) + " - " + cloneErr.Error())
+		}
+	} else {
+		// The repository's URL might have changed since it was cloned.
+		if _, remoteErr := runGitCommand(workDir, gitEnvironment, "remote", "set-url", "origin", gitRepo); remoteErr != nil {
+			return "", errors.New("Can't update " + getRedactedRepoURL(gitRepo) + " - " + remoteErr.Error())
+		}
+		if _, fetchErr := runGitCommand(workDir, gitEnvironment, "fetch", "--prune", "--tags", "--force", "origin"); fetchErr != nil {
+			return "", errors.New("Can't update " + getRedactedRepoURL(gitRepo) + " - " + fetchErr.Error())
+		}
+	}
+	// A branch is checked out as it is on the remote, anything else (a tag or commit) as given. Without a gitRef, the remote's default branch.
+	checkoutTarget := "origin/HEAD"
+	if gitRef != "" {
+		checkoutTarget = gitRef
+		if _, branchErr := runGitCommand(workDir, gitEnvironment, "rev-parse", "--verify", "--quiet", "refs/remotes/origin/" + gitRef); branchErr == nil {
+			checkoutTarget = "origin/" + gitRef
+		}
+	} else if _, headErr := runGitCommand(workDir, gitEnvironment, "rev-parse", "--verify", "--quiet", "refs/remotes/origin/HEAD"); headErr != nil {
+		// A repository cloned before the remote's default branch was known - ask the remote.
+		runGitCommand(workDir, gitEnvironment, "remote", "set-head", "origin", "--auto")
+	}
+	if _, checkoutErr := runGitCommand(workDir, gitEnvironment, "checkout", "--force", "--detach", checkoutTarget, "--"); checkoutErr != nil {
+		return "", errors.New("Can't check out \"" + strings.TrimPrefix(checkoutTarget, "origin/") + "\" - " + checkoutErr.Error())
+	}
+	gitCommit, revParseErr := runGitCommand(workDir, gitEnvironment, "rev-parse", "HEAD")
+	if revParseErr != nil {
+		return "", errors.New("Can't find the commit checked out - " + revParseErr.Error())
+	}
+	gitCommit = strings.TrimSpace(gitCommit)
+	checkedOutRef := gitRef
+	if checkedOutRef == "" {
+		checkedOutRef = "default branch"
+	}
+	theRecordOutput("system", "Checked out " + getRedactedRepoURL(gitRepo) + " (" + checkedOutRef + ") at commit " + gitCommit + ".")
+	return gitCommit, nil
+}
+
+// Check the given Task's git settings: that git can be found and the deploy key, if given, exists outside the Task root.
+func checkTaskGitConfig(theTaskID string, theTaskDetails map[string]string) []string {
+	var problems []string
+	if !taskUsesGit(theTaskDetails) {
+		return problems
+	}
+	if _, lookErr := exec.LookPath("git"); lookErr != nil {
+		problems = append(problems, "The Task has a gitRepo, but git can't be found - " + lookErr.Error())
+	}
+	if gitKey := strings.TrimSpace(theTaskDetails["gitkey"]); gitKey != "" {
+		if keyPath, keyErr := getTaskGitKeyPath(theTaskDetails); keyErr != nil {
+			problems = append(problems, keyErr.Error())
+		} else if _, statErr := os.Stat(keyPath); statErr != nil {
+			problems = append(problems, "Deploy key \"" + gitKey + "\" can't be found.")
+		}
+	}
+	return problems
+}
@@ -0,0 +1,170 @@
+package main
+// GitHub and GitLab webhooks - building on webhook triggers (see hooks.go), a Task can be started by a repository's webhooks, for using Web
+// Console as a simple deploy bot. Point a GitHub webhook at /hooks/github/<taskID>, or a GitLab one at /hooks/gitlab/<taskID>, with the Task's
+// "hooksecret" as the webhook's secret (GitHub) or secret token (GitLab). Calls are checked against the secret, then filtered by the Task's
+// options before the Task is run:
+//   hookEvents: a comma-separated list of the events to run the Task for - "push" (the default), "tag", "pull_request" (a GitHub pull request
+//     or GitLab merge request being opened or updated) or "release". GitHub's "ping" event is always answered, without running the Task.
+//   hookBranches: a comma-separated list of branches (or, for "tag" and "release" events, tags) to run the Task for, which can include
+//     wildcards, e.g. "main, release/*". Blank (the default) means any.
+// Details of the event are passed to the Task as parameters: EVENT, BRANCH (or TAG), COMMIT (the full SHA), REPOSITORY and SENDER, so appear
+// as WEBCONSOLE_PARAM_BRANCH and so on. Parameters from the Task's "hookparameters" option are added as for any webhook.
+
+import (
+	// Standard libraries.
+	"path"
+	"errors"
+	"strings"
+	"net/http"
+	"crypto/subtle"
+	"encoding/json"
+)
+
+// The events a GitHub or GitLab webhook call can be for, as given in "hookEvents", keyed by the event names the two use.
+var gitHubHookEvents = map[string]string{"push": "push", "pull_request": "pull_request", "release": "release"}
+var gitLabHookEvents = map[string]string{"Push Hook": "push", "Tag Push Hook": "tag", "Merge Request Hook": "pull_request", "Release Hook": "release"}
+
+// A commit SHA of all zeros means a branch or tag was deleted.
+const deletedCommitSHA = "0000000000000000000000000000000000000000"
+
+// Check a webhook call from the given provider ("github" or "gitlab") is signed with the Task's "hooksecret", and work out the parameters to
+// run the Task with. Returns a reason the call is being ignored (blank if the Task should be run) - the event or branch isn't one the Task is
+// run for, for instance.
+func checkGitHostHook(theProvider string, theRequest *http.Request, theRequestBody []byte, theTaskDetails map[string]string) (map[string]string, string, error) {
+	if theTaskDetails["hooksecret"] == "" {
+		return nil, "", errors.New("webhooks aren't enabled for this Task")
+	}
+	var payloadJSON interface{}
+	if theRequest.Form.Get("payload") != "" {
+		json.Unmarshal([]byte(theRequest.Form.Get("payload")), &payloadJSON)
+	} else {
+		json.Unmarshal(theRequestBody, &payloadJSON)
+	}
+	payloadValue := func(thePath string) string {
+		jsonValue, _ := getJSONPathValue(payloadJSON, thePath)
+		return jsonValue
+	}
+	hookParameters := map[string]string{}
+	hookEvent := ""
+	if theProvider == "github" {
+		// GitHub signs the request body in the same way as any other webhook.
+		if signatureErr := checkHookRequest(theRequest, theRequestBody, theTaskDetails); signatureErr != nil {
+			return nil, "", signatureErr
+		}
+		gitHubEvent := theRequest.Header.Get("X-GitHub-Event")
+		if gitHubEvent == "ping" {
+			return nil, "ping", nil
+		}
+		hookEvent = gitHubHookEvents[gitHubEvent]
+		hookParameters["repository"] = payloadValue("repository.full_name")
+		hookParameters["sender"] = payloadValue("sender.login")
+		switch hookEvent {
+			case "push":
+				hookParameters["commit"] = payloadValue("after")
+				if strings.HasPrefix(payloadValue("ref"), "refs/tags/") {
+					hookEvent = "tag"
+				}
+			case "pull_request":
+				if pullRequestAction := payloadValue("action"); pullRequestAction != "opened" && pullRequestAction != "synchronize" && pullRequestAction != "reopened" {
+					return nil, "pull request " + pullRequestAction, nil
+				}
+				hookParameters["branch"] = payloadValue("pull_request.head.ref")
+				hookParameters["commit"] = payloadValue("pull_request.head.sha")
+			case "release":
+				if releaseAction := payloadValue("action"); releaseAction != "published" {
+					return nil, "release " + releaseAction, nil
+				}
+				hookParameters["tag"] = payloadValue("release.tag_name")
+		}
+	} else {
+		// GitLab sends the secret itself, as a header.
+		gitLabToken := theRequest.Header.Get("X-Gitlab-Token")
+		if gitLabToken == "" {
+			return nil, "", errors.New("missing token")
+		}
+		if subtle.ConstantTimeCompare([]byte(gitLabToken), []byte(theTaskDetails["hooksecret"])) != 1 {
+			return nil, "", errors.New("incorrect token")
+		}
+		hookEvent = gitLabHookEvents[theRequest.Header.Get("X-Gitlab-Event")]
+		hookParameters["repository"] = payloadValue("project.path_with_namespace")
+		hookParameters["sender"] = payloadValue("user_username")
+		switch hookEvent {
+			case "push", "tag":
+				hookParameters["commit"] = payloadValue("checkout_sha")
+				if hookParameters["commit"] == "" {
+					hookParameters["commit"] = payloadValue("after")
+				}
+			case "pull_request":
+				if mergeRequestAction := payloadValue("object_attributes.action"); mergeRequestAction != "open" && mergeRequestAction != "update" && mergeRequestAction != "reopen" {
+					return nil, "merge request " + mergeRequestAction, nil
+				}
+				hookParameters["branch"] = payloadValue("object_attributes.source_branch")
+				hookParameters["commit"] = payloadValue("object_attributes.last_commit.id")
+				hookParameters["sender"] = payloadValue("user.username")
+			case "release":
+				if releaseAction := payloadValue("action"); releaseAction != "create" {
+					return nil, "release " + releaseAction, nil
+				}
+				hookParameters["tag"] = payloadValue("tag")
+		}
+	}
+	if hookEvent == "" {
+		return nil, "unsupported event", nil
+	}
+	hookParameters["event"] = hookEvent
+	// Pushes give the full name of the branch or tag pushed.
+	if hookEvent == "push" {
+		hookParameters["branch"] = strings.TrimPrefix(payloadValue("ref"), "refs/heads/")
+	} else if hookEvent == "tag" {
+		hookParameters["tag"] = strings.TrimPrefix(payloadValue("ref"), "refs/tags/")
+	}
+	if (hookEvent == "push" || hookEvent == "tag") && (hookParameters["commit"] == "" || hookParameters["commit"] == deletedCommitSHA) {
+		return nil, "branch or tag deleted", nil
+	}
+	// Filter by event, then by branch or tag.
+	wantedEvents := theTaskDetails["hookevents"]
+	if strings.TrimSpace(wantedEvents) == "" {
+		wantedEvents = "push"
+	}
+	eventWanted := false
+	for _, wantedEvent := range strings.Split(wantedEvents, ",") {
+		if strings.TrimSpace(strings.ToLower(wantedEvent)) == hookEvent {
+			eventWanted = true
+		}
+	}
+	if !eventWanted {
+		return nil, "not run for " + hookEvent + " events", nil
+	}
+	hookRef := hookParameters["branch"] + hookParameters["tag"]
+	if strings.TrimSpace(theTaskDetails["hookbranches"]) != "" {
+		refWanted := false
+		for _, wantedRef := range strings.Split(theTaskDetails["hookbranches"], ",") {
+			if refMatched, _ := path.Match(strings.TrimSpace(wantedRef), hookRef); refMatched {
+				refWanted = true
+			}
+		}
+		if !refWanted {
+			return nil, "not run for \"" + hookRef + "\"", nil
+		}
+	}
+	for parameterName, parameterValue := range hookParameters {
+		if parameterValue == "" {
+			delete(hookParameters, parameterName)
+		}
+	}
+	return hookParameters, "", nil
+}
+
+// Returns a short description of a GitHub or GitLab webhook call, for the audit log, e.g. "push to main (commit 1a2b3c4)".
+func describeGitHostHook(theHookParameters map[string]string) string {
+	hookDescription := theHookParameters["event"]
+	if theHookParameters["branch"] != "" {
+		hookDescription = hookDescription + " to " + theHookParameters["branch"]
+	} else if theHookParameters["tag"] != "" {
+		hookDescription = hookDescription + " " + theHookParameters["tag"]
+	}
+	if len(theHookParameters["commit"]) >= 7 {
+		hookDescription = hookDescription + " (commit " + theHookParameters["commit"][:7] + ")"
+	}
+	return hookDescription
+}
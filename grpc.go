@@ -0,0 +1,436 @@
+package main
+// gRPC API - the core API calls (getting a token, running and stopping a Task, its status and its output) as a gRPC service, for integrations
+// that would rather work from a protobuf contract and streams than poll. The service is described by webconsole.proto in the webroot (served
+// at api/docs/webconsole.proto). gRPC runs over HTTP/2, which the web server already speaks (unless "http2" is set to "false"), so gRPC
+// requests are served on the same port as everything else, picked out by their "application/grpc" content type.
+// Each gRPC call is made as the matching API call, so works exactly the same way - the same authorisation, rate limiting, tenants (by host
+// name, or with the tenant's prefix in front of the service's path) and error messages, which are returned as the gRPC status message. Messages
+// are encoded and decoded here rather than with generated code, as the service only needs a handful of simple messages.
+
+import (
+	// Standard libraries.
+	"io"
+	"fmt"
+	"math"
+	"time"
+	"bytes"
+	"errors"
+	"strings"
+	"net/url"
+	"net/http"
+	"encoding/json"
+	"encoding/binary"
+)
+
+// The gRPC service's name, as found in request paths ("/webconsole.WebConsole/RunTask").
+const grpcServiceName = "webconsole.WebConsole"
+
+// The largest message we'll accept from a client, in bytes.
+const maxGRPCMessageSize = 1024 * 1024
+
+// gRPC status codes used.
+const (
+	grpcStatusOK = 0
+	grpcStatusUnknown = 2
+	grpcStatusInvalidArgument = 3
+	grpcStatusFailedPrecondition = 9
+	grpcStatusResourceExhausted = 8
+	grpcStatusUnimplemented = 12
+	grpcStatusUnauthenticated = 16
+)
+
+// A decoded protobuf message - the last value given for each field, either as a number (varint and fixed-size fields) or as bytes (strings
+// and embedded messages).
+type protoMessage struct {
+	numbers map[int]uint64
+	values map[int][]byte
+}
+
+// Decode the given protobuf message.
+func decodeProtoMessage(theData []byte) (protoMessage, error) {
+	message := protoMessage{map[int]uint64{}, map[int][]byte{}}
+	for len(theData) > 0 {
+		fieldKey, keyLength := binary.Uvarint(theData)
+		if keyLength <= 0 {
+			return message, errors.New("Invalid message.")
+		}
+		theData = theData[keyLength:]
+		fieldNumber := int(fieldKey >> 3)
+		switch fieldKey & 7 {
+			case 0:
+				fieldValue, valueLength := binary.Uvarint(theData)
+				if valueLength <= 0 {
+					return message, errors.New("Invalid message.")
+				}
+				message.numbers[fieldNumber] = fieldValue
+				theData = theData[valueLength:]
+			case 1:
+				if len(theData) < 8 {
+					return message, errors.New("Invalid message.")
+				}
+				message.numbers[fieldNumber] = binary.LittleEndian.Uint64(theData)
+				theData = theData[8:]
+			case 2:
+				fieldLength, lengthLength := binary.Uvarint(theData)
+				if lengthLength <= 0 || fieldLength > uint64(len(theData) - lengthLength) {
+					return message, errors.New("Invalid message.")
+				}
+				message.values[fieldNumber] = theData[lengthLength:lengthLength + int(fieldLength)]
+				theData = theData[lengthLength + int(fieldLength):]
+			case 5:
+				if len(theData) < 4 {
+					return message, errors.New("Invalid message.")
+				}
+				message.numbers[fieldNumber] = uint64(binary.LittleEndian.Uint32(theData))
+				theData = theData[4:]
+			default:
+				return message, errors.New("Invalid message.")
+		}
+	}
+	return message, nil
+}
+
+// Append the given string field to the given protobuf message. Empty strings, as the default, aren't sent.
+func appendProtoString(theData []byte, theField int, theValue string) []byte {
+	if theValue == "" {
+		return theData
+	}
+	theData = binary.AppendUvarint(theData, uint64(theField << 3 | 2))
+	theData = binary.AppendUvarint(theData, uint64(len(theValue)))
+	return append(theData, theValue...)
+}
+
+// Append the given embedded message to the given protobuf message.
+func appendProtoMessage(theData []byte, theField int, theValue []byte) []byte {
+	theData = binary.AppendUvarint(theData, uint64(theField << 3 | 2))
+	theData = binary.AppendUvarint(theData, uint64(len(theValue)))
+	return append(theData, theValue...)
+}
+
+// Append the given integer (int64 or bool) field to the given protobuf message. Zero, as the default, isn't sent.
+func appendProtoInt(theData []byte, theField int, theValue int64) []byte {
+	if theValue == 0 {
+		return theData
+	}
+	theData = binary.AppendUvarint(theData, uint64(theField << 3))
+	return binary.AppendUvarint(theData, uint64(theValue))
+}
+
+// Append the given double field to the given protobuf message. Zero, as the default, isn't sent.
+func appendProtoDouble(theData []byte, theField int, theValue float64) []byte {
+	if theValue == 0 {
+		return theData
+	}
+	theData = binary.AppendUvarint(theData, uint64(theField << 3 | 1))
+	return binary.LittleEndian.AppendUint64(theData, math.Float64bits(theValue))
+}
+
+// Returns 1 for true, 0 for false, for boolean fields.
+func protoBool(theValue bool) int64 {
+	if theValue {
+		return 1
+	}
+	return 0
+}
+
+// Read the next message sent by a gRPC client. Messages are sent as a compressed flag (we don't accept compressed messages), a four-byte length,
+// then the message.
+func readGRPCMessage(theReader io.Reader) ([]byte, error) {
+	frameHeader := make([]byte, 5)
+	if _, readErr := io.ReadFull(theReader, frameHeader); readErr != nil {
+		return nil, readErr
+	}
+	if frameHeader[0] != 0 {
+		return nil, errors.New("Compressed messages aren't supported.")
+	}
+	messageLength := binary.BigEndian.Uint32(frameHeader[1:])
+	if messageLength > maxGRPCMessageSize {
+		return nil, errors.New("Message too large.")
+	}
+	message := make([]byte, messageLength)
+	_, readErr := io.ReadFull(theReader, message)
+	return message, readErr
+}
+
+// Send a message to a gRPC client.
+func writeGRPCMessage(theResponseWriter http.ResponseWriter, theMessage []byte) {
+	frameHeader := []byte{0, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(frameHeader[1:], uint32(len(theMessage)))
+	theResponseWriter.Write(append(frameHeader, theMessage...))
+	if outputFlusher, flusherOK := theResponseWriter.(http.Flusher); flusherOK {
+		outputFlusher.Flush()
+	}
+}
+
+// Returns the gRPC status code for the given error from an API call, going by its error code rather than its (possibly translated) message.
+func getGRPCErrorStatus(theError error) int {
+	switch getAPIErrorCode(theError) {
+		case errorCodeNotAuthorised:
+			return grpcStatusUnauthenticated
+		case errorCodeTooManyRequests:
+			return grpcStatusResourceExhausted
+		case errorCodeNotFound:
+			return grpcStatusUnimplemented
+	}
+	return grpcStatusUnknown
+}
+
+// Returns true if the given request is a gRPC call.
+func isGRPCRequest(theRequest *http.Request) bool {
+	contentType := theRequest.Header.Get("Content-Type")
+	return theRequest.ProtoMajor == 2 && (contentType == "application/grpc" || contentType == "application/grpc+proto")
+}
+
+// A ResponseWriter that collects the response to an API call made for a gRPC call. If a line handler is given, each complete line of the
+// response is passed to it as it's written, for streamed output.
+type grpcCallWriter struct {
+	responseWriter http.ResponseWriter
+	header http.Header
+	response bytes.Buffer
+	lineHandler func([]byte)
+}
+
+func (theWriter *grpcCallWriter) Header() http.Header {
+	return theWriter.header
+}
+
+func (theWriter *grpcCallWriter) WriteHeader(theStatusCode int) {
+}
+
+func (theWriter *grpcCallWriter) Write(theData []byte) (int, error) {
+	theWriter.response.Write(theData)
+	for theWriter.lineHandler != nil {
+		lineEnd := bytes.IndexByte(theWriter.response.Bytes(), '\n')
+		if lineEnd == -1 {
+			break
+		}
+		theWriter.lineHandler(bytes.TrimSpace(theWriter.response.Next(lineEnd + 1)))
+	}
+	return len(theData), nil
+}
+
+// Output is passed on as it's written, so there's nothing to flush - this just tells the API call it can stream.
+func (theWriter *grpcCallWriter) Flush() {
+}
+
+// Lets http.ResponseController reach the gRPC call's own ResponseWriter, so a streamed call can lift the write timeout.
+func (theWriter *grpcCallWriter) Unwrap() http.ResponseWriter {
+	return theWriter.responseWriter
+}
+
+// Make the given API call for the given gRPC request, with the given values and the request's own headers (so a token given as metadata is
+// used). Returns the response, or an error with the API call's error message. The line handler, if not nil, is given each line of the response
+// as it's written.
+func callGRPCAPI(theResponseWriter http.ResponseWriter, theRequest *http.Request, thePathPrefix string, theAPICall string, theValues url.Values, theLineHandler func([]byte)) (string, error) {
+	requestBody := theValues.Encode()
+	apiRequest := theRequest.Clone(theRequest.Context())
+	apiRequest.Method = http.MethodPost
+	apiRequest.URL = &url.URL{Path: thePathPrefix + "/api/" + theAPICall}
+	apiRequest.RequestURI = apiRequest.URL.Path
+	apiRequest.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	apiRequest.Body = io.NopCloser(strings.NewReader(requestBody))
+	apiRequest.ContentLength = int64(len(requestBody))
+	apiRequest.Form = nil
+	apiRequest.PostForm = nil
+	callWriter := &grpcCallWriter{responseWriter: theResponseWriter, header: http.Header{}, lineHandler: theLineHandler}
+	http.DefaultServeMux.ServeHTTP(callWriter, apiRequest)
+	apiResponse := callWriter.response.String()
+	if strings.HasPrefix(apiResponse, "ERROR: ") {
+		return "", &apiCallError{callWriter.header.Get("X-Error-Code"), strings.TrimSpace(strings.TrimPrefix(apiResponse, "ERROR: "))}
+	}
+	return apiResponse, nil
+}
+
+// Returns the given Task's status, from the getTaskStatus API call, as a TaskStatus message and the ID of the run it gives (the current run,
+// if the Task is running, otherwise the last run, if there's been one).
+func getGRPCTaskStatus(theResponseWriter http.ResponseWriter, theRequest *http.Request, thePathPrefix string, theValues url.Values) ([]byte, string, error) {
+	statusJSON, callErr := callGRPCAPI(theResponseWriter, theRequest, thePathPrefix, "getTaskStatus", theValues, nil)
+	if callErr != nil {
+		return nil, "", callErr
+	}
+	var taskStatus struct {
+		Running bool `json:"running"`
+		RunID string `json:"runID"`
+		Started int64 `json:"started"`
+		NextRun int64 `json:"nextRun"`
+		Usage *struct {
+			Sampled int64 `json:"sampled"`
+			CPUSeconds float64 `json:"cpuSeconds"`
+			MemoryBytes int64 `json:"memoryBytes"`
+			Processes int64 `json:"processes"`
+		} `json:"usage"`
+		LastRun *struct {
+			RunID string `json:"runID"`
+			Succeeded bool `json:"succeeded"`
+			Error string `json:"error"`
+		} `json:"lastRun"`
+		Results map[string]string `json:"results"`
+	}
+	if jsonErr := json.Unmarshal([]byte(statusJSON), &taskStatus); jsonErr != nil {
+		return nil, "", jsonErr
+	}
+	statusMessage := appendProtoInt(nil, 1, protoBool(taskStatus.Running))
+	statusMessage = appendProtoString(statusMessage, 2, taskStatus.RunID)
+	statusMessage = appendProtoInt(statusMessage, 3, taskStatus.Started)
+	statusMessage = appendProtoInt(statusMessage, 4, taskStatus.NextRun)
+	if taskStatus.Usage != nil {
+		usageMessage := appendProtoInt(nil, 1, taskStatus.Usage.Sampled)
+		usageMessage = appendProtoDouble(usageMessage, 2, taskStatus.Usage.CPUSeconds)
+		usageMessage = appendProtoInt(usageMessage, 3, taskStatus.Usage.MemoryBytes)
+		usageMessage = appendProtoInt(usageMessage, 4, taskStatus.Usage.Processes)
+		statusMessage = appendProtoMessage(statusMessage, 5, usageMessage)
+	}
+	runID := taskStatus.RunID
+	if taskStatus.LastRun != nil {
+		runResultMessage := appendProtoString(nil, 1, taskStatus.LastRun.RunID)
+		runResultMessage = appendProtoInt(runResultMessage, 2, protoBool(taskStatus.LastRun.Succeeded))
+		runResultMessage = appendProtoString(runResultMessage, 3, taskStatus.LastRun.Error)
+		statusMessage = appendProtoMessage(statusMessage, 6, runResultMessage)
+		runID = taskStatus.LastRun.RunID
+	}
+	// A map is encoded as a repeated message of key and value.
+	for resultName, resultValue := range taskStatus.Results {
+		statusMessage = appendProtoMessage(statusMessage, 7, appendProtoString(appendProtoString(nil, 1, resultName), 2, resultValue))
+	}
+	return statusMessage, runID, nil
+}
+
+// Stream the output of the given run of the given Task (as given by the request values) to the gRPC client, each line as an OutputLine message
+// wrapped as the given field of a message (or, if field is 0, as it is), until the run finishes.
+func streamGRPCTaskOutput(theResponseWriter http.ResponseWriter, theRequest *http.Request, thePathPrefix string, theValues url.Values, theField int) error {
+	theValues.Set("format", "ndjson")
+	_, callErr := callGRPCAPI(theResponseWriter, theRequest, thePathPrefix, "streamTaskOutput", theValues, func(theLine []byte) {
+		outputEvent := taskOutputEvent{}
+		if json.Unmarshal(theLine, &outputEvent) != nil || outputEvent.Stream == "eof" {
+			return
+		}
+		outputMessage := appendProtoString(nil, 1, outputEvent.Timestamp)
+		outputMessage = appendProtoString(outputMessage, 2, outputEvent.Stream)
+		outputMessage = appendProtoString(outputMessage, 3, outputEvent.Line)
+		outputMessage = appendProtoString(outputMessage, 4, outputEvent.RunID)
+		if theField != 0 {
+			outputMessage = appendProtoMessage(nil, theField, outputMessage)
+		}
+		writeGRPCMessage(theResponseWriter, outputMessage)
+	})
+	return callErr
+}
+
+// Handle the Run call: start the Task given in the client's first message, then stream its output, stopping the Task if the client asks, and
+// finish with how the run went.
+func runGRPCTask(theResponseWriter http.ResponseWriter, theRequest *http.Request, thePathPrefix string, theFirstMessage protoMessage) (int, error) {
+	taskValues := url.Values{"taskID": {string(theFirstMessage.values[1])}, "token": {string(theFirstMessage.values[2])}}
+	// Note the run before this one, so the new run can be told apart from it.
+	_, previousRunID, statusErr := getGRPCTaskStatus(theResponseWriter, theRequest, thePathPrefix, taskValues)
+	if statusErr != nil {
+		return getGRPCErrorStatus(statusErr), statusErr
+	}
+	runResponse, runErr := callGRPCAPI(theResponseWriter, theRequest, thePathPrefix, "runTask", taskValues, nil)
+	if runErr != nil {
+		return getGRPCErrorStatus(runErr), runErr
+	}
+	if strings.TrimSpace(runResponse) == "PENDING" {
+		return grpcStatusFailedPrecondition, errors.New("The run needs approval before it starts.")
+	}
+	// Stop the Task if the client sends a message asking to.
+	go func() {
+		for {
+			controlData, readErr := readGRPCMessage(theRequest.Body)
+			if readErr != nil {
+				return
+			}
+			if controlMessage, decodeErr := decodeProtoMessage(controlData); decodeErr == nil && controlMessage.numbers[3] == 1 {
+				callGRPCAPI(theResponseWriter, theRequest, thePathPrefix, "stopTask", taskValues, nil)
+			}
+		}
+	}()
+	// Wait for the new run to start (or, if it was quick, to have finished), then stream its output.
+	runID := previousRunID
+	for runID == previousRunID {
+		if theRequest.Context().Err() != nil {
+			return grpcStatusUnknown, theRequest.Context().Err()
+		}
+		time.Sleep(250 * time.Millisecond)
+		_, runID, statusErr = getGRPCTaskStatus(theResponseWriter, theRequest, thePathPrefix, taskValues)
+		if statusErr != nil {
+			return getGRPCErrorStatus(statusErr), statusErr
+		}
+	}
+	outputValues := url.Values{"taskID": taskValues["taskID"], "token": taskValues["token"], "runID": {runID}}
+	if outputErr := streamGRPCTaskOutput(theResponseWriter, theRequest, thePathPrefix, outputValues, 1); outputErr != nil {
+		return getGRPCErrorStatus(outputErr), outputErr
+	}
+	statusMessage, _, statusErr := getGRPCTaskStatus(theResponseWriter, theRequest, thePathPrefix, taskValues)
+	if statusErr != nil {
+		return getGRPCErrorStatus(statusErr), statusErr
+	}
+	if decodedStatus, decodeErr := decodeProtoMessage(statusMessage); decodeErr == nil {
+		if runResultMessage, resultFound := decodedStatus.values[6]; resultFound {
+			writeGRPCMessage(theResponseWriter, appendProtoMessage(nil, 2, runResultMessage))
+		}
+	}
+	return grpcStatusOK, nil
+}
+
+// Handle a gRPC call, making the matching API call and returning its result. The call's status is returned in the response's trailers.
+func handleGRPCRequest(theResponseWriter http.ResponseWriter, theRequest *http.Request) {
+	theResponseWriter.Header().Set("Content-Type", "application/grpc")
+	theResponseWriter.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+	theResponseWriter.WriteHeader(http.StatusOK)
+	callStatus := grpcStatusOK
+	var callErr error
+	// Anything in front of the service's name is the path prefix (the server's and/or a tenant's) to make API calls under.
+	servicePos := strings.Index(theRequest.URL.Path, "/" + grpcServiceName + "/")
+	if servicePos == -1 {
+		callStatus, callErr = grpcStatusUnimplemented, errors.New("Unknown service.")
+	} else {
+		pathPrefix := theRequest.URL.Path[:servicePos]
+		methodName := theRequest.URL.Path[servicePos + len(grpcServiceName) + 2:]
+		requestData, readErr := readGRPCMessage(theRequest.Body)
+		requestMessage, decodeErr := decodeProtoMessage(requestData)
+		if readErr != nil {
+			callStatus, callErr = grpcStatusInvalidArgument, readErr
+		} else if decodeErr != nil {
+			callStatus, callErr = grpcStatusInvalidArgument, decodeErr
+		} else {
+			taskValues := url.Values{"taskID": {string(requestMessage.values[1])}, "token": {string(requestMessage.values[2])}}
+			var apiResponse string
+			switch methodName {
+				case "GetToken":
+					apiResponse, callErr = callGRPCAPI(theResponseWriter, theRequest, pathPrefix, "getToken", url.Values{"taskID": {string(requestMessage.values[1])}, "secret": {string(requestMessage.values[2])}, "scope": {string(requestMessage.values[3])}}, nil)
+					if callErr == nil {
+						writeGRPCMessage(theResponseWriter, appendProtoString(nil, 1, strings.TrimSpace(apiResponse)))
+					}
+				case "RunTask":
+					apiResponse, callErr = callGRPCAPI(theResponseWriter, theRequest, pathPrefix, "runTask", taskValues, nil)
+					if callErr == nil {
+						writeGRPCMessage(theResponseWriter, appendProtoInt(nil, 1, protoBool(strings.TrimSpace(apiResponse) == "PENDING")))
+					}
+				case "StopTask":
+					if _, callErr = callGRPCAPI(theResponseWriter, theRequest, pathPrefix, "stopTask", taskValues, nil); callErr == nil {
+						writeGRPCMessage(theResponseWriter, []byte{})
+					}
+				case "GetTaskStatus":
+					var statusMessage []byte
+					if statusMessage, _, callErr = getGRPCTaskStatus(theResponseWriter, theRequest, pathPrefix, taskValues); callErr == nil {
+						writeGRPCMessage(theResponseWriter, statusMessage)
+					}
+				case "StreamTaskOutput":
+					taskValues.Set("line", fmt.Sprint(int64(requestMessage.numbers[3])))
+					taskValues.Set("runID", string(requestMessage.values[4]))
+					callErr = streamGRPCTaskOutput(theResponseWriter, theRequest, pathPrefix, taskValues, 0)
+				case "Run":
+					callStatus, callErr = runGRPCTask(theResponseWriter, theRequest, pathPrefix, requestMessage)
+				default:
+					callStatus, callErr = grpcStatusUnimplemented, errors.New("Unknown method " + methodName + ".")
+			}
+			if callErr != nil && callStatus == grpcStatusOK {
+				callStatus = getGRPCErrorStatus(callErr)
+			}
+		}
+	}
+	theResponseWriter.Header().Set("Grpc-Status", fmt.Sprint(callStatus))
+	if callErr != nil {
+		theResponseWriter.Header().Set("Grpc-Message", url.PathEscape(callErr.Error()))
+	}
+}
@@ -0,0 +1,134 @@
+package main
+// Task health - a summary of how every Task is doing, so a single status page or monitoring check can cover all the jobs the server runs.
+// api/admin/getHealth lists each Task (of the tenant asked for, if any - see tenants.go) with its status ("running", "succeeded", "failed",
+// "never run" or, for a run with no record of how it finished, "unknown"), its last run, the average length of its recent runs, how many runs in a
+// row have failed and when its next run is due (a retry or service restart waiting to start - see schedule.go). With "check=true", the response has a
+// "503 Service Unavailable" status if any Task's last run failed, for monitoring tools that only look at the status. For a single Task,
+// api/taskFreshness checks the Task has finished a run successfully within the last "maxAge" seconds, with a "503 Service Unavailable" status if it
+// hasn't, so existing HTTP monitoring tools can alert on a scheduled run that was missed (or keeps failing). Runs are read from the run store (see
+// store.go), which records when each run finished and how it went.
+
+import (
+	// Standard libraries.
+	"time"
+	"errors"
+)
+
+// How many recent runs the average run length is worked out from - the failure streak can go back further.
+const healthAverageRuns = 10
+
+// A Task's last run, in its health summary. A run still in progress has no finish time or result yet.
+type healthRun struct {
+	RunID string `json:"runID"`
+	Started int64 `json:"started"`
+	Finished int64 `json:"finished,omitempty"`
+	Succeeded bool `json:"succeeded"`
+	Error string `json:"error,omitempty"`
+}
+
+// How a Task is doing.
+type taskHealth struct {
+	TaskID string `json:"taskID"`
+	Title string `json:"title"`
+	Status string `json:"status"`
+	LastRun *healthRun `json:"lastRun"`
+	AverageDuration int64 `json:"averageDuration"`
+	FailureStreak int `json:"failureStreak"`
+	NextRun int64 `json:"nextRun,omitempty"`
+}
+
+// Returns the health of the given Task.
+func getTaskHealth(theTaskID string, theTitle string) (taskHealth, error) {
+	health := taskHealth{TaskID: theTaskID, Title: theTitle, Status: "never run"}
+	if retryDue, retryFound := getRetryDue(theTaskID); retryFound {
+		health.NextRun = retryDue.Unix()
+	}
+	runList, listErr := getRunList(theTaskID)
+	if listErr != nil {
+		return health, listErr
+	}
+	var totalDuration int64
+	durationCount := 0
+	runsChecked := 0
+	streakEnded := false
+	// Go through the runs newest first. Runs without a recorded finish (from before finish times were recorded, or cut short by the server
+	// stopping) end the failure streak, as how they went isn't known.
+	for runIndex := len(runList) - 1; runIndex >= 0; runIndex = runIndex - 1 {
+		runID := runList[runIndex]
+		runStarted, parseErr := time.ParseInLocation(runIDFormat, runID, time.Local)
+		if parseErr != nil {
+			continue
+		}
+		if taskIsRunning(theTaskID) && taskRunIDs[theTaskID] == runID {
+			health.Status = "running"
+			health.LastRun = &healthRun{RunID: runID, Started: runStarted.Unix()}
+			continue
+		}
+		runFinished, runResult, finishErr := runStore.GetRunFinish(theTaskID, runID)
+		if finishErr != nil {
+			return health, finishErr
+		}
+		runsChecked = runsChecked + 1
+		if health.LastRun == nil {
+			health.LastRun = &healthRun{RunID: runID, Started: runStarted.Unix(), Finished: runFinished, Succeeded: runFinished > 0 && runResult == "", Error: runResult}
+			health.Status = "failed"
+			if runFinished == 0 {
+				health.Status = "unknown"
+			} else if runResult == "" {
+				health.Status = "succeeded"
+			}
+		}
+		if runFinished == 0 || runResult == "" {
+			streakEnded = true
+		} else if !streakEnded {
+			health.FailureStreak = health.FailureStreak + 1
+		}
+		if runFinished >= runStarted.Unix() && runsChecked <= healthAverageRuns {
+			totalDuration = totalDuration + runFinished - runStarted.Unix()
+			durationCount = durationCount + 1
+		}
+		if streakEnded && runsChecked >= healthAverageRuns {
+			break
+		}
+	}
+	if durationCount > 0 {
+		health.AverageDuration = totalDuration / int64(durationCount)
+	}
+	return health, nil
+}
+
+// Returns the ID and finish time of the given Task's most recent successful run - none, if it hasn't had one.
+func getLastSuccess(theTaskID string) (string, time.Time, error) {
+	runList, listErr := getRunList(theTaskID)
+	if listErr != nil {
+		return "", time.Time{}, listErr
+	}
+	for runIndex := len(runList) - 1; runIndex >= 0; runIndex = runIndex - 1 {
+		runFinished, runResult, finishErr := runStore.GetRunFinish(theTaskID, runList[runIndex])
+		if finishErr != nil {
+			return "", time.Time{}, finishErr
+		}
+		if runFinished > 0 && runResult == "" {
+			return runList[runIndex], time.Unix(runFinished, 0), nil
+		}
+	}
+	return "", time.Time{}, nil
+}
+
+// Returns the health of each of the given tenant's Tasks (all Tasks, if no tenant is given), in order of Task ID.
+func getHealthSummary(theTenant *tenant) ([]taskHealth, error) {
+	taskList, taskErr := getTenantTaskList(theTenant)
+	if taskErr != nil {
+		return nil, taskErr
+	}
+	healthSummary := []taskHealth{}
+	for _, task := range taskList {
+		health, healthErr := getTaskHealth(task["taskID"], task["title"])
+		if healthErr != nil {
+			return nil, errors.New("Can't read run history of Task " + localTaskID(theTenant, task["taskID"]) + ".")
+		}
+		health.TaskID = localTaskID(theTenant, task["taskID"])
+		healthSummary = append(healthSummary, health)
+	}
+	return healthSummary, nil
+}
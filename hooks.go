@@ -0,0 +1,195 @@
+package main
+// Webhook triggers - lets external systems (GitHub, cron services, monitoring and so on) start a Task by calling /hooks/<taskID>. Each Task's
+// hook is authenticated either with an HMAC signature of the request body (the "hooksecret" option) or a bearer token (the "hooktoken" option),
+// and values from the request's payload can be passed to the Task as parameters (the "hookparameters" option).
+
+import (
+	// Standard libraries.
+	"fmt"
+	"errors"
+	"strings"
+	"net/http"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+)
+
+// The most we'll read of a webhook request's body.
+const maxHookBodySize = 1024 * 1024
+
+// Who a run request made by a webhook (for a Task needing approval) is recorded as coming from - never a token, so anyone with access to the
+// Task and its approver secret can approve it.
+const hookRequester = "webhook"
+
+// Check a webhook request is allowed to trigger the given Task. If the Task has a "hooksecret", the request must be signed with it - an
+// HMAC-SHA256 of the request body, hex-encoded and prefixed with "sha256=", in an "X-Hub-Signature-256" header (as sent by GitHub) or an
+// "X-Webconsole-Signature" header. Otherwise, if the Task has a "hooktoken" (a Bcrypt hash), the matching token must be given as a Bearer token
+// or "token" parameter.
+func checkHookRequest(theRequest *http.Request, theRequestBody []byte, theTaskDetails map[string]string) error {
+	if theTaskDetails["hooksecret"] != "" {
+		requestSignature := theRequest.Header.Get("X-Hub-Signature-256")
+		if requestSignature == "" {
+			requestSignature = theRequest.Header.Get("X-Webconsole-Signature")
+		}
+		if !strings.HasPrefix(requestSignature, "sha256=") {
+			return errors.New("missing signature")
+		}
+		givenMAC, hexErr := hex.DecodeString(strings.TrimPrefix(requestSignature, "sha256="))
+		if hexErr != nil {
+			return errors.New("invalid signature")
+		}
+		expectedMAC := hmac.New(sha256.New, []byte(theTaskDetails["hooksecret"]))
+		expectedMAC.Write(theRequestBody)
+		if !hmac.Equal(givenMAC, expectedMAC.Sum(nil)) {
+			return errors.New("incorrect signature")
+		}
+		return nil
+	}
+	if theTaskDetails["hooktoken"] != "" {
+		hookToken := getRequestCredential(theRequest, "token", true)
+		if hookToken == "" || !checkPasswordHash(hookToken, theTaskDetails["hooktoken"]) {
+			return errors.New("incorrect token")
+		}
+		return nil
+	}
+	return errors.New("webhooks aren't enabled for this Task")
+}
+
+// Find the value at the given dot-separated path (e.g. "repository.name") in a decoded JSON object, returned as a string.
+func getJSONPathValue(theJSON interface{}, thePath string) (string, bool) {
+	currentValue := theJSON
+	for _, pathPart := range strings.Split(thePath, ".") {
+		currentObject, isObject := currentValue.(map[string]interface{})
+		if !isObject {
+			return "", false
+		}
+		currentValue, isObject = currentObject[pathPart]
+		if !isObject {
+			return "", false
+		}
+	}
+	switch typedValue := currentValue.(type) {
+		case string:
+			return typedValue, true
+		case float64, bool:
+			return fmt.Sprint(typedValue), true
+		case nil:
+			return "", true
+	}
+	valueJSON, _ := json.Marshal(currentValue)
+	return string(valueJSON), true
+}
+
+// Get the parameters to pass to a Task from a webhook request, as given by the Task's "hookparameters" option - a comma-separated list of
+// "name=path" pairs, where path is a dot-separated path into a JSON payload (either the request body, or a form value called "payload" as
+// GitHub sends) or, for form-encoded requests, the name of a form value.
+func getHookParameters(theRequest *http.Request, theRequestBody []byte, theTaskDetails map[string]string) map[string]string {
+	hookParameters := map[string]string{}
+	if theTaskDetails["hookparameters"] == "" {
+		return hookParameters
+	}
+	var payloadJSON interface{}
+	if theRequest.Form.Get("payload") != "" {
+		json.Unmarshal([]byte(theRequest.Form.Get("payload")), &payloadJSON)
+	} else {
+		json.Unmarshal(theRequestBody, &payloadJSON)
+	}
+	for _, parameterMapping := range strings.Split(theTaskDetails["hookparameters"], ",") {
+		mappingSplit := strings.SplitN(parameterMapping, "=", 2)
+		if len(mappingSplit) < 2 {
+			continue
+		}
+		parameterName := strings.TrimSpace(mappingSplit[0])
+		parameterPath := strings.TrimSpace(mappingSplit[1])
+		if parameterValue, valueFound := getJSONPathValue(payloadJSON, parameterPath); valueFound {
+			hookParameters[parameterName] = parameterValue
+		} else if theRequest.Form.Get(parameterPath) != "" {
+			hookParameters[parameterName] = theRequest.Form.Get(parameterPath)
+		}
+	}
+	return hookParameters
+}
+
+// Handle a call to a Task's webhook, starting the Task if the request is authorised. The Task ID in the path is in the namespace of the given
+// tenant (see tenants.go), if any.
+func handleHookRequest(theResponseWriter http.ResponseWriter, theRequest *http.Request, theRequestPath string, theRequestBody []byte, theTenant *tenant) {
+	hookTaskID := strings.Trim(strings.TrimPrefix(theRequestPath, "/hooks/"), "/")
+	// Calls from GitHub and GitLab, to /hooks/github/<taskID> or /hooks/gitlab/<taskID>, are handled as described in githooks.go.
+	hookProvider := ""
+	for _, gitHost := range []string{"github", "gitlab"} {
+		if strings.HasPrefix(hookTaskID, gitHost + "/") {
+			hookProvider = gitHost
+			hookTaskID = strings.TrimPrefix(hookTaskID, gitHost + "/")
+		}
+	}
+	taskID := tenantTaskID(theTenant, hookTaskID)
+	taskDetails, taskErr := getTaskDetails(taskID)
+	// Unknown Tasks are refused in the same way as calls that aren't authorised, so Task IDs can't be guessed - see errors.go.
+	if checkTaskID(hookTaskID) != nil || taskErr != nil {
+		writeNotAuthorised(theResponseWriter, theRequest, http.StatusUnauthorized, "unknown Task")
+		return
+	}
+	if ipErr := checkClientIPAllowed(getClientIP(theRequest), taskDetails); ipErr != nil {
+		writeAuditLog(taskID, "Webhook call refused: " + ipErr.Error())
+		writeNotAuthorised(theResponseWriter, theRequest, http.StatusUnauthorized, ipErr.Error())
+		return
+	}
+	hookParameters := map[string]string{}
+	hookDescription := "webhook"
+	hookTrigger := runTrigger{Kind: "webhook", ClientIP: getClientIP(theRequest)}
+	var hookErr error
+	if hookProvider != "" {
+		ignoreReason := ""
+		hookParameters, ignoreReason, hookErr = checkGitHostHook(hookProvider, theRequest, theRequestBody, taskDetails)
+		if hookErr == nil && ignoreReason != "" {
+			// Calls for events the Task isn't run for still succeed, so the provider doesn't report the webhook as failing.
+			fmt.Fprint(theResponseWriter, "OK - ignored, " + ignoreReason + ".")
+			return
+		}
+		hookDescription = map[string]string{"github": "GitHub", "gitlab": "GitLab"}[hookProvider] + " webhook, " + describeGitHostHook(hookParameters) + ","
+		hookTrigger.Source = map[string]string{"github": "GitHub", "gitlab": "GitLab"}[hookProvider] + ", " + describeGitHostHook(hookParameters)
+	} else {
+		hookErr = checkHookRequest(theRequest, theRequestBody, taskDetails)
+	}
+	if hookErr != nil {
+		writeAuditLog(taskID, "Webhook call from " + getClientIP(theRequest) + " refused: " + hookErr.Error())
+		writeNotAuthorised(theResponseWriter, theRequest, http.StatusUnauthorized, hookErr.Error())
+		return
+	}
+	if taskIsRunning(taskID) {
+		http.Error(theResponseWriter, "ERROR: Task is already running.", http.StatusConflict)
+		return
+	}
+	for parameterName, parameterValue := range getHookParameters(theRequest, theRequestBody, taskDetails) {
+		hookParameters[parameterName] = parameterValue
+	}
+	if parametersErr := checkTaskParameters(taskDetails, hookParameters); parametersErr != nil {
+		writeAuditLog(taskID, "Webhook call from " + getClientIP(theRequest) + " refused: " + parametersErr.Error())
+		http.Error(theResponseWriter, "ERROR: " + parametersErr.Error(), http.StatusBadRequest)
+		return
+	}
+	// A Task with an approval gate isn't started by a webhook either, just asked for, the same as from api/runTask - see approvalgates.go.
+	if runNeedsApproval(taskDetails) {
+		if quotaErr := checkRunQuotas(taskID, taskDetails, hookTrigger, false); quotaErr != nil {
+			writeAuditLog(taskID, "Webhook call from " + getClientIP(theRequest) + " refused: " + quotaErr.Error())
+			writeStartError(theResponseWriter, quotaErr)
+			return
+		}
+		requestRun(taskID, hookRequester, hookParameters, hookTrigger)
+		writeAuditLog(taskID, "Run requested by " + hookDescription + " from " + getClientIP(theRequest) + ".")
+		fmt.Fprint(theResponseWriter, "PENDING")
+		return
+	}
+	if startErr := startTask(taskID, taskDetails, hookParameters, hookTrigger); startErr != nil {
+		if _, isExceeded := startErr.(quotaExceededError); isExceeded {
+			writeAuditLog(taskID, "Webhook call from " + getClientIP(theRequest) + " refused: " + startErr.Error())
+			writeStartError(theResponseWriter, startErr)
+			return
+		}
+		http.Error(theResponseWriter, "ERROR: " + startErr.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	writeAuditLog(taskID, "Run triggered by " + hookDescription + " from " + getClientIP(theRequest) + ".")
+	fmt.Fprint(theResponseWriter, "OK")
+}
@@ -0,0 +1,115 @@
+package main
+// Hook scripts - a Task can have scripts in a "hooks" folder in its own folder that are run around each of its runs, for setting things up and
+// tidying up without changing the Task's own command, in whatever language suits:
+//   pre-run: run before the Task's command. If it fails, so does the run, without the command being run.
+//   post-run: run after every run, whether it succeeded or not.
+//   on-failure: run after a run that failed (but not one that's about to be retried - see retries.go), before any post-run hook.
+// A hook is an executable file (or, on Windows, a batch file or PowerShell script) named after the hook, with or without an extension, e.g.
+// hooks/pre-run.sh. Hooks run in the Task's working folder with the same environment variables as the Task, plus WEBCONSOLE_HOOK (the hook's
+// name) and, after a run, WEBCONSOLE_RUN_RESULT ("success" or "failure") and WEBCONSOLE_RUN_ERROR, and are given the same details as a JSON
+// object on STDIN. A hook's output goes to the audit log, not the Task's output, one entry per line (with secrets masked), followed by how
+// the hook went. Hooks are stopped if still running after hookScriptTimeout.
+
+import (
+	// Standard libraries.
+	"os"
+	"sort"
+	"time"
+	"bytes"
+	"errors"
+	"strings"
+	"io/ioutil"
+	"encoding/json"
+	"path/filepath"
+)
+
+// How long a hook script can run for before it's stopped.
+const hookScriptTimeout = 5 * time.Minute
+
+// Post-run and on-failure hooks are run once a run has finished (see events.go), in the background so they don't hold up anything else.
+func init() {
+	subscribeTaskEvents(eventTaskFinished, func(theEvent taskEvent) {
+		if findHookScript(theEvent.taskID, "on-failure") == "" && findHookScript(theEvent.taskID, "post-run") == "" {
+			return
+		}
+		// The run's parameters are only kept while it's running, so the hooks' environment is worked out now.
+		hookEnvironment := append(os.Environ(), getTaskEnvironment(theEvent.taskID, theEvent.taskDetails, theEvent.runID, "", taskParameters[theEvent.taskID])...)
+		hookRedactor := newRedactor(theEvent.taskDetails, taskParameters[theEvent.taskID], "")
+		runResult := "success"
+		if theEvent.runError != "" {
+			runResult = "failure"
+		}
+		hookDetails := map[string]interface{}{"taskID": theEvent.taskID, "runID": theEvent.runID, "title": theEvent.taskDetails["title"], "result": runResult, "error": theEvent.runError}
+		go func() {
+			if theEvent.runError != "" && !theEvent.retryScheduled {
+				runHookScript(theEvent.taskID, theEvent.taskDetails, "on-failure", hookEnvironment, hookDetails, hookRedactor)
+			}
+			runHookScript(theEvent.taskID, theEvent.taskDetails, "post-run", hookEnvironment, hookDetails, hookRedactor)
+		}()
+	})
+}
+
+// Returns the path of the given Task's script for the given hook, or "" if it doesn't have one.
+func findHookScript(theTaskID string, theHookName string) string {
+	hooksFolder := arguments["taskroot"] + "/" + theTaskID + "/hooks"
+	hookFiles, readDirErr := ioutil.ReadDir(hooksFolder)
+	if readDirErr != nil {
+		return ""
+	}
+	sort.Slice(hookFiles, func(firstPos int, secondPos int) bool { return hookFiles[firstPos].Name() < hookFiles[secondPos].Name() })
+	for _, hookFile := range hookFiles {
+		if !hookFile.IsDir() && strings.TrimSuffix(hookFile.Name(), filepath.Ext(hookFile.Name())) == theHookName {
+			if absolutePath, absErr := filepath.Abs(hooksFolder + "/" + hookFile.Name()); absErr == nil {
+				return absolutePath
+			}
+		}
+	}
+	return ""
+}
+
+// Run the given Task's script for the given hook, if it has one, with the given environment and details, writing its output to the audit log.
+// Returns an error if the hook failed.
+func runHookScript(theTaskID string, theTaskDetails map[string]string, theHookName string, theEnvironment []string, theDetails map[string]interface{}, theRedactor *strings.Replacer) error {
+	hookPath := findHookScript(theTaskID, theHookName)
+	if hookPath == "" {
+		return nil
+	}
+	hookDetails := map[string]interface{}{"hook": theHookName}
+	for detailName, detailValue := range theDetails {
+		hookDetails[detailName] = detailValue
+	}
+	hookDetailsJSON, _ := json.Marshal(hookDetails)
+	hookEnvironment := append(append([]string{}, theEnvironment...), "WEBCONSOLE_HOOK=" + theHookName)
+	if runResult, resultFound := theDetails["result"]; resultFound {
+		hookEnvironment = append(hookEnvironment, "WEBCONSOLE_RUN_RESULT=" + runResult.(string), "WEBCONSOLE_RUN_ERROR=" + theDetails["error"].(string))
+	}
+	workDir := getTaskWorkDir(theTaskID, theTaskDetails)
+	hookCommand := newTaskCommand(getPlatformCommand([]string{hookPath}, workDir))
+	hookCommand.Dir = workDir
+	hookCommand.Env = hookEnvironment
+	hookCommand.Stdin = bytes.NewReader(hookDetailsJSON)
+	var hookOutput bytes.Buffer
+	hookCommand.Stdout = &hookOutput
+	hookCommand.Stderr = &hookOutput
+	setProcessGroup(hookCommand)
+	hookErr := hookCommand.Start()
+	if hookErr == nil {
+		trackProcessTree(hookCommand)
+		hookTimer := time.AfterFunc(hookScriptTimeout, func() {
+			killProcessTree(hookCommand)
+		})
+		hookErr = hookCommand.Wait()
+		hookTimer.Stop()
+	}
+	for _, outputLine := range strings.Split(strings.TrimRight(hookOutput.String(), "\r\n"), "\n") {
+		if strings.TrimSpace(outputLine) != "" {
+			writeAuditLog(theTaskID, "Hook " + theHookName + ": " + theRedactor.Replace(strings.TrimRight(outputLine, "\r")))
+		}
+	}
+	if hookErr != nil {
+		writeAuditLog(theTaskID, "Hook " + theHookName + " failed - " + hookErr.Error())
+		return errors.New(theHookName + " hook failed - " + hookErr.Error())
+	}
+	writeAuditLog(theTaskID, "Hook " + theHookName + " succeeded.")
+	return nil
+}
@@ -0,0 +1,125 @@
+package main
+// The landing page - index.html in the webroot (or a tenant's webroot, see tenants.go) is a template (see Go's html/template package), filled
+// in on the server with the page's title, intro text and the public Tasks, so the list of Tasks is there even for browsers without
+// JavaScript. What's shown is set in the main config file:
+//   landingTitle: the page's title and heading (by default, "Web Console").
+//   landingIntro: text to show under the heading - blank for none.
+//   landingGroups: a comma-separated list of the tags whose Tasks are listed, in the order to list them - "(untagged)" stands for Tasks
+//     without tags. Blank (the default) lists every group: Tasks without tags first, then each tag in alphabetical order.
+//   landingOrder: the order of Tasks within each group - "id" (the default) or "title".
+// A "tag" parameter in the page's URL (e.g. index.html?tag=Reports) lists only the Tasks with that tag, as before.
+
+import (
+	// Standard libraries.
+	"sort"
+	"bytes"
+	"errors"
+	"strings"
+	"net/http"
+	"html/template"
+)
+
+// What the landing page template is given to fill in.
+type landingPage struct {
+	Title string
+	Intro string
+	Tag string
+	Groups []landingGroup
+}
+
+// A group of public Tasks on the landing page - those with the given tag, or without tags if Tag is blank.
+type landingGroup struct {
+	Tag string
+	Tasks []landingTask
+}
+type landingTask struct {
+	TaskID string
+	Title string
+	Description string
+}
+
+// The entry in "landingGroups" standing for Tasks without tags.
+const untaggedLandingGroup = "(untagged)"
+
+// Returns the landing page's public Tasks, grouped as set by "landingGroups" and "landingOrder", listing only the Tasks with the given tag
+// if one is given.
+func getLandingGroups(theTenant *tenant, theTag string) ([]landingGroup, error) {
+	taskList, taskErr := getTenantTaskList(theTenant)
+	if taskErr != nil {
+		return nil, taskErr
+	}
+	var publicTasks []map[string]string
+	for _, task := range filterTasksByTag(taskList, theTag) {
+		if task["public"] == "Y" {
+			publicTasks = append(publicTasks, task)
+		}
+	}
+	if arguments["landingorder"] == "title" {
+		sort.SliceStable(publicTasks, func(first int, second int) bool {
+			return strings.ToLower(publicTasks[first]["title"]) < strings.ToLower(publicTasks[second]["title"])
+		})
+	}
+	groupList, taskGroups := groupTasksByTag(publicTasks)
+	if strings.TrimSpace(arguments["landinggroups"]) != "" {
+		groupsByName := map[string]string{}
+		for _, groupName := range groupList {
+			groupsByName[strings.ToLower(groupName)] = groupName
+		}
+		var landingGroupList []string
+		for _, landingGroupName := range strings.Split(arguments["landinggroups"], ",") {
+			landingGroupName = strings.TrimSpace(landingGroupName)
+			if strings.ToLower(landingGroupName) == untaggedLandingGroup {
+				landingGroupName = ""
+			}
+			if groupName, groupFound := groupsByName[strings.ToLower(landingGroupName)]; groupFound {
+				landingGroupList = append(landingGroupList, groupName)
+				delete(groupsByName, strings.ToLower(landingGroupName))
+			}
+		}
+		groupList = landingGroupList
+	}
+	var landingGroups []landingGroup
+	for _, groupName := range groupList {
+		var groupTasks []landingTask
+		for _, task := range taskGroups[groupName] {
+			groupTasks = append(groupTasks, landingTask{TaskID: localTaskID(theTenant, task["taskID"]), Title: task["title"], Description: task["description"]})
+		}
+		landingGroups = append(landingGroups, landingGroup{Tag: groupName, Tasks: groupTasks})
+	}
+	return landingGroups, nil
+}
+
+// Check the landing page settings.
+func checkLandingConfig() error {
+	if landingOrder := arguments["landingorder"]; landingOrder != "" && landingOrder != "id" && landingOrder != "title" {
+		return errors.New("Invalid landingorder \"" + landingOrder + "\" - should be \"id\" or \"title\".")
+	}
+	return nil
+}
+
+// Serve the landing page for the given tenant (if any), filling in its template.
+func serveLandingPage(theResponseWriter http.ResponseWriter, theRequest *http.Request, theTenant *tenant) {
+	landingTemplate, templateErr := template.ParseFiles(getWebrootPath(theTenant, "index.html"))
+	if templateErr != nil {
+		http.Error(theResponseWriter, "ERROR: Couldn't read index.html - " + templateErr.Error(), http.StatusInternalServerError)
+		return
+	}
+	pageData := landingPage{Title: arguments["landingtitle"], Intro: arguments["landingintro"], Tag: theRequest.Form.Get("tag")}
+	if pageData.Title == "" {
+		pageData.Title = "Web Console"
+	}
+	var groupsErr error
+	pageData.Groups, groupsErr = getLandingGroups(theTenant, pageData.Tag)
+	if groupsErr != nil {
+		http.Error(theResponseWriter, "ERROR: " + groupsErr.Error(), http.StatusInternalServerError)
+		return
+	}
+	// The page is rendered in full before anything is sent, so an error part-way through doesn't leave half a page.
+	var pageBuffer bytes.Buffer
+	if executeErr := landingTemplate.Execute(&pageBuffer, pageData); executeErr != nil {
+		http.Error(theResponseWriter, "ERROR: Couldn't fill in index.html - " + executeErr.Error(), http.StatusInternalServerError)
+		return
+	}
+	theResponseWriter.Header().Set("Content-Type", "text/html; charset=utf-8")
+	theResponseWriter.Write(pageBuffer.Bytes())
+}
@@ -0,0 +1,82 @@
+//go:build linux
+// +build linux
+
+package main
+// Per-Task resource limits on Linux - CPU time and memory limits (via rlimits) and niceness, so a misbehaving Task can't starve the host.
+
+import (
+	// Standard libraries.
+	"fmt"
+	"errors"
+	"unsafe"
+	"strconv"
+	"syscall"
+	"os/exec"
+)
+
+// Set a resource limit on another process, via the prlimit64 system call (which the syscall package doesn't expose directly).
+func setProcessRlimit(thePID int, theResource int, theLimit uint64) error {
+	newLimit := syscall.Rlimit{Cur: theLimit, Max: theLimit}
+	_, _, errNo := syscall.RawSyscall6(syscall.SYS_PRLIMIT64, uintptr(thePID), uintptr(theResource), uintptr(unsafe.Pointer(&newLimit)), 0, 0, 0)
+	if errNo != 0 {
+		return errNo
+	}
+	return nil
+}
+
+// Apply the limits set in the Task's config to its (just started) process: "cpulimit" (seconds of CPU time), "memlimit" (megabytes of memory)
+// and "nice" (scheduling priority, 0 to 19 - negative values need root). Child processes started later inherit the limits.
+func applyProcessLimits(theCommand *exec.Cmd, theTaskDetails map[string]string) error {
+	taskPID := theCommand.Process.Pid
+	if theTaskDetails["cpulimit"] != "" && theTaskDetails["cpulimit"] != "0" {
+		cpuLimit, atoiErr := strconv.ParseUint(theTaskDetails["cpulimit"], 10, 64)
+		if atoiErr != nil {
+			return errors.New("cpulimit isn't a number.")
+		}
+		if limitErr := setProcessRlimit(taskPID, syscall.RLIMIT_CPU, cpuLimit); limitErr != nil {
+			return errors.New("Couldn't set CPU limit - " + limitErr.Error())
+		}
+	}
+	if theTaskDetails["memlimit"] != "" && theTaskDetails["memlimit"] != "0" {
+		memLimit, atoiErr := strconv.ParseUint(theTaskDetails["memlimit"], 10, 64)
+		if atoiErr != nil {
+			return errors.New("memlimit isn't a number.")
+		}
+		if limitErr := setProcessRlimit(taskPID, syscall.RLIMIT_AS, memLimit * 1024 * 1024); limitErr != nil {
+			return errors.New("Couldn't set memory limit - " + limitErr.Error())
+		}
+	}
+	if theTaskDetails["nice"] != "" && theTaskDetails["nice"] != "0" {
+		niceValue, atoiErr := strconv.Atoi(theTaskDetails["nice"])
+		if atoiErr != nil {
+			return errors.New("nice isn't a number.")
+		}
+		// Tasks run in their own process group, so set the priority of the whole group.
+		if niceErr := syscall.Setpriority(syscall.PRIO_PGRP, taskPID, niceValue); niceErr != nil {
+			return errors.New("Couldn't set niceness - " + niceErr.Error())
+		}
+	}
+	return nil
+}
+
+// If a Task's process was killed because it went over one of its limits, return a message saying so, otherwise return an empty string.
+func describeLimitExit(theExitErr error, theTaskDetails map[string]string) string {
+	exitErr, isExitErr := theExitErr.(*exec.ExitError)
+	if !isExitErr {
+		return ""
+	}
+	waitStatus, isWaitStatus := exitErr.Sys().(syscall.WaitStatus)
+	if !isWaitStatus || !waitStatus.Signaled() {
+		return ""
+	}
+	// Going over the soft CPU limit sends SIGXCPU. We set the soft and hard limits to the same value, but the kernel sends SIGKILL if a process
+	// ignores SIGXCPU and carries on past the hard limit.
+	if theTaskDetails["cpulimit"] != "" && theTaskDetails["cpulimit"] != "0" && (waitStatus.Signal() == syscall.SIGXCPU || waitStatus.Signal() == syscall.SIGKILL) {
+		return fmt.Sprintf("Task killed - exceeded its CPU time limit of %s seconds.", theTaskDetails["cpulimit"])
+	}
+	// Going over the memory limit makes memory allocations fail, which most programs respond to by aborting or crashing.
+	if theTaskDetails["memlimit"] != "" && theTaskDetails["memlimit"] != "0" && (waitStatus.Signal() == syscall.SIGABRT || waitStatus.Signal() == syscall.SIGSEGV || waitStatus.Signal() == syscall.SIGKILL) {
+		return fmt.Sprintf("Task killed (%s) - probably exceeded its memory limit of %sMB.", waitStatus.Signal().String(), theTaskDetails["memlimit"])
+	}
+	return ""
+}
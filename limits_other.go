@@ -0,0 +1,26 @@
+//go:build !linux
+// +build !linux
+
+package main
+// Per-Task resource limits are only supported on Linux - on other platforms, we just report that any limits set can't be applied.
+
+import (
+	// Standard libraries.
+	"errors"
+	"os/exec"
+)
+
+// Return an error if any limits are set in the Task's config, as they can't be applied on this platform.
+func applyProcessLimits(theCommand *exec.Cmd, theTaskDetails map[string]string) error {
+	for _, limitName := range []string{"cpulimit", "memlimit", "nice"} {
+		if theTaskDetails[limitName] != "" && theTaskDetails[limitName] != "0" {
+			return errors.New("Process limits (cpulimit, memlimit, nice) are only supported on Linux.")
+		}
+	}
+	return nil
+}
+
+// Limits aren't applied on this platform, so never the reason a Task was killed.
+func describeLimitExit(theExitErr error, theTaskDetails map[string]string) string {
+	return ""
+}
@@ -0,0 +1,98 @@
+package main
+// Searching and paging through lists of Tasks and runs, for the listing API calls (getPublicTaskList, admin listTasks, getRunList) and
+// "webconsole task list". All take the same optional parameters:
+// q - only list Tasks whose title or description contain this (not case-sensitive).
+// limit - list at most this many items.
+// offset - skip this many items first.
+// after - a cursor: start after the item with this ID, as given by the X-Next-Cursor header of the previous page. Unlike offset, this doesn't
+// skip or repeat anything if items are added or removed between pages.
+// When a list is cut short by limit, the API calls set the X-Next-Cursor header to the last ID listed, and X-Total-Count to the number of
+// items there are in all.
+
+import (
+	// Standard libraries.
+	"sort"
+	"errors"
+	"strconv"
+	"strings"
+	"net/http"
+)
+
+// Returns the Tasks in the given list whose title or description contain the given text. Every Task matches blank text.
+func searchTasks(theTaskList []map[string]string, theQuery string) []map[string]string {
+	theQuery = strings.ToLower(strings.TrimSpace(theQuery))
+	if theQuery == "" {
+		return theTaskList
+	}
+	var matchingTasks []map[string]string
+	for _, task := range theTaskList {
+		if strings.Contains(strings.ToLower(task["title"]), theQuery) || strings.Contains(strings.ToLower(task["description"]), theQuery) {
+			matchingTasks = append(matchingTasks, task)
+		}
+	}
+	return matchingTasks
+}
+
+// Works out which part of a list of IDs (sorted, oldest or lowest first unless theDescending is true) to return, given "limit", "offset" and
+// "after" values (any of which can be blank). Returns the start and end positions of the page, and the cursor for the next page (blank if this
+// is the last page).
+func getListPage(theIDs []string, theDescending bool, theLimit string, theOffset string, theAfter string) (int, int, string, error) {
+	pageStart := 0
+	pageEnd := len(theIDs)
+	if theAfter != "" {
+		// The item given by the cursor might have gone since, so look for the first item that would have come after it.
+		pageStart = sort.Search(len(theIDs), func(thePosition int) bool {
+			if theDescending {
+				return theIDs[thePosition] < theAfter
+			}
+			return theIDs[thePosition] > theAfter
+		})
+	}
+	if theOffset != "" {
+		offsetValue, offsetErr := strconv.Atoi(theOffset)
+		if offsetErr != nil || offsetValue < 0 {
+			return 0, 0, "", errors.New("Invalid offset \"" + theOffset + "\" - should be a whole number, 0 or more.")
+		}
+		pageStart = pageStart + offsetValue
+	}
+	if pageStart > len(theIDs) {
+		pageStart = len(theIDs)
+	}
+	if theLimit != "" {
+		limitValue, limitErr := strconv.Atoi(theLimit)
+		if limitErr != nil || limitValue < 1 {
+			return 0, 0, "", errors.New("Invalid limit \"" + theLimit + "\" - should be a whole number, 1 or more.")
+		}
+		if pageStart + limitValue < pageEnd {
+			pageEnd = pageStart + limitValue
+		}
+	}
+	nextCursor := ""
+	if pageEnd < len(theIDs) && pageEnd > 0 {
+		nextCursor = theIDs[pageEnd-1]
+	}
+	return pageStart, pageEnd, nextCursor, nil
+}
+
+// Returns the page of the given Tasks (sorted by ID) asked for by the "limit", "offset" and "after" values of the given request, setting the
+// X-Next-Cursor and X-Total-Count headers.
+func getTaskListPage(theResponseWriter http.ResponseWriter, theRequest *http.Request, theTaskList []map[string]string) ([]map[string]string, error) {
+	var taskIDs []string
+	for _, task := range theTaskList {
+		taskIDs = append(taskIDs, task["taskID"])
+	}
+	pageStart, pageEnd, nextCursor, pageErr := getListPage(taskIDs, false, theRequest.Form.Get("limit"), theRequest.Form.Get("offset"), theRequest.Form.Get("after"))
+	if pageErr != nil {
+		return nil, pageErr
+	}
+	setListPageHeaders(theResponseWriter, len(theTaskList), nextCursor)
+	return theTaskList[pageStart:pageEnd], nil
+}
+
+// Set the headers telling the client how many items there are in all and, if there are more to come, the cursor for the next page.
+func setListPageHeaders(theResponseWriter http.ResponseWriter, theTotalCount int, theNextCursor string) {
+	theResponseWriter.Header().Set("X-Total-Count", strconv.Itoa(theTotalCount))
+	if theNextCursor != "" {
+		theResponseWriter.Header().Set("X-Next-Cursor", theNextCursor)
+	}
+}
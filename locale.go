@@ -0,0 +1,231 @@
+package main
+// Translations of server-generated messages - errors returned by the API, authorisation failures and the progress lines Web Console adds to a
+// Task's output - so people who don't read English aren't shown them in English. Translations are read at startup from message catalogues, CSV
+// files in the "locales" folder of the webroot named after their locale (e.g. "de.csv", "pt-br.csv"), each line giving an English message and
+// its translation. Messages with values in them are given as format strings, e.g. "Attempt %d of %d." - the values are carried over into the
+// translation, in the same order unless the translation says otherwise (e.g. "%[2]s ... %[1]s"), and are themselves translated if they're in
+// the catalogue. Anything not in the catalogue is left in English.
+// API responses are translated for the locale the client asks for in its Accept-Language header, falling back to the "locale" option (English
+// if not set); output lines, which everyone watching a Task sees, are translated for the "locale" option. "ERROR: EOF", which the web page acts on,
+// is never translated, and neither are responses to agents or Task callbacks - other clients should go by the X-Error-Code header (see
+// errors.go), which is the same whatever the language.
+
+import (
+	// Standard libraries.
+	"io"
+	"os"
+	"fmt"
+	"sort"
+	"regexp"
+	"strconv"
+	"strings"
+	"net/http"
+	"io/ioutil"
+	"encoding/csv"
+	"path/filepath"
+)
+
+// A locale's translations - messages without values, by English text, and messages with values, as patterns to match.
+type messageCatalogue struct {
+	messages map[string]string
+	patterns []messagePattern
+}
+
+// A message with values in it: a pattern matching the English message, and the format string to give the translation.
+type messagePattern struct {
+	match *regexp.Regexp
+	translation string
+}
+
+// Message catalogues, by locale - read at startup.
+var messageCatalogues = map[string]*messageCatalogue{}
+
+// Messages that are never translated, as clients act on their exact text.
+var fixedMessages = map[string]bool{"EOF": true}
+
+// Prefixes kept in English at the start of messages, so clients can still tell errors and warnings from other output.
+var messagePrefixes = []string{"ERROR: ", "WARNING: "}
+
+// Matches the values in a format string.
+var formatVerbRegexp = regexp.MustCompile(`%(\[[0-9]+\])?[sdv]`)
+
+// Read every message catalogue in the webroot's "locales" folder. Returns the locales found.
+func loadMessageCatalogues() ([]string, error) {
+	var locales []string
+	catalogueFiles, readDirErr := ioutil.ReadDir(arguments["webroot"] + "/locales")
+	if os.IsNotExist(readDirErr) {
+		return locales, nil
+	} else if readDirErr != nil {
+		return locales, readDirErr
+	}
+	for _, catalogueFile := range catalogueFiles {
+		if catalogueFile.IsDir() || !strings.HasSuffix(strings.ToLower(catalogueFile.Name()), ".csv") {
+			continue
+		}
+		locale := strings.ToLower(strings.TrimSuffix(catalogueFile.Name(), filepath.Ext(catalogueFile.Name())))
+		catalogue, catalogueErr := readMessageCatalogue(arguments["webroot"] + "/locales/" + catalogueFile.Name())
+		if catalogueErr != nil {
+			return locales, fmt.Errorf("Can't read message catalogue %s - %s", catalogueFile.Name(), catalogueErr.Error())
+		}
+		messageCatalogues[locale] = catalogue
+		locales = append(locales, locale)
+	}
+	return locales, nil
+}
+
+// Read the given message catalogue file.
+func readMessageCatalogue(theCataloguePath string) (*messageCatalogue, error) {
+	catalogueFile, openErr := os.Open(theCataloguePath)
+	if openErr != nil {
+		return nil, openErr
+	}
+	defer catalogueFile.Close()
+	catalogue := &messageCatalogue{messages: map[string]string{}}
+	csvData := csv.NewReader(catalogueFile)
+	csvData.FieldsPerRecord = -1
+	for {
+		csvDataRecord, csvDataErr := csvData.Read()
+		if csvDataErr == io.EOF {
+			break
+		}
+		if csvDataErr != nil {
+			return nil, csvDataErr
+		}
+		if len(csvDataRecord) < 2 || strings.TrimSpace(csvDataRecord[0]) == "" || strings.TrimSpace(csvDataRecord[1]) == "" {
+			continue
+		}
+		englishMessage := strings.TrimSpace(csvDataRecord[0])
+		if formatVerbRegexp.MatchString(englishMessage) {
+			// Each value matches as little as it can, numbers only matching digits, so "Started chained Task %s (%s)." finds both values.
+			matchPattern := regexp.QuoteMeta(englishMessage)
+			matchPattern = strings.Replace(matchPattern, "%d", "(-?[0-9]+)", -1)
+			matchPattern = strings.Replace(matchPattern, "%s", "(.+?)", -1)
+			matchPattern = strings.Replace(matchPattern, "%v", "(.+?)", -1)
+			matchRegexp, regexpErr := regexp.Compile("^" + matchPattern + "$")
+			if regexpErr != nil {
+				return nil, fmt.Errorf("invalid message \"%s\" - %s", englishMessage, regexpErr.Error())
+			}
+			catalogue.patterns = append(catalogue.patterns, messagePattern{matchRegexp, formatVerbRegexp.ReplaceAllString(strings.TrimSpace(csvDataRecord[1]), "%${1}s")})
+		} else {
+			catalogue.messages[englishMessage] = strings.TrimSpace(csvDataRecord[1])
+		}
+	}
+	return catalogue, nil
+}
+
+// Returns the "locale" option, if there's a catalogue for it, otherwise "en".
+func getDefaultLocale() string {
+	defaultLocale := strings.ToLower(strings.TrimSpace(arguments["locale"]))
+	if _, catalogueFound := messageCatalogues[defaultLocale]; catalogueFound {
+		return defaultLocale
+	}
+	return "en"
+}
+
+// Returns the locale to use for the given request - the first of the languages given in its Accept-Language header (in order of preference)
+// that there's a catalogue for, or English if that comes first, otherwise the default locale.
+func getRequestLocale(theRequest *http.Request) string {
+	type languagePreference struct {
+		language string
+		quality float64
+	}
+	var preferences []languagePreference
+	for _, languageRange := range strings.Split(theRequest.Header.Get("Accept-Language"), ",") {
+		rangeSplit := strings.Split(languageRange, ";")
+		preference := languagePreference{strings.ToLower(strings.TrimSpace(rangeSplit[0])), 1}
+		for _, rangeParameter := range rangeSplit[1:] {
+			if strings.HasPrefix(strings.TrimSpace(rangeParameter), "q=") {
+				preference.quality, _ = strconv.ParseFloat(strings.TrimPrefix(strings.TrimSpace(rangeParameter), "q="), 64)
+			}
+		}
+		if preference.language != "" && preference.language != "*" && preference.quality > 0 {
+			preferences = append(preferences, preference)
+		}
+	}
+	sort.SliceStable(preferences, func(firstPos int, secondPos int) bool {
+		return preferences[firstPos].quality > preferences[secondPos].quality
+	})
+	for _, preference := range preferences {
+		baseLanguage := strings.SplitN(preference.language, "-", 2)[0]
+		for _, locale := range []string{preference.language, baseLanguage} {
+			if _, catalogueFound := messageCatalogues[locale]; catalogueFound {
+				return locale
+			}
+		}
+		if baseLanguage == "en" {
+			return "en"
+		}
+	}
+	return getDefaultLocale()
+}
+
+// Returns the given message translated for the given locale, or the message as it is if there's no translation. Any "ERROR: " or "WARNING: "
+// prefix is kept as it is.
+func localiseMessage(theLocale string, theMessage string) string {
+	catalogue, catalogueFound := messageCatalogues[theLocale]
+	if !catalogueFound || fixedMessages[theMessage] {
+		return theMessage
+	}
+	for _, messagePrefix := range messagePrefixes {
+		if strings.HasPrefix(theMessage, messagePrefix) {
+			return messagePrefix + localiseMessage(theLocale, theMessage[len(messagePrefix):])
+		}
+	}
+	if translation, translationFound := catalogue.messages[theMessage]; translationFound {
+		return translation
+	}
+	for _, pattern := range catalogue.patterns {
+		if messageValues := pattern.match.FindStringSubmatch(theMessage); messageValues != nil {
+			var translatedValues []interface{}
+			for _, messageValue := range messageValues[1:] {
+				translatedValues = append(translatedValues, localiseMessage(theLocale, messageValue))
+			}
+			return fmt.Sprintf(pattern.translation, translatedValues...)
+		}
+	}
+	return theMessage
+}
+
+// A ResponseWriter that translates error messages for the given locale as they're written.
+type localisingResponseWriter struct {
+	http.ResponseWriter
+	locale string
+}
+
+// Error messages are written in one go (by fmt.Fprintf or http.Error), so can be translated as they're written. Anything else is passed on as
+// it is.
+func (theWriter *localisingResponseWriter) Write(theData []byte) (int, error) {
+	if !strings.HasPrefix(string(theData), "ERROR: ") {
+		return theWriter.ResponseWriter.Write(theData)
+	}
+	errorMessage := strings.TrimRight(string(theData), "\n")
+	translatedMessage := localiseMessage(theWriter.locale, errorMessage)
+	if translatedMessage == errorMessage {
+		return theWriter.ResponseWriter.Write(theData)
+	}
+	if _, writeErr := theWriter.ResponseWriter.Write([]byte(translatedMessage + string(theData[len(errorMessage):]))); writeErr != nil {
+		return 0, writeErr
+	}
+	return len(theData), nil
+}
+
+// Output is streamed, so needs to be flushed as it's written.
+func (theWriter *localisingResponseWriter) Flush() {
+	if outputFlusher, flusherOK := theWriter.ResponseWriter.(http.Flusher); flusherOK {
+		outputFlusher.Flush()
+	}
+}
+
+// Lets http.ResponseController reach the underlying ResponseWriter.
+func (theWriter *localisingResponseWriter) Unwrap() http.ResponseWriter {
+	return theWriter.ResponseWriter
+}
+
+// Returns the given ResponseWriter, wrapped to translate error messages for the given request's locale if there's a catalogue for it.
+func newLocalisingResponseWriter(theResponseWriter http.ResponseWriter, theRequest *http.Request) http.ResponseWriter {
+	requestLocale := getRequestLocale(theRequest)
+	if _, catalogueFound := messageCatalogues[requestLocale]; !catalogueFound {
+		return theResponseWriter
+	}
+	return &localisingResponseWriter{theResponseWriter, requestLocale}
+}
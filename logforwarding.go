@@ -0,0 +1,238 @@
+package main
+// Log forwarding - so Task runs show up in a central log platform alongside everything else, a Task's output can be sent on as it happens to a
+// syslog server, and each finished run's log shipped to Loki or Elasticsearch. Settings can be given in a Task's config.txt or, to apply to
+// all Tasks, in the main config file:
+//   syslog: where to send each line of output - "udp://host:514", "tcp://host:514" or the path of a local syslog socket (e.g. /dev/log).
+//     Lines are sent in RFC 5424 format, with the Task ID as the message ID and a severity depending on the stream the line came from.
+//   loki: the URL of a Loki push endpoint (e.g. http://loki:3100/loki/api/v1/push) to ship each finished run's log to.
+//   elasticsearch: the URL of an Elasticsearch index (e.g. http://elastic:9200/webconsole) to add each line of a finished run's log to.
+// Output is forwarded after any secrets have been masked. Only the handful of syslog features we need are implemented, so there's no extra
+// library to install. Forwarding is best-effort - lines that can't be sent are dropped, and shipping failures are noted in the audit log.
+
+import (
+	// Standard libraries.
+	"os"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+	"bufio"
+	"bytes"
+	"errors"
+	"strings"
+	"net/url"
+	"net/http"
+	"encoding/json"
+)
+
+// How many lines can be waiting to go to syslog before new lines are dropped, so a slow or unreachable syslog server doesn't hold up Tasks.
+const syslogQueueLength = 1000
+
+// A line of output waiting to be sent to syslog.
+type syslogMessage struct {
+	address string
+	taskID string
+	line taskOutputLine
+}
+var syslogQueue = make(chan syslogMessage, syslogQueueLength)
+
+// The syslog address of each running Task that's forwarding its output, keyed by Task and run ID (see runKey).
+var syslogRunAddresses = map[string]string{}
+var syslogRunAddressesLock sync.Mutex
+
+// Syslog severities for each stream: stderr is a warning, Web Console's own messages a notice, anything else informational.
+var syslogSeverities = map[string]int{"stderr": 4, "system": 5}
+
+// Messages are sent with the "user-level messages" syslog facility.
+const syslogFacility = 1
+
+func init() {
+	subscribeTaskEvents(eventTaskStarted, func(theEvent taskEvent) {
+		if syslogAddress := getTaskSetting(theEvent.taskDetails, "syslog"); syslogAddress != "" {
+			syslogRunAddressesLock.Lock()
+			defer syslogRunAddressesLock.Unlock()
+			syslogRunAddresses[runKey(theEvent.taskID, theEvent.runID)] = syslogAddress
+		}
+	})
+	subscribeTaskEvents(eventOutputLine, func(theEvent taskEvent) {
+		syslogRunAddressesLock.Lock()
+		syslogAddress, addressFound := syslogRunAddresses[runKey(theEvent.taskID, theEvent.runID)]
+		syslogRunAddressesLock.Unlock()
+		if addressFound {
+			select {
+				case syslogQueue <- syslogMessage{syslogAddress, theEvent.taskID, theEvent.outputLine}:
+				default:
+			}
+		}
+	})
+	subscribeTaskEvents(eventTaskFinished, func(theEvent taskEvent) {
+		syslogRunAddressesLock.Lock()
+		delete(syslogRunAddresses, runKey(theEvent.taskID, theEvent.runID))
+		syslogRunAddressesLock.Unlock()
+		lokiURL := getTaskSetting(theEvent.taskDetails, "loki")
+		elasticsearchURL := getTaskSetting(theEvent.taskDetails, "elasticsearch")
+		if lokiURL == "" && elasticsearchURL == "" {
+			return
+		}
+		go func() {
+			runOutput, readErr := readRunOutput(theEvent.taskID, theEvent.runID)
+			if readErr != nil {
+				writeAuditLog(theEvent.taskID, "Log shipping for run " + theEvent.runID + " failed: " + readErr.Error())
+				return
+			}
+			if lokiURL != "" {
+				if shipErr := shipToLoki(lokiURL, theEvent.taskID, theEvent.runID, runOutput); shipErr != nil {
+					writeAuditLog(theEvent.taskID, "Log shipping to Loki for run " + theEvent.runID + " failed: " + shipErr.Error())
+				}
+			}
+			if elasticsearchURL != "" {
+				if shipErr := shipToElasticsearch(elasticsearchURL, theEvent.taskID, theEvent.runID, runOutput); shipErr != nil {
+					writeAuditLog(theEvent.taskID, "Log shipping to Elasticsearch for run " + theEvent.runID + " failed: " + shipErr.Error())
+				}
+			}
+		}()
+	})
+	go sendSyslogMessages()
+}
+
+// Send lines waiting in the syslog queue, keeping a connection open to each syslog server and reconnecting if a connection is lost.
+func sendSyslogMessages() {
+	syslogConnections := map[string]net.Conn{}
+	syslogHostname, _ := os.Hostname()
+	if syslogHostname == "" {
+		syslogHostname = "-"
+	}
+	for message := range syslogQueue {
+		severity, severityFound := syslogSeverities[message.line.stream]
+		if !severityFound {
+			severity = 6
+		}
+		formattedMessage := fmt.Sprintf("<%d>1 %s %s webconsole %d %s - %s", syslogFacility * 8 + severity, message.line.timestamp.Format(time.RFC3339Nano),
+			syslogHostname, os.Getpid(), message.taskID, message.line.line)
+		// Over TCP, each message is preceded by its length (RFC 6587 octet counting) so lines can't run together.
+		if strings.HasPrefix(message.address, "tcp://") {
+			formattedMessage = fmt.Sprintf("%d %s", len(formattedMessage), formattedMessage)
+		}
+		for attempt := 1; attempt <= 2; attempt = attempt + 1 {
+			if syslogConnections[message.address] == nil {
+				syslogConnection, dialErr := dialSyslog(message.address)
+				if dialErr != nil {
+					fmt.Println("ERROR: Can't send output to syslog at " + message.address + " - " + dialErr.Error())
+					break
+				}
+				syslogConnections[message.address] = syslogConnection
+			}
+			syslogConnections[message.address].SetWriteDeadline(time.Now().Add(5 * time.Second))
+			if _, writeErr := syslogConnections[message.address].Write([]byte(formattedMessage)); writeErr == nil {
+				break
+			}
+			syslogConnections[message.address].Close()
+			delete(syslogConnections, message.address)
+		}
+	}
+}
+
+// Connect to the given syslog address - "udp://host:port", "tcp://host:port" or the path of a local socket.
+func dialSyslog(theAddress string) (net.Conn, error) {
+	if strings.HasPrefix(theAddress, "/") {
+		syslogConnection, dialErr := net.Dial("unixgram", theAddress)
+		if dialErr != nil {
+			syslogConnection, dialErr = net.Dial("unix", theAddress)
+		}
+		return syslogConnection, dialErr
+	}
+	syslogURL, urlErr := url.Parse(theAddress)
+	if urlErr != nil || (syslogURL.Scheme != "udp" && syslogURL.Scheme != "tcp") || syslogURL.Host == "" {
+		return nil, errors.New("should be \"udp://host:port\", \"tcp://host:port\" or the path of a local socket")
+	}
+	syslogHost := syslogURL.Host
+	if syslogURL.Port() == "" {
+		syslogHost = net.JoinHostPort(syslogURL.Host, "514")
+	}
+	return net.DialTimeout(syslogURL.Scheme, syslogHost, 5 * time.Second)
+}
+
+// Read the given run's output back from its NDJSON log.
+func readRunOutput(theTaskID string, theRunID string) ([]taskOutputEvent, error) {
+	ndjsonFile, openErr := os.Open(arguments["taskroot"] + "/" + theTaskID + "/runs/" + theRunID + "/log.ndjson")
+	if openErr != nil {
+		return nil, errors.New("Can't read the run's log.")
+	}
+	defer ndjsonFile.Close()
+	var runOutput []taskOutputEvent
+	ndjsonScanner := bufio.NewScanner(ndjsonFile)
+	ndjsonScanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for ndjsonScanner.Scan() {
+		var outputEvent taskOutputEvent
+		if json.Unmarshal(ndjsonScanner.Bytes(), &outputEvent) == nil {
+			runOutput = append(runOutput, outputEvent)
+		}
+	}
+	return runOutput, nil
+}
+
+// Post the given body to a log platform, returning an error if it can't be sent or isn't accepted. Credentials can be given in the URL.
+func postLogs(theIntegration string, theURL string, theContentType string, theBody []byte) error {
+	logRequest, requestErr := http.NewRequest("POST", theURL, bytes.NewReader(theBody))
+	if requestErr != nil {
+		return requestErr
+	}
+	logRequest.Header.Set("Content-Type", theContentType)
+	if theIntegration == "elasticsearch" && arguments["elasticsearchapikey"] != "" {
+		logRequest.Header.Set("Authorization", "ApiKey " + arguments["elasticsearchapikey"])
+	}
+	logResponse, postErr := getHTTPClient(theIntegration).Do(logRequest)
+	if postErr != nil {
+		return postErr
+	}
+	defer logResponse.Body.Close()
+	if logResponse.StatusCode >= 300 {
+		return errors.New(logResponse.Status)
+	}
+	// Elasticsearch's bulk API returns success even if some lines weren't added, saying so in the response.
+	var bulkResponse struct {
+		Errors bool `json:"errors"`
+	}
+	if theIntegration == "elasticsearch" && json.NewDecoder(logResponse.Body).Decode(&bulkResponse) == nil && bulkResponse.Errors {
+		return errors.New("Elasticsearch couldn't add some lines.")
+	}
+	return nil
+}
+
+// Ship the given run's output to Loki, as one stream for each of the run's output streams, labelled with the Task and run.
+func shipToLoki(theURL string, theTaskID string, theRunID string, theOutput []taskOutputEvent) error {
+	type lokiStream struct {
+		Stream map[string]string `json:"stream"`
+		Values [][]string `json:"values"`
+	}
+	var lokiStreams []*lokiStream
+	streamsByName := map[string]*lokiStream{}
+	for _, outputEvent := range theOutput {
+		if streamsByName[outputEvent.Stream] == nil {
+			streamsByName[outputEvent.Stream] = &lokiStream{Stream: map[string]string{"job": "webconsole", "task": theTaskID, "run": theRunID, "stream": outputEvent.Stream}}
+			lokiStreams = append(lokiStreams, streamsByName[outputEvent.Stream])
+		}
+		eventTime, _ := time.Parse(time.RFC3339Nano, outputEvent.Timestamp)
+		streamsByName[outputEvent.Stream].Values = append(streamsByName[outputEvent.Stream].Values, []string{fmt.Sprint(eventTime.UnixNano()), outputEvent.Line})
+	}
+	if len(lokiStreams) == 0 {
+		return nil
+	}
+	lokiJSON, _ := json.Marshal(map[string]interface{}{"streams": lokiStreams})
+	return postLogs("loki", theURL, "application/json", lokiJSON)
+}
+
+// Ship the given run's output to an Elasticsearch index, one document per line, using the bulk API.
+func shipToElasticsearch(theURL string, theTaskID string, theRunID string, theOutput []taskOutputEvent) error {
+	var bulkBody bytes.Buffer
+	for _, outputEvent := range theOutput {
+		documentJSON, _ := json.Marshal(map[string]string{"@timestamp": outputEvent.Timestamp, "taskID": theTaskID, "runID": theRunID, "stream": outputEvent.Stream, "message": outputEvent.Line})
+		bulkBody.WriteString("{\"index\":{}}\n")
+		bulkBody.Write(documentJSON)
+		bulkBody.WriteString("\n")
+	}
+	if bulkBody.Len() == 0 {
+		return nil
+	}
+	return postLogs("elasticsearch", strings.TrimRight(theURL, "/") + "/_bulk", "application/x-ndjson", bulkBody.Bytes())
+}
@@ -0,0 +1,185 @@
+package main
+// Metrics push - for sites that collect metrics with StatsD or InfluxDB, each run's duration, exit status and outcome, and how many runs are
+// queued up, are sent to whichever of those the main config file gives: "statsd" (the host:port of a StatsD server, sent to over UDP) and / or
+// "influxdb" (the URL of an InfluxDB write endpoint, e.g. http://influx:8086/api/v2/write?org=ops&bucket=webconsole, with "influxdbtoken"
+// sent as the API token if set). Run metrics are sent as each run finishes; queue depths (runs in progress, waiting for approval and waiting
+// to be retried) every "metricsinterval" seconds. Metric names start with "metricsprefix" (by default, "webconsole"). Sending is best-effort -
+// a metric that can't be sent is dropped, with a message in the server's output.
+
+import (
+	// Standard libraries.
+	"fmt"
+	"net"
+	"sync"
+	"time"
+	"bytes"
+	"regexp"
+	"strconv"
+	"strings"
+	"net/http"
+)
+
+// How often, in seconds, to send queue depths, unless "metricsinterval" is set.
+const defaultMetricsInterval = 10
+
+// When each current run started, keyed by Task and run ID (see runKey), so its duration can be worked out when it finishes.
+var metricsRunStarts = map[string]time.Time{}
+var metricsRunStartsLock sync.Mutex
+
+// Characters that can't be used in a StatsD metric name or an InfluxDB tag.
+var metricNameRegexp = regexp.MustCompile("[^A-Za-z0-9_-]")
+
+func init() {
+	subscribeTaskEvents(eventTaskStarted, func(theEvent taskEvent) {
+		if !metricsEnabled() {
+			return
+		}
+		metricsRunStartsLock.Lock()
+		defer metricsRunStartsLock.Unlock()
+		metricsRunStarts[runKey(theEvent.taskID, theEvent.runID)] = theEvent.time
+	})
+	subscribeTaskEvents(eventTaskFinished, func(theEvent taskEvent) {
+		if !metricsEnabled() {
+			return
+		}
+		metricsRunStartsLock.Lock()
+		runStart, startFound := metricsRunStarts[runKey(theEvent.taskID, theEvent.runID)]
+		delete(metricsRunStarts, runKey(theEvent.taskID, theEvent.runID))
+		metricsRunStartsLock.Unlock()
+		if !startFound {
+			return
+		}
+		runOutcome := "success"
+		if theEvent.runError != "" {
+			runOutcome = "failure"
+		}
+		runDuration := theEvent.time.Sub(runStart)
+		exitStatus := getRunExitStatus(theEvent.runError)
+		metricsPrefix := getMetricsPrefix()
+		taskName := metricNameRegexp.ReplaceAllString(theEvent.taskID, "_")
+		go func() {
+			// StatsD has no tags, so the Task ID goes in the metric name. A gauge with a "-" sign is taken as a change to its value, so
+			// an exit status is only sent if there is one.
+			statsdMetrics := []string{
+				fmt.Sprintf("%s.task.%s.duration:%d|ms", metricsPrefix, taskName, runDuration.Milliseconds()),
+				fmt.Sprintf("%s.task.%s.runs.%s:1|c", metricsPrefix, taskName, runOutcome),
+			}
+			if exitStatus >= 0 {
+				statsdMetrics = append(statsdMetrics, fmt.Sprintf("%s.task.%s.exit_status:%d|g", metricsPrefix, taskName, exitStatus))
+			}
+			sendStatsD(statsdMetrics)
+			sendInfluxDB([]string{
+				fmt.Sprintf("%s_run,task=%s,outcome=%s duration=%f,exit_status=%di,retry_scheduled=%t %d", metricsPrefix, taskName, runOutcome,
+					runDuration.Seconds(), exitStatus, theEvent.retryScheduled, theEvent.time.UnixNano()),
+			})
+		}()
+	})
+}
+
+// Returns true if metrics are to be sent anywhere.
+func metricsEnabled() bool {
+	return arguments["statsd"] != "" || arguments["influxdb"] != ""
+}
+
+// Returns the prefix for metric names.
+func getMetricsPrefix() string {
+	if arguments["metricsprefix"] == "" {
+		return "webconsole"
+	}
+	return metricNameRegexp.ReplaceAllString(arguments["metricsprefix"], "_")
+}
+
+// Returns the exit status given by a run's error - 0 for a run that succeeded, the status the Task exited with if it failed with one, or -1 if
+// it failed some other way (it was stopped, timed out, didn't start or didn't match its success pattern).
+func getRunExitStatus(theRunError string) int {
+	if theRunError == "" {
+		return 0
+	}
+	exitStatus := 0
+	if _, scanErr := fmt.Sscanf(theRunError, "exit status %d", &exitStatus); scanErr == nil {
+		return exitStatus
+	}
+	return -1
+}
+
+// Send the given metrics to the StatsD server, if one is set, in a single packet.
+func sendStatsD(theMetrics []string) {
+	if arguments["statsd"] == "" {
+		return
+	}
+	statsdConnection, dialErr := net.DialTimeout("udp", arguments["statsd"], 5 * time.Second)
+	if dialErr != nil {
+		fmt.Println("ERROR: Can't send metrics to StatsD - " + dialErr.Error())
+		return
+	}
+	defer statsdConnection.Close()
+	statsdConnection.Write([]byte(strings.Join(theMetrics, "\n")))
+}
+
+// Send the given points, in InfluxDB's line protocol, to the InfluxDB write endpoint, if one is set.
+func sendInfluxDB(thePoints []string) {
+	if arguments["influxdb"] == "" {
+		return
+	}
+	influxRequest, requestErr := newInfluxDBRequest(strings.Join(thePoints, "\n"))
+	if requestErr != nil {
+		fmt.Println("ERROR: Can't send metrics to InfluxDB - " + requestErr.Error())
+		return
+	}
+	influxResponse, postErr := getHTTPClient("metrics").Do(influxRequest)
+	if postErr != nil {
+		fmt.Println("ERROR: Can't send metrics to InfluxDB - " + postErr.Error())
+		return
+	}
+	influxResponse.Body.Close()
+	if influxResponse.StatusCode >= 300 {
+		fmt.Println("ERROR: Can't send metrics to InfluxDB - " + influxResponse.Status)
+	}
+}
+
+// Returns the request to write the given points to InfluxDB. Writes are timestamped in nanoseconds, InfluxDB's default precision.
+func newInfluxDBRequest(thePoints string) (*http.Request, error) {
+	influxRequest, requestErr := http.NewRequest("POST", arguments["influxdb"], bytes.NewReader([]byte(thePoints)))
+	if requestErr != nil {
+		return nil, requestErr
+	}
+	influxRequest.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if arguments["influxdbtoken"] != "" {
+		influxRequest.Header.Set("Authorization", "Token " + arguments["influxdbtoken"])
+	}
+	return influxRequest, nil
+}
+
+// Returns how often, in seconds, to send queue depths.
+func getMetricsInterval() (int, error) {
+	if arguments["metricsinterval"] == "" {
+		return defaultMetricsInterval, nil
+	}
+	metricsInterval, intervalErr := strconv.Atoi(arguments["metricsinterval"])
+	if intervalErr != nil || metricsInterval < 1 {
+		return defaultMetricsInterval, fmt.Errorf("Invalid metricsinterval \"%s\" - should be a whole number of seconds.", arguments["metricsinterval"])
+	}
+	return metricsInterval, nil
+}
+
+// A periodic task, run in a separate thread (goroutine), that sends how many runs are in progress, waiting for approval (see approvalgates.go)
+// and waiting to be retried (see retries.go).
+func pushQueueMetrics() {
+	if !metricsEnabled() {
+		return
+	}
+	metricsInterval, _ := getMetricsInterval()
+	for true {
+		metricsPrefix := getMetricsPrefix()
+		runsInProgress, runsAwaitingApproval, runsAwaitingRetry := len(runningTasks), len(pendingRuns), len(pendingRetries)
+		sendStatsD([]string{
+			fmt.Sprintf("%s.queue.running:%d|g", metricsPrefix, runsInProgress),
+			fmt.Sprintf("%s.queue.awaiting_approval:%d|g", metricsPrefix, runsAwaitingApproval),
+			fmt.Sprintf("%s.queue.awaiting_retry:%d|g", metricsPrefix, runsAwaitingRetry),
+		})
+		sendInfluxDB([]string{
+			fmt.Sprintf("%s_queue running=%di,awaiting_approval=%di,awaiting_retry=%di %d", metricsPrefix, runsInProgress, runsAwaitingApproval, runsAwaitingRetry, time.Now().UnixNano()),
+		})
+		time.Sleep(time.Duration(metricsInterval) * time.Second)
+	}
+}
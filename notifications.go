@@ -0,0 +1,251 @@
+package main
+// Notifications - let people know when Tasks start, succeed or fail, via Slack, Microsoft Teams or email. Notification settings can be given in
+// a Task's config.txt or, to apply to all Tasks, in the main config file.
+
+import (
+	// Standard libraries.
+	"fmt"
+	"sort"
+	"time"
+	"bytes"
+	"regexp"
+	"strings"
+	"strconv"
+	"net"
+	"net/url"
+	"net/smtp"
+	"crypto/tls"
+	"encoding/json"
+)
+
+// Default notification messages for each event, used unless a "notifystart", "notifysuccess" or "notifyfailure" template is set.
+var defaultNotificationTemplates = map[string]string{
+	"start": "<<TITLE>> started by <<TRIGGER>> (run <<RUNID>>).",
+	"success": "<<TITLE>> finished successfully (run <<RUNID>>, triggered by <<TRIGGER>>).",
+	"failure": "<<TITLE>> failed (run <<RUNID>>, triggered by <<TRIGGER>>): <<ERROR>>",
+	"budget": "<<TITLE>> <<ERROR>>",
+}
+
+// Notifications are sent when runs start and finish (see events.go). A failed run that's going to be retried isn't reported - only its last
+// attempt is.
+func init() {
+	subscribeTaskEvents(eventTaskStarted, func(theEvent taskEvent) {
+		go sendRunNotifications(theEvent.taskID, theEvent.taskDetails, theEvent.runID, theEvent.trigger, "start", "", map[string]string{})
+	})
+	subscribeTaskEvents(eventTaskFinished, func(theEvent taskEvent) {
+		// The run's results (see results.go) are fetched now, before another run can replace them.
+		runResults := getTaskResults(theEvent.taskID)
+		if theEvent.runError == "" {
+			go sendRunNotifications(theEvent.taskID, theEvent.taskDetails, theEvent.runID, theEvent.trigger, "success", "", runResults)
+		} else if !theEvent.retryScheduled {
+			go sendRunNotifications(theEvent.taskID, theEvent.taskDetails, theEvent.runID, theEvent.trigger, "failure", theEvent.runError, runResults)
+		}
+	})
+}
+
+// Returns the given setting for a Task - the value from the Task's config if set, otherwise the value from the main config.
+func getTaskSetting(theTaskDetails map[string]string, theSetting string) string {
+	if theTaskDetails[theSetting] != "" {
+		return theTaskDetails[theSetting]
+	}
+	return arguments[theSetting]
+}
+
+// Returns the URL of the given Task's page, if we know the URL Webconsole is reached at (the "baseurl" option), or an empty string otherwise.
+func getTaskPageURL(theTaskID string) string {
+	if arguments["baseurl"] == "" {
+		return ""
+	}
+	return strings.TrimRight(arguments["baseurl"], "/") + "/view?taskID=" + url.QueryEscape(theTaskID)
+}
+
+// Matches a placeholder for one of a run's results in a notification template.
+var resultPlaceholderRegexp = regexp.MustCompile("<<RESULT:([^>]*)>>")
+
+// Fill in a notification template for the given Task, run and event. <<TRIGGER>> is filled in with who or what started the run (see
+// triggers.go). <<RESULT:name>> placeholders are filled in from the run's results, or left blank for results the run didn't give.
+func formatNotification(theTaskID string, theTaskDetails map[string]string, theRunID string, theTrigger runTrigger, theEvent string, theError string, theResults map[string]string) string {
+	notificationTemplate := getTaskSetting(theTaskDetails, "notify" + theEvent)
+	if notificationTemplate == "" {
+		notificationTemplate = defaultNotificationTemplates[theEvent]
+	}
+	notificationTitle := theTaskDetails["title"]
+	if notificationTitle == "" {
+		notificationTitle = "Task " + theTaskID
+	}
+	notificationTemplate = resultPlaceholderRegexp.ReplaceAllStringFunc(notificationTemplate, func(thePlaceholder string) string {
+		return theResults[resultPlaceholderRegexp.FindStringSubmatch(thePlaceholder)[1]]
+	})
+	return strings.NewReplacer("<<TITLE>>", notificationTitle, "<<TASKID>>", theTaskID, "<<RUNID>>", theRunID, "<<ERROR>>", theError,
+		"<<TRIGGER>>", describeTrigger(theTrigger), "<<URL>>", getTaskPageURL(theTaskID)).Replace(notificationTemplate)
+}
+
+// Post a message to a Slack or Teams incoming webhook - both accept a simple JSON object with a "text" value.
+func postChatMessage(theIntegration string, theWebhookURL string, theMessage string) error {
+	messageJSON, _ := json.Marshal(map[string]string{"text": theMessage})
+	chatResponse, postErr := getHTTPClient(theIntegration).Post(theWebhookURL, "application/json", bytes.NewReader(messageJSON))
+	if postErr != nil {
+		return postErr
+	}
+	chatResponse.Body.Close()
+	if chatResponse.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %s", chatResponse.Status)
+	}
+	return nil
+}
+
+// Send an email via the SMTP server given in the main config file ("smtphost", "smtpport", "smtpusername", "smtppassword" and "smtpfrom"). Port
+// 465 uses TLS from the start, other ports use STARTTLS if the server supports it.
+func sendEmail(theRecipients []string, theSubject string, theBody string) error {
+	smtpPort := arguments["smtpport"]
+	if smtpPort == "" {
+		smtpPort = "587"
+	}
+	smtpAddress := net.JoinHostPort(arguments["smtphost"], smtpPort)
+	smtpFrom := arguments["smtpfrom"]
+	if smtpFrom == "" {
+		smtpFrom = arguments["smtpusername"]
+	}
+	emailMessage := "From: " + smtpFrom + "\r\nTo: " + strings.Join(theRecipients, ", ") + "\r\nSubject: " + strings.NewReplacer("\r", " ", "\n", " ").Replace(theSubject) + "\r\nDate: " +
+		time.Now().Format(time.RFC1123Z) + "\r\nMIME-Version: 1.0\r\nContent-Type: text/plain; charset=UTF-8\r\n\r\n" +
+		strings.Replace(theBody, "\n", "\r\n", -1)
+	var smtpAuth smtp.Auth
+	if arguments["smtpusername"] != "" {
+		smtpAuth = smtp.PlainAuth("", arguments["smtpusername"], arguments["smtppassword"], arguments["smtphost"])
+	}
+	if smtpPort != "465" {
+		return smtp.SendMail(smtpAddress, smtpAuth, smtpFrom, theRecipients, []byte(emailMessage))
+	}
+	tlsConnection, dialErr := tls.DialWithDialer(&net.Dialer{Timeout: 30 * time.Second}, "tcp", smtpAddress, &tls.Config{ServerName: arguments["smtphost"]})
+	if dialErr != nil {
+		return dialErr
+	}
+	smtpClient, clientErr := smtp.NewClient(tlsConnection, arguments["smtphost"])
+	if clientErr != nil {
+		return clientErr
+	}
+	defer smtpClient.Close()
+	if smtpAuth != nil {
+		if authErr := smtpClient.Auth(smtpAuth); authErr != nil {
+			return authErr
+		}
+	}
+	if fromErr := smtpClient.Mail(smtpFrom); fromErr != nil {
+		return fromErr
+	}
+	for _, recipient := range theRecipients {
+		if recipientErr := smtpClient.Rcpt(recipient); recipientErr != nil {
+			return recipientErr
+		}
+	}
+	dataWriter, dataErr := smtpClient.Data()
+	if dataErr != nil {
+		return dataErr
+	}
+	if _, writeErr := dataWriter.Write([]byte(emailMessage)); writeErr != nil {
+		return writeErr
+	}
+	if closeErr := dataWriter.Close(); closeErr != nil {
+		return closeErr
+	}
+	return smtpClient.Quit()
+}
+
+// Returns the last lines of the given run's log, up to the number given by the "emailloglines" setting (50 by default).
+func getLogExcerpt(theTaskID string, theTaskDetails map[string]string, theRunID string) string {
+	excerptLines, atoiErr := strconv.Atoi(getTaskSetting(theTaskDetails, "emailloglines"))
+	if atoiErr != nil {
+		excerptLines = 50
+	}
+	logContents, readErr := readRunFile(theTaskID, theRunID, "log.txt")
+	if readErr != nil || excerptLines <= 0 {
+		return ""
+	}
+	logLines := strings.Split(strings.TrimRight(string(logContents), "\n"), "\n")
+	if len(logLines) > excerptLines {
+		logLines = logLines[len(logLines)-excerptLines:]
+	}
+	return strings.Join(logLines, "\n")
+}
+
+// Send notifications about a Task's run. The event is "start", "success" or "failure" - only events listed in the "notifyon" setting
+// (by default, "success,failure") are sent - or "budget", a Task's runtime budget running out (see budgets.go), which is always sent. The
+// run's trigger and results (see results.go) can be used in the message.
+func sendRunNotifications(theTaskID string, theTaskDetails map[string]string, theRunID string, theTrigger runTrigger, theEvent string, theError string, theResults map[string]string) {
+	notifyOn := getTaskSetting(theTaskDetails, "notifyon")
+	if notifyOn == "" {
+		notifyOn = "success,failure"
+	}
+	eventWanted := theEvent == "budget"
+	for _, notifyEvent := range strings.Split(notifyOn, ",") {
+		if strings.TrimSpace(strings.ToLower(notifyEvent)) == theEvent {
+			eventWanted = true
+		}
+	}
+	if !eventWanted {
+		return
+	}
+	notificationMessage := formatNotification(theTaskID, theTaskDetails, theRunID, theTrigger, theEvent, theError, theResults)
+	taskPageURL := getTaskPageURL(theTaskID)
+	if slackWebhook := getTaskSetting(theTaskDetails, "slackwebhook"); slackWebhook != "" {
+		slackMessage := notificationMessage
+		if taskPageURL != "" {
+			slackMessage = slackMessage + " <" + taskPageURL + "|View output>"
+		}
+		if postErr := postChatMessage("slack", slackWebhook, slackMessage); postErr != nil {
+			writeAuditLog(theTaskID, "Slack notification for run " + theRunID + " failed: " + postErr.Error())
+		}
+	}
+	if teamsWebhook := getTaskSetting(theTaskDetails, "teamswebhook"); teamsWebhook != "" {
+		teamsMessage := notificationMessage
+		if taskPageURL != "" {
+			teamsMessage = teamsMessage + " [View output](" + taskPageURL + ")"
+		}
+		if postErr := postChatMessage("teams", teamsWebhook, teamsMessage); postErr != nil {
+			writeAuditLog(theTaskID, "Teams notification for run " + theRunID + " failed: " + postErr.Error())
+		}
+	}
+	if notifyEmail := getTaskSetting(theTaskDetails, "notifyemail"); notifyEmail != "" && arguments["smtphost"] != "" {
+		var emailRecipients []string
+		for _, emailRecipient := range strings.Split(notifyEmail, ",") {
+			if strings.TrimSpace(emailRecipient) != "" {
+				emailRecipients = append(emailRecipients, strings.TrimSpace(emailRecipient))
+			}
+		}
+		emailBody := notificationMessage + "\n\nTriggered by: " + describeTrigger(theTrigger)
+		if theEvent == "budget" {
+			emailBody = notificationMessage + "\n\nLast run: " + theRunID
+		}
+		if theTrigger.ClientIP != "" {
+			emailBody = emailBody + " from " + theTrigger.ClientIP
+		}
+		emailBody = emailBody + "\n"
+		if len(theTrigger.Parameters) > 0 {
+			var parameterNames []string
+			for parameterName := range theTrigger.Parameters {
+				parameterNames = append(parameterNames, parameterName)
+			}
+			sort.Strings(parameterNames)
+			emailBody = emailBody + "Parameters:\n"
+			for _, parameterName := range parameterNames {
+				emailBody = emailBody + "  " + parameterName + "=" + theTrigger.Parameters[parameterName] + "\n"
+			}
+		}
+		if theEvent == "success" || theEvent == "failure" {
+			exitStatus := "success"
+			if theError != "" {
+				exitStatus = theError
+			}
+			emailBody = emailBody + "Exit status: " + exitStatus + "\n"
+		}
+		if taskPageURL != "" {
+			emailBody = emailBody + "Output: " + taskPageURL + "\n"
+		}
+		if logExcerpt := getLogExcerpt(theTaskID, theTaskDetails, theRunID); (theEvent == "success" || theEvent == "failure") && logExcerpt != "" {
+			emailBody = emailBody + "\nEnd of log:\n\n" + logExcerpt + "\n"
+		}
+		if emailErr := sendEmail(emailRecipients, "[Web Console] " + notificationMessage, emailBody); emailErr != nil {
+			writeAuditLog(theTaskID, "Email notification for run " + theRunID + " failed: " + emailErr.Error())
+		}
+	}
+}
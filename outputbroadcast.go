@@ -0,0 +1,101 @@
+package main
+// Output fan-out - each Task's output is held in a single buffer (taskOutputs), shared by everyone viewing the Task, however many viewers there
+// are. Viewers each keep their own cursor, the number of lines they've been sent so far - for api/getTaskOutput, the "line" parameter the
+// client sends each time, for api/streamTaskOutput an outputSubscriber - and are sent only the lines after it, so nothing a viewer does changes
+// the buffer. Lines are only added by the run itself (see runTask), and the buffer is only replaced when a run starts, when a finished run's
+// output is loaded from its log (once, not on every request - see loadTaskOutput) or from another server (see redis.go), or by a data purge.
+// Streaming viewers wait on the buffer's update channel, closed whenever lines are added, so new output is sent as soon as it arrives rather
+// than each viewer checking every so often. The buffer is guarded by a lock, as runs add to it while viewers read it.
+
+import (
+	// Standard libraries.
+	"sync"
+	"time"
+)
+
+// Guards taskOutputs and taskOutputUpdates.
+var taskOutputsLock sync.RWMutex
+
+// For each Task, a channel closed (and replaced) whenever the Task's output changes.
+var taskOutputUpdates = map[string]chan struct{}{}
+
+// A viewer following a Task's output, with how far through it they are.
+type outputSubscriber struct {
+	taskID string
+	cursor int
+}
+
+// Let viewers waiting on the given Task's output know it has changed. The lock must be held.
+func signalOutputUpdate(theTaskID string) {
+	if updateChannel, channelFound := taskOutputUpdates[theTaskID]; channelFound {
+		close(updateChannel)
+		delete(taskOutputUpdates, theTaskID)
+	}
+}
+
+// Replace the given Task's output, e.g. when a run starts or a previous run's output is loaded.
+func setTaskOutput(theTaskID string, theLines []taskOutputLine) {
+	taskOutputsLock.Lock()
+	defer taskOutputsLock.Unlock()
+	taskOutputs[theTaskID] = theLines
+	signalOutputUpdate(theTaskID)
+}
+
+// Add the given lines to the end of the given Task's output.
+func appendTaskOutput(theTaskID string, theLines ...taskOutputLine) {
+	taskOutputsLock.Lock()
+	defer taskOutputsLock.Unlock()
+	taskOutputs[theTaskID] = append(taskOutputs[theTaskID], theLines...)
+	signalOutputUpdate(theTaskID)
+}
+
+// Returns the given Task's output from the given line onwards. The lines returned are shared with other viewers, so mustn't be changed.
+func getTaskOutputLines(theTaskID string, theFrom int) []taskOutputLine {
+	taskOutputsLock.RLock()
+	defer taskOutputsLock.RUnlock()
+	if theFrom >= len(taskOutputs[theTaskID]) {
+		return nil
+	}
+	return taskOutputs[theTaskID][theFrom:len(taskOutputs[theTaskID]):len(taskOutputs[theTaskID])]
+}
+
+// Returns a channel that's closed when the given Task's output next changes.
+func getOutputUpdate(theTaskID string) <-chan struct{} {
+	taskOutputsLock.Lock()
+	defer taskOutputsLock.Unlock()
+	updateChannel, channelFound := taskOutputUpdates[theTaskID]
+	if !channelFound {
+		updateChannel = make(chan struct{})
+		taskOutputUpdates[theTaskID] = updateChannel
+	}
+	return updateChannel
+}
+
+// Start following the given Task's output from the given line.
+func newOutputSubscriber(theTaskID string, theCursor int) *outputSubscriber {
+	return &outputSubscriber{theTaskID, theCursor}
+}
+
+// Returns the lines of output the subscriber hasn't had yet, moving its cursor past them.
+func (theSubscriber *outputSubscriber) next() []taskOutputLine {
+	newLines := getTaskOutputLines(theSubscriber.taskID, theSubscriber.cursor)
+	theSubscriber.cursor = theSubscriber.cursor + len(newLines)
+	return newLines
+}
+
+// Wait until the subscriber's Task has new output, the given time has passed or the given channel (e.g. a request's context) is closed -
+// returning false in the last case.
+func (theSubscriber *outputSubscriber) wait(theTimeout time.Duration, theDone <-chan struct{}) bool {
+	updateChannel := getOutputUpdate(theSubscriber.taskID)
+	// Output added since the subscriber last looked doesn't need waiting for.
+	if len(getTaskOutputLines(theSubscriber.taskID, theSubscriber.cursor)) > 0 {
+		return true
+	}
+	select {
+		case <-updateChannel:
+		case <-time.After(theTimeout):
+		case <-theDone:
+			return false
+	}
+	return true
+}
@@ -0,0 +1,97 @@
+package main
+// Output limits - how much of a run's output is held in memory (and so shown in the web interface and sent to API clients), so a command that
+// dumps gigabytes of output can't exhaust the server's memory. Limits can be set for the whole server in the config file, or for each Task in
+// its config.txt (a Task's own setting wins):
+// maxoutputlines - hold at most this many lines.
+// maxoutputbytes - hold at most this many bytes of output.
+// Blank or 0 means no limit, which is the default. Output up to the limit is shown as it arrives. Past that, a marker line is shown, and the
+// most recent lines (up to half the limit) are kept back and shown when the run finishes, after a "...N lines truncated..." marker for any
+// lines in between. The run's log files always get the full output.
+
+import (
+	// Standard libraries.
+	"fmt"
+	"time"
+	"errors"
+	"strconv"
+)
+
+// The settings that limit how much output is held in memory.
+var outputLimitSettings = []string{"maxoutputlines", "maxoutputbytes"}
+
+// Keeps track of the output of one run (or loaded log), deciding which lines to hold in memory.
+type outputLimiter struct {
+	maxLines int64
+	maxBytes int64
+	keptLines int64
+	keptBytes int64
+	truncated bool
+	tail []taskOutputLine
+	tailBytes int64
+	droppedLines int64
+}
+
+// Returns the given output limit setting for the given Task - the Task's own value if it has one, otherwise the server's. Returns 0 (no limit)
+// if neither is set.
+func getOutputLimit(theTaskDetails map[string]string, theSetting string) (int64, error) {
+	limitString := theTaskDetails[theSetting]
+	if limitString == "" {
+		limitString = arguments[theSetting]
+	}
+	if limitString == "" {
+		return 0, nil
+	}
+	limitValue, limitErr := strconv.ParseInt(limitString, 10, 64)
+	if limitErr != nil || limitValue < 0 {
+		return 0, errors.New("Invalid " + theSetting + " \"" + limitString + "\" - should be a whole number, 0 or more.")
+	}
+	return limitValue, nil
+}
+
+// Returns an output limiter for the given Task. Invalid limits (reported by "webconsole check") are ignored.
+func newOutputLimiter(theTaskDetails map[string]string) *outputLimiter {
+	maxLines, _ := getOutputLimit(theTaskDetails, "maxoutputlines")
+	maxBytes, _ := getOutputLimit(theTaskDetails, "maxoutputbytes")
+	return &outputLimiter{maxLines: maxLines, maxBytes: maxBytes}
+}
+
+// Pass a line of output through the limiter. Returns the lines to add to the output buffer straight away - the line itself while under the
+// limit, a marker line when the limit is first reached, and nothing after that (the line is kept back as part of the tail).
+func (theLimiter *outputLimiter) addLine(theLine taskOutputLine) []taskOutputLine {
+	lineBytes := int64(len(theLine.line)) + 1
+	if !theLimiter.truncated {
+		if (theLimiter.maxLines == 0 || theLimiter.keptLines < theLimiter.maxLines) && (theLimiter.maxBytes == 0 || theLimiter.keptBytes + lineBytes <= theLimiter.maxBytes) {
+			theLimiter.keptLines = theLimiter.keptLines + 1
+			theLimiter.keptBytes = theLimiter.keptBytes + lineBytes
+			return []taskOutputLine{theLine}
+		}
+		theLimiter.truncated = true
+		theLimiter.addTailLine(theLine, lineBytes)
+		return []taskOutputLine{{time.Now(), "system", "...output limit reached - the last lines will be shown when the Task finishes, the full output is in the run's log..."}}
+	}
+	theLimiter.addTailLine(theLine, lineBytes)
+	return nil
+}
+
+// Add a line to the tail, dropping the oldest lines if the tail is over half the limit.
+func (theLimiter *outputLimiter) addTailLine(theLine taskOutputLine, theLineBytes int64) {
+	theLimiter.tail = append(theLimiter.tail, theLine)
+	theLimiter.tailBytes = theLimiter.tailBytes + theLineBytes
+	for len(theLimiter.tail) > 0 && ((theLimiter.maxLines > 0 && int64(len(theLimiter.tail)) > theLimiter.maxLines / 2) || (theLimiter.maxBytes > 0 && theLimiter.tailBytes > theLimiter.maxBytes / 2)) {
+		theLimiter.tailBytes = theLimiter.tailBytes - int64(len(theLimiter.tail[0].line)) - 1
+		theLimiter.tail = theLimiter.tail[1:]
+		theLimiter.droppedLines = theLimiter.droppedLines + 1
+	}
+}
+
+// Returns the lines kept back once the output is over the limit, to add to the output buffer when the run finishes - preceded, if any lines
+// have been dropped, by a marker saying how many.
+func (theLimiter *outputLimiter) finish() []taskOutputLine {
+	var finalLines []taskOutputLine
+	if theLimiter.droppedLines > 0 {
+		finalLines = append(finalLines, taskOutputLine{time.Now(), "system", fmt.Sprintf("...%d lines truncated...", theLimiter.droppedLines)})
+	}
+	finalLines = append(finalLines, theLimiter.tail...)
+	theLimiter.tail = nil
+	return finalLines
+}
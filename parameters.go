@@ -0,0 +1,192 @@
+package main
+// Parameter rules - checks on the values a Task's parameters (from webhooks, presets or api/runTask) can have, made on the server before the
+// Task is started, so a "server" parameter meant to hold a host name can't be given "; rm -rf /" - whether or not the Task's command is run by
+// a shell. Rules are given in the Task's config.txt, one per line, as "parameter name rule: value":
+// parameter server pattern: [a-z0-9.-]+
+// parameter count min: 1
+// parameter count max: 10
+// parameter environment options: staging, production
+// A "pattern" is a regular expression the whole value has to match, "min" and "max" are limits for a number and "options" lists the only values
+// allowed. A parameter with rules can also be given to api/runTask directly, as "param_" followed by its name. Parameters without rules are
+// passed on as before. Runs with a parameter that breaks its rules aren't started, and every parameter that's wrong is reported.
+
+import (
+	// Standard libraries.
+	"sort"
+	"math"
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+	"net/http"
+)
+
+// The rules for one of a Task's parameters.
+type parameterRule struct {
+	pattern *regexp.Regexp
+	patternText string
+	min string
+	max string
+	options []string
+}
+
+// A run's parameters that break their rules, each with why.
+type invalidParametersError struct {
+	problems map[string]string
+}
+
+// Returns what's wrong with each parameter, e.g. "Invalid parameters - count should be at most 10; server should match [a-z0-9.-]+.".
+func (theErr invalidParametersError) Error() string {
+	var problemLines []string
+	for _, parameterName := range theErr.names() {
+		problemLines = append(problemLines, parameterName + " " + theErr.problems[parameterName])
+	}
+	return "Invalid parameters - " + strings.Join(problemLines, "; ") + "."
+}
+
+// Returns the names of the invalid parameters, in order.
+func (theErr invalidParametersError) names() []string {
+	var parameterNames []string
+	for parameterName := range theErr.problems {
+		parameterNames = append(parameterNames, parameterName)
+	}
+	sort.Strings(parameterNames)
+	return parameterNames
+}
+
+// Returns the given Task's parameter rules, by parameter name (lowercase - parameter names aren't case-sensitive).
+func getParameterRules(theTaskDetails map[string]string) (map[string]*parameterRule, error) {
+	parameterRules := map[string]*parameterRule{}
+	for configKey, configValue := range theTaskDetails {
+		keyFields := strings.Fields(configKey)
+		if len(keyFields) == 0 || keyFields[0] != "parameter" {
+			continue
+		}
+		if len(keyFields) != 3 || !parameterNameRegexp.MatchString(keyFields[1]) {
+			return parameterRules, errors.New("Invalid parameter rule \"" + configKey + "\" - should be \"parameter name rule: value\".")
+		}
+		rule, ruleFound := parameterRules[keyFields[1]]
+		if !ruleFound {
+			rule = &parameterRule{}
+			parameterRules[keyFields[1]] = rule
+		}
+		switch keyFields[2] {
+			case "pattern":
+				patternRegexp, regexpErr := regexp.Compile("^(?:" + configValue + ")$")
+				if regexpErr != nil {
+					return parameterRules, errors.New("Invalid pattern for parameter " + keyFields[1] + " - " + regexpErr.Error())
+				}
+				rule.pattern = patternRegexp
+				rule.patternText = configValue
+			case "min", "max":
+				if limitValue, parseErr := strconv.ParseFloat(configValue, 64); parseErr != nil || math.IsNaN(limitValue) {
+					return parameterRules, errors.New("Invalid " + keyFields[2] + " for parameter " + keyFields[1] + " - should be a number.")
+				}
+				if keyFields[2] == "min" {
+					rule.min = configValue
+				} else {
+					rule.max = configValue
+				}
+			case "options":
+				for _, optionValue := range strings.Split(configValue, ",") {
+					rule.options = append(rule.options, strings.TrimSpace(optionValue))
+				}
+			default:
+				return parameterRules, errors.New("Unknown parameter rule \"" + keyFields[2] + "\" - should be pattern, min, max or options.")
+		}
+	}
+	return parameterRules, nil
+}
+
+// Returns why the given value breaks the given rule, or "" if it doesn't.
+func checkParameterValue(theRule *parameterRule, theValue string) string {
+	if theRule.pattern != nil && !theRule.pattern.MatchString(theValue) {
+		return "should match " + theRule.patternText
+	}
+	if theRule.min != "" || theRule.max != "" {
+		// ParseFloat accepts "NaN" and "Inf", which would get past both limits (NaN compares false with everything).
+		numberValue, parseErr := strconv.ParseFloat(theValue, 64)
+		if parseErr != nil || math.IsNaN(numberValue) || math.IsInf(numberValue, 0) {
+			return "should be a number"
+		}
+		if minValue, _ := strconv.ParseFloat(theRule.min, 64); theRule.min != "" && numberValue < minValue {
+			return "should be at least " + theRule.min
+		}
+		if maxValue, _ := strconv.ParseFloat(theRule.max, 64); theRule.max != "" && numberValue > maxValue {
+			return "should be at most " + theRule.max
+		}
+	}
+	if len(theRule.options) > 0 {
+		for _, optionValue := range theRule.options {
+			if theValue == optionValue {
+				return ""
+			}
+		}
+		return "should be one of " + strings.Join(theRule.options, ", ")
+	}
+	return ""
+}
+
+// Check the given parameters against the given Task's rules. Returns an invalidParametersError listing every parameter that breaks its rules.
+func checkTaskParameters(theTaskDetails map[string]string, theParameters map[string]string) error {
+	parameterRules, rulesErr := getParameterRules(theTaskDetails)
+	if rulesErr != nil {
+		return rulesErr
+	}
+	invalidParameters := invalidParametersError{map[string]string{}}
+	for parameterName, parameterValue := range theParameters {
+		if rule, ruleFound := parameterRules[strings.ToLower(parameterName)]; ruleFound {
+			if valueProblem := checkParameterValue(rule, parameterValue); valueProblem != "" {
+				invalidParameters.problems[parameterName] = valueProblem
+			}
+		}
+	}
+	if len(invalidParameters.problems) > 0 {
+		return invalidParameters
+	}
+	return nil
+}
+
+// Write an error response for the given error from checking a run's parameters. If parameters broke their rules, their names are listed
+// (comma-separated) in an "X-Invalid-Parameters" header, and the message says what's wrong with each.
+func writeParametersError(theResponseWriter http.ResponseWriter, theErr error) {
+	if invalidParameters, isInvalid := theErr.(invalidParametersError); isInvalid {
+		theResponseWriter.Header().Set("X-Invalid-Parameters", strings.Join(invalidParameters.names(), ","))
+		writeErrorResponse(theResponseWriter, 0, errorCodeInvalidParameters, invalidParameters.Error())
+	} else {
+		writeErrorResponse(theResponseWriter, 0, errorCodeInvalidRequest, theErr.Error())
+	}
+}
+
+// Returns the parameters given to api/runTask (as "param_" and the parameter's name) that the given Task has rules for, on top of the given
+// parameters (from a preset, say), which aren't changed.
+func getRequestParameters(theTaskDetails map[string]string, theFormValues map[string][]string, theParameters map[string]string) (map[string]string, error) {
+	parameterRules, rulesErr := getParameterRules(theTaskDetails)
+	if rulesErr != nil {
+		return theParameters, rulesErr
+	}
+	requestParameters := map[string]string{}
+	for parameterName, parameterValue := range theParameters {
+		requestParameters[parameterName] = parameterValue
+	}
+	for formName, formValues := range theFormValues {
+		if !strings.HasPrefix(formName, "param_") || len(formValues) == 0 {
+			continue
+		}
+		parameterName := strings.TrimPrefix(formName, "param_")
+		if _, ruleFound := parameterRules[strings.ToLower(parameterName)]; !ruleFound {
+			return theParameters, errors.New("Unknown parameter \"" + parameterName + "\".")
+		}
+		// A preset's value for the same parameter, whatever case it's in, is replaced.
+		for existingName := range requestParameters {
+			if strings.EqualFold(existingName, parameterName) {
+				delete(requestParameters, existingName)
+			}
+		}
+		requestParameters[parameterName] = formValues[0]
+	}
+	if len(requestParameters) == 0 {
+		return theParameters, nil
+	}
+	return requestParameters, nil
+}
@@ -0,0 +1,392 @@
+package main
+// Passkey (WebAuthn) authentication for admin access - registration and assertion ("login") for phishing-resistant authentication. We only need
+// a small part of the WebAuthn specification: we don't check attestation statements (we ask browsers for "none"), and support the ES256 and
+// RS256 algorithms used by practically every authenticator.
+
+import (
+	// Standard libraries.
+	"os"
+	"sync"
+	"time"
+	"math"
+	"bytes"
+	"errors"
+	"strings"
+	"strconv"
+	"net/url"
+	"net/http"
+	"math/big"
+	"io/ioutil"
+	"crypto"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/elliptic"
+	"encoding/json"
+	"encoding/base64"
+	"encoding/binary"
+)
+
+// COSE algorithm identifiers for the signature algorithms we support.
+const coseAlgES256 = -7
+const coseAlgRS256 = -257
+
+// Challenges we've issued for passkey registration or login, with the time they were issued, guarded by passkeyChallengesLock as login requests
+// are handled concurrently (and don't need authenticating). Each challenge can only be used once.
+var passkeyChallenges = map[string]int64{}
+var passkeyChallengesLock sync.Mutex
+
+// The most challenges that can be waiting to be used at once, so unauthenticated requests can't fill up the server's memory - expired ones are
+// cleared out along with expired tokens.
+const maxPasskeyChallenges = 1000
+
+// A registered passkey - the credential ID, signature algorithm, public key and the last signature counter value we saw.
+type passkey struct {
+	credentialID string
+	algorithm int
+	publicKey interface{}
+	signCount uint32
+}
+
+// Passkeys are stored one per line in passkeys.txt, in the root of the Tasks folder, as tab-separated base64url-encoded credential ID, algorithm,
+// base64-encoded PKIX public key and signature counter.
+func passkeysPath() string {
+	return arguments["taskroot"] + "/passkeys.txt"
+}
+
+// Read the list of registered passkeys.
+func readPasskeys() ([]passkey, error) {
+	var passkeys []passkey
+	passkeysContents, readErr := ioutil.ReadFile(passkeysPath())
+	if readErr != nil {
+		if os.IsNotExist(readErr) {
+			return passkeys, nil
+		}
+		return passkeys, errors.New("Can't read passkeys file.")
+	}
+	for _, passkeyLine := range strings.Split(string(passkeysContents), "\n") {
+		passkeyFields := strings.Split(passkeyLine, "\t")
+		if len(passkeyFields) == 4 {
+			algorithm, algErr := strconv.Atoi(passkeyFields[1])
+			publicKeyBytes, keyErr := base64.StdEncoding.DecodeString(passkeyFields[2])
+			signCount, countErr := strconv.ParseUint(passkeyFields[3], 10, 32)
+			if algErr == nil && keyErr == nil && countErr == nil {
+				publicKey, parseErr := x509.ParsePKIXPublicKey(publicKeyBytes)
+				if parseErr == nil {
+					passkeys = append(passkeys, passkey{passkeyFields[0], algorithm, publicKey, uint32(signCount)})
+				}
+			}
+		}
+	}
+	return passkeys, nil
+}
+
+// Write the list of registered passkeys.
+func writePasskeys(thePasskeys []passkey) error {
+	passkeysString := ""
+	for _, thePasskey := range thePasskeys {
+		publicKeyBytes, marshalErr := x509.MarshalPKIXPublicKey(thePasskey.publicKey)
+		if marshalErr != nil {
+			return marshalErr
+		}
+		passkeysString = passkeysString + thePasskey.credentialID + "\t" + strconv.Itoa(thePasskey.algorithm) + "\t" + base64.StdEncoding.EncodeToString(publicKeyBytes) + "\t" + strconv.FormatUint(uint64(thePasskey.signCount), 10) + "\n"
+	}
+	return ioutil.WriteFile(passkeysPath(), []byte(passkeysString), 0600)
+}
+
+// The relying party ID for passkeys - the host name users reach this server on. Can be set with the "passkeyrpid" option, otherwise taken from the
+// request (which will be wrong behind a proxy that rewrites the Host header).
+func getPasskeyRPID(theRequest *http.Request) string {
+	if arguments["passkeyrpid"] != "" {
+		return arguments["passkeyrpid"]
+	}
+	requestURL := url.URL{Host: theRequest.Host}
+	return requestURL.Hostname()
+}
+
+// Issue a new passkey challenge, returned as the JSON object the client-side code needs to call the WebAuthn API. Challenges come from the system's
+// secure random number generator, as a predictable challenge would let a signed response be replayed.
+func newPasskeyChallenge(theRequest *http.Request) (string, error) {
+	challengeStart, randomErr := generateSecureRandomString()
+	if randomErr != nil {
+		return "", randomErr
+	}
+	challengeEnd, randomErr := generateSecureRandomString()
+	if randomErr != nil {
+		return "", randomErr
+	}
+	challenge := challengeStart + challengeEnd
+	passkeyChallengesLock.Lock()
+	defer passkeyChallengesLock.Unlock()
+	if len(passkeyChallenges) >= maxPasskeyChallenges {
+		return "", errors.New("Too many passkey logins in progress - try again later.")
+	}
+	passkeyChallenges[challenge] = time.Now().Unix()
+	optionsJSON, _ := json.Marshal(map[string]string{"challenge": base64.RawURLEncoding.EncodeToString([]byte(challenge)), "rpID": getPasskeyRPID(theRequest)})
+	return string(optionsJSON), nil
+}
+
+// Forget challenges issued longer ago than the given timestamp.
+func clearExpiredPasskeyChallenges(theTimestamp int64) {
+	passkeyChallengesLock.Lock()
+	defer passkeyChallengesLock.Unlock()
+	for challenge, challengeTime := range passkeyChallenges {
+		if challengeTime < theTimestamp {
+			delete(passkeyChallenges, challenge)
+		}
+	}
+}
+
+// Check the client data JSON returned by the browser - it should be for the given type of operation, for one of our (unused, unexpired) challenges,
+// and from a page on our relying party's host.
+func checkPasskeyClientData(theRequest *http.Request, theClientDataJSON []byte, theType string) error {
+	var clientData struct {
+		Type string `json:"type"`
+		Challenge string `json:"challenge"`
+		Origin string `json:"origin"`
+	}
+	if jsonErr := json.Unmarshal(theClientDataJSON, &clientData); jsonErr != nil {
+		return errors.New("Invalid client data.")
+	}
+	if clientData.Type != theType {
+		return errors.New("Wrong client data type.")
+	}
+	challengeBytes, challengeErr := base64.RawURLEncoding.DecodeString(clientData.Challenge)
+	passkeyChallengesLock.Lock()
+	challengeTime, challengeFound := passkeyChallenges[string(challengeBytes)]
+	delete(passkeyChallenges, string(challengeBytes))
+	passkeyChallengesLock.Unlock()
+	if challengeErr != nil || !challengeFound || time.Now().Unix() - challengeTime > tokenTimeout {
+		return errors.New("Unknown or expired challenge.")
+	}
+	originURL, originErr := url.Parse(clientData.Origin)
+	if originErr != nil || originURL.Hostname() != getPasskeyRPID(theRequest) {
+		return errors.New("Wrong origin.")
+	}
+	return nil
+}
+
+// Check the start of the authenticator data returned by an authenticator - the hash of our relying party ID and the "user present" flag - and
+// return the flags and signature counter.
+func checkPasskeyAuthenticatorData(theRequest *http.Request, theAuthData []byte) (byte, uint32, error) {
+	if len(theAuthData) < 37 {
+		return 0, 0, errors.New("Authenticator data too short.")
+	}
+	rpIDHash := sha256.Sum256([]byte(getPasskeyRPID(theRequest)))
+	if !bytes.Equal(theAuthData[0:32], rpIDHash[:]) {
+		return 0, 0, errors.New("Wrong relying party ID.")
+	}
+	if theAuthData[32] & 0x01 == 0 {
+		return 0, 0, errors.New("User not present.")
+	}
+	return theAuthData[32], binary.BigEndian.Uint32(theAuthData[33:37]), nil
+}
+
+// Complete a passkey registration, given the base64url-encoded client data JSON and attestation object from the browser. The new passkey is added
+// to the list of registered passkeys.
+func registerPasskey(theRequest *http.Request, theClientDataJSON string, theAttestationObject string) error {
+	clientDataJSON, clientDataErr := base64.RawURLEncoding.DecodeString(strings.TrimRight(theClientDataJSON, "="))
+	attestationObjectBytes, attestationErr := base64.RawURLEncoding.DecodeString(strings.TrimRight(theAttestationObject, "="))
+	if clientDataErr != nil || attestationErr != nil {
+		return errors.New("Invalid encoding.")
+	}
+	if clientDataCheckErr := checkPasskeyClientData(theRequest, clientDataJSON, "webauthn.create"); clientDataCheckErr != nil {
+		return clientDataCheckErr
+	}
+	attestationObject, _, cborErr := decodeCBOR(attestationObjectBytes)
+	attestationMap, isMap := attestationObject.(map[interface{}]interface{})
+	if cborErr != nil || !isMap {
+		return errors.New("Invalid attestation object.")
+	}
+	authData, isBytes := attestationMap["authData"].([]byte)
+	if !isBytes {
+		return errors.New("Invalid attestation object.")
+	}
+	authFlags, signCount, authDataErr := checkPasskeyAuthenticatorData(theRequest, authData)
+	if authDataErr != nil {
+		return authDataErr
+	}
+	// The attested credential data: a 16-byte AAGUID, a 2-byte credential ID length, the credential ID, then the COSE-encoded public key.
+	if authFlags & 0x40 == 0 || len(authData) < 55 {
+		return errors.New("No credential data.")
+	}
+	credentialIDLength := int(binary.BigEndian.Uint16(authData[53:55]))
+	if len(authData) < 55 + credentialIDLength {
+		return errors.New("Credential data too short.")
+	}
+	credentialID := base64.RawURLEncoding.EncodeToString(authData[55:55+credentialIDLength])
+	coseKey, _, coseErr := decodeCBOR(authData[55+credentialIDLength:])
+	if coseErr != nil {
+		return errors.New("Invalid credential public key.")
+	}
+	algorithm, publicKey, keyErr := parseCOSEKey(coseKey)
+	if keyErr != nil {
+		return keyErr
+	}
+	passkeys, readErr := readPasskeys()
+	if readErr != nil {
+		return readErr
+	}
+	passkeys = append(passkeys, passkey{credentialID, algorithm, publicKey, signCount})
+	return writePasskeys(passkeys)
+}
+
+// Check a passkey assertion (login), given the base64url-encoded credential ID, client data JSON, authenticator data and signature from the
+// browser. Returns nil if the assertion is valid for one of our registered passkeys.
+func checkPasskeyAssertion(theRequest *http.Request, theCredentialID string, theClientDataJSON string, theAuthenticatorData string, theSignature string) error {
+	credentialID := strings.TrimRight(theCredentialID, "=")
+	clientDataJSON, clientDataErr := base64.RawURLEncoding.DecodeString(strings.TrimRight(theClientDataJSON, "="))
+	authData, authDataErr := base64.RawURLEncoding.DecodeString(strings.TrimRight(theAuthenticatorData, "="))
+	signature, signatureErr := base64.RawURLEncoding.DecodeString(strings.TrimRight(theSignature, "="))
+	if clientDataErr != nil || authDataErr != nil || signatureErr != nil {
+		return errors.New("Invalid encoding.")
+	}
+	passkeys, readErr := readPasskeys()
+	if readErr != nil {
+		return readErr
+	}
+	for pl, thePasskey := range passkeys {
+		if thePasskey.credentialID == credentialID {
+			if clientDataCheckErr := checkPasskeyClientData(theRequest, clientDataJSON, "webauthn.get"); clientDataCheckErr != nil {
+				return clientDataCheckErr
+			}
+			_, signCount, authDataCheckErr := checkPasskeyAuthenticatorData(theRequest, authData)
+			if authDataCheckErr != nil {
+				return authDataCheckErr
+			}
+			// The signature is over the authenticator data followed by the hash of the client data.
+			clientDataHash := sha256.Sum256(clientDataJSON)
+			signedHash := sha256.Sum256(append(append([]byte{}, authData...), clientDataHash[:]...))
+			signatureValid := false
+			if ecdsaKey, isECDSA := thePasskey.publicKey.(*ecdsa.PublicKey); isECDSA && thePasskey.algorithm == coseAlgES256 {
+				signatureValid = ecdsa.VerifyASN1(ecdsaKey, signedHash[:], signature)
+			} else if rsaKey, isRSA := thePasskey.publicKey.(*rsa.PublicKey); isRSA && thePasskey.algorithm == coseAlgRS256 {
+				signatureValid = rsa.VerifyPKCS1v15(rsaKey, crypto.SHA256, signedHash[:], signature) == nil
+			}
+			if !signatureValid {
+				return errors.New("Invalid signature.")
+			}
+			// Authenticators that keep a signature counter should always give an increasing value - if not, the passkey might have been cloned.
+			if (signCount != 0 || thePasskey.signCount != 0) && signCount <= thePasskey.signCount {
+				return errors.New("Signature counter went backwards - passkey may have been cloned.")
+			}
+			passkeys[pl].signCount = signCount
+			return writePasskeys(passkeys)
+		}
+	}
+	return errors.New("Unknown passkey.")
+}
+
+// Parse a COSE-encoded public key (as decoded from CBOR), returning the COSE algorithm identifier and the public key.
+func parseCOSEKey(theCOSEKey interface{}) (int, interface{}, error) {
+	coseMap, isMap := theCOSEKey.(map[interface{}]interface{})
+	if !isMap {
+		return 0, nil, errors.New("Invalid credential public key.")
+	}
+	algorithm, _ := coseMap[int64(3)].(int64)
+	if algorithm == coseAlgES256 {
+		xBytes, xOK := coseMap[int64(-2)].([]byte)
+		yBytes, yOK := coseMap[int64(-3)].([]byte)
+		if !xOK || !yOK {
+			return 0, nil, errors.New("Invalid ES256 public key.")
+		}
+		publicKey := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(xBytes), Y: new(big.Int).SetBytes(yBytes)}
+		if !publicKey.Curve.IsOnCurve(publicKey.X, publicKey.Y) {
+			return 0, nil, errors.New("Invalid ES256 public key.")
+		}
+		return coseAlgES256, publicKey, nil
+	} else if algorithm == coseAlgRS256 {
+		nBytes, nOK := coseMap[int64(-1)].([]byte)
+		eBytes, eOK := coseMap[int64(-2)].([]byte)
+		if !nOK || !eOK || len(eBytes) > 4 {
+			return 0, nil, errors.New("Invalid RS256 public key.")
+		}
+		return coseAlgRS256, &rsa.PublicKey{N: new(big.Int).SetBytes(nBytes), E: int(new(big.Int).SetBytes(eBytes).Int64())}, nil
+	}
+	return 0, nil, errors.New("Unsupported passkey algorithm (only ES256 and RS256 are supported).")
+}
+
+// A minimal CBOR decoder - just enough to read WebAuthn attestation objects and COSE keys. Returns the decoded value and any remaining data. Maps
+// are returned as map[interface{}]interface{}, integers as int64, byte strings as []byte and text strings as string.
+func decodeCBOR(theData []byte) (interface{}, []byte, error) {
+	if len(theData) == 0 {
+		return nil, nil, errors.New("Unexpected end of CBOR data.")
+	}
+	majorType := theData[0] >> 5
+	additionalInfo := theData[0] & 0x1f
+	theData = theData[1:]
+	// Read the argument that follows the initial byte - a count, length or value depending on the major type.
+	var argument uint64
+	if additionalInfo < 24 {
+		argument = uint64(additionalInfo)
+	} else if additionalInfo <= 27 {
+		argumentLength := 1 << (additionalInfo - 24)
+		if len(theData) < argumentLength {
+			return nil, nil, errors.New("Unexpected end of CBOR data.")
+		}
+		for pl := 0; pl < argumentLength; pl++ {
+			argument = argument << 8 | uint64(theData[pl])
+		}
+		theData = theData[argumentLength:]
+	} else {
+		return nil, nil, errors.New("Unsupported CBOR encoding.")
+	}
+	switch majorType {
+		case 0:
+			if argument > math.MaxInt64 {
+				return nil, nil, errors.New("CBOR integer too large.")
+			}
+			return int64(argument), theData, nil
+		case 1:
+			if argument > math.MaxInt64 {
+				return nil, nil, errors.New("CBOR integer too large.")
+			}
+			return -1 - int64(argument), theData, nil
+		case 2, 3:
+			if uint64(len(theData)) < argument {
+				return nil, nil, errors.New("Unexpected end of CBOR data.")
+			}
+			if majorType == 2 {
+				return append([]byte{}, theData[:argument]...), theData[argument:], nil
+			}
+			return string(theData[:argument]), theData[argument:], nil
+		case 4:
+			var result []interface{}
+			for pl := uint64(0); pl < argument; pl++ {
+				var item interface{}
+				var itemErr error
+				item, theData, itemErr = decodeCBOR(theData)
+				if itemErr != nil {
+					return nil, nil, itemErr
+				}
+				result = append(result, item)
+			}
+			return result, theData, nil
+		case 5:
+			result := map[interface{}]interface{}{}
+			for pl := uint64(0); pl < argument; pl++ {
+				var key, value interface{}
+				var itemErr error
+				key, theData, itemErr = decodeCBOR(theData)
+				if itemErr == nil {
+					value, theData, itemErr = decodeCBOR(theData)
+				}
+				if itemErr != nil {
+					return nil, nil, itemErr
+				}
+				// Arrays and maps can't be used as Go map keys (and never are in WebAuthn data), so aren't accepted as keys.
+				switch key.(type) {
+					case []byte:
+						key = string(key.([]byte))
+					case []interface{}, map[interface{}]interface{}:
+						return nil, nil, errors.New("Unsupported CBOR map key.")
+				}
+				result[key] = value
+			}
+			return result, theData, nil
+		case 7:
+			return map[uint64]interface{}{20: false, 21: true, 22: nil}[argument], theData, nil
+	}
+	return nil, nil, errors.New("Unsupported CBOR type.")
+}
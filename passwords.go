@@ -0,0 +1,103 @@
+package main
+// Password hashing helpers. Secrets are stored as hashes, either Bcrypt (the default) or Argon2id (set "passwordhash" to "argon2id"), and both
+// kinds of hash can always be checked, so changing the setting only affects newly-hashed secrets.
+
+import (
+	// Standard libraries.
+	"fmt"
+	"errors"
+	"strings"
+	"strconv"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+
+	// Argon2id, the password hashing algorithm recommended by OWASP.
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Returns a new random 16-character string (from the same letters as generateRandomString) for secrets, tokens and IDs that mustn't be
+// guessable - unlike generateRandomString, it uses the system's secure random number generator.
+func generateSecureRandomString() (string, error) {
+	result := make([]byte, 0, 16)
+	randomBytes := make([]byte, 32)
+	for len(result) < 16 {
+		if _, randErr := rand.Read(randomBytes); randErr != nil {
+			return "", errors.New("Can't generate random string - " + randErr.Error())
+		}
+		for _, randomByte := range randomBytes {
+			// Bytes past the last whole multiple of the number of letters are skipped, so each letter is equally likely.
+			if int(randomByte) < 256 - (256 % len(letters)) && len(result) < 16 {
+				result = append(result, letters[int(randomByte) % len(letters)])
+			}
+		}
+	}
+	return string(result), nil
+}
+
+// The Bcrypt cost used if "bcryptcost" isn't set. Each step up doubles the time taken to hash (and check) a secret.
+const defaultBcryptCost = 14
+
+// The Argon2id parameters used for new hashes: memory (in KiB), iterations and parallelism, as recommended by OWASP. They're stored in each hash,
+// so can be changed without affecting existing hashes.
+const argon2Memory = 19 * 1024
+const argon2Iterations = 2
+const argon2Threads = 1
+const argon2SaltLength = 16
+const argon2KeyLength = 32
+
+// Returns the Bcrypt cost to use - "bcryptcost" if set, otherwise the default.
+func getBcryptCost() (int, error) {
+	if arguments["bcryptcost"] == "" {
+		return defaultBcryptCost, nil
+	}
+	bcryptCost, costErr := strconv.Atoi(arguments["bcryptcost"])
+	if costErr != nil || bcryptCost < bcrypt.MinCost || bcryptCost > bcrypt.MaxCost {
+		return defaultBcryptCost, fmt.Errorf("Invalid bcryptcost \"%s\" - should be a whole number from %d to %d.", arguments["bcryptcost"], bcrypt.MinCost, bcrypt.MaxCost)
+	}
+	return bcryptCost, nil
+}
+
+// Returns true if the given string is a password hash we can check - Bcrypt or Argon2id.
+func isPasswordHash(theHash string) bool {
+	return strings.HasPrefix(theHash, "$2") || strings.HasPrefix(theHash, "$argon2id$")
+}
+
+// Hash the given password with Argon2id, returning the hash in the standard "$argon2id$v=19$m=...,t=...,p=...$salt$key" format.
+func hashPasswordArgon2(thePassword string) (string, error) {
+	passwordSalt := make([]byte, argon2SaltLength)
+	if _, randErr := rand.Read(passwordSalt); randErr != nil {
+		return "", randErr
+	}
+	passwordKey := argon2.IDKey([]byte(thePassword), passwordSalt, argon2Iterations, argon2Memory, argon2Threads, argon2KeyLength)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, argon2Memory, argon2Iterations, argon2Threads,
+		base64.RawStdEncoding.EncodeToString(passwordSalt), base64.RawStdEncoding.EncodeToString(passwordKey)), nil
+}
+
+// Check a plain text password against an Argon2id hash, using the parameters stored in the hash.
+func checkPasswordArgon2(thePassword string, theHash string) (bool, error) {
+	hashFields := strings.Split(theHash, "$")
+	if len(hashFields) != 6 || hashFields[1] != "argon2id" {
+		return false, errors.New("not an Argon2id hash")
+	}
+	var hashVersion int
+	if _, scanErr := fmt.Sscanf(hashFields[2], "v=%d", &hashVersion); scanErr != nil || hashVersion != argon2.Version {
+		return false, errors.New("unsupported Argon2 version")
+	}
+	var hashMemory, hashIterations uint32
+	var hashThreads uint8
+	if _, scanErr := fmt.Sscanf(hashFields[3], "m=%d,t=%d,p=%d", &hashMemory, &hashIterations, &hashThreads); scanErr != nil {
+		return false, errors.New("invalid Argon2 parameters")
+	}
+	passwordSalt, saltErr := base64.RawStdEncoding.DecodeString(hashFields[4])
+	if saltErr != nil {
+		return false, saltErr
+	}
+	hashKey, keyErr := base64.RawStdEncoding.DecodeString(hashFields[5])
+	if keyErr != nil {
+		return false, keyErr
+	}
+	passwordKey := argon2.IDKey([]byte(thePassword), passwordSalt, hashIterations, hashMemory, hashThreads, uint32(len(hashKey)))
+	return subtle.ConstantTimeCompare(passwordKey, hashKey) == 1, nil
+}
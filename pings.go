@@ -0,0 +1,93 @@
+package main
+// Dead man's switch pings - with "pingURL" set to a check's URL at healthchecks.io (or a service that works the same way, such as a
+// self-hosted Healthchecks or Uptime Kuma push monitor), each run of the Task tells the service how it went: the URL with "/start" added
+// when a run starts, the URL itself when it succeeds and the URL with "/fail" added when it fails (but not when it's about to be retried -
+// see retries.go - only its last attempt is reported). The service alerts if the pings stop coming, so a scheduled Task that silently stops
+// running gets noticed as well as one that fails. Success and failure pings include the end of the run's log (as for notification emails -
+// see notifications.go), which the service keeps with the ping. Each run's pings are sent in order, its finish ping only once its start ping
+// has been. Pings that can't be sent are recorded in the audit log.
+
+import (
+	// Standard libraries.
+	"fmt"
+	"sync"
+	"errors"
+	"strings"
+	"net/url"
+)
+
+// Guards runStartPings.
+var runStartPingsLock sync.Mutex
+
+// For each running Task with a start ping being sent, a channel closed once it has been, keyed by Task and run ID (see runKey).
+var runStartPings = map[string]chan struct{}{}
+
+// Runs are reported as they start and finish (see events.go), in the background so a slow service doesn't hold anything up. A run's finish
+// ping waits for its start ping, so the service doesn't get them the wrong way round (and think a short run is still going).
+func init() {
+	subscribeTaskEvents(eventTaskStarted, func(theEvent taskEvent) {
+		if theEvent.taskDetails["pingurl"] == "" {
+			return
+		}
+		startPingSent := make(chan struct{})
+		runStartPingsLock.Lock()
+		runStartPings[runKey(theEvent.taskID, theEvent.runID)] = startPingSent
+		runStartPingsLock.Unlock()
+		go func() {
+			sendRunPing(theEvent.taskID, theEvent.taskDetails, theEvent.runID, "start")
+			close(startPingSent)
+		}()
+	})
+	subscribeTaskEvents(eventTaskFinished, func(theEvent taskEvent) {
+		runStartPingsLock.Lock()
+		startPingSent, startPingFound := runStartPings[runKey(theEvent.taskID, theEvent.runID)]
+		delete(runStartPings, runKey(theEvent.taskID, theEvent.runID))
+		runStartPingsLock.Unlock()
+		pingEvent := ""
+		if theEvent.runError == "" {
+			pingEvent = "success"
+		} else if !theEvent.retryScheduled {
+			pingEvent = "fail"
+		}
+		if theEvent.taskDetails["pingurl"] == "" || pingEvent == "" {
+			return
+		}
+		go func() {
+			if startPingFound {
+				<-startPingSent
+			}
+			sendRunPing(theEvent.taskID, theEvent.taskDetails, theEvent.runID, pingEvent)
+		}()
+	})
+}
+
+// Check a Task's "pingurl" setting is an HTTP or HTTPS URL.
+func checkPingURL(thePingURL string) error {
+	parsedURL, parseErr := url.Parse(thePingURL)
+	if parseErr != nil || (parsedURL.Scheme != "http" && parsedURL.Scheme != "https") || parsedURL.Host == "" {
+		return errors.New("Invalid pingurl \"" + thePingURL + "\" - should be an http:// or https:// URL.")
+	}
+	return nil
+}
+
+// Ping the given Task's dead man's switch for the given run, which is starting ("start"), has succeeded ("success") or has failed ("fail").
+func sendRunPing(theTaskID string, theTaskDetails map[string]string, theRunID string, theEvent string) {
+	pingURL := strings.TrimRight(theTaskDetails["pingurl"], "/")
+	pingBody := ""
+	if theEvent != "success" {
+		pingURL = pingURL + "/" + theEvent
+	}
+	if theEvent != "start" {
+		pingBody = getLogExcerpt(theTaskID, theTaskDetails, theRunID)
+	}
+	pingResponse, pingErr := getHTTPClient("ping").Post(pingURL, "text/plain; charset=utf-8", strings.NewReader(pingBody))
+	if pingErr == nil {
+		pingResponse.Body.Close()
+		if pingResponse.StatusCode >= 300 {
+			pingErr = fmt.Errorf("service returned %s", pingResponse.Status)
+		}
+	}
+	if pingErr != nil {
+		writeAuditLog(theTaskID, "Dead man's switch " + theEvent + " ping for run " + theRunID + " failed: " + pingErr.Error())
+	}
+}
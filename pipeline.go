@@ -0,0 +1,339 @@
+package main
+// Dependencies, chained Tasks and pipelines - simple build / deploy chains without needing a separate CI system.
+//
+// A Task's "after" option lists Tasks (comma-separated IDs) to run first: when the Task is run, each of those is run in turn (or, if already
+// running, waited for) and the Task itself only runs if they all succeed. Dependencies can have dependencies of their own, but not loops.
+//
+// Working the other way round, a Task's "onSuccess" and "onFailure" options list Tasks to start once the Task has finished - a simpler way
+// of chaining Tasks together. Again, these can't loop back to a Task already in the chain (via any mix of onSuccess and onFailure).
+//
+// Instead of a single "command", a Task can be a pipeline of steps, each with its own command, given in config.txt as:
+// step 1 build: make
+// step 2 test: make test
+// step 2 lint: make lint
+// step 3 deploy: ./deploy.sh
+// Steps run in order of their number (their "stage") - steps with the same number run at the same time. If any step fails, the steps in later
+// stages are skipped and the run fails. Each line of a step's output is prefixed with the step's name, and also written to its own log file
+// in the run's "steps" folder, with the status of each step kept in the run's steps.txt file.
+
+import (
+	// Standard libraries.
+	"os"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+	"os/exec"
+	"io/ioutil"
+)
+
+// One step of a pipeline.
+type pipelineStep struct {
+	stage int
+	name string
+	command string
+}
+
+// A running pipeline (or a Task waiting for its dependencies), so it can be stopped.
+type pipelineRun struct {
+	lock sync.Mutex
+	stopped bool
+	commands []*exec.Cmd
+}
+
+// The pipelines running, by Task ID.
+var pipelineRuns = map[string]*pipelineRun{}
+
+// Step names are used for log file names, so are kept simple.
+var stepNameRegexp = regexp.MustCompile("^[A-Za-z0-9_-]+$")
+
+// Returns the given Task's pipeline steps, sorted by stage, or none if the Task isn't a pipeline. Read from the Task's config directly, as
+// step names keep their case.
+func getPipelineSteps(theTaskID string) ([]pipelineStep, error) {
+	var steps []pipelineStep
+	configContents, configErr := taskStore.ReadTaskConfig(theTaskID)
+	if configErr != nil {
+		return steps, errors.New("Can't open Task config file.")
+	}
+	stepNames := map[string]bool{}
+	for _, configLine := range strings.Split(string(configContents), "\n") {
+		itemSplit := strings.SplitN(configLine, ":", 2)
+		keyFields := strings.Fields(itemSplit[0])
+		if len(itemSplit) < 2 || len(keyFields) == 0 || strings.ToLower(keyFields[0]) != "step" {
+			continue
+		}
+		if len(keyFields) != 3 {
+			return steps, errors.New("Invalid step \"" + strings.TrimSpace(itemSplit[0]) + "\" - should be \"step number name: command\".")
+		}
+		stepStage, stageErr := strconv.Atoi(keyFields[1])
+		if stageErr != nil || stepStage < 0 {
+			return steps, errors.New("Invalid step number \"" + keyFields[1] + "\" - should be a whole number.")
+		}
+		if !stepNameRegexp.MatchString(keyFields[2]) {
+			return steps, errors.New("Invalid step name \"" + keyFields[2] + "\" - should be letters, numbers, \"-\" and \"_\" only.")
+		}
+		if stepNames[strings.ToLower(keyFields[2])] {
+			return steps, errors.New("There's more than one step called \"" + keyFields[2] + "\".")
+		}
+		stepNames[strings.ToLower(keyFields[2])] = true
+		if stepCommand, parseErr := parseCommandString(itemSplit[1]); parseErr != nil {
+			return steps, errors.New("Step \"" + keyFields[2] + "\": " + parseErr.Error())
+		} else if len(stepCommand) == 0 {
+			return steps, errors.New("No command set for step \"" + keyFields[2] + "\".")
+		}
+		steps = append(steps, pipelineStep{stepStage, keyFields[2], strings.TrimSpace(itemSplit[1])})
+	}
+	sort.SliceStable(steps, func(i, j int) bool { return steps[i].stage < steps[j].stage })
+	return steps, nil
+}
+
+// Returns the Task IDs in the given comma-separated list.
+func splitTaskIDs(theList string) []string {
+	var taskIDs []string
+	for _, taskID := range strings.Split(theList, ",") {
+		if strings.TrimSpace(taskID) != "" {
+			taskIDs = append(taskIDs, strings.TrimSpace(taskID))
+		}
+	}
+	return taskIDs
+}
+
+// Returns the IDs of the Tasks the given Task depends on (its "after" option).
+func getTaskDependencies(theTaskDetails map[string]string) []string {
+	return splitTaskIDs(theTaskDetails["after"])
+}
+
+// Check the given Task's dependencies (and theirs, and so on) all exist and don't loop back on themselves. theChain is the Tasks that led to
+// this one - nil to start with.
+func checkTaskDependencies(theTaskID string, theChain []string) error {
+	for _, chainTaskID := range theChain {
+		if chainTaskID == theTaskID {
+			return errors.New("Dependencies loop: " + strings.Join(append(theChain, theTaskID), " -> ") + ".")
+		}
+	}
+	taskDetails, taskErr := getTaskDetails(theTaskID)
+	if taskErr != nil && len(theChain) == 0 {
+		return taskErr
+	} else if taskErr != nil {
+		return errors.New("Dependency \"" + theTaskID + "\" (of " + theChain[len(theChain)-1] + ") doesn't exist.")
+	}
+	for _, dependencyID := range getTaskDependencies(taskDetails) {
+		if dependencyErr := checkTaskDependencies(dependencyID, append(theChain, theTaskID)); dependencyErr != nil {
+			return dependencyErr
+		}
+	}
+	return nil
+}
+
+// Check that the Tasks started when the given Task finishes (its "onSuccess" and "onFailure" options, and theirs, and so on) never lead back to
+// a Task already in the chain. theChain is the Tasks that led to this one - nil to start with. Chained Tasks that don't exist are left for
+// startChainedTasks to report.
+func checkTaskTriggers(theTaskID string, theChain []string) error {
+	for _, chainTaskID := range theChain {
+		if chainTaskID == theTaskID {
+			return errors.New("Chained Tasks loop: " + strings.Join(append(theChain, theTaskID), " -> ") + ".")
+		}
+	}
+	taskDetails, taskErr := getTaskDetails(theTaskID)
+	if taskErr != nil {
+		return nil
+	}
+	for _, nextTaskID := range splitTaskIDs(taskDetails["onsuccess"] + "," + taskDetails["onfailure"]) {
+		if triggerErr := checkTaskTriggers(nextTaskID, append(theChain, theTaskID)); triggerErr != nil {
+			return triggerErr
+		}
+	}
+	return nil
+}
+
+// Start the Tasks to run now the given Task has finished - its "onSuccess" Tasks if theRunError is blank, otherwise its "onFailure" Tasks.
+// Progress is reported through theRecordOutput.
+func startChainedTasks(theTaskID string, theTaskDetails map[string]string, theRunError string, theRecordOutput func(string, string)) {
+	triggerName := "onsuccess"
+	if theRunError != "" {
+		triggerName = "onfailure"
+	}
+	nextTaskIDs := splitTaskIDs(theTaskDetails[triggerName])
+	if len(nextTaskIDs) == 0 {
+		return
+	}
+	if triggerErr := checkTaskTriggers(theTaskID, nil); triggerErr != nil {
+		theRecordOutput("system", "WARNING: Not starting chained Tasks - " + triggerErr.Error())
+		return
+	}
+	for _, nextTaskID := range nextTaskIDs {
+		nextTaskDetails, _ := getTaskDetails(nextTaskID)
+		if taskIsRunning(nextTaskID) {
+			theRecordOutput("system", "WARNING: Chained Task " + nextTaskID + " is already running, so wasn't started again.")
+		} else if startErr := startTask(nextTaskID, nextTaskDetails, nil, runTrigger{Kind: "chained", Source: "after Task " + theTaskID + ", " + triggerName}); startErr != nil {
+			theRecordOutput("system", "WARNING: Couldn't start chained Task " + nextTaskID + " - " + startErr.Error())
+		} else {
+			theRecordOutput("system", "Started chained Task " + nextTaskID + " (" + nextTaskDetails["title"] + ").")
+			writeAuditLog(nextTaskID, "Started by Task " + theTaskID + " (" + triggerName + ").")
+		}
+	}
+}
+
+// Run each of the given Task's dependencies in turn, waiting for each to finish - or, if a dependency is already running, wait for that run
+// to finish. Progress is reported through theRecordOutput. Returns an error if a dependency fails, or the Task is stopped while waiting.
+func runTaskDependencies(theTaskID string, theTaskDetails map[string]string, theRecordOutput func(string, string)) error {
+	run := pipelineRuns[theTaskID]
+	for _, dependencyID := range getTaskDependencies(theTaskDetails) {
+		dependencyDetails, dependencyErr := getTaskDetails(dependencyID)
+		if dependencyErr != nil {
+			return errors.New("Dependency \"" + dependencyID + "\" doesn't exist.")
+		}
+		if taskIsRunning(dependencyID) {
+			theRecordOutput("system", "Waiting for dependency " + dependencyID + " (" + dependencyDetails["title"] + ") to finish...")
+		} else {
+			theRecordOutput("system", "Running dependency " + dependencyID + " (" + dependencyDetails["title"] + ")...")
+			if startErr := startTask(dependencyID, dependencyDetails, nil, runTrigger{Kind: "dependency", Source: "needed by Task " + theTaskID}); startErr != nil {
+				return errors.New("Dependency " + dependencyID + " couldn't be started - " + startErr.Error())
+			}
+		}
+		for taskIsRunning(dependencyID) {
+			if run != nil && run.stopped {
+				return errors.New("Stopped while waiting for dependency " + dependencyID + ".")
+			}
+			time.Sleep(500 * time.Millisecond)
+		}
+		if taskRunResults[dependencyID] != "" {
+			return errors.New("Dependency " + dependencyID + " failed - " + taskRunResults[dependencyID])
+		}
+		theRecordOutput("system", "Dependency " + dependencyID + " succeeded.")
+	}
+	return nil
+}
+
+// Start running the given pipeline steps, in the Task's folder, with the given environment variables. Works like startTaskProcess: output
+// lines (prefixed with each step's name) are passed back on the returned channel, which is closed once the pipeline has finished, and the
+// function returned gives the overall result.
+func startPipelineSteps(theTaskID string, theRunFolder string, theSteps []pipelineStep, theEnvironment []string, theTaskDetails map[string]string) (chan taskOutputLine, func() error) {
+	run := pipelineRuns[theTaskID]
+	outputLines := make(chan taskOutputLine)
+	stepStatuses := map[string]string{}
+	for _, step := range theSteps {
+		stepStatuses[step.name] = "waiting"
+	}
+	os.MkdirAll(theRunFolder + "/steps", os.ModePerm)
+	var statusLock sync.Mutex
+	// Record a step's status, and write the status of every step to the run's steps.txt file.
+	setStepStatus := func(theStepName string, theStatus string) {
+		statusLock.Lock()
+		defer statusLock.Unlock()
+		stepStatuses[theStepName] = theStatus
+		statusString := ""
+		for _, step := range theSteps {
+			statusString = statusString + fmt.Sprintf("%d\t%s\t%s\n", step.stage, step.name, stepStatuses[step.name])
+		}
+		ioutil.WriteFile(theRunFolder + "/steps.txt", []byte(statusString), 0644)
+	}
+	// Write the steps.txt file straight away, with every step waiting.
+	setStepStatus(theSteps[0].name, "waiting")
+	var failedSteps []string
+	// Run one step, returning its error (if any) once it has finished.
+	runStep := func(theStep pipelineStep) error {
+		// Step commands have already been checked by getPipelineSteps.
+		commandArray, _ := getCommandArray(theStep.command, theTaskDetails)
+		stepCommand := newTaskCommand(addStrictArguments(commandArray, theTaskDetails, "", taskParameters[theTaskID]))
+		stepCommand.Dir = getTaskWorkDir(theTaskID, theTaskDetails)
+		stepCommand.Env = append(theEnvironment, "WEBCONSOLE_STEP=" + theStep.name)
+		run.lock.Lock()
+		if run.stopped {
+			run.lock.Unlock()
+			return errors.New("stopped")
+		}
+		stepLines, startErr := startTaskProcess(stepCommand)
+		if startErr == nil {
+			run.commands = append(run.commands, stepCommand)
+		}
+		run.lock.Unlock()
+		if startErr != nil {
+			return startErr
+		}
+		if limitsErr := applyProcessLimits(stepCommand, theTaskDetails); limitsErr != nil {
+			outputLines <- taskOutputLine{time.Now(), "system", "WARNING: [" + theStep.name + "] " + limitsErr.Error()}
+		}
+		stepLog, _ := os.Create(theRunFolder + "/steps/" + theStep.name + ".log")
+		for stepLine := range stepLines {
+			if stepLog != nil {
+				stepLog.Write([]byte(stepLine.line + "\n"))
+			}
+			outputLines <- taskOutputLine{stepLine.timestamp, stepLine.stream, "[" + theStep.name + "] " + stepLine.line}
+		}
+		if stepLog != nil {
+			stepLog.Close()
+		}
+		if exitErr := stepCommand.Wait(); exitErr != nil {
+			if limitMessage := describeLimitExit(exitErr, theTaskDetails); limitMessage != "" {
+				return errors.New(limitMessage)
+			}
+			return exitErr
+		}
+		return nil
+	}
+	var pipelineErr error
+	go func() {
+		for stageStart := 0; stageStart < len(theSteps); {
+			stageEnd := stageStart
+			for stageEnd < len(theSteps) && theSteps[stageEnd].stage == theSteps[stageStart].stage {
+				stageEnd = stageEnd + 1
+			}
+			if len(failedSteps) > 0 || run.stopped {
+				for _, step := range theSteps[stageStart:stageEnd] {
+					setStepStatus(step.name, "skipped")
+				}
+				stageStart = stageEnd
+				continue
+			}
+			var stageRunning sync.WaitGroup
+			var failedLock sync.Mutex
+			for _, step := range theSteps[stageStart:stageEnd] {
+				stageRunning.Add(1)
+				go func(theStep pipelineStep) {
+					defer stageRunning.Done()
+					outputLines <- taskOutputLine{time.Now(), "system", "Step " + theStep.name + " started."}
+					setStepStatus(theStep.name, "running")
+					if stepErr := runStep(theStep); stepErr != nil {
+						setStepStatus(theStep.name, "failed\t" + stepErr.Error())
+						outputLines <- taskOutputLine{time.Now(), "system", "Step " + theStep.name + " failed - " + stepErr.Error()}
+						failedLock.Lock()
+						failedSteps = append(failedSteps, theStep.name)
+						failedLock.Unlock()
+					} else {
+						setStepStatus(theStep.name, "succeeded")
+						outputLines <- taskOutputLine{time.Now(), "system", "Step " + theStep.name + " succeeded."}
+					}
+				}(step)
+			}
+			stageRunning.Wait()
+			stageStart = stageEnd
+		}
+		if len(failedSteps) > 0 {
+			pipelineErr = errors.New("Pipeline failed at step " + strings.Join(failedSteps, ", ") + ".")
+		}
+		close(outputLines)
+	}()
+	return outputLines, func() error { return pipelineErr }
+}
+
+// Stop the given Task's pipeline (or its wait for its dependencies), stopping any steps that are running. Returns false if the Task isn't a
+// pipeline or waiting for its dependencies.
+func stopPipelineRun(theTaskID string) bool {
+	run, runFound := pipelineRuns[theTaskID]
+	if !runFound {
+		return false
+	}
+	run.lock.Lock()
+	defer run.lock.Unlock()
+	run.stopped = true
+	// Steps that have already finished are simply skipped over by killProcessTree.
+	for _, stepCommand := range run.commands {
+		killProcessTree(stepCommand)
+	}
+	return true
+}
@@ -0,0 +1,113 @@
+package main
+// Plain HTML views - for browsers without JavaScript (minimal browsers, lynx, locked-down kiosks), /plain is a Task page that works with forms
+// and links alone. It shows the Task's title, description, status and output, with "Run" and "Stop" buttons (not shown for view-only tokens)
+// posting back to the same page, and while a run is in progress the page reloads itself every few seconds (with a meta refresh) to show new
+// output. The page is plain.html in the webroot, filled in with Go's html/template package. The view page (webconsole.html) sends browsers
+// without JavaScript here, and the landing page's forms work without JavaScript too (see landing.go), so the whole console can be used this way.
+
+import (
+	// Standard libraries.
+	"bytes"
+	"net/url"
+	"net/http"
+	"html/template"
+)
+
+// How many of the most recent lines of output the plain view shows, and how often (in seconds) it reloads while the Task is running.
+const plainViewLines = 500
+const plainViewRefresh = 3
+
+// A line of output in the plain view.
+type plainOutputLine struct {
+	Stream string
+	Line string
+}
+
+// What the plain view template is given to fill in.
+type plainViewPage struct {
+	TaskID string
+	Token string
+	Title string
+	Description template.HTML
+	PageURL string
+	Status string
+	Running bool
+	CanRun bool
+	Message string
+	Refresh int
+	SkippedLines int
+	Output []plainOutputLine
+}
+
+// Serve the plain view of the given Task. A POST with "action" set to "run" or "stop" runs or stops the Task first, unless the token given
+// is view-only.
+func servePlainView(theResponseWriter http.ResponseWriter, theRequest *http.Request, theTenant *tenant, theTaskID string, theTaskDetails map[string]string, theToken string, theTokenScope string) {
+	plainTemplate, templateErr := template.ParseFiles(getWebrootPath(theTenant, "plain.html"))
+	if templateErr != nil {
+		http.Error(theResponseWriter, "ERROR: Couldn't read plain.html - " + templateErr.Error(), http.StatusInternalServerError)
+		return
+	}
+	pageData := plainViewPage{TaskID: localTaskID(theTenant, theTaskID), Token: theToken, Title: theTaskDetails["title"],
+		Description: template.HTML(theTaskDetails["description"]), CanRun: theTokenScope != "view"}
+	pageData.PageURL = "plain?taskID=" + url.QueryEscape(pageData.TaskID) + "&token=" + url.QueryEscape(theToken)
+	// Actions are only taken from a form post, so reloading the page (or a link being prefetched) never runs anything.
+	if theRequest.Method == "POST" && pageData.CanRun {
+		switch theRequest.Form.Get("action") {
+			case "run":
+				if runNeedsApproval(theTaskDetails) && !taskIsRunning(theTaskID) {
+					requestRun(theTaskID, theToken, nil, getRequestTrigger(theRequest, theToken))
+					pageData.Message = "Run requested - it will start once approved."
+				} else if startErr := startTask(theTaskID, theTaskDetails, nil, getRequestTrigger(theRequest, theToken)); startErr != nil {
+					pageData.Message = "ERROR: " + startErr.Error()
+				}
+			case "stop":
+				if cancelPendingRun(theTaskID) {
+					pageData.Message = "Run request cancelled."
+				} else if cancelRetry(theTaskID) {
+					resetServiceState(theTaskID)
+					writeAuditLog(theTaskID, "Retry cancelled.")
+					pageData.Message = "Retry cancelled."
+				} else if stopErr := stopTask(theTaskID, "Task stopped by user."); stopErr != nil {
+					pageData.Message = "ERROR: " + stopErr.Error()
+				}
+		}
+	}
+	// As for getTaskOutput, a Task not running here has its output fetched from the server running it, or its last run's log.
+	_, runningHere := runningTasks[theTaskID]
+	runningElsewhere := false
+	if !runningHere {
+		sharedOutputFound := false
+		sharedOutputFound, runningElsewhere = loadSharedTaskOutput(theTaskID)
+		if !sharedOutputFound {
+			loadTaskOutput(theTaskID)
+		}
+	}
+	pageData.Running = runningHere || runningElsewhere || taskRunningInOldServer(theTaskID)
+	pageData.Status = "Not running."
+	if pageData.Running {
+		pageData.Status = "Running."
+	} else if getPendingRun(theTaskID) != "" {
+		pageData.Status = "Waiting for approval."
+	} else if retryPending(theTaskID) {
+		pageData.Status = "Waiting to retry."
+	}
+	if pageData.Status != "Not running." {
+		pageData.Refresh = plainViewRefresh
+	}
+	taskOutput := getTaskOutputLines(theTaskID, 0)
+	if len(taskOutput) > plainViewLines {
+		pageData.SkippedLines = len(taskOutput) - plainViewLines
+		taskOutput = taskOutput[pageData.SkippedLines:]
+	}
+	for _, outputLine := range taskOutput {
+		pageData.Output = append(pageData.Output, plainOutputLine{Stream: outputLine.stream, Line: outputLine.line})
+	}
+	var pageBuffer bytes.Buffer
+	if executeErr := plainTemplate.Execute(&pageBuffer, pageData); executeErr != nil {
+		http.Error(theResponseWriter, "ERROR: Couldn't fill in plain.html - " + executeErr.Error(), http.StatusInternalServerError)
+		return
+	}
+	theResponseWriter.Header().Set("Content-Type", "text/html; charset=utf-8")
+	theResponseWriter.Header().Set("Cache-Control", "no-store")
+	theResponseWriter.Write(pageBuffer.Bytes())
+}
@@ -0,0 +1,131 @@
+package main
+// Parameter presets - named sets of parameters ("staging", "production") for a Task, so users can pick one when running the Task instead of
+// giving every value each time. Presets are kept in the Task's config.txt, one per line, as "preset name: NAME=value, NAME=value", e.g.
+// preset staging: environment=staging, region=eu-west-1
+// preset production: environment=production, region=us-east-1
+// and are passed to the Task like any other parameters, as WEBCONSOLE_PARAM_ environment variables. A run picks a preset with api/runTask's
+// "preset" parameter, the web interface's preset list or "webconsole task run abc123 --preset staging". Presets can be listed and saved with
+// api/getPresets and api/admin/savePreset (saving needs admin rights, as a preset's values are written to config.txt), or "webconsole task
+// preset", as well as by editing config.txt - each change is recorded in the audit log.
+
+import (
+	// Standard libraries.
+	"sort"
+	"errors"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// Preset names are lowercase, as config.txt keys aren't case-sensitive. Parameter names become part of an environment variable's name.
+var presetNameRegexp = regexp.MustCompile("^[a-z0-9_-]{1,64}$")
+var parameterNameRegexp = regexp.MustCompile("^[A-Za-z0-9_]{1,64}$")
+
+// Parse a preset's parameters, given as "NAME=value, NAME=value". Line breaks and other control characters aren't allowed, as presets are
+// kept one per line in config.txt.
+func parsePresetValues(theValues string) (map[string]string, error) {
+	presetValues := map[string]string{}
+	if strings.IndexFunc(theValues, unicode.IsControl) != -1 {
+		return presetValues, errors.New("Invalid preset values - line breaks and other control characters aren't allowed.")
+	}
+	for _, presetValue := range strings.Split(theValues, ",") {
+		if strings.TrimSpace(presetValue) == "" {
+			continue
+		}
+		valueSplit := strings.SplitN(presetValue, "=", 2)
+		if len(valueSplit) < 2 || !parameterNameRegexp.MatchString(strings.TrimSpace(valueSplit[0])) {
+			return presetValues, errors.New("Invalid preset value \"" + strings.TrimSpace(presetValue) + "\" - should be \"NAME=value\".")
+		}
+		presetValues[strings.TrimSpace(valueSplit[0])] = strings.TrimSpace(valueSplit[1])
+	}
+	return presetValues, nil
+}
+
+// Returns the given preset parameters as "NAME=value, NAME=value", in order of name.
+func formatPresetValues(theValues map[string]string) string {
+	var parameterNames []string
+	for parameterName := range theValues {
+		parameterNames = append(parameterNames, parameterName)
+	}
+	sort.Strings(parameterNames)
+	var formattedValues []string
+	for _, parameterName := range parameterNames {
+		formattedValues = append(formattedValues, parameterName + "=" + theValues[parameterName])
+	}
+	return strings.Join(formattedValues, ", ")
+}
+
+// Returns the given Task's presets, by name. Presets that can't be parsed are left out - "webconsole --check" reports them (see checkTaskConfig).
+func getTaskPresets(theTaskDetails map[string]string) map[string]map[string]string {
+	taskPresets := map[string]map[string]string{}
+	for configKey, configValue := range theTaskDetails {
+		if !strings.HasPrefix(configKey, "preset ") {
+			continue
+		}
+		presetName := strings.TrimSpace(strings.TrimPrefix(configKey, "preset "))
+		if presetValues, parseErr := parsePresetValues(configValue); parseErr == nil && presetNameRegexp.MatchString(presetName) {
+			taskPresets[presetName] = presetValues
+		}
+	}
+	return taskPresets
+}
+
+// Returns the parameters for a run of the given Task using the given preset - none, if no preset is given.
+func getPresetParameters(theTaskDetails map[string]string, thePresetName string) (map[string]string, error) {
+	if thePresetName == "" {
+		return nil, nil
+	}
+	presetValues, presetFound := getTaskPresets(theTaskDetails)[strings.ToLower(thePresetName)]
+	if !presetFound {
+		return nil, errors.New("No such preset \"" + thePresetName + "\".")
+	}
+	return presetValues, nil
+}
+
+// Save the given preset for the given Task, or remove it if no values are given, recording the change (made as described by theSavedBy, e.g.
+// "from the command line") in the audit log.
+func savePreset(theTaskID string, thePresetName string, theValues string, theSavedBy string) error {
+	if strings.IndexFunc(thePresetName, unicode.IsControl) != -1 {
+		return errors.New("Invalid preset name - line breaks and other control characters aren't allowed.")
+	}
+	thePresetName = strings.ToLower(strings.TrimSpace(thePresetName))
+	if !presetNameRegexp.MatchString(thePresetName) {
+		return errors.New("Invalid preset name - use letters, numbers, dashes and underscores.")
+	}
+	presetValues, parseErr := parsePresetValues(theValues)
+	if parseErr != nil {
+		return parseErr
+	}
+	// A preset can't be saved with values its Task wouldn't be run with - see parameters.go.
+	taskDetails, taskErr := getTaskDetails(theTaskID)
+	if taskErr != nil {
+		return taskErr
+	}
+	if parametersErr := checkTaskParameters(taskDetails, presetValues); parametersErr != nil {
+		return parametersErr
+	}
+	if setErr := setTaskConfigValues(theTaskID, map[string]string{"preset " + thePresetName: formatPresetValues(presetValues)}); setErr != nil {
+		return setErr
+	}
+	if len(presetValues) == 0 {
+		writeAuditLog(theTaskID, "Preset " + thePresetName + " removed " + theSavedBy + ".")
+	} else {
+		writeAuditLog(theTaskID, "Preset " + thePresetName + " saved " + theSavedBy + ".")
+	}
+	return nil
+}
+
+// Returns the given Task's presets for listing, with the values of secret parameters (see redact.go) masked.
+func listTaskPresets(theTaskDetails map[string]string) map[string]map[string]string {
+	taskPresets := getTaskPresets(theTaskDetails)
+	for _, presetValues := range taskPresets {
+		for parameterName := range presetValues {
+			for _, secretParameterName := range strings.Split(theTaskDetails["secretparameters"], ",") {
+				if strings.EqualFold(strings.TrimSpace(secretParameterName), parameterName) {
+					presetValues[parameterName] = redactionMask
+				}
+			}
+		}
+	}
+	return taskPresets
+}
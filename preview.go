@@ -0,0 +1,73 @@
+package main
+// Run previews ("dry runs") - what a run of a Task would execute, without running anything: the command line (or, for a pipeline, each step's
+// command), the folder it runs in and the environment variables it's given, worked out in the same way as for a real run. Handy for checking
+// exactly what a destructive script is about to be handed before triggering it. Secrets are masked just as they are in a run's output (see
+// redact.go), and the values that are only known once a run starts - its run ID and callback token - are shown as placeholders.
+
+import (
+	// Standard libraries.
+	"fmt"
+	"errors"
+	"strings"
+)
+
+// Placeholders for the values that are only decided when a run starts.
+const previewRunID = "<run ID>"
+const previewCallbackToken = "<callback token>"
+
+// Returns the given command line as it would be typed (see parseCommandString), with any argument that contains spaces or quotes (or is blank)
+// quoted.
+func formatCommandLine(theCommandArray []string) string {
+	var formattedArguments []string
+	for _, commandArgument := range theCommandArray {
+		if commandArgument == "" || strings.ContainsAny(commandArgument, " \t\"'") {
+			commandArgument = "\"" + strings.Replace(commandArgument, "\"", "\\\"", -1) + "\""
+		}
+		formattedArguments = append(formattedArguments, commandArgument)
+	}
+	return strings.Join(formattedArguments, " ")
+}
+
+// Returns a description of what a run of the given Task, started with the given parameters, would execute.
+func previewTask(theTaskID string, theTaskDetails map[string]string, theParameters map[string]string) (string, error) {
+	pipelineSteps, stepsErr := getPipelineSteps(theTaskID)
+	if stepsErr != nil {
+		return "", stepsErr
+	}
+	commandArray, commandErr := getTaskCommand(theTaskID, theTaskDetails, theParameters)
+	if commandErr != nil {
+		return "", commandErr
+	}
+	if len(commandArray) == 0 && len(pipelineSteps) == 0 {
+		return "", errors.New("No command set for this Task.")
+	}
+	var preview []string
+	if len(pipelineSteps) > 0 {
+		for _, pipelineStep := range pipelineSteps {
+			stepCommand, _ := getCommandArray(pipelineStep.command, theTaskDetails)
+			stepCommand = addStrictArguments(stepCommand, theTaskDetails, "", theParameters)
+			preview = append(preview, fmt.Sprintf("Step %d %s: %s", pipelineStep.stage, pipelineStep.name, formatCommandLine(stepCommand)))
+		}
+	} else {
+		preview = append(preview, "Command: " + formatCommandLine(commandArray))
+	}
+	if theTaskDetails["runner"] != "" {
+		preview = append(preview, "Agent: " + theTaskDetails["runner"] + " (runs in the agent's own folder for this Task, with the agent's environment)")
+	} else {
+		preview = append(preview, "Folder: " + getTaskWorkDir(theTaskID, theTaskDetails))
+	}
+	for _, dependencyID := range getTaskDependencies(theTaskDetails) {
+		preview = append(preview, "Runs first: " + dependencyID)
+	}
+	if runNeedsApproval(theTaskDetails) {
+		preview = append(preview, "Needs approval before running.")
+	}
+	preview = append(preview, "Environment (as well as the server's own environment):")
+	for _, environmentVariable := range getTaskEnvironment(theTaskID, theTaskDetails, previewRunID, previewCallbackToken, theParameters) {
+		preview = append(preview, "  " + environmentVariable)
+	}
+	if len(pipelineSteps) > 0 {
+		preview = append(preview, "  WEBCONSOLE_STEP=<step name>")
+	}
+	return newRedactor(theTaskDetails, theParameters, "").Replace(strings.Join(preview, "\n")), nil
+}
@@ -0,0 +1,97 @@
+//go:build !windows
+// +build !windows
+
+package main
+// Process handling for Linux, MacOS and other Unix-like systems - running Tasks in their own process group so the whole process tree can be
+// killed, and reaping orphaned processes when we are running as PID 1 (for instance, in a container).
+
+import (
+	// Standard libraries.
+	"os"
+	"strings"
+	"strconv"
+	"syscall"
+	"os/exec"
+	"os/signal"
+	"io/ioutil"
+	"path/filepath"
+)
+
+// The signals that can be sent to a running Task with api/signalTask (see signals.go), by name without the "SIG" prefix.
+var platformSignals = map[string]syscall.Signal{"HUP": syscall.SIGHUP, "INT": syscall.SIGINT, "QUIT": syscall.SIGQUIT, "TERM": syscall.SIGTERM,
+	"KILL": syscall.SIGKILL, "USR1": syscall.SIGUSR1, "USR2": syscall.SIGUSR2, "ALRM": syscall.SIGALRM, "WINCH": syscall.SIGWINCH,
+	"CONT": syscall.SIGCONT, "STOP": syscall.SIGSTOP, "TSTP": syscall.SIGTSTP}
+
+// Returns the command line that runs the given command via the shell, for Tasks with the "shell" option set.
+func getShellCommand(theCommand string) []string {
+	return []string{"/bin/sh", "-c", theCommand}
+}
+
+// Unix-like systems can run any executable file directly, so commands need no changes.
+func getPlatformCommand(theCommandArray []string, theWorkDir string) []string {
+	return theCommandArray
+}
+
+// Returns a command ready to run the given command line.
+func newTaskCommand(theCommandArray []string) *exec.Cmd {
+	return exec.Command(theCommandArray[0], theCommandArray[1:]...)
+}
+
+// Start the Task's command in a new process group, so any child processes it starts (shell wrappers, etc) can be killed along with it.
+func setProcessGroup(theCommand *exec.Cmd) {
+	if theCommand.SysProcAttr == nil {
+		theCommand.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	theCommand.SysProcAttr.Setpgid = true
+}
+
+// A Task's process group is set up as it starts, nothing more to do here.
+func trackProcessTree(theCommand *exec.Cmd) {
+}
+
+// Kill a running Task's command along with every process in its process group.
+func killProcessTree(theCommand *exec.Cmd) error {
+	if theCommand.Process == nil {
+		return nil
+	}
+	// A negative PID signals the whole process group.
+	killErr := syscall.Kill(-theCommand.Process.Pid, syscall.SIGKILL)
+	if killErr != nil {
+		return theCommand.Process.Kill()
+	}
+	return nil
+}
+
+// When running as PID 1, orphaned processes (for instance, those left behind by a killed shell script) get re-parented to us, and it's our job to
+// reap them when they exit or they'll be left as zombies. We can't simply wait on any child, as that would steal the exit status of running Tasks,
+// so instead we look in /proc for zombie children that aren't running Tasks. Does nothing if we're not PID 1.
+func reapZombies() {
+	if os.Getpid() != 1 {
+		return
+	}
+	childSignals := make(chan os.Signal, 1)
+	signal.Notify(childSignals, syscall.SIGCHLD)
+	for range childSignals {
+		taskPIDs := map[int]bool{}
+		for _, runningTask := range runningTasks {
+			if runningTask.Process != nil {
+				taskPIDs[runningTask.Process.Pid] = true
+			}
+		}
+		statPaths, _ := filepath.Glob("/proc/[0-9]*/stat")
+		for _, statPath := range statPaths {
+			statContents, statErr := ioutil.ReadFile(statPath)
+			if statErr == nil {
+				// The stat file's format is "pid (command) state ppid ...", and the command can contain spaces, so split after the last bracket.
+				statFields := strings.Fields(string(statContents)[strings.LastIndex(string(statContents), ")")+1:])
+				if len(statFields) > 1 && statFields[0] == "Z" && statFields[1] == "1" {
+					var waitStatus syscall.WaitStatus
+					zombiePID, atoiErr := strconv.Atoi(strings.Fields(string(statContents))[0])
+					if atoiErr == nil && !taskPIDs[zombiePID] {
+						syscall.Wait4(zombiePID, &waitStatus, syscall.WNOHANG, nil)
+					}
+				}
+			}
+		}
+	}
+}
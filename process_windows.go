@@ -0,0 +1,147 @@
+//go:build windows
+// +build windows
+
+package main
+// Process handling for Windows - running batch files and PowerShell scripts with the right interpreter, keeping Tasks' console windows hidden,
+// and killing a Task's whole process tree. Windows doesn't have Unix-style process groups, so each Task's process is put in a job object
+// instead: every process it starts joins the same job, and the job can be killed as a whole, even if the processes in between have exited.
+
+import (
+	// Standard libraries.
+	"sync"
+	"strconv"
+	"strings"
+	"syscall"
+	"os/exec"
+	"path/filepath"
+)
+
+// Windows process creation flags and access rights not defined by the syscall package.
+const createNoWindow = 0x08000000
+const processSetQuota = 0x0100
+
+// The job object functions, from kernel32.dll (not wrapped by the syscall package).
+var kernel32DLL = syscall.NewLazyDLL("kernel32.dll")
+var createJobObjectProc = kernel32DLL.NewProc("CreateJobObjectW")
+var assignProcessToJobObjectProc = kernel32DLL.NewProc("AssignProcessToJobObject")
+var terminateJobObjectProc = kernel32DLL.NewProc("TerminateJobObject")
+
+// The job object for each running Task process, by process ID.
+var processJobs = map[int]syscall.Handle{}
+var processJobsLock sync.Mutex
+
+// Windows processes don't have signals - stopping a Task is done with its job object instead - so api/signalTask (see signals.go) has none
+// to send.
+var platformSignals = map[string]syscall.Signal{}
+
+// Returns the command line that runs the given command via the shell, for Tasks with the "shell" option set. "/S" has cmd remove just the
+// outer quotes newTaskCommand adds, leaving any others in the command alone.
+func getShellCommand(theCommand string) []string {
+	return []string{"cmd", "/S", "/C", theCommand}
+}
+
+// Returns the given command line ready to run on Windows: forward slashes in the command's path are turned round, a command in the working
+// folder is found without needing ".\" (as cmd does), and batch files and PowerShell scripts are run by their interpreter - Windows can't run
+// them directly.
+func getPlatformCommand(theCommandArray []string, theWorkDir string) []string {
+	if len(theCommandArray) == 0 {
+		return theCommandArray
+	}
+	commandPath := filepath.FromSlash(theCommandArray[0])
+	if !strings.ContainsAny(commandPath, "\\:") {
+		if localPath, lookErr := exec.LookPath(filepath.Join(theWorkDir, commandPath)); lookErr == nil {
+			if absolutePath, absErr := filepath.Abs(localPath); absErr == nil {
+				commandPath = absolutePath
+			}
+		}
+	}
+	commandArray := append([]string{commandPath}, theCommandArray[1:]...)
+	switch strings.ToLower(filepath.Ext(commandPath)) {
+	case ".bat", ".cmd":
+		var quotedArguments []string
+		for _, commandArgument := range commandArray {
+			quotedArguments = append(quotedArguments, syscall.EscapeArg(commandArgument))
+		}
+		return getShellCommand(strings.Join(quotedArguments, " "))
+	case ".ps1":
+		return append([]string{"powershell.exe", "-NoProfile", "-NonInteractive", "-ExecutionPolicy", "Bypass", "-File", commandPath}, commandArray[1:]...)
+	}
+	return commandArray
+}
+
+// Returns a command ready to run the given command line. cmd.exe doesn't follow the usual rules for quoting arguments, so a shell command is
+// handed over exactly as written rather than quoted by Go.
+func newTaskCommand(theCommandArray []string) *exec.Cmd {
+	newCommand := exec.Command(theCommandArray[0], theCommandArray[1:]...)
+	if len(theCommandArray) == 4 && strings.EqualFold(theCommandArray[0], "cmd") && theCommandArray[1] == "/S" && theCommandArray[2] == "/C" {
+		newCommand.SysProcAttr = &syscall.SysProcAttr{CmdLine: "cmd /S /C \"" + theCommandArray[3] + "\""}
+	}
+	return newCommand
+}
+
+// Start the Task's command without a console window - otherwise, when running as a desktop application, every Task pops up a window.
+func setProcessGroup(theCommand *exec.Cmd) {
+	if theCommand.SysProcAttr == nil {
+		theCommand.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	theCommand.SysProcAttr.HideWindow = true
+	theCommand.SysProcAttr.CreationFlags = theCommand.SysProcAttr.CreationFlags | createNoWindow
+}
+
+// Put a newly-started Task's process in a job object of its own, so it can be killed along with everything it starts. The job is closed once
+// the process exits. If the job can't be set up, killProcessTree falls back to taskkill.
+func trackProcessTree(theCommand *exec.Cmd) {
+	processID := theCommand.Process.Pid
+	jobHandle, _, _ := createJobObjectProc.Call(0, 0)
+	if jobHandle == 0 {
+		return
+	}
+	processHandle, openErr := syscall.OpenProcess(processSetQuota|syscall.PROCESS_TERMINATE|syscall.SYNCHRONIZE, false, uint32(processID))
+	if openErr != nil {
+		syscall.CloseHandle(syscall.Handle(jobHandle))
+		return
+	}
+	if assigned, _, _ := assignProcessToJobObjectProc.Call(jobHandle, uintptr(processHandle)); assigned == 0 {
+		syscall.CloseHandle(processHandle)
+		syscall.CloseHandle(syscall.Handle(jobHandle))
+		return
+	}
+	processJobsLock.Lock()
+	processJobs[processID] = syscall.Handle(jobHandle)
+	processJobsLock.Unlock()
+	go func() {
+		syscall.WaitForSingleObject(processHandle, syscall.INFINITE)
+		processJobsLock.Lock()
+		delete(processJobs, processID)
+		processJobsLock.Unlock()
+		syscall.CloseHandle(processHandle)
+		syscall.CloseHandle(syscall.Handle(jobHandle))
+	}()
+}
+
+// Kill a running Task's command along with any child processes it started - via its job object if it has one, otherwise with taskkill's /T
+// option.
+func killProcessTree(theCommand *exec.Cmd) error {
+	if theCommand.Process == nil {
+		return nil
+	}
+	// Hold the lock while killing the job, so it can't be closed part-way through.
+	processJobsLock.Lock()
+	jobTerminated := uintptr(0)
+	if jobHandle, jobFound := processJobs[theCommand.Process.Pid]; jobFound {
+		jobTerminated, _, _ = terminateJobObjectProc.Call(uintptr(jobHandle), 1)
+	}
+	processJobsLock.Unlock()
+	if jobTerminated != 0 {
+		return nil
+	}
+	killErr := exec.Command("taskkill", "/T", "/F", "/PID", strconv.Itoa(theCommand.Process.Pid)).Run()
+	if killErr != nil {
+		return theCommand.Process.Kill()
+	}
+	return nil
+}
+
+// Zombie processes are a Unix thing, nothing to do here.
+func reapZombies() {
+}
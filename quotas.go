@@ -0,0 +1,223 @@
+package main
+// Run quotas - limits on how many times a Task can be run in a given time, to keep expensive Tasks (cloud jobs, scripts sending SMS messages)
+// under control. Unlike the "ratelimit" option, which just makes a Task wait a while after each run, a quota is a budget: "quota: 20 per day"
+// lets the Task be run twenty times in any 24 hours, however close together. "userquota: 5 per day" sets a budget for each user as well - as
+// web-console doesn't have user accounts, a user is the client IP address a run was asked for from (see triggers.go), and runs not asked for by
+// a client (chained Tasks, retries, schedules) only count towards the Task's own quota. Periods can be "hour", "day" or "week". Runs are
+// counted from the Task's run history, so quotas carry on across restarts (and between servers sharing a run store) - runs still within a
+// quota's period are kept however the Task's run retention is set (see retention.go). A run that would go over
+// a quota isn't started, with an error saying how many runs the quota allows and when the next one can start. An admin can let a Task go over
+// its quotas with "webconsole task quota abc123 --grant 3" or api/admin/grantQuota - the granted runs are kept in the Task's config.txt as
+// "quotagrant", and used up by runs that would otherwise have been refused.
+
+import (
+	// Standard libraries.
+	"fmt"
+	"time"
+	"errors"
+	"strconv"
+	"strings"
+	"net/http"
+)
+
+// How long each quota period is.
+var quotaPeriods = map[string]time.Duration{"hour": time.Hour, "day": 24 * time.Hour, "week": 7 * 24 * time.Hour}
+
+// A quota, e.g. 20 runs per day.
+type runQuota struct {
+	runs int
+	period string
+}
+
+// A run refused for going over a quota, with how long until the next run will be allowed.
+type quotaExceededError struct {
+	message string
+	retryAfter time.Duration
+}
+
+// Returns the quota that was exceeded, and when the next run can start.
+func (theErr quotaExceededError) Error() string {
+	return theErr.message
+}
+
+// Parse a quota, given as "20 per day" (or "20/day"). A blank quota is no quota, returned with no runs.
+func parseRunQuota(theQuota string) (runQuota, error) {
+	if strings.TrimSpace(theQuota) == "" {
+		return runQuota{}, nil
+	}
+	quotaFields := strings.Fields(strings.Replace(strings.ToLower(theQuota), "/", " per ", 1))
+	if len(quotaFields) != 3 || quotaFields[1] != "per" {
+		return runQuota{}, errors.New("Invalid quota \"" + theQuota + "\" - should be \"20 per day\".")
+	}
+	quotaRuns, runsErr := strconv.Atoi(quotaFields[0])
+	if runsErr != nil || quotaRuns < 1 {
+		return runQuota{}, errors.New("Invalid quota \"" + theQuota + "\" - the number of runs should be at least 1.")
+	}
+	quotaPeriod := strings.TrimSuffix(quotaFields[2], "s")
+	if _, periodFound := quotaPeriods[quotaPeriod]; !periodFound {
+		return runQuota{}, errors.New("Invalid quota \"" + theQuota + "\" - the period should be hour, day or week.")
+	}
+	return runQuota{quotaRuns, quotaPeriod}, nil
+}
+
+// Returns the start times of the given Task's runs since the given time, asked for from the given client IP address (any client, if blank),
+// oldest first.
+func getRunsSince(theTaskID string, theSince time.Time, theClientIP string) ([]time.Time, error) {
+	runIDs, listErr := runStore.ListRunIDs(theTaskID)
+	if listErr != nil {
+		return nil, listErr
+	}
+	var runTimes []time.Time
+	for _, runID := range runIDs {
+		runTime, parseErr := time.ParseInLocation(runIDFormat, runID, time.Local)
+		if parseErr != nil || runTime.Before(theSince) {
+			continue
+		}
+		if theClientIP != "" {
+			if savedTrigger, _ := getRunTrigger(theTaskID, runID); savedTrigger.ClientIP != theClientIP {
+				continue
+			}
+		}
+		runTimes = append(runTimes, runTime)
+	}
+	return runTimes, nil
+}
+
+// Returns how far back the given Task's quotas count runs - the longest of their periods, or 0 if the Task has no quotas. Runs in that time
+// aren't removed by pruning (see retention.go), as that would let the Task go over its quotas.
+func getQuotaWindow(theTaskDetails map[string]string) time.Duration {
+	var quotaWindow time.Duration
+	for _, quotaSetting := range []string{"quota", "userquota"} {
+		if quota, quotaErr := parseRunQuota(theTaskDetails[quotaSetting]); quotaErr == nil && quota.runs > 0 && quotaPeriods[quota.period] > quotaWindow {
+			quotaWindow = quotaPeriods[quota.period]
+		}
+	}
+	return quotaWindow
+}
+
+// Check the given quota (the Task's own if no client IP address is given, otherwise the quota for runs asked for from that address) would
+// allow another run of the given Task.
+func checkQuota(theTaskID string, theQuota runQuota, theClientIP string) error {
+	if theQuota.runs == 0 {
+		return nil
+	}
+	currentTime := time.Now()
+	runTimes, runsErr := getRunsSince(theTaskID, currentTime.Add(-quotaPeriods[theQuota.period]), theClientIP)
+	if runsErr != nil {
+		return runsErr
+	}
+	if len(runTimes) < theQuota.runs {
+		return nil
+	}
+	// The next run can start once enough of the counted runs are more than a period old.
+	retryAfter := runTimes[len(runTimes)-theQuota.runs].Add(quotaPeriods[theQuota.period]).Sub(currentTime).Round(time.Second)
+	quotaDescription := fmt.Sprintf("this Task can be run %d times per %s", theQuota.runs, theQuota.period)
+	if theClientIP != "" {
+		quotaDescription = fmt.Sprintf("each user can run this Task %d times per %s", theQuota.runs, theQuota.period)
+	}
+	return quotaExceededError{fmt.Sprintf("Quota exceeded - %s. Try again in %s.", quotaDescription, retryAfter), retryAfter}
+}
+
+// Check another run of the given Task, started by the given trigger, is within the Task's quotas (and runtime budget - see budgets.go). A run
+// that isn't is allowed if an admin has granted runs past the quotas and there are any left - if theUseGrant is set, it uses one of them up.
+func checkRunQuotas(theTaskID string, theTaskDetails map[string]string, theTrigger runTrigger, theUseGrant bool) error {
+	taskQuota, quotaErr := parseRunQuota(theTaskDetails["quota"])
+	if quotaErr != nil {
+		return quotaErr
+	}
+	userQuota, quotaErr := parseRunQuota(theTaskDetails["userquota"])
+	if quotaErr != nil {
+		return quotaErr
+	}
+	quotaErr = checkQuota(theTaskID, taskQuota, "")
+	if quotaErr == nil && theTrigger.ClientIP != "" {
+		quotaErr = checkQuota(theTaskID, userQuota, theTrigger.ClientIP)
+	}
+	if quotaErr == nil {
+		quotaErr = checkRuntimeBudget(theTaskID, theTaskDetails)
+	}
+	if _, isExceeded := quotaErr.(quotaExceededError); isExceeded {
+		if grantedRuns, _ := strconv.Atoi(theTaskDetails["quotagrant"]); grantedRuns > 0 {
+			if !theUseGrant {
+				return nil
+			}
+			remainingGrant := ""
+			if grantedRuns > 1 {
+				remainingGrant = strconv.Itoa(grantedRuns - 1)
+			}
+			if setErr := setTaskConfigValues(theTaskID, map[string]string{"quotagrant": remainingGrant}); setErr != nil {
+				return setErr
+			}
+			theTaskDetails["quotagrant"] = remainingGrant
+			writeAuditLog(theTaskID, "Run allowed past the quota by a granted run, " + strconv.Itoa(grantedRuns - 1) + " left.")
+			return nil
+		}
+	}
+	return quotaErr
+}
+
+// Let the given Task be run the given number of times more than its quotas allow, recording the grant (made as described by theGrantedBy,
+// e.g. "via the admin API") in the audit log. Returns the number of granted runs the Task now has.
+func grantQuota(theTaskID string, theRuns string, theGrantedBy string) (int, error) {
+	grantRuns, runsErr := strconv.Atoi(theRuns)
+	if runsErr != nil || grantRuns < 1 {
+		return 0, errors.New("Invalid number of runs \"" + theRuns + "\" - should be at least 1.")
+	}
+	taskDetails, taskErr := getTaskDetails(theTaskID)
+	if taskErr != nil {
+		return 0, taskErr
+	}
+	grantedRuns, _ := strconv.Atoi(taskDetails["quotagrant"])
+	grantedRuns = grantedRuns + grantRuns
+	if setErr := setTaskConfigValues(theTaskID, map[string]string{"quotagrant": strconv.Itoa(grantedRuns)}); setErr != nil {
+		return 0, setErr
+	}
+	writeAuditLog(theTaskID, fmt.Sprintf("%d runs past the quota granted %s, %d in all.", grantRuns, theGrantedBy, grantedRuns))
+	return grantedRuns, nil
+}
+
+// Returns a description of how much of the given Task's quotas has been used, one line per quota, e.g. "quota: 12 of 20 runs in the last day".
+func describeQuotaUsage(theTaskID string, theTaskDetails map[string]string) ([]string, error) {
+	var usageLines []string
+	for _, quotaName := range []string{"quota", "userquota"} {
+		taskQuota, quotaErr := parseRunQuota(theTaskDetails[quotaName])
+		if quotaErr != nil {
+			return usageLines, quotaErr
+		}
+		if taskQuota.runs == 0 {
+			continue
+		}
+		if quotaName == "userquota" {
+			usageLines = append(usageLines, fmt.Sprintf("userquota: %d runs per %s for each client IP address", taskQuota.runs, taskQuota.period))
+			continue
+		}
+		runTimes, runsErr := getRunsSince(theTaskID, time.Now().Add(-quotaPeriods[taskQuota.period]), "")
+		if runsErr != nil {
+			return usageLines, runsErr
+		}
+		usageLines = append(usageLines, fmt.Sprintf("quota: %d of %d runs in the last %s", len(runTimes), taskQuota.runs, taskQuota.period))
+	}
+	if budgetUsage, budgetErr := describeBudgetUsage(theTaskID, theTaskDetails); budgetErr != nil {
+		return usageLines, budgetErr
+	} else if budgetUsage != "" {
+		usageLines = append(usageLines, budgetUsage)
+	}
+	if len(usageLines) == 0 {
+		usageLines = append(usageLines, "No quota or budget set.")
+	}
+	if grantedRuns, _ := strconv.Atoi(theTaskDetails["quotagrant"]); grantedRuns > 0 {
+		usageLines = append(usageLines, fmt.Sprintf("quotagrant: %d runs past the quota granted", grantedRuns))
+	}
+	return usageLines, nil
+}
+
+// Write an error response for the given error from starting a run: for a run over its quota, a "429 Too Many Requests" status with a
+// "Retry-After" header, otherwise a plain error.
+func writeStartError(theResponseWriter http.ResponseWriter, theErr error) {
+	if quotaErr, isExceeded := theErr.(quotaExceededError); isExceeded {
+		theResponseWriter.Header().Set("Retry-After", strconv.Itoa(int(quotaErr.retryAfter.Seconds()) + 1))
+		writeErrorResponse(theResponseWriter, http.StatusTooManyRequests, errorCodeQuotaExceeded, quotaErr.Error())
+	} else {
+		fmt.Fprintf(theResponseWriter, "ERROR: %s", theErr.Error())
+	}
+}
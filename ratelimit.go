@@ -0,0 +1,123 @@
+package main
+// Per-client rate limiting - a token bucket for each client IP address, applied to the endpoints that check credentials or start Tasks, so a
+// single client can't hammer the server guessing secrets or starting Tasks. Every other call that checks a credential is covered by counting
+// failed attempts: each request refused as not authorised (see writeNotAuthorised) takes a token from a second bucket for the client, and while
+// that bucket is empty the client's requests are refused without checking anything, so secrets can't be guessed through any API call. Requests
+// that succeed don't count, so clients polling for output aren't held up. This is separate from a Task's own "ratelimit" option, which limits
+// how often that Task runs regardless of who asks.
+
+import (
+	// Standard libraries.
+	"sync"
+	"time"
+	"strconv"
+	"strings"
+)
+
+// A token bucket for one client: how many requests the client can still make right now, and when we last topped the bucket up.
+type clientBucket struct {
+	tokens float64
+	lastUpdate time.Time
+}
+
+// Each client's bucket for rate-limited requests, and for failed authentication attempts, guarded by clientBucketsLock as requests are handled
+// concurrently.
+var clientBuckets = map[string]*clientBucket{}
+var authFailureBuckets = map[string]*clientBucket{}
+var clientBucketsLock sync.Mutex
+
+// The paths that are rate limited - anything that checks a secret or token for the first time, or starts a Task.
+var rateLimitedPaths = []string{"/view", "/run", "/api/getToken", "/api/runTask", "/api/admin/", "/api/passkeyLogin", "/api/agent/register", "/hooks/"}
+
+// Returns true if the given request path is rate limited.
+func isRateLimitedPath(theRequestPath string) bool {
+	for _, rateLimitedPath := range rateLimitedPaths {
+		if strings.HasPrefix(theRequestPath, rateLimitedPath) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the per-client rate limit settings: the number of requests allowed per minute ("clientratelimit", default 60, 0 to turn rate
+// limiting off) and the number that can be made in a quick burst ("clientrateburst", default 20).
+func getClientRateLimits() (float64, float64) {
+	requestsPerMinute, rateErr := strconv.ParseFloat(arguments["clientratelimit"], 64)
+	if rateErr != nil {
+		requestsPerMinute = 60
+	}
+	burstSize, burstErr := strconv.ParseFloat(arguments["clientrateburst"], 64)
+	if burstErr != nil || burstSize < 1 {
+		burstSize = 20
+	}
+	return requestsPerMinute, burstSize
+}
+
+// Take a token from the given client's bucket. Returns 0 if the request is allowed, otherwise the number of seconds until the client can try
+// again.
+func takeClientToken(theClientIP string) int {
+	requestsPerMinute, burstSize := getClientRateLimits()
+	if requestsPerMinute <= 0 {
+		return 0
+	}
+	// If we're sharing state with other servers via Redis, use the client's bucket there so the limit applies across all servers.
+	if retryAfter, sharedBucket := takeSharedClientToken(theClientIP, requestsPerMinute, burstSize); sharedBucket {
+		return retryAfter
+	}
+	return takeBucketToken(clientBuckets, theClientIP, requestsPerMinute, burstSize, true)
+}
+
+// Top up the given client's bucket in the given set of buckets, then take a token from it if theTake is set. Returns 0 if the bucket had a
+// token, otherwise the number of seconds until it will have.
+func takeBucketToken(theBuckets map[string]*clientBucket, theClientIP string, theRequestsPerMinute float64, theBurstSize float64, theTake bool) int {
+	clientBucketsLock.Lock()
+	defer clientBucketsLock.Unlock()
+	currentTime := time.Now()
+	bucket, bucketFound := theBuckets[theClientIP]
+	if !bucketFound {
+		bucket = &clientBucket{theBurstSize, currentTime}
+		theBuckets[theClientIP] = bucket
+	}
+	bucket.tokens = bucket.tokens + (currentTime.Sub(bucket.lastUpdate).Minutes() * theRequestsPerMinute)
+	if bucket.tokens > theBurstSize {
+		bucket.tokens = theBurstSize
+	}
+	bucket.lastUpdate = currentTime
+	if bucket.tokens < 1 {
+		return int(((1 - bucket.tokens) / theRequestsPerMinute) * 60) + 1
+	}
+	if theTake {
+		bucket.tokens = bucket.tokens - 1
+	}
+	return 0
+}
+
+// Count a failed authentication attempt from the given client.
+func recordAuthFailure(theClientIP string) {
+	if requestsPerMinute, burstSize := getClientRateLimits(); requestsPerMinute > 0 {
+		takeBucketToken(authFailureBuckets, theClientIP, requestsPerMinute, burstSize, true)
+	}
+}
+
+// Returns 0 if the given client can make requests that check credentials, otherwise (if it has failed to authenticate too often) the number of
+// seconds until it can try again.
+func checkAuthFailures(theClientIP string) int {
+	requestsPerMinute, burstSize := getClientRateLimits()
+	if requestsPerMinute <= 0 {
+		return 0
+	}
+	return takeBucketToken(authFailureBuckets, theClientIP, requestsPerMinute, burstSize, false)
+}
+
+// Forget about clients we haven't heard from for a while - their buckets will have filled back up anyway.
+func clearIdleClientBuckets() {
+	clientBucketsLock.Lock()
+	defer clientBucketsLock.Unlock()
+	for _, buckets := range []map[string]*clientBucket{clientBuckets, authFailureBuckets} {
+		for clientIP, bucket := range buckets {
+			if time.Since(bucket.lastUpdate) > tokenTimeout * time.Second {
+				delete(buckets, clientIP)
+			}
+		}
+	}
+}
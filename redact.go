@@ -0,0 +1,61 @@
+package main
+// Secret redaction - masks secret values wherever they would otherwise show up in a Task's output: the output buffer (and so the API and web
+// interface), log files, run history, notifications and the audit log. The values masked for a run are:
+// - Any secret-looking setting (anything with "secret", "token" or "password" in its name, see isSecretKeyword) in the Task's config or the
+//   server's config - e.g. "hookToken", "smtpPassword".
+// - The values of any parameters the Task was started with that are named in the Task's "secretParameters" option.
+// - The values of any environment variables named in the Task's, or the server's, "redactEnvironment" option.
+// - The run's callback token.
+
+import (
+	// Standard libraries.
+	"os"
+	"sort"
+	"strings"
+)
+
+// What secret values are replaced with.
+const redactionMask = "********"
+
+// The shortest value that will be masked - masking very short values (a "Y", say) would mangle ordinary output.
+const minimumRedactedLength = 4
+
+// Returns a Replacer that masks all the secret values for the given run of the given Task.
+func newRedactor(theTaskDetails map[string]string, theParameters map[string]string, theCallbackToken string) *strings.Replacer {
+	redactedValues := map[string]bool{theCallbackToken: true}
+	for _, settings := range []map[string]string{arguments, theTaskDetails} {
+		for settingName, settingValue := range settings {
+			if isSecretKeyword(settingName) {
+				redactedValues[settingValue] = true
+			}
+		}
+	}
+	// Parameter names aren't case-sensitive (they're passed to the Task in capitals).
+	for _, secretParameterName := range strings.Split(theTaskDetails["secretparameters"], ",") {
+		for parameterName, parameterValue := range theParameters {
+			if strings.EqualFold(strings.TrimSpace(secretParameterName), parameterName) {
+				redactedValues[parameterValue] = true
+			}
+		}
+	}
+	for _, variableNames := range []string{arguments["redactenvironment"], theTaskDetails["redactenvironment"]} {
+		for _, variableName := range strings.Split(variableNames, ",") {
+			if variableName = strings.TrimSpace(variableName); variableName != "" {
+				redactedValues[os.Getenv(variableName)] = true
+			}
+		}
+	}
+	// Longer values go first, so a secret that contains another secret is masked as a whole.
+	var sortedValues []string
+	for redactedValue := range redactedValues {
+		if len(redactedValue) >= minimumRedactedLength {
+			sortedValues = append(sortedValues, redactedValue)
+		}
+	}
+	sort.Slice(sortedValues, func(i, j int) bool { return len(sortedValues[i]) > len(sortedValues[j]) })
+	var replacements []string
+	for _, redactedValue := range sortedValues {
+		replacements = append(replacements, redactedValue, redactionMask)
+	}
+	return strings.NewReplacer(replacements...)
+}
@@ -0,0 +1,380 @@
+package main
+// Shared state in Redis, for running several Web Console servers behind a load balancer. With a "redis" URL set in the config file, tokens,
+// client rate limit counters and the state and output of running Tasks are kept in Redis as well as in memory, so any server can accept a token
+// issued by another, rate limits apply across all servers, and a client polling for a Task's output can be sent to any server, not just the
+// one running the Task. Only the handful of Redis commands we need are implemented, so there's no extra library to install.
+
+import (
+	// Standard libraries.
+	"io"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+	"bufio"
+	"errors"
+	"strconv"
+	"strings"
+	"net/url"
+	"crypto/tls"
+	"encoding/json"
+)
+
+// How long (in seconds) a running Task's entry in Redis lasts without being refreshed - if the server running it goes away, other servers will
+// stop treating it as running after this long.
+const sharedRunTimeout = 60
+
+// The most lines of a run's output kept in Redis for a Task without output limits (see outputlimits.go) - only the latest are kept.
+const sharedOutputMaxLines = 10000
+
+// A connection to a Redis server. Commands are sent one at a time over a single connection, reconnecting if the connection is lost.
+type redisClient struct {
+	address string
+	useTLS bool
+	password string
+	database string
+	lock sync.Mutex
+	connection net.Conn
+	reader *bufio.Reader
+}
+
+// The Redis server, if one is configured - nil otherwise.
+var sharedRedis *redisClient
+
+// The prefix added to all our keys in Redis, so one Redis server can be shared with other applications.
+var sharedKeyPrefix = "webconsole:"
+
+// Connect to the Redis server, selecting the right database and authenticating if needed.
+func (theClient *redisClient) connect() error {
+	var dialErr error
+	if theClient.useTLS {
+		theClient.connection, dialErr = tls.DialWithDialer(&net.Dialer{Timeout: 5 * time.Second}, "tcp", theClient.address, &tls.Config{ServerName: strings.Split(theClient.address, ":")[0]})
+	} else {
+		theClient.connection, dialErr = net.DialTimeout("tcp", theClient.address, 5 * time.Second)
+	}
+	if dialErr != nil {
+		return dialErr
+	}
+	theClient.reader = bufio.NewReader(theClient.connection)
+	if theClient.password != "" {
+		if _, authErr := theClient.send("AUTH", theClient.password); authErr != nil {
+			theClient.connection.Close()
+			theClient.connection = nil
+			return authErr
+		}
+	}
+	if theClient.database != "" {
+		if _, selectErr := theClient.send("SELECT", theClient.database); selectErr != nil {
+			theClient.connection.Close()
+			theClient.connection = nil
+			return selectErr
+		}
+	}
+	return nil
+}
+
+// Send a command on the current connection and read the reply.
+func (theClient *redisClient) send(theArguments ...string) (interface{}, error) {
+	var redisCommand strings.Builder
+	fmt.Fprintf(&redisCommand, "*%d\r\n", len(theArguments))
+	for _, commandArgument := range theArguments {
+		fmt.Fprintf(&redisCommand, "$%d\r\n%s\r\n", len(commandArgument), commandArgument)
+	}
+	theClient.connection.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, writeErr := theClient.connection.Write([]byte(redisCommand.String())); writeErr != nil {
+		return nil, writeErr
+	}
+	return theClient.readReply()
+}
+
+// Read a reply from Redis - a string, integer, array (of replies) or nil.
+func (theClient *redisClient) readReply() (interface{}, error) {
+	replyLine, readErr := theClient.reader.ReadString('\n')
+	if readErr != nil {
+		return nil, readErr
+	}
+	replyLine = strings.TrimRight(replyLine, "\r\n")
+	if replyLine == "" {
+		return nil, errors.New("empty reply from Redis")
+	}
+	switch replyLine[0] {
+		case '+':
+			return replyLine[1:], nil
+		case '-':
+			return nil, errors.New("Redis error: " + replyLine[1:])
+		case ':':
+			return strconv.ParseInt(replyLine[1:], 10, 64)
+		case '$':
+			replyLength, _ := strconv.Atoi(replyLine[1:])
+			if replyLength < 0 {
+				return nil, nil
+			}
+			replyBytes := make([]byte, replyLength + 2)
+			if _, readErr := io.ReadFull(theClient.reader, replyBytes); readErr != nil {
+				return nil, readErr
+			}
+			return string(replyBytes[:replyLength]), nil
+		case '*':
+			replyCount, _ := strconv.Atoi(replyLine[1:])
+			if replyCount < 0 {
+				return nil, nil
+			}
+			replyArray := make([]interface{}, replyCount)
+			for pl := 0; pl < replyCount; pl = pl + 1 {
+				var itemErr error
+				if replyArray[pl], itemErr = theClient.readReply(); itemErr != nil && !strings.HasPrefix(itemErr.Error(), "Redis error") {
+					return nil, itemErr
+				}
+			}
+			return replyArray, nil
+	}
+	return nil, errors.New("unexpected reply from Redis")
+}
+
+// Run a Redis command, (re)connecting first if needed. If the connection fails part-way through, the command is tried once more on a new
+// connection.
+func (theClient *redisClient) do(theArguments ...string) (interface{}, error) {
+	theClient.lock.Lock()
+	defer theClient.lock.Unlock()
+	for attempt := 0; attempt < 2; attempt = attempt + 1 {
+		if theClient.connection == nil {
+			if connectErr := theClient.connect(); connectErr != nil {
+				return nil, connectErr
+			}
+		}
+		redisReply, redisErr := theClient.send(theArguments...)
+		if redisErr == nil || strings.HasPrefix(redisErr.Error(), "Redis error") {
+			return redisReply, redisErr
+		}
+		theClient.connection.Close()
+		theClient.connection = nil
+	}
+	return nil, errors.New("lost connection to Redis")
+}
+
+// Connect to the Redis server given by the "redis" option (e.g. "redis://:password@redis.example.com:6379/0", or "rediss://" for TLS), if set.
+func openSharedState() error {
+	if arguments["redis"] == "" {
+		return nil
+	}
+	redisURL, parseErr := url.Parse(arguments["redis"])
+	if parseErr != nil || (redisURL.Scheme != "redis" && redisURL.Scheme != "rediss") || redisURL.Hostname() == "" {
+		return errors.New("Invalid Redis URL \"" + arguments["redis"] + "\" - should be \"redis://host:port/database\".")
+	}
+	redisAddress := redisURL.Host
+	if redisURL.Port() == "" {
+		redisAddress = net.JoinHostPort(redisURL.Hostname(), "6379")
+	}
+	redisPassword, _ := redisURL.User.Password()
+	sharedRedis = &redisClient{address: redisAddress, useTLS: redisURL.Scheme == "rediss", password: redisPassword, database: strings.Trim(redisURL.Path, "/")}
+	if arguments["redisprefix"] != "" {
+		sharedKeyPrefix = arguments["redisprefix"]
+	}
+	if _, pingErr := sharedRedis.do("PING"); pingErr != nil {
+		sharedRedis = nil
+		return errors.New("Can't connect to Redis - " + pingErr.Error())
+	}
+	return nil
+}
+
+// Save a token in Redis, expiring when it would expire in memory.
+func saveSharedToken(theToken savedToken) {
+	if sharedRedis != nil {
+		tokenValue := theToken.kind + "\t" + theToken.name + "\t" + theToken.taskID + "\t" + strconv.FormatInt(theToken.issued, 10) + "\t" + theToken.clientIP
+		sharedRedis.do("SET", sharedKeyPrefix + "token:" + theToken.token, tokenValue, "EX", strconv.Itoa(tokenTimeout))
+	}
+}
+
+// Remove a token from Redis, so no other server picks it up.
+func deleteSharedToken(theToken string) {
+	if sharedRedis != nil {
+		sharedRedis.do("DEL", sharedKeyPrefix + "token:" + theToken)
+	}
+}
+
+// If the given token of the given kind isn't known to this server, see if another server issued it and, if so, add it to our tokens.
+func loadSharedToken(theKind string, theToken string) {
+	if sharedRedis == nil || theToken == "" {
+		return
+	}
+	if (theKind == "task" && tokens[theToken] != 0) || (theKind == "admin" && adminTokens[theToken] != 0) || (theKind == "agent" && agentTokens[theToken] != "") {
+		return
+	}
+	tokenReply, _ := sharedRedis.do("GET", sharedKeyPrefix + "token:" + theToken)
+	tokenValue, tokenFound := tokenReply.(string)
+	if !tokenFound {
+		return
+	}
+	// Tokens saved by older versions only have a kind and name.
+	tokenSplit := strings.SplitN(tokenValue, "\t", 5)
+	if tokenSplit[0] != theKind || len(tokenSplit) < 2 {
+		return
+	}
+	switch theKind {
+		case "task":
+			tokens[theToken] = time.Now().Unix()
+			if tokenSplit[1] != "" {
+				tokenScopes[theToken] = tokenSplit[1]
+			}
+			if len(tokenSplit) == 5 && tokenSplit[2] != "" {
+				tokenIssued, _ := strconv.ParseInt(tokenSplit[3], 10, 64)
+				taskTokenDetails[theToken] = tokenDetails{tokenSplit[2], tokenIssued, tokenSplit[4]}
+			}
+		case "admin":
+			adminTokens[theToken] = time.Now().Unix()
+		case "agent":
+			agentTokens[theToken] = tokenSplit[1]
+			agentLastSeen[tokenSplit[1]] = time.Now().Unix()
+	}
+}
+
+// A token bucket kept in Redis, updated in one step by a Lua script so servers don't trip over each other. Returns the number of seconds until
+// the client can try again, or 0 if the request is allowed.
+const sharedBucketScript = `local bucket = redis.call("HMGET", KEYS[1], "tokens", "updated")
+local rate = tonumber(ARGV[1]) / 60
+local burst = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local tokens = tonumber(bucket[1]) or burst
+local updated = tonumber(bucket[2]) or now
+tokens = math.min(burst, tokens + (now - updated) * rate)
+local retry = 0
+if tokens < 1 then retry = math.ceil((1 - tokens) / rate) else tokens = tokens - 1 end
+redis.call("HSET", KEYS[1], "tokens", tostring(tokens), "updated", tostring(now))
+redis.call("EXPIRE", KEYS[1], 600)
+return retry`
+
+// Take a token from the given client's bucket in Redis. The second value returned is false if Redis isn't in use (or can't be reached), in
+// which case the bucket in memory is used instead.
+func takeSharedClientToken(theClientIP string, theRequestsPerMinute float64, theBurstSize float64) (int, bool) {
+	if sharedRedis == nil {
+		return 0, false
+	}
+	bucketReply, bucketErr := sharedRedis.do("EVAL", sharedBucketScript, "1", sharedKeyPrefix + "ratelimit:" + theClientIP,
+		strconv.FormatFloat(theRequestsPerMinute, 'f', -1, 64), strconv.FormatFloat(theBurstSize, 'f', -1, 64),
+		strconv.FormatFloat(float64(time.Now().UnixNano()) / 1e9, 'f', 3, 64))
+	if bucketErr != nil {
+		return 0, false
+	}
+	retryAfter, _ := bucketReply.(int64)
+	return int(retryAfter), true
+}
+
+// Claim the right to run the given Task, so two servers can't run the same Task at once. Returns false if another server is running it.
+func claimSharedRun(theTaskID string) bool {
+	if sharedRedis == nil {
+		return true
+	}
+	claimReply, claimErr := sharedRedis.do("SET", sharedKeyPrefix + "running:" + theTaskID, "", "NX", "EX", strconv.Itoa(sharedRunTimeout))
+	return claimErr != nil || claimReply != nil
+}
+
+// Give up a claim made by claimSharedRun without running the Task.
+func releaseSharedRun(theTaskID string) {
+	if sharedRedis != nil {
+		sharedRedis.do("DEL", sharedKeyPrefix + "running:" + theTaskID)
+	}
+}
+
+// Tell other servers we've started a run of the given Task. Returns a function to pass each line of output on to other servers, and a function
+// to call when the run has finished. Output is sent to Redis in the background, in batches, so a Task printing a lot isn't held up waiting for
+// Redis, and the list is trimmed to the Task's output limits. The run's output is kept in Redis for a while after the run finishes, so clients
+// polling other servers still get the end of it.
+func startSharedRun(theTaskID string, theTaskDetails map[string]string, theRunID string) (func(taskOutputLine), func()) {
+	if sharedRedis == nil {
+		return func(taskOutputLine) {}, func() {}
+	}
+	// The output passed on is already limited (see runTask), to the limit, a marker line and a tail of up to half the limit.
+	maxLines := int64(sharedOutputMaxLines)
+	if limitLines, _ := getOutputLimit(theTaskDetails, "maxoutputlines"); limitLines > 0 {
+		maxLines = limitLines + 1 + (limitLines / 2)
+	}
+	runningKey := sharedKeyPrefix + "running:" + theTaskID
+	outputKey := sharedKeyPrefix + "output:" + theTaskID
+	sharedRedis.do("DEL", outputKey)
+	sharedRedis.do("SET", runningKey, theRunID, "EX", strconv.Itoa(sharedRunTimeout))
+	runFinished := make(chan bool)
+	go func() {
+		for {
+			select {
+				case <-runFinished:
+					return
+				case <-time.After((sharedRunTimeout / 3) * time.Second):
+					sharedRedis.do("EXPIRE", runningKey, strconv.Itoa(sharedRunTimeout))
+			}
+		}
+	}()
+	// Lines waiting to be sent, and a signal that there are some.
+	var pendingLines []string
+	var pendingLock sync.Mutex
+	linesWaiting := make(chan bool, 1)
+	outputSent := make(chan bool)
+	go func() {
+		for runDone := false; !runDone; {
+			select {
+				case <-linesWaiting:
+				case <-runFinished:
+					runDone = true
+			}
+			pendingLock.Lock()
+			sendLines := pendingLines
+			pendingLines = nil
+			pendingLock.Unlock()
+			if len(sendLines) > 0 {
+				sharedRedis.do(append([]string{"RPUSH", outputKey}, sendLines...)...)
+				sharedRedis.do("LTRIM", outputKey, strconv.FormatInt(-maxLines, 10), "-1")
+			}
+		}
+		close(outputSent)
+	}()
+	publishOutput := func(theOutputLine taskOutputLine) {
+		pendingLock.Lock()
+		pendingLines = append(pendingLines, string(formatOutputEvent(theOutputLine, theRunID)))
+		pendingLock.Unlock()
+		select {
+			case linesWaiting <- true:
+			default:
+		}
+	}
+	finishRun := func() {
+		close(runFinished)
+		<-outputSent
+		sharedRedis.do("EXPIRE", outputKey, strconv.Itoa(tokenTimeout))
+		sharedRedis.do("DEL", runningKey)
+	}
+	return publishOutput, finishRun
+}
+
+// Returns true if the given Task is running on another server.
+func taskRunningElsewhere(theTaskID string) bool {
+	if sharedRedis == nil {
+		return false
+	}
+	runningReply, _ := sharedRedis.do("EXISTS", sharedKeyPrefix + "running:" + theTaskID)
+	runningCount, _ := runningReply.(int64)
+	return runningCount > 0
+}
+
+// For a Task that isn't running on this server, fetch the output of its current (or most recently finished) run on another server into the
+// Task's output buffer. Returns whether any output was found, and whether the Task is still running.
+func loadSharedTaskOutput(theTaskID string) (bool, bool) {
+	if sharedRedis == nil {
+		return false, false
+	}
+	taskRunning := taskRunningElsewhere(theTaskID)
+	outputReply, outputErr := sharedRedis.do("LRANGE", sharedKeyPrefix + "output:" + theTaskID, "0", "-1")
+	outputEvents, _ := outputReply.([]interface{})
+	if outputErr != nil || len(outputEvents) == 0 {
+		return false, taskRunning
+	}
+	loadedOutput := make([]taskOutputLine, 0)
+	for _, outputEvent := range outputEvents {
+		var parsedEvent taskOutputEvent
+		if eventJSON, isString := outputEvent.(string); isString && json.Unmarshal([]byte(eventJSON), &parsedEvent) == nil {
+			eventTime, _ := time.Parse(time.RFC3339Nano, parsedEvent.Timestamp)
+			loadedOutput = append(loadedOutput, taskOutputLine{eventTime, parsedEvent.Stream, parsedEvent.Line})
+			taskRunIDs[theTaskID] = parsedEvent.RunID
+		}
+	}
+	setTaskOutput(theTaskID, loadedOutput)
+	return true, taskRunning
+}
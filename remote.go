@@ -0,0 +1,250 @@
+package main
+// Remote client mode - "webconsole remote run --server https://console.example.com --task abc123 --secret ..." runs a Task on another Web
+// Console server, printing its output as it runs just as "webconsole task run" does for a Task on this machine, and exits with the Task's own
+// exit status, so a Task on a server can be run as a step in a script or CI pipeline. The secret can be the Task's secret or a token for it,
+// and is best given as WEBCONSOLE_SECRET (or WEBCONSOLE_SECRET_FILE) to keep it out of the process list. Output is followed through dropped
+// connections, along with any retries of a failed run (see retries.go). Ctrl-C stops the Task on the server.
+
+import (
+	// Standard libraries.
+	"io"
+	"os"
+	"fmt"
+	"time"
+	"bufio"
+	"errors"
+	"strings"
+	"net/url"
+	"net/http"
+	"os/signal"
+	"io/ioutil"
+	"encoding/json"
+)
+
+// The token used for calls to the remote server - got in exchange for the secret when first needed.
+var remoteToken = ""
+
+// The parts of api/getTaskStatus we need to follow a run.
+type remoteTaskStatus struct {
+	Running bool `json:"running"`
+	RunID string `json:"runID"`
+	NextRun int64 `json:"nextRun"`
+	LastRun *struct {
+		RunID string `json:"runID"`
+		Succeeded bool `json:"succeeded"`
+		Error string `json:"error"`
+	} `json:"lastRun"`
+}
+
+// Make an API call to the remote server with the given credential (if any), returning the response. An error returned by the server (a
+// response starting "ERROR: ") is returned as an error with the server's message and error code (see apiCallError).
+func postRemote(theFunction string, theValues url.Values, theCredential string) (*http.Response, error) {
+	remoteRequest, requestErr := http.NewRequest("POST", strings.TrimRight(arguments["server"], "/") + "/api/" + theFunction, strings.NewReader(theValues.Encode()))
+	if requestErr != nil {
+		return nil, requestErr
+	}
+	remoteRequest.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if theCredential != "" {
+		remoteRequest.Header.Set("Authorization", "Bearer " + theCredential)
+	}
+	// Output is streamed for as long as the Task runs, so there's no overall time limit on calls.
+	remoteClient := getHTTPClient("remote")
+	remoteClient.Timeout = 0
+	remoteResponse, responseErr := remoteClient.Do(remoteRequest)
+	if responseErr != nil {
+		return nil, responseErr
+	}
+	responseReader := bufio.NewReader(remoteResponse.Body)
+	if responseStart, _ := responseReader.Peek(len("ERROR: ")); string(responseStart) == "ERROR: " {
+		errorMessage, _ := ioutil.ReadAll(io.LimitReader(responseReader, 64 * 1024))
+		remoteResponse.Body.Close()
+		return nil, &apiCallError{remoteResponse.Header.Get("X-Error-Code"), strings.TrimSpace(string(errorMessage))}
+	}
+	if remoteResponse.StatusCode != http.StatusOK {
+		remoteResponse.Body.Close()
+		return nil, errors.New("ERROR: Unexpected response from server - " + remoteResponse.Status)
+	}
+	remoteResponse.Body = ioutil.NopCloser(responseReader)
+	return remoteResponse, nil
+}
+
+// Exchange the secret for a token. If the secret isn't accepted, it might be a token already - getToken returns a token it's given as it is.
+func getRemoteToken() error {
+	// A Task with two-factor authentication (see totp.go) needs a code from "--totp" too.
+	tokenResponse, tokenErr := postRemote("getToken", url.Values{"taskID": {arguments["task"]}, "secret": {arguments["secret"]}, "totp": {arguments["totp"]}}, "")
+	if getAPIErrorCode(tokenErr) == errorCodeNotAuthorised {
+		var bearerErr error
+		if tokenResponse, bearerErr = postRemote("getToken", url.Values{"taskID": {arguments["task"]}}, arguments["secret"]); bearerErr == nil {
+			tokenErr = nil
+		}
+	}
+	if tokenErr != nil {
+		return tokenErr
+	}
+	defer tokenResponse.Body.Close()
+	newToken, readErr := ioutil.ReadAll(tokenResponse.Body)
+	if readErr != nil {
+		return readErr
+	}
+	remoteToken = strings.TrimSpace(string(newToken))
+	return nil
+}
+
+// Make an API call to the remote server for the Task being run, getting a token first if we don't have one, and a new one if it has expired.
+func callRemote(theFunction string, theValues url.Values) (*http.Response, error) {
+	theValues.Set("taskID", arguments["task"])
+	for attempt := 1; ; attempt = attempt + 1 {
+		if remoteToken == "" {
+			if tokenErr := getRemoteToken(); tokenErr != nil {
+				return nil, tokenErr
+			}
+		}
+		remoteResponse, callErr := postRemote(theFunction, theValues, remoteToken)
+		// The server doesn't say why a call wasn't authorised, so the token is renewed once in case it has expired.
+		if attempt == 1 && getAPIErrorCode(callErr) == errorCodeNotAuthorised {
+			remoteToken = ""
+			continue
+		}
+		return remoteResponse, callErr
+	}
+}
+
+// As callRemote, returning the whole of the response as a string.
+func callRemoteString(theFunction string, theValues url.Values) (string, error) {
+	remoteResponse, callErr := callRemote(theFunction, theValues)
+	if callErr != nil {
+		return "", callErr
+	}
+	defer remoteResponse.Body.Close()
+	responseBody, readErr := ioutil.ReadAll(remoteResponse.Body)
+	return string(responseBody), readErr
+}
+
+// Returns the remote Task's status.
+func getRemoteTaskStatus() (remoteTaskStatus, error) {
+	taskStatus := remoteTaskStatus{}
+	statusJSON, callErr := callRemoteString("getTaskStatus", url.Values{})
+	if callErr != nil {
+		return taskStatus, callErr
+	}
+	jsonErr := json.Unmarshal([]byte(statusJSON), &taskStatus)
+	return taskStatus, jsonErr
+}
+
+// Print the output of the given run of the remote Task as it arrives, until the run finishes. If the connection is lost, it's made again,
+// carrying on from where it left off.
+func printRemoteOutput(theRunID string) error {
+	linesPrinted := 0
+	for {
+		outputResponse, callErr := callRemote("streamTaskOutput", url.Values{"format": {"ndjson"}, "line": {fmt.Sprint(linesPrinted)}, "runID": {theRunID}})
+		if callErr != nil && strings.HasPrefix(callErr.Error(), "ERROR: ") {
+			return callErr
+		}
+		if callErr == nil {
+			outputScanner := bufio.NewScanner(outputResponse.Body)
+			outputScanner.Buffer(make([]byte, 64 * 1024), 16 * 1024 * 1024)
+			for outputScanner.Scan() {
+				outputEvent := taskOutputEvent{}
+				if json.Unmarshal(outputScanner.Bytes(), &outputEvent) != nil {
+					continue
+				}
+				if outputEvent.Stream == "eof" {
+					outputResponse.Body.Close()
+					return nil
+				}
+				outputLine := outputEvent.Line
+				if arguments["timestamps"] == "true" {
+					outputTime, _ := time.Parse(time.RFC3339Nano, outputEvent.Timestamp)
+					outputLine = outputTime.Local().Format(outputTimestampFormat) + "\t" + outputLine
+				}
+				if outputEvent.Stream == "stderr" {
+					fmt.Fprintln(os.Stderr, outputLine)
+				} else {
+					fmt.Println(outputLine)
+				}
+				linesPrinted = linesPrinted + 1
+			}
+			outputResponse.Body.Close()
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// Run the Task given by "task" (or as the value of "remoterun") on the server given by "server", printing its output as it goes. Returns the
+// exit status to exit with: 0 if the Task succeeded, the Task's own exit status if it failed with one, otherwise 1.
+func runRemoteTask() int {
+	if arguments["task"] == "" && arguments["remoterun"] != "true" {
+		arguments["task"] = arguments["remoterun"]
+	}
+	if arguments["task"] == "" || arguments["task"] == "true" || arguments["server"] == "" || arguments["server"] == "true" {
+		fmt.Println("ERROR: Give the server and the ID of the Task to run, e.g. \"webconsole remote run --server https://console.example.com --task abc123\".")
+		return 1
+	}
+	// Note the run before this one, so the new run can be told apart from it - until the new run gets going, the Task's output is still the
+	// last run's.
+	taskStatus, statusErr := getRemoteTaskStatus()
+	if statusErr != nil {
+		fmt.Println(statusErr.Error())
+		return 1
+	}
+	runID := taskStatus.RunID
+	if taskStatus.LastRun != nil {
+		runID = taskStatus.LastRun.RunID
+	}
+	runResponse, runErr := callRemoteString("runTask", url.Values{"preset": {arguments["preset"]}})
+	if runErr != nil {
+		fmt.Println(runErr.Error())
+		return 1
+	}
+	approvalPending := strings.TrimSpace(runResponse) == "PENDING"
+	if approvalPending {
+		fmt.Println("Waiting for the run to be approved...")
+	}
+	// Stop the Task (which also cancels any retry) if the user hits Ctrl-C. Its output carries on until it has stopped.
+	interruptSignals := make(chan os.Signal, 1)
+	signal.Notify(interruptSignals, os.Interrupt)
+	go func() {
+		<-interruptSignals
+		if _, stopErr := callRemoteString("stopTask", url.Values{}); stopErr != nil {
+			fmt.Println(stopErr.Error())
+		}
+	}()
+	for {
+		// Wait for the next run - the one just started, or a retry - to start, or find that there isn't going to be one.
+		previousRunID := runID
+		for runID == previousRunID {
+			taskStatus, statusErr = getRemoteTaskStatus()
+			if statusErr != nil {
+				fmt.Println(statusErr.Error())
+				return 1
+			}
+			if taskStatus.Running && taskStatus.RunID != "" {
+				runID = taskStatus.RunID
+			} else if !taskStatus.Running && taskStatus.LastRun != nil && taskStatus.LastRun.RunID != previousRunID {
+				runID = taskStatus.LastRun.RunID
+			} else if approvalPending && !taskStatus.Running {
+				if pendingRun, pendingErr := callRemoteString("getPendingRun", url.Values{}); pendingErr == nil && strings.TrimSpace(pendingRun) == "" {
+					fmt.Println("ERROR: The run wasn't approved.")
+					return 1
+				}
+			} else if !taskStatus.Running && taskStatus.NextRun == 0 && taskStatus.LastRun != nil {
+				if taskStatus.LastRun.Succeeded {
+					return 0
+				}
+				exitStatus := 0
+				if _, scanErr := fmt.Sscanf(taskStatus.LastRun.Error, "exit status %d", &exitStatus); scanErr == nil && exitStatus > 0 && exitStatus < 256 {
+					return exitStatus
+				}
+				return 1
+			}
+			if runID == previousRunID {
+				time.Sleep(time.Second)
+			}
+		}
+		approvalPending = false
+		if outputErr := printRemoteOutput(runID); outputErr != nil {
+			fmt.Println(outputErr.Error())
+			return 1
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package main
+// Resource usage - while a Task runs, its processes are sampled every few seconds for the CPU time they've used, the memory they're using and
+// how many of them there are, so a job that looks stuck can be seen to be busy crunching data (or not). The latest sample is returned by
+// api/getTaskStatus. A Task's "usageinterval" option (or the server's, a Task's own setting wins) also adds a line to the Task's output every
+// that many seconds giving its usage. How the processes are sampled depends on the platform - see resourceusage_*.go. Tasks run on an agent
+// aren't sampled.
+
+import (
+	// Standard libraries.
+	"fmt"
+	"sync"
+	"time"
+	"errors"
+	"strconv"
+	"os/exec"
+)
+
+// How often a running Task's resource usage is sampled.
+const usageSampleInterval = 5 * time.Second
+
+// A sample of the resources used by a Task's processes: the CPU time (user and system) used so far by the processes and any children they've
+// finished with, the memory (resident set size) they're using now, and how many of them are running.
+type resourceUsage struct {
+	sampled time.Time
+	cpuSeconds float64
+	memoryBytes int64
+	processes int
+}
+
+// One process's details, as read by the Unix-like platforms' samplers: its ID, parent's ID and process group ID, the CPU time it (and any
+// children it has finished with) has used, and the memory it's using.
+type processSample struct {
+	processID string
+	parentID string
+	groupID string
+	cpuSeconds float64
+	memoryBytes int64
+}
+
+// The latest resource usage sample for each running Task, by Task ID.
+var taskResourceUsage = map[string]resourceUsage{}
+var taskResourceUsageLock sync.Mutex
+
+// Returns the given Task's "usageinterval" setting, in seconds - the Task's own value if it has one, otherwise the server's. Returns 0 (no
+// usage lines in the Task's output) if neither is set.
+func getUsageInterval(theTaskDetails map[string]string) (int, error) {
+	intervalString := theTaskDetails["usageinterval"]
+	if intervalString == "" {
+		intervalString = arguments["usageinterval"]
+	}
+	if intervalString == "" {
+		return 0, nil
+	}
+	intervalValue, intervalErr := strconv.Atoi(intervalString)
+	if intervalErr != nil || intervalValue < 0 {
+		return 0, errors.New("Invalid usageinterval \"" + intervalString + "\" - should be a whole number of seconds, 0 or more.")
+	}
+	return intervalValue, nil
+}
+
+// Returns the given resource usage as a line of text for a Task's output.
+func formatResourceUsage(theUsage resourceUsage) string {
+	return fmt.Sprintf("Resource usage: CPU time %.1fs, memory %.1fMB, %d process(es).", theUsage.cpuSeconds, float64(theUsage.memoryBytes) / (1024 * 1024), theUsage.processes)
+}
+
+// Returns the commands currently running for the given Task - its own command or, for a pipeline, the steps that are running.
+func getTaskProcesses(theTaskID string) []*exec.Cmd {
+	var taskProcesses []*exec.Cmd
+	if run, runFound := pipelineRuns[theTaskID]; runFound {
+		run.lock.Lock()
+		taskProcesses = append(taskProcesses, run.commands...)
+		run.lock.Unlock()
+	} else if runningTask, taskFound := runningTasks[theTaskID]; taskFound {
+		taskProcesses = append(taskProcesses, runningTask)
+	}
+	var runningProcesses []*exec.Cmd
+	for _, taskProcess := range taskProcesses {
+		if taskProcess.Process != nil && taskProcess.ProcessState == nil {
+			runningProcesses = append(runningProcesses, taskProcess)
+		}
+	}
+	return runningProcesses
+}
+
+// Returns the combined resource usage of the given Task's running processes, and whether there were any to sample.
+func sampleTaskUsage(theTaskID string) (resourceUsage, bool) {
+	taskUsage := resourceUsage{sampled: time.Now()}
+	sampled := false
+	for _, taskProcess := range getTaskProcesses(theTaskID) {
+		if processUsage, usageErr := getProcessTreeUsage(taskProcess); usageErr == nil {
+			taskUsage.cpuSeconds = taskUsage.cpuSeconds + processUsage.cpuSeconds
+			taskUsage.memoryBytes = taskUsage.memoryBytes + processUsage.memoryBytes
+			taskUsage.processes = taskUsage.processes + processUsage.processes
+			sampled = true
+		}
+	}
+	return taskUsage, sampled
+}
+
+// Returns the combined resource usage of the given process's tree, out of the given list of every process: the processes in its process group
+// (which it was started as the leader of), along with any processes started from them that have moved to a process group of their own - as
+// "timeout" and some shells do with the commands they run.
+func sumProcessTree(theProcessID int, theProcessList []processSample) (resourceUsage, error) {
+	var treeUsage resourceUsage
+	treeProcesses := map[string]bool{}
+	for _, listProcess := range theProcessList {
+		if listProcess.groupID == strconv.Itoa(theProcessID) {
+			treeProcesses[listProcess.processID] = true
+		}
+	}
+	// Keep adding the children of processes already in the tree until there are none left to add.
+	for treeGrown := true; treeGrown; {
+		treeGrown = false
+		for _, listProcess := range theProcessList {
+			if !treeProcesses[listProcess.processID] && treeProcesses[listProcess.parentID] {
+				treeProcesses[listProcess.processID] = true
+				treeGrown = true
+			}
+		}
+	}
+	for _, listProcess := range theProcessList {
+		if treeProcesses[listProcess.processID] {
+			treeUsage.cpuSeconds = treeUsage.cpuSeconds + listProcess.cpuSeconds
+			treeUsage.memoryBytes = treeUsage.memoryBytes + listProcess.memoryBytes
+			treeUsage.processes = treeUsage.processes + 1
+		}
+	}
+	if treeUsage.processes == 0 {
+		return treeUsage, errors.New("No processes found.")
+	}
+	return treeUsage, nil
+}
+
+// Sample the given Task's resource usage until the returned function is called (when the run finishes), sending a usage line to theOutputLines
+// (the run's callback channel, so it's recorded along with the rest of the run's output) every usageinterval seconds if the Task has that set.
+func startUsageSampling(theTaskID string, theTaskDetails map[string]string, theOutputLines chan taskOutputLine) func() {
+	usageInterval, _ := getUsageInterval(theTaskDetails)
+	stopSampling := make(chan bool)
+	samplingStopped := make(chan bool)
+	go func() {
+		sampleTicker := time.NewTicker(usageSampleInterval)
+		defer sampleTicker.Stop()
+		lastReported := time.Now()
+		for {
+			select {
+				case <-stopSampling:
+					close(samplingStopped)
+					return
+				case <-sampleTicker.C:
+			}
+			taskUsage, sampled := sampleTaskUsage(theTaskID)
+			if !sampled {
+				continue
+			}
+			taskResourceUsageLock.Lock()
+			taskResourceUsage[theTaskID] = taskUsage
+			taskResourceUsageLock.Unlock()
+			// Allow for the ticker being a little early or late, so an interval that's a multiple of the sample interval is kept to.
+			if usageInterval > 0 && time.Since(lastReported) + (usageSampleInterval / 2) >= time.Duration(usageInterval) * time.Second {
+				select {
+					case theOutputLines <- taskOutputLine{time.Now(), "system", formatResourceUsage(taskUsage)}:
+					case <-stopSampling:
+						close(samplingStopped)
+						return
+				}
+				lastReported = time.Now()
+			}
+		}
+	}()
+	return func() {
+		close(stopSampling)
+		<-samplingStopped
+		taskResourceUsageLock.Lock()
+		delete(taskResourceUsage, theTaskID)
+		taskResourceUsageLock.Unlock()
+	}
+}
+
+// Returns the latest resource usage sample for the given Task, if it's running and has been sampled.
+func getTaskResourceUsage(theTaskID string) (resourceUsage, bool) {
+	taskResourceUsageLock.Lock()
+	defer taskResourceUsageLock.Unlock()
+	taskUsage, usageFound := taskResourceUsage[theTaskID]
+	return taskUsage, usageFound
+}
@@ -0,0 +1,51 @@
+//go:build linux
+// +build linux
+
+package main
+// Resource usage sampling on Linux - read from /proc for every process in the Task's process group, along with any processes started from them
+// that have moved to a process group of their own.
+
+import (
+	// Standard libraries.
+	"os"
+	"strconv"
+	"strings"
+	"os/exec"
+	"io/ioutil"
+)
+
+// The units CPU times are given in in /proc - USER_HZ, which is 100 on every architecture Linux runs on today.
+const procClockTicks = 100
+
+// Returns the resources used by the given command's process and every other process in its process tree.
+func getProcessTreeUsage(theCommand *exec.Cmd) (resourceUsage, error) {
+	procEntries, readDirErr := ioutil.ReadDir("/proc")
+	if readDirErr != nil {
+		return resourceUsage{}, readDirErr
+	}
+	var processList []processSample
+	for _, procEntry := range procEntries {
+		if _, atoiErr := strconv.Atoi(procEntry.Name()); atoiErr != nil {
+			continue
+		}
+		statContents, readErr := ioutil.ReadFile("/proc/" + procEntry.Name() + "/stat")
+		if readErr != nil {
+			continue
+		}
+		// The process's name (in brackets) can contain spaces, so the fields are counted from after it. See "man 5 proc" - the fields used
+		// here are ppid (4), pgrp (5), utime (14), stime (15), cutime (16), cstime (17) and rss (24), counting from 1 for the PID.
+		statString := string(statContents)
+		statFields := strings.Fields(statString[strings.LastIndex(statString, ")") + 1:])
+		if len(statFields) < 22 {
+			continue
+		}
+		cpuTicks := int64(0)
+		for _, fieldPos := range []int{11, 12, 13, 14} {
+			fieldValue, _ := strconv.ParseInt(statFields[fieldPos], 10, 64)
+			cpuTicks = cpuTicks + fieldValue
+		}
+		rssPages, _ := strconv.ParseInt(statFields[21], 10, 64)
+		processList = append(processList, processSample{procEntry.Name(), statFields[1], statFields[2], float64(cpuTicks) / procClockTicks, rssPages * int64(os.Getpagesize())})
+	}
+	return sumProcessTree(theCommand.Process.Pid, processList)
+}
@@ -0,0 +1,50 @@
+//go:build !linux && !windows
+// +build !linux,!windows
+
+package main
+// Resource usage sampling on MacOS and other Unix-like systems without /proc - ask ps about every process in the Task's process group, along
+// with any processes started from them that have moved to a process group of their own.
+
+import (
+	// Standard libraries.
+	"strconv"
+	"strings"
+	"os/exec"
+)
+
+// Returns the resources used by the given command's process and every other process in its process tree.
+func getProcessTreeUsage(theCommand *exec.Cmd) (resourceUsage, error) {
+	psOutput, psErr := exec.Command("ps", "-A", "-o", "pid=", "-o", "ppid=", "-o", "pgid=", "-o", "rss=", "-o", "time=").Output()
+	if psErr != nil {
+		return resourceUsage{}, psErr
+	}
+	var processList []processSample
+	for _, psLine := range strings.Split(string(psOutput), "\n") {
+		psFields := strings.Fields(psLine)
+		if len(psFields) != 5 {
+			continue
+		}
+		// ps gives resident set size in kilobytes.
+		rssKilobytes, _ := strconv.ParseInt(psFields[3], 10, 64)
+		processList = append(processList, processSample{psFields[0], psFields[1], psFields[2], parsePSTime(psFields[4]), rssKilobytes * 1024})
+	}
+	return sumProcessTree(theCommand.Process.Pid, processList)
+}
+
+// Returns the given CPU time from ps, in any of the forms ps uses ("[[dd-]hh:]mm:ss[.cc]"), in seconds.
+func parsePSTime(theTime string) float64 {
+	totalSeconds := float64(0)
+	if dayPos := strings.Index(theTime, "-"); dayPos != -1 {
+		timeDays, _ := strconv.ParseFloat(theTime[:dayPos], 64)
+		totalSeconds = timeDays * 24 * 60 * 60
+		theTime = theTime[dayPos + 1:]
+	}
+	timeFields := strings.Split(theTime, ":")
+	fieldSeconds := float64(1)
+	for fieldPos := len(timeFields) - 1; fieldPos >= 0; fieldPos = fieldPos - 1 {
+		fieldValue, _ := strconv.ParseFloat(timeFields[fieldPos], 64)
+		totalSeconds = totalSeconds + (fieldValue * fieldSeconds)
+		fieldSeconds = fieldSeconds * 60
+	}
+	return totalSeconds
+}
@@ -0,0 +1,111 @@
+//go:build windows
+// +build windows
+
+package main
+// Resource usage sampling on Windows - CPU time and the process list come from the Task's job object (see process_windows.go), memory from each
+// process in the job. If the Task's process couldn't be put in a job, just that process is sampled.
+
+import (
+	// Standard libraries.
+	"errors"
+	"unsafe"
+	"syscall"
+	"os/exec"
+)
+
+// Job object information classes, and the access right needed to read a process's memory usage.
+const jobObjectBasicAccountingInformation = 1
+const jobObjectBasicProcessIdList = 3
+const processQueryLimitedInformation = 0x1000
+
+// The most processes in a job that are sampled for memory usage.
+const maxJobProcesses = 256
+
+var queryInformationJobObjectProc = kernel32DLL.NewProc("QueryInformationJobObject")
+var getProcessMemoryInfoProc = kernel32DLL.NewProc("K32GetProcessMemoryInfo")
+
+// JOBOBJECT_BASIC_ACCOUNTING_INFORMATION - times are in 100-nanosecond units.
+type jobAccountingInformation struct {
+	totalUserTime int64
+	totalKernelTime int64
+	thisPeriodTotalUserTime int64
+	thisPeriodTotalKernelTime int64
+	totalPageFaultCount uint32
+	totalProcesses uint32
+	activeProcesses uint32
+	totalTerminatedProcesses uint32
+}
+
+// JOBOBJECT_BASIC_PROCESS_ID_LIST, with room for maxJobProcesses process IDs.
+type jobProcessIDList struct {
+	numberOfAssignedProcesses uint32
+	numberOfProcessIdsInList uint32
+	processIDs [maxJobProcesses]uintptr
+}
+
+// PROCESS_MEMORY_COUNTERS.
+type processMemoryCounters struct {
+	cb uint32
+	pageFaultCount uint32
+	peakWorkingSetSize uintptr
+	workingSetSize uintptr
+	quotaPeakPagedPoolUsage uintptr
+	quotaPagedPoolUsage uintptr
+	quotaPeakNonPagedPoolUsage uintptr
+	quotaNonPagedPoolUsage uintptr
+	pagefileUsage uintptr
+	peakPagefileUsage uintptr
+}
+
+// Returns the memory (working set) the given process is using.
+func getProcessMemory(theProcessID uint32) int64 {
+	processHandle, openErr := syscall.OpenProcess(processQueryLimitedInformation, false, theProcessID)
+	if openErr != nil {
+		return 0
+	}
+	defer syscall.CloseHandle(processHandle)
+	memoryCounters := processMemoryCounters{}
+	memoryCounters.cb = uint32(unsafe.Sizeof(memoryCounters))
+	if gotInfo, _, _ := getProcessMemoryInfoProc.Call(uintptr(processHandle), uintptr(unsafe.Pointer(&memoryCounters)), uintptr(memoryCounters.cb)); gotInfo == 0 {
+		return 0
+	}
+	return int64(memoryCounters.workingSetSize)
+}
+
+// Returns the resources used by the given command's process and every other process in its job.
+func getProcessTreeUsage(theCommand *exec.Cmd) (resourceUsage, error) {
+	var processUsage resourceUsage
+	processID := theCommand.Process.Pid
+	// Hold the lock while using the job, so it can't be closed part-way through.
+	processJobsLock.Lock()
+	defer processJobsLock.Unlock()
+	jobHandle, jobFound := processJobs[processID]
+	if !jobFound {
+		processHandle, openErr := syscall.OpenProcess(processQueryLimitedInformation, false, uint32(processID))
+		if openErr != nil {
+			return processUsage, openErr
+		}
+		defer syscall.CloseHandle(processHandle)
+		var creationTime, exitTime, kernelTime, userTime syscall.Filetime
+		if timesErr := syscall.GetProcessTimes(processHandle, &creationTime, &exitTime, &kernelTime, &userTime); timesErr != nil {
+			return processUsage, timesErr
+		}
+		processUsage.cpuSeconds = float64(int64(kernelTime.HighDateTime) << 32 + int64(kernelTime.LowDateTime) + int64(userTime.HighDateTime) << 32 + int64(userTime.LowDateTime)) / 1e7
+		processUsage.memoryBytes = getProcessMemory(uint32(processID))
+		processUsage.processes = 1
+		return processUsage, nil
+	}
+	accountingInformation := jobAccountingInformation{}
+	if gotInfo, _, _ := queryInformationJobObjectProc.Call(uintptr(jobHandle), jobObjectBasicAccountingInformation, uintptr(unsafe.Pointer(&accountingInformation)), unsafe.Sizeof(accountingInformation), 0); gotInfo == 0 {
+		return processUsage, errors.New("Couldn't read job accounting information.")
+	}
+	processUsage.cpuSeconds = float64(accountingInformation.totalUserTime + accountingInformation.totalKernelTime) / 1e7
+	processUsage.processes = int(accountingInformation.activeProcesses)
+	processIDList := jobProcessIDList{}
+	// The list is filled in as far as it goes even if there are too many processes to fit, in which case the call "fails" with ERROR_MORE_DATA.
+	queryInformationJobObjectProc.Call(uintptr(jobHandle), jobObjectBasicProcessIdList, uintptr(unsafe.Pointer(&processIDList)), unsafe.Sizeof(processIDList), 0)
+	for processPos := uint32(0); processPos < processIDList.numberOfProcessIdsInList && processPos < maxJobProcesses; processPos = processPos + 1 {
+		processUsage.memoryBytes = processUsage.memoryBytes + getProcessMemory(uint32(processIDList.processIDs[processPos]))
+	}
+	return processUsage, nil
+}
@@ -0,0 +1,120 @@
+package main
+// Result extraction - values picked out of a Task's output, such as the size of a backup or the number of records imported, so they can be
+// shown and used without anyone having to read through the output. A Task's "resultPattern" option is a regular expression with named groups:
+// each line of output it matches sets a result for each group that matched, named after the group, so "Backed up (?P<size>[0-9.]+[KMG]B)"
+// sets "size" to "4.2GB". If "resultJSON" is "Y", the last JSON object the Task prints on a line of its own gives results too, one per value.
+// A run's results are returned by api/getTaskStatus as "results", can be used in notification templates as <<RESULT:name>>, and are saved
+// in the run's folder as results.json.
+
+import (
+	// Standard libraries.
+	"sync"
+	"regexp"
+	"strings"
+	"io/ioutil"
+	"encoding/json"
+)
+
+// The results of each Task's current (or most recent) run.
+var taskResults = map[string]map[string]string{}
+var taskResultsLock sync.Mutex
+
+// How results are picked out of a running Task's output, keyed by Task and run ID (see runKey).
+type resultExtractor struct {
+	pattern *regexp.Regexp
+	lastJSON bool
+}
+var resultExtractors = map[string]resultExtractor{}
+
+func init() {
+	subscribeTaskEvents(eventTaskStarted, func(theEvent taskEvent) {
+		taskResultsLock.Lock()
+		defer taskResultsLock.Unlock()
+		taskResults[theEvent.taskID] = map[string]string{}
+		extractor := resultExtractor{lastJSON: theEvent.taskDetails["resultjson"] == "Y"}
+		// An invalid pattern is ignored here - "webconsole --check" reports it (see checkTaskConfig).
+		if theEvent.taskDetails["resultpattern"] != "" {
+			extractor.pattern, _ = regexp.Compile(theEvent.taskDetails["resultpattern"])
+		}
+		if extractor.pattern != nil || extractor.lastJSON {
+			resultExtractors[runKey(theEvent.taskID, theEvent.runID)] = extractor
+		}
+	})
+	subscribeTaskEvents(eventOutputLine, func(theEvent taskEvent) {
+		// Only the Task's own output (and events it sends) is looked at, not Web Console's messages.
+		if theEvent.outputLine.stream == "system" {
+			return
+		}
+		taskResultsLock.Lock()
+		defer taskResultsLock.Unlock()
+		extractor, extractorFound := resultExtractors[runKey(theEvent.taskID, theEvent.runID)]
+		if !extractorFound {
+			return
+		}
+		if extractor.pattern != nil {
+			if patternMatch := extractor.pattern.FindStringSubmatch(theEvent.outputLine.line); patternMatch != nil {
+				for groupIndex, groupName := range extractor.pattern.SubexpNames() {
+					if groupName != "" && patternMatch[groupIndex] != "" {
+						taskResults[theEvent.taskID][groupName] = patternMatch[groupIndex]
+					}
+				}
+			}
+		}
+		if extractor.lastJSON {
+			for resultName, resultValue := range parseResultJSON(theEvent.outputLine.line) {
+				taskResults[theEvent.taskID][resultName] = resultValue
+			}
+		}
+	})
+	subscribeTaskEvents(eventTaskFinished, func(theEvent taskEvent) {
+		taskResultsLock.Lock()
+		defer taskResultsLock.Unlock()
+		delete(resultExtractors, runKey(theEvent.taskID, theEvent.runID))
+		if len(taskResults[theEvent.taskID]) > 0 {
+			resultsJSON, _ := json.MarshalIndent(taskResults[theEvent.taskID], "", "\t")
+			ioutil.WriteFile(arguments["taskroot"] + "/" + theEvent.taskID + "/runs/" + theEvent.runID + "/results.json", resultsJSON, 0644)
+		}
+	})
+}
+
+// If the given line of output is a JSON object, returns its values as results - strings as they are, anything else as JSON. Returns nil if not.
+func parseResultJSON(theLine string) map[string]string {
+	theLine = strings.TrimSpace(theLine)
+	if !strings.HasPrefix(theLine, "{") || !strings.HasSuffix(theLine, "}") {
+		return nil
+	}
+	var jsonValues map[string]interface{}
+	if json.Unmarshal([]byte(theLine), &jsonValues) != nil {
+		return nil
+	}
+	jsonResults := map[string]string{}
+	for valueName, jsonValue := range jsonValues {
+		if stringValue, isString := jsonValue.(string); isString {
+			jsonResults[valueName] = stringValue
+		} else if jsonValue == nil {
+			jsonResults[valueName] = ""
+		} else {
+			encodedValue, _ := json.Marshal(jsonValue)
+			jsonResults[valueName] = string(encodedValue)
+		}
+	}
+	return jsonResults
+}
+
+// Returns the results of the given Task's current (or most recent) run - read from the run's results.json if the run was before the server
+// started. Returns an empty map if there aren't any.
+func getTaskResults(theTaskID string) map[string]string {
+	taskResultsLock.Lock()
+	defer taskResultsLock.Unlock()
+	runResults := map[string]string{}
+	if currentResults, resultsFound := taskResults[theTaskID]; resultsFound {
+		for resultName, resultValue := range currentResults {
+			runResults[resultName] = resultValue
+		}
+	} else if runList, _ := getRunList(theTaskID); len(runList) > 0 {
+		if resultsJSON, readErr := readRunFile(theTaskID, runList[len(runList)-1], "results.json"); readErr == nil {
+			json.Unmarshal(resultsJSON, &runResults)
+		}
+	}
+	return runResults
+}
@@ -0,0 +1,176 @@
+package main
+// Run retention - how much run history (each run's folder of logs and any other files the run left there) to keep. Limits can be set for the
+// whole server in the config file, or for each Task in its config.txt (a Task's own setting wins):
+// keepruns - keep at most this many runs.
+// keepdays - remove runs started more than this many days ago.
+// keepmb - remove the oldest runs until the Task's runs take up no more than this many megabytes.
+// Blank or 0 means no limit, which is the default. Whatever the limits, a Task's most recent run is always kept, as are runs still counted by
+// its quotas (see quotas.go). Runs are pruned by a background
+// "janitor" every hour, or on demand with "webconsole task prune".
+
+import (
+	// Standard libraries.
+	"os"
+	"fmt"
+	"time"
+	"errors"
+	"strconv"
+	"path/filepath"
+)
+
+// How often, in seconds, the janitor checks for runs to remove.
+const retentionCheckPeriod = 3600
+
+// The settings that limit how many runs are kept.
+var retentionSettings = []string{"keepruns", "keepdays", "keepmb"}
+
+// Returns the given retention setting for the given Task - the Task's own value if it has one, otherwise the server's. Returns 0 (no limit) if
+// neither is set.
+func getRetentionLimit(theTaskDetails map[string]string, theSetting string) (int64, error) {
+	limitString := theTaskDetails[theSetting]
+	if limitString == "" {
+		limitString = arguments[theSetting]
+	}
+	if limitString == "" {
+		return 0, nil
+	}
+	limitValue, limitErr := strconv.ParseInt(limitString, 10, 64)
+	if limitErr != nil || limitValue < 0 {
+		return 0, errors.New("Invalid " + theSetting + " \"" + limitString + "\" - should be a whole number, 0 or more.")
+	}
+	return limitValue, nil
+}
+
+// Returns the total size, in bytes, of the files in the given folder.
+func getFolderSize(theFolder string) int64 {
+	var folderSize int64
+	filepath.Walk(theFolder, func(thePath string, theInfo os.FileInfo, theErr error) error {
+		if theErr == nil && !theInfo.IsDir() {
+			folderSize = folderSize + theInfo.Size()
+		}
+		return nil
+	})
+	return folderSize
+}
+
+// Remove the given Task's runs that fall outside its retention limits. Returns the IDs of the runs removed.
+func pruneTaskRuns(theTaskID string) ([]string, error) {
+	var prunedRunIDs []string
+	taskDetails, taskErr := getTaskDetails(theTaskID)
+	if taskErr != nil {
+		return prunedRunIDs, taskErr
+	}
+	limits := map[string]int64{}
+	for _, retentionSetting := range retentionSettings {
+		limitValue, limitErr := getRetentionLimit(taskDetails, retentionSetting)
+		if limitErr != nil {
+			return prunedRunIDs, limitErr
+		}
+		limits[retentionSetting] = limitValue
+	}
+	if limits["keepruns"] == 0 && limits["keepdays"] == 0 && limits["keepmb"] == 0 {
+		return prunedRunIDs, nil
+	}
+	runList, listErr := getRunList(theTaskID)
+	if listErr != nil {
+		return prunedRunIDs, listErr
+	}
+	if len(runList) < 2 {
+		return prunedRunIDs, nil
+	}
+	removeRun := func(theRunID string) error {
+		if archiveErr := deleteArchivedRun(theTaskID, theRunID); archiveErr != nil {
+			return errors.New("Can't remove run " + theRunID + " from the archive - " + archiveErr.Error())
+		}
+		if removeErr := os.RemoveAll(arguments["taskroot"] + "/" + theTaskID + "/runs/" + theRunID); removeErr != nil {
+			return errors.New("Can't remove run " + theRunID + " - " + removeErr.Error())
+		}
+		if deleteErr := runStore.DeleteRun(theTaskID, theRunID); deleteErr != nil {
+			return errors.New("Couldn't remove run " + theRunID + " from run history - " + deleteErr.Error())
+		}
+		prunedRunIDs = append(prunedRunIDs, theRunID)
+		return nil
+	}
+	// Runs are oldest first. The last one is the most recent run, which is always kept, so only the others are considered - and only those
+	// started before the Task's quotas' window, so runs its quotas count stay in its run history.
+	prunableRuns := runList[:len(runList)-1]
+	quotaWindow := getQuotaWindow(taskDetails)
+	for runPos, runID := range prunableRuns {
+		if runStarted, parseErr := time.ParseInLocation(runIDFormat, runID, time.Local); parseErr == nil && quotaWindow > 0 && time.Since(runStarted) < quotaWindow {
+			prunableRuns = runList[:runPos]
+			break
+		}
+	}
+	dayCutoff := time.Now().Add(-time.Duration(limits["keepdays"]) * 24 * time.Hour)
+	var keptRunIDs []string
+	for runPos, runID := range prunableRuns {
+		runStarted, parseErr := time.ParseInLocation(runIDFormat, runID, time.Local)
+		if (limits["keepruns"] > 0 && int64(runPos) < int64(len(runList)) - limits["keepruns"]) || (limits["keepdays"] > 0 && parseErr == nil && runStarted.Before(dayCutoff)) {
+			if removeErr := removeRun(runID); removeErr != nil {
+				return prunedRunIDs, removeErr
+			}
+		} else {
+			keptRunIDs = append(keptRunIDs, runID)
+		}
+	}
+	if limits["keepmb"] > 0 {
+		runSizes := map[string]int64{}
+		var totalSize int64
+		for _, runID := range runList[len(prunableRuns):] {
+			totalSize = totalSize + getFolderSize(arguments["taskroot"] + "/" + theTaskID + "/runs/" + runID)
+		}
+		for _, runID := range keptRunIDs {
+			runSizes[runID] = getFolderSize(arguments["taskroot"] + "/" + theTaskID + "/runs/" + runID)
+			totalSize = totalSize + runSizes[runID]
+		}
+		for _, runID := range keptRunIDs {
+			if totalSize <= limits["keepmb"] * 1024 * 1024 {
+				break
+			}
+			if removeErr := removeRun(runID); removeErr != nil {
+				return prunedRunIDs, removeErr
+			}
+			totalSize = totalSize - runSizes[runID]
+		}
+	}
+	if len(prunedRunIDs) > 0 {
+		writeAuditLog(theTaskID, fmt.Sprintf("%d old runs removed (%s to %s).", len(prunedRunIDs), prunedRunIDs[0], prunedRunIDs[len(prunedRunIDs)-1]))
+	}
+	return prunedRunIDs, nil
+}
+
+// Prune the runs of every Task. Returns a report of what was removed, one line per Task. A problem with one Task doesn't stop the others being
+// pruned - it's included in the report, starting "ERROR", and an error is returned at the end.
+func pruneAllRuns() ([]string, error) {
+	var report []string
+	taskIDs, listErr := taskStore.ListTaskIDs()
+	if listErr != nil {
+		return report, errors.New("Can't list Tasks - " + listErr.Error())
+	}
+	problemCount := 0
+	for _, taskID := range taskIDs {
+		prunedRunIDs, pruneErr := pruneTaskRuns(taskID)
+		if len(prunedRunIDs) > 0 {
+			report = append(report, fmt.Sprintf("Task %s: %d runs removed.", taskID, len(prunedRunIDs)))
+		}
+		if pruneErr != nil {
+			problemCount = problemCount + 1
+			report = append(report, "ERROR: Task " + taskID + ": " + pruneErr.Error())
+		}
+	}
+	if problemCount > 0 {
+		return report, fmt.Errorf("Problems pruning %d Tasks.", problemCount)
+	}
+	return report, nil
+}
+
+// The janitor - a periodic task, run in a separate thread (goroutine), that removes runs outside their Task's retention limits.
+func runJanitor() {
+	for true {
+		report, _ := pruneAllRuns()
+		for _, reportLine := range report {
+			fmt.Println("Janitor: " + reportLine)
+		}
+		time.Sleep(retentionCheckPeriod * time.Second)
+	}
+}
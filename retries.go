@@ -0,0 +1,130 @@
+package main
+// Retries - a Task that sometimes fails for reasons outside its control (a flaky network, a busy database) can be set to run again
+// automatically when a run fails, rather than needing someone to notice and re-run it. A Task's "retries" option gives how many times to try
+// again, and "retryDelay" how many seconds to wait before each retry (at least 1, and at least the Task's rate limit, if it has one). Each
+// attempt is a run of its own in the run history, and chained Tasks and failure notifications wait for the last attempt. Runs that fail to
+// start (for instance, because the command can't be found) or that are stopped by a user aren't retried, but runs that time out are.
+
+import (
+	// Standard libraries.
+	"fmt"
+	"time"
+	"strconv"
+)
+
+// A retry waiting to start, with the parameters the failed run was given and what the retry's trigger will be (see triggers.go).
+type pendingRetry struct {
+	timer *time.Timer
+	due time.Time
+	attempt int
+	delay int
+	parameters map[string]string
+	trigger runTrigger
+}
+
+// Retries waiting to start, by Task ID.
+var pendingRetries = map[string]*pendingRetry{}
+
+// The attempt number the next run of each Task is, if it's a retry, by Task ID.
+var nextRunAttempts = map[string]int{}
+
+// Returns the given Task's retry settings: how many times to retry a failed run, and how many seconds to wait before each retry. Invalid
+// settings (reported by "webconsole check") count as 0.
+func getRetryPolicy(theTaskDetails map[string]string) (int, int) {
+	taskRetries, _ := strconv.Atoi(theTaskDetails["retries"])
+	retryDelay, _ := strconv.Atoi(theTaskDetails["retrydelay"])
+	rateLimit, _ := strconv.Atoi(theTaskDetails["ratelimit"])
+	if retryDelay < rateLimit {
+		retryDelay = rateLimit
+	}
+	if taskRetries < 0 {
+		taskRetries = 0
+	}
+	// Wait at least a second, so anyone following the Task's output has time to see the end of the failed run before the retry starts.
+	if retryDelay < 1 {
+		retryDelay = 1
+	}
+	return taskRetries, retryDelay
+}
+
+// Returns the attempt number of a Task's run that's just starting - 1 unless the run is a retry. A retry of an earlier run that's still waiting
+// to start is cancelled, as this run takes its place.
+func startRunAttempt(theTaskID string) int {
+	cancelRetry(theTaskID)
+	runAttempt, attemptFound := nextRunAttempts[theTaskID]
+	delete(nextRunAttempts, theTaskID)
+	if !attemptFound {
+		return 1
+	}
+	return runAttempt
+}
+
+// Called when a run of the given Task, started with the given parameters, has failed - if the Task has retries left, schedule the next attempt
+// and return true. The retry's delay starts once startRetryTimer is called, when the failed run has finished tidying up.
+func scheduleRetry(theTaskID string, theTaskDetails map[string]string, theParameters map[string]string, theAttempt int, theRecordOutput func(string, string)) bool {
+	taskRetries, retryDelay := getRetryPolicy(theTaskDetails)
+	if theAttempt > taskRetries {
+		return false
+	}
+	theRecordOutput("system", fmt.Sprintf("Attempt %d of %d failed - retrying in %d seconds.", theAttempt, taskRetries + 1, retryDelay))
+	pendingRetries[theTaskID] = &pendingRetry{attempt: theAttempt + 1, delay: retryDelay, parameters: theParameters,
+		trigger: runTrigger{Kind: "retry", Source: fmt.Sprintf("attempt %d", theAttempt + 1)}}
+	return true
+}
+
+// Start the delay before the given Task's scheduled retry, if it has one.
+func startRetryTimer(theTaskID string) {
+	retry, retryFound := pendingRetries[theTaskID]
+	if !retryFound {
+		return
+	}
+	retry.due = time.Now().Add(time.Duration(retry.delay) * time.Second)
+	retry.timer = time.AfterFunc(time.Duration(retry.delay) * time.Second, func() {
+		if pendingRetries[theTaskID] != retry {
+			return
+		}
+		// The retry stays pending until the run has started, so there's no moment when the Task looks finished.
+		defer delete(pendingRetries, theTaskID)
+		if taskIsRunning(theTaskID) {
+			writeAuditLog(theTaskID, "Retry skipped - the Task is already running.")
+			return
+		}
+		taskDetails, taskErr := getTaskDetails(theTaskID)
+		if taskErr == nil {
+			nextRunAttempts[theTaskID] = retry.attempt
+			taskErr = startTask(theTaskID, taskDetails, retry.parameters, retry.trigger)
+		}
+		if taskErr != nil {
+			delete(nextRunAttempts, theTaskID)
+			writeAuditLog(theTaskID, "Retry couldn't be started: " + taskErr.Error())
+		}
+	})
+}
+
+// Cancel the given Task's retry waiting to start, if it has one. Returns true if there was a retry to cancel.
+func cancelRetry(theTaskID string) bool {
+	retry, retryFound := pendingRetries[theTaskID]
+	if !retryFound {
+		return false
+	}
+	if retry.timer != nil {
+		retry.timer.Stop()
+	}
+	delete(pendingRetries, theTaskID)
+	return true
+}
+
+// Returns true if the given Task has a retry waiting to start.
+func retryPending(theTaskID string) bool {
+	_, retryFound := pendingRetries[theTaskID]
+	return retryFound
+}
+
+// Returns when the given Task's retry waiting to start is due to start, if it has one.
+func getRetryDue(theTaskID string) (time.Time, bool) {
+	retry, retryFound := pendingRetries[theTaskID]
+	if !retryFound || retry.timer == nil {
+		return time.Time{}, false
+	}
+	return retry.due, true
+}
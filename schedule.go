@@ -0,0 +1,148 @@
+package main
+// Schedule overview - so operations teams can see when Tasks have run and will run next, api/admin/getSchedule lists the runs the server has
+// lined up (retries waiting to start - see retries.go - and restarts of service Tasks - see servicemode.go) and each Task's recent runs, as JSON
+// or, with "format=ics", as an iCalendar feed. The feed can be subscribed to from a calendar app using a URL with the admin secret (or a
+// tenant's admin secret, to see just that tenant's Tasks) as a parameter, e.g. https://example.com/api/admin/getSchedule?format=ics&adminSecret=...
+// Each run is an event lasting from when it started to when its log was last written to - a run still in progress lasts until now.
+
+import (
+	// Standard libraries.
+	"os"
+	"fmt"
+	"sort"
+	"time"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// How many days of recent runs to list, unless "days" is given, and the most that can be asked for.
+const defaultScheduleDays = 7
+const maxScheduleDays = 90
+
+// A run in the schedule overview. Upcoming runs don't have a run ID or finish time yet, running ones don't have a finish time.
+type scheduleEntry struct {
+	TaskID string `json:"taskID"`
+	Title string `json:"title"`
+	Kind string `json:"kind"`
+	RunID string `json:"runID,omitempty"`
+	Start int64 `json:"start"`
+	Finish int64 `json:"finish,omitempty"`
+}
+
+// Returns the upcoming and recent runs of the given tenant's Tasks (or all Tasks, if no tenant is given), recent runs going back the given
+// number of days. Upcoming runs are soonest first, recent runs newest first.
+func getSchedule(theTenant *tenant, theDays string) ([]scheduleEntry, []scheduleEntry, error) {
+	scheduleDays := defaultScheduleDays
+	if theDays != "" {
+		var daysErr error
+		scheduleDays, daysErr = strconv.Atoi(theDays)
+		if daysErr != nil || scheduleDays < 0 || scheduleDays > maxScheduleDays {
+			return nil, nil, fmt.Errorf("Invalid days \"%s\" - should be a whole number from 0 to %d.", theDays, maxScheduleDays)
+		}
+	}
+	taskList, taskErr := getTenantTaskList(theTenant)
+	if taskErr != nil {
+		return nil, nil, taskErr
+	}
+	recentSince := time.Now().AddDate(0, 0, -scheduleDays)
+	upcomingRuns := []scheduleEntry{}
+	recentRuns := []scheduleEntry{}
+	for _, task := range taskList {
+		taskID := task["taskID"]
+		if retryDue, retryFound := getRetryDue(taskID); retryFound {
+			upcomingKind := "retry"
+			if taskIsService(task) {
+				upcomingKind = "restart"
+			}
+			upcomingRuns = append(upcomingRuns, scheduleEntry{TaskID: localTaskID(theTenant, taskID), Title: task["title"], Kind: upcomingKind, Start: retryDue.Unix()})
+		}
+		runList, runListErr := getRunList(taskID)
+		if runListErr != nil {
+			return nil, nil, errors.New("Can't read run history of Task " + localTaskID(theTenant, taskID) + ".")
+		}
+		for _, runID := range runList {
+			runStart, parseErr := time.ParseInLocation(runIDFormat, runID, time.Local)
+			if parseErr != nil || runStart.Before(recentSince) {
+				continue
+			}
+			recentRun := scheduleEntry{TaskID: localTaskID(theTenant, taskID), Title: task["title"], Kind: "run", RunID: runID, Start: runStart.Unix()}
+			if taskIsRunning(taskID) && taskRunIDs[taskID] == runID {
+				recentRun.Kind = "running"
+			} else {
+				recentRun.Finish = runStart.Unix()
+				if logInfo, statErr := os.Stat(arguments["taskroot"] + "/" + taskID + "/runs/" + runID + "/log.txt"); statErr == nil && logInfo.ModTime().After(runStart) {
+					recentRun.Finish = logInfo.ModTime().Unix()
+				}
+			}
+			recentRuns = append(recentRuns, recentRun)
+		}
+	}
+	sort.SliceStable(upcomingRuns, func(first int, second int) bool {
+		return upcomingRuns[first].Start < upcomingRuns[second].Start
+	})
+	sort.SliceStable(recentRuns, func(first int, second int) bool {
+		return recentRuns[first].Start > recentRuns[second].Start
+	})
+	return upcomingRuns, recentRuns, nil
+}
+
+// Escape text for an iCalendar property value.
+func escapeICalText(theText string) string {
+	return strings.NewReplacer("\\", "\\\\", ";", "\\;", ",", "\\,", "\r", "", "\n", "\\n").Replace(theText)
+}
+
+// Returns the given iCalendar content line, folded so no line is longer than 75 bytes, ending with CRLF.
+func foldICalLine(theLine string) string {
+	var foldedLine strings.Builder
+	lineLength := 0
+	for _, lineRune := range theLine {
+		runeLength := len(string(lineRune))
+		if lineLength + runeLength > 75 {
+			foldedLine.WriteString("\r\n ")
+			lineLength = 1
+		}
+		foldedLine.WriteRune(lineRune)
+		lineLength = lineLength + runeLength
+	}
+	foldedLine.WriteString("\r\n")
+	return foldedLine.String()
+}
+
+// Returns the given upcoming and recent runs as an iCalendar feed, one event per run.
+func formatScheduleICal(theUpcomingRuns []scheduleEntry, theRecentRuns []scheduleEntry) string {
+	iCalTime := func(theTime int64) string {
+		return time.Unix(theTime, 0).UTC().Format("20060102T150405Z")
+	}
+	iCalNow := time.Now().Unix()
+	iCalLines := []string{"BEGIN:VCALENDAR", "VERSION:2.0", "PRODID:-//Webconsole//Schedule//EN", "CALSCALE:GREGORIAN", "X-WR-CALNAME:Webconsole"}
+	for _, scheduledRun := range append(append([]scheduleEntry{}, theUpcomingRuns...), theRecentRuns...) {
+		eventUID := scheduledRun.TaskID + "-" + scheduledRun.RunID
+		eventSummary := scheduledRun.Title
+		eventDescription := "Task " + scheduledRun.TaskID + ", run " + scheduledRun.RunID + "."
+		eventFinish := scheduledRun.Finish
+		switch scheduledRun.Kind {
+			case "retry", "restart":
+				eventUID = scheduledRun.TaskID + "-" + scheduledRun.Kind + "-" + strconv.FormatInt(scheduledRun.Start, 10)
+				eventSummary = scheduledRun.Title + " (" + scheduledRun.Kind + ")"
+				eventDescription = "Task " + scheduledRun.TaskID + ", " + scheduledRun.Kind + " due to start."
+				eventFinish = scheduledRun.Start
+			case "running":
+				eventSummary = scheduledRun.Title + " (running)"
+				eventFinish = iCalNow
+		}
+		// A calendar event needs to end after it starts, so very short runs are shown as lasting a minute.
+		if eventFinish < scheduledRun.Start + 60 {
+			eventFinish = scheduledRun.Start + 60
+		}
+		iCalLines = append(iCalLines, "BEGIN:VEVENT", "UID:" + escapeICalText(eventUID) + "@webconsole", "DTSTAMP:" + iCalTime(iCalNow),
+			"DTSTART:" + iCalTime(scheduledRun.Start), "DTEND:" + iCalTime(eventFinish), "SUMMARY:" + escapeICalText(eventSummary),
+			"DESCRIPTION:" + escapeICalText(eventDescription), "END:VEVENT")
+	}
+	iCalLines = append(iCalLines, "END:VCALENDAR")
+	var iCalFeed strings.Builder
+	for _, iCalLine := range iCalLines {
+		iCalFeed.WriteString(foldICalLine(iCalLine))
+	}
+	return iCalFeed.String()
+}
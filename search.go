@@ -0,0 +1,102 @@
+package main
+// Searching run history - finding which runs of a Task logged a given line (an error message, say) without downloading every run's log. Each
+// run's log.txt is searched a line at a time, so large logs aren't read into memory, and results are given grep-style: a match as
+// "runID:lineNumber:line", a line of context around a match as "runID-lineNumber-line", with "--" between separate groups of lines.
+
+import (
+	// Standard libraries.
+	"fmt"
+	"sort"
+	"bufio"
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// The most lines of context that can be asked for either side of a match.
+const maxSearchContext = 10
+
+// The most matching lines returned by one search, so a search for something common doesn't return every line of every log.
+const maxSearchMatches = 1000
+
+// Search the logs of the given Task's runs for lines matching theQuery - plain text (not case-sensitive) or, if theRegexp is true, a regular
+// expression - oldest run first unless theNewestFirst is true. Returns the results, with theContext lines either side of each match, and
+// whether the results were cut short at maxSearchMatches.
+func searchRuns(theTaskID string, theQuery string, theRegexp bool, theContext int, theNewestFirst bool) ([]string, bool, error) {
+	var results []string
+	if theQuery == "" {
+		return results, false, errors.New("Missing parameter q.")
+	}
+	if theContext < 0 || theContext > maxSearchContext {
+		return results, false, fmt.Errorf("Invalid context - should be from 0 to %d lines.", maxSearchContext)
+	}
+	var queryRegexp *regexp.Regexp
+	if theRegexp {
+		var regexpErr error
+		if queryRegexp, regexpErr = regexp.Compile(theQuery); regexpErr != nil {
+			return results, false, errors.New("Invalid regular expression - " + regexpErr.Error())
+		}
+	}
+	lineMatches := func(theLine string) bool {
+		if queryRegexp != nil {
+			return queryRegexp.MatchString(theLine)
+		}
+		return strings.Contains(strings.ToLower(theLine), strings.ToLower(theQuery))
+	}
+	runList, listErr := getRunList(theTaskID)
+	if listErr != nil {
+		return results, false, listErr
+	}
+	if theNewestFirst {
+		sort.Sort(sort.Reverse(sort.StringSlice(runList)))
+	}
+	matchCount := 0
+	for _, runID := range runList {
+		// Archived runs are read from the archive - see archive.go.
+		logFile, openErr := openRunFile(theTaskID, runID, "log.txt")
+		if openErr != nil {
+			continue
+		}
+		// The lines before the current one (up to theContext of them), the line number of the last line written to the results, and how
+		// many more lines after a match are still to be written.
+		var previousLines []string
+		lastWritten := 0
+		contextToCome := 0
+		logScanner := bufio.NewScanner(logFile)
+		logScanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+		for lineNumber := 1; logScanner.Scan(); lineNumber = lineNumber + 1 {
+			logLine := logScanner.Text()
+			if lineMatches(logLine) {
+				if matchCount == maxSearchMatches {
+					logFile.Close()
+					return results, true, nil
+				}
+				matchCount = matchCount + 1
+				if lastWritten > 0 && lineNumber - len(previousLines) > lastWritten + 1 {
+					results = append(results, "--")
+				} else if lastWritten == 0 && len(results) > 0 {
+					results = append(results, "--")
+				}
+				for previousPos, previousLine := range previousLines {
+					results = append(results, runID + "-" + strconv.Itoa(lineNumber - len(previousLines) + previousPos) + "-" + previousLine)
+				}
+				results = append(results, runID + ":" + strconv.Itoa(lineNumber) + ":" + logLine)
+				lastWritten = lineNumber
+				contextToCome = theContext
+				previousLines = nil
+			} else if contextToCome > 0 {
+				results = append(results, runID + "-" + strconv.Itoa(lineNumber) + "-" + logLine)
+				lastWritten = lineNumber
+				contextToCome = contextToCome - 1
+			} else if theContext > 0 {
+				previousLines = append(previousLines, logLine)
+				if len(previousLines) > theContext {
+					previousLines = previousLines[1:]
+				}
+			}
+		}
+		logFile.Close()
+	}
+	return results, false, nil
+}
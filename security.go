@@ -0,0 +1,123 @@
+package main
+// Security headers and cross-site request checks. Web Console runs commands on the server, so it's worth making it as hard as possible for other
+// sites to frame its pages or trick a user's browser into making requests to it. Sessions use tokens passed with each request rather than
+// cookies, so a browser never attaches credentials to a request by itself - the token acts as the CSRF token for authenticated calls. The
+// checks here cover the rest: calls that start a Task or log in without an existing token. API calls that change anything are only accepted as
+// POST requests, so that a link or image on another site (which a browser fetches with a GET request) can't make them.
+
+import (
+	// Standard libraries.
+	"net"
+	"errors"
+	"strings"
+	"net/url"
+	"net/http"
+)
+
+// The default Content Security Policy - our pages use inline scripts and styles, but everything else comes from Web Console itself.
+const defaultContentSecurityPolicy = "default-src 'self'; script-src 'self' 'unsafe-inline'; style-src 'self' 'unsafe-inline'; img-src 'self' data:; object-src 'none'; base-uri 'self'; form-action 'self'"
+
+// Returns true if the given request came directly from one of the proxies listed in "trustedproxies".
+func requestFromTrustedProxy(theRequest *http.Request) bool {
+	if arguments["trustedproxies"] == "" {
+		return false
+	}
+	proxyIP, _, splitErr := net.SplitHostPort(theRequest.RemoteAddr)
+	if splitErr != nil {
+		proxyIP = theRequest.RemoteAddr
+	}
+	fromProxy, _ := ipInList(proxyIP, arguments["trustedproxies"])
+	return fromProxy
+}
+
+// Returns true if the given request was made over HTTPS, either directly or via a trusted proxy that says so in "X-Forwarded-Proto".
+func requestIsHTTPS(theRequest *http.Request) bool {
+	if theRequest.TLS != nil {
+		return true
+	}
+	return requestFromTrustedProxy(theRequest) && strings.EqualFold(theRequest.Header.Get("X-Forwarded-Proto"), "https")
+}
+
+// Set the standard security headers on a response. "securityheaders" can be set to "false" to leave them off (e.g. if a reverse proxy adds its
+// own), "contentsecuritypolicy" replaces the default policy ("none" to leave it off), "frameancestors" sets which sites can show our pages in a
+// frame (by default, only Web Console itself) and "hstsmaxage" turns on Strict-Transport-Security for HTTPS requests.
+func setSecurityHeaders(theResponseWriter http.ResponseWriter, theRequest *http.Request) {
+	if arguments["securityheaders"] == "false" {
+		return
+	}
+	responseHeaders := theResponseWriter.Header()
+	responseHeaders.Set("X-Content-Type-Options", "nosniff")
+	responseHeaders.Set("Referrer-Policy", "same-origin")
+	frameAncestors := arguments["frameancestors"]
+	if frameAncestors == "" {
+		frameAncestors = "'self'"
+		responseHeaders.Set("X-Frame-Options", "SAMEORIGIN")
+	}
+	contentSecurityPolicy := arguments["contentsecuritypolicy"]
+	if contentSecurityPolicy == "" {
+		contentSecurityPolicy = defaultContentSecurityPolicy + "; frame-ancestors " + frameAncestors
+	}
+	if contentSecurityPolicy != "none" {
+		responseHeaders.Set("Content-Security-Policy", contentSecurityPolicy)
+	}
+	if arguments["hstsmaxage"] != "" && arguments["hstsmaxage"] != "0" && requestIsHTTPS(theRequest) {
+		responseHeaders.Set("Strict-Transport-Security", "max-age=" + arguments["hstsmaxage"] + "; includeSubDomains")
+	}
+}
+
+// API calls that start, stop or change something, which are only accepted as POST requests.
+var stateChangingAPICalls = []string{"/api/runTask", "/api/stopTask", "/api/signalTask", "/api/uploadFile", "/api/approveTask", "/api/rejectTask",
+	"/api/approveRun", "/api/rejectRun", "/api/admin/createShareLink", "/api/admin/revokeToken", "/api/admin/revokeTaskTokens", "/api/admin/enrolTOTP",
+	"/api/admin/confirmTOTP", "/api/admin/removeTOTP", "/api/admin/changeTaskSecret", "/api/admin/grantQuota", "/api/admin/savePreset",
+	"/api/admin/bulkUpdate", "/api/admin/cloneTask", "/api/admin/purgeData", "/api/admin/setBroadcast", "/api/admin/passkeyRegisterBegin",
+	"/api/admin/passkeyRegisterFinish"}
+
+// Returns true if the given request path is an API call that changes something.
+func isStateChangingAPICall(theRequestPath string) bool {
+	for _, apiCall := range stateChangingAPICalls {
+		if strings.HasPrefix(theRequestPath, apiCall) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check a request (for the given path) didn't come from another site. An API call that changes something has to be a POST request. Browsers
+// send "Sec-Fetch-Site" and "Origin" headers with cross-site requests, so we refuse any POST marked as cross-site or with an Origin that isn't
+// this server or one listed in "allowedorigins". Requests from scripts and command-line tools (which don't send these headers) aren't affected.
+// Set "csrfprotection" to "false" to turn these checks off.
+func checkRequestOrigin(theRequest *http.Request, theRequestPath string) error {
+	if arguments["csrfprotection"] == "false" {
+		return nil
+	}
+	if theRequest.Method != http.MethodPost {
+		if isStateChangingAPICall(theRequestPath) {
+			return errors.New("this call needs a POST request")
+		}
+		return nil
+	}
+	if theRequest.Header.Get("Sec-Fetch-Site") == "cross-site" {
+		return errors.New("cross-site request refused")
+	}
+	requestOrigin := theRequest.Header.Get("Origin")
+	if requestOrigin == "" {
+		return nil
+	}
+	originURL, parseErr := url.Parse(requestOrigin)
+	if parseErr != nil || originURL.Host == "" {
+		return errors.New("invalid Origin \"" + requestOrigin + "\"")
+	}
+	// A reverse proxy might pass requests on with its own Host header, giving the original in "X-Forwarded-Host".
+	if strings.EqualFold(originURL.Host, theRequest.Host) {
+		return nil
+	}
+	if requestFromTrustedProxy(theRequest) && strings.EqualFold(originURL.Host, theRequest.Header.Get("X-Forwarded-Host")) {
+		return nil
+	}
+	for _, allowedOrigin := range strings.Split(arguments["allowedorigins"], ",") {
+		if allowedOrigin = strings.TrimRight(strings.TrimSpace(allowedOrigin), "/"); allowedOrigin != "" && strings.EqualFold(allowedOrigin, requestOrigin) {
+			return nil
+		}
+	}
+	return errors.New("request from other site \"" + requestOrigin + "\" refused")
+}
@@ -0,0 +1,47 @@
+package main
+// Installing Web Console as a service - a systemd unit on Linux (see service_linux.go) or, on Windows, a service run via NSSM (see
+// service_windows.go). Other platforms use the install scripts instead.
+
+import (
+	// Standard libraries.
+	"os"
+	"sort"
+	"path/filepath"
+)
+
+// The name the service is installed under.
+const serviceName = "webconsole"
+
+// Returns the command line the installed service should run: this executable, the "serve" command, the config file, Tasks folder and web root
+// in use (as absolute paths, as services don't start in the current folder) and any other options given alongside "install-service".
+func getServiceCommandLine(theCommandLineArguments map[string]string) ([]string, error) {
+	executablePath, executableErr := os.Executable()
+	if executableErr != nil {
+		return nil, executableErr
+	}
+	serviceArguments := map[string]string{}
+	for argumentName, argumentValue := range theCommandLineArguments {
+		if argumentName != "installservice" && argumentName != "uninstallservice" && argumentName != "start" {
+			serviceArguments[argumentName] = argumentValue
+		}
+	}
+	for _, pathName := range []string{"config", "taskroot", "webroot"} {
+		if arguments[pathName] != "" {
+			absolutePath, absoluteErr := filepath.Abs(arguments[pathName])
+			if absoluteErr != nil {
+				return nil, absoluteErr
+			}
+			serviceArguments[pathName] = absolutePath
+		}
+	}
+	var argumentNames []string
+	for argumentName := range serviceArguments {
+		argumentNames = append(argumentNames, argumentName)
+	}
+	sort.Strings(argumentNames)
+	serviceCommandLine := []string{executablePath, "serve"}
+	for _, argumentName := range argumentNames {
+		serviceCommandLine = append(serviceCommandLine, "--" + argumentName, serviceArguments[argumentName])
+	}
+	return serviceCommandLine, nil
+}
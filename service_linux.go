@@ -0,0 +1,101 @@
+//go:build linux
+// +build linux
+
+package main
+// Installing Web Console as a systemd service on Linux, and telling systemd (via sd_notify) when the web server is ready for requests.
+
+import (
+	// Standard libraries.
+	"os"
+	"net"
+	"errors"
+	"strings"
+	"strconv"
+	"os/exec"
+	"io/ioutil"
+)
+
+// Where the systemd unit file is written.
+const systemdUnitPath = "/etc/systemd/system/" + serviceName + ".service"
+
+// Write a systemd unit file for Web Console, then enable and start the service. The unit uses "Type=notify", so systemd knows Web Console has
+// started once the web server is actually listening. "systemctl reload" upgrades the server to the executable on disk (see upgrade.go).
+func installService(theCommandLineArguments map[string]string) error {
+	serviceCommandLine, commandErr := getServiceCommandLine(theCommandLineArguments)
+	if commandErr != nil {
+		return errors.New("Can't work out service command line - " + commandErr.Error())
+	}
+	// systemd expands "$" and "%" in ExecStart, so those are doubled up, and anything with spaces or quotes in is quoted.
+	for argumentPos, serviceArgument := range serviceCommandLine {
+		serviceArgument = strings.NewReplacer("$", "$$", "%", "%%").Replace(serviceArgument)
+		if strings.ContainsAny(serviceArgument, " \t\"'\\") {
+			serviceArgument = strconv.Quote(serviceArgument)
+		}
+		serviceCommandLine[argumentPos] = serviceArgument
+	}
+	unitContents := "[Unit]\n" +
+		"Description=Web Console\n" +
+		"Wants=network-online.target\n" +
+		"After=network-online.target\n" +
+		"\n" +
+		"[Service]\n" +
+		"Type=notify\n" +
+		"ExecStart=" + strings.Join(serviceCommandLine, " ") + "\n" +
+		"ExecReload=/bin/kill -USR2 $MAINPID\n" +
+		"Restart=always\n" +
+		"RestartSec=4\n" +
+		"\n" +
+		"[Install]\n" +
+		"WantedBy=multi-user.target\n"
+	if writeErr := ioutil.WriteFile(systemdUnitPath, []byte(unitContents), 0644); writeErr != nil {
+		return errors.New("Can't write " + systemdUnitPath + " (are you running as root?) - " + writeErr.Error())
+	}
+	for _, systemctlArguments := range [][]string{{"daemon-reload"}, {"enable", "--now", serviceName}} {
+		if systemctlOutput, systemctlErr := exec.Command("systemctl", systemctlArguments...).CombinedOutput(); systemctlErr != nil {
+			return errors.New("\"systemctl " + strings.Join(systemctlArguments, " ") + "\" failed - " + strings.TrimSpace(string(systemctlOutput)))
+		}
+	}
+	return nil
+}
+
+// Stop and disable the systemd service, then remove its unit file.
+func uninstallService() error {
+	if _, statErr := os.Stat(systemdUnitPath); os.IsNotExist(statErr) {
+		return errors.New("Service isn't installed - no " + systemdUnitPath + " found.")
+	}
+	exec.Command("systemctl", "disable", "--now", serviceName).Run()
+	if removeErr := os.Remove(systemdUnitPath); removeErr != nil {
+		return errors.New("Can't remove " + systemdUnitPath + " (are you running as root?) - " + removeErr.Error())
+	}
+	exec.Command("systemctl", "daemon-reload").Run()
+	return nil
+}
+
+// Tell systemd the web server is ready, if we were started by systemd with "Type=notify" (which sets NOTIFY_SOCKET). Does nothing otherwise.
+func notifyServiceReady() {
+	sendServiceNotification("READY=1")
+}
+
+// Tell systemd the given process (the new server started by an upgrade - see upgrade.go) is now the service's main process, so the service
+// doesn't count as stopped when this one exits.
+func notifyServiceMainPID(theProcessID int) {
+	sendServiceNotification("MAINPID=" + strconv.Itoa(theProcessID))
+}
+
+// Send the given status to systemd, if it started us.
+func sendServiceNotification(theStatus string) {
+	notifySocket := os.Getenv("NOTIFY_SOCKET")
+	if notifySocket == "" {
+		return
+	}
+	// A socket name starting with "@" is in the abstract namespace, which Go writes as a leading zero byte.
+	if strings.HasPrefix(notifySocket, "@") {
+		notifySocket = "\x00" + notifySocket[1:]
+	}
+	notifyConnection, dialErr := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: notifySocket, Net: "unixgram"})
+	if dialErr != nil {
+		return
+	}
+	defer notifyConnection.Close()
+	notifyConnection.Write([]byte(theStatus))
+}
@@ -0,0 +1,24 @@
+//go:build !linux && !windows
+// +build !linux,!windows
+
+package main
+// Installing Web Console as a service is only supported on Linux (systemd) and Windows - elsewhere, use the install scripts.
+
+import (
+	// Standard libraries.
+	"errors"
+)
+
+func installService(theCommandLineArguments map[string]string) error {
+	return errors.New("Installing as a service isn't supported on this platform - see install.sh.")
+}
+
+func uninstallService() error {
+	return errors.New("Installing as a service isn't supported on this platform - see install.sh.")
+}
+
+func notifyServiceReady() {
+}
+
+func notifyServiceMainPID(theProcessID int) {
+}
@@ -0,0 +1,84 @@
+//go:build windows
+// +build windows
+
+package main
+// Installing Web Console as a Windows service. A Windows service has to answer the Service Control Manager, which a plain executable doesn't, so
+// (as install.bat does) we use NSSM, the Non-Sucking Service Manager, to run Web Console as a service.
+
+import (
+	// Standard libraries.
+	"os"
+	"errors"
+	"strings"
+	"os/exec"
+	"path/filepath"
+)
+
+// The service's name is capitalised on Windows, matching install.bat.
+const windowsServiceName = "WebConsole"
+
+// Find nssm.exe - alongside webconsole.exe, in the NSSM folder that comes with Web Console, or on the PATH.
+func findNSSM() (string, error) {
+	executablePath, _ := os.Executable()
+	executableFolder := filepath.Dir(executablePath)
+	for _, nssmPath := range []string{filepath.Join(executableFolder, "nssm.exe"), filepath.Join(executableFolder, "NSSM", "2.24", "win64", "nssm.exe"), filepath.Join("NSSM", "2.24", "win64", "nssm.exe")} {
+		if _, statErr := os.Stat(nssmPath); statErr == nil {
+			return nssmPath, nil
+		}
+	}
+	if nssmPath, lookErr := exec.LookPath("nssm.exe"); lookErr == nil {
+		return nssmPath, nil
+	}
+	return "", errors.New("Can't find nssm.exe - put it alongside webconsole.exe (it's in Web Console's NSSM folder) or on the PATH.")
+}
+
+// Run NSSM with the given arguments, returning any error along with NSSM's output.
+func runNSSM(theNSSMPath string, theArguments ...string) error {
+	nssmOutput, nssmErr := exec.Command(theNSSMPath, theArguments...).CombinedOutput()
+	if nssmErr != nil {
+		// NSSM writes its messages in UTF-16, so strip the zero bytes to make them readable.
+		return errors.New("\"nssm " + strings.Join(theArguments, " ") + "\" failed - " + strings.TrimSpace(strings.Replace(string(nssmOutput), "\x00", "", -1)))
+	}
+	return nil
+}
+
+// Register Web Console as a Windows service, set to start automatically, and start it.
+func installService(theCommandLineArguments map[string]string) error {
+	nssmPath, nssmErr := findNSSM()
+	if nssmErr != nil {
+		return nssmErr
+	}
+	serviceCommandLine, commandErr := getServiceCommandLine(theCommandLineArguments)
+	if commandErr != nil {
+		return errors.New("Can't work out service command line - " + commandErr.Error())
+	}
+	for _, nssmArguments := range [][]string{
+		append([]string{"install", windowsServiceName}, serviceCommandLine...),
+		{"set", windowsServiceName, "DisplayName", "Web Console"},
+		{"set", windowsServiceName, "AppNoConsole", "1"},
+		{"set", windowsServiceName, "Start", "SERVICE_AUTO_START"},
+		{"start", windowsServiceName},
+	} {
+		if runErr := runNSSM(nssmPath, nssmArguments...); runErr != nil {
+			return runErr
+		}
+	}
+	return nil
+}
+
+// Stop and remove the Windows service.
+func uninstallService() error {
+	nssmPath, nssmErr := findNSSM()
+	if nssmErr != nil {
+		return nssmErr
+	}
+	runNSSM(nssmPath, "stop", windowsServiceName)
+	return runNSSM(nssmPath, "remove", windowsServiceName, "confirm")
+}
+
+// NSSM considers the service started as soon as the process is running, so there's nothing to tell it.
+func notifyServiceReady() {
+}
+
+func notifyServiceMainPID(theProcessID int) {
+}
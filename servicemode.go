@@ -0,0 +1,91 @@
+package main
+// Service mode - for Tasks that should always be running (a small service wrapped in a Task), "mode: service" has the server start the Task
+// when the server starts and start it again whenever it exits, for whatever reason, unless a user stopped it. Restarts back off exponentially
+// (1 second, then 2, 4 and so on, up to 5 minutes) while the Task keeps exiting soon after starting, and go back to 1 second once a run has
+// stayed up for a minute. A Task that keeps exiting soon after starting is flagged as being in a crash loop, shown on its page and by
+// api/getTaskStatus. Restarts are scheduled in the same way as retries (see retries.go), so stopping the Task cancels a pending restart too.
+
+import (
+	// Standard libraries.
+	"fmt"
+	"time"
+	"strings"
+)
+
+// How long a run has to stay up to count as healthy, resetting the restart delay.
+const serviceHealthyRuntime = 60 * time.Second
+
+// The longest a service is left before being restarted.
+const serviceMaxRestartDelay = 5 * time.Minute
+
+// How many quick exits in a row count as a crash loop.
+const serviceCrashLoopExits = 5
+
+// The restart history of a service Task: how many times in a row it has exited soon after starting.
+type serviceState struct {
+	quickExits int
+}
+
+// The state of each service Task that has been restarted, by Task ID.
+var serviceStates = map[string]*serviceState{}
+
+// Returns true if the given Task runs in service mode.
+func taskIsService(theTaskDetails map[string]string) bool {
+	return strings.ToLower(strings.TrimSpace(theTaskDetails["mode"])) == "service"
+}
+
+// Returns the delay before a service's next restart, given how many times in a row it has exited soon after starting.
+func getServiceRestartDelay(theQuickExits int) time.Duration {
+	restartDelay := time.Second
+	for exitCount := 1; exitCount < theQuickExits && restartDelay < serviceMaxRestartDelay; exitCount = exitCount + 1 {
+		restartDelay = restartDelay * 2
+	}
+	if restartDelay > serviceMaxRestartDelay {
+		restartDelay = serviceMaxRestartDelay
+	}
+	return restartDelay
+}
+
+// Called when a run of the given service Task, started with the given parameters, has finished after the given time - schedule a restart,
+// with a delay depending on how many times in a row it has exited soon after starting. The restart's delay starts once startRetryTimer is
+// called, when the run has finished tidying up.
+func scheduleServiceRestart(theTaskID string, theParameters map[string]string, theRunTime time.Duration, theRecordOutput func(string, string)) {
+	state, stateFound := serviceStates[theTaskID]
+	if !stateFound {
+		state = &serviceState{}
+		serviceStates[theTaskID] = state
+	}
+	if theRunTime >= serviceHealthyRuntime {
+		state.quickExits = 0
+	}
+	state.quickExits = state.quickExits + 1
+	restartDelay := getServiceRestartDelay(state.quickExits)
+	if state.quickExits >= serviceCrashLoopExits {
+		theRecordOutput("system", fmt.Sprintf("Service exited - crash loop, %d quick exits in a row - restarting in %d seconds.", state.quickExits, int(restartDelay.Seconds())))
+	} else {
+		theRecordOutput("system", fmt.Sprintf("Service exited - restarting in %d seconds.", int(restartDelay.Seconds())))
+	}
+	pendingRetries[theTaskID] = &pendingRetry{attempt: 1, delay: int(restartDelay.Seconds()), parameters: theParameters, trigger: runTrigger{Kind: "service restart"}}
+}
+
+// Forget the given service Task's restart history - called when a user stops it.
+func resetServiceState(theTaskID string) {
+	delete(serviceStates, theTaskID)
+}
+
+// Returns the status of the given Task's service mode for api/getTaskStatus - how many times in a row it has exited soon after starting, and
+// whether that counts as a crash loop - or nil if the Task isn't a service.
+func getServiceStatus(theTaskID string, theTaskDetails map[string]string) map[string]interface{} {
+	if !taskIsService(theTaskDetails) {
+		return nil
+	}
+	quickExits := 0
+	if state, stateFound := serviceStates[theTaskID]; stateFound {
+		quickExits = state.quickExits
+	}
+	// Once a run has stayed up long enough it's no longer in a crash loop, even though it hasn't exited yet to reset the count.
+	if _, taskRunning := runningTasks[theTaskID]; taskRunning && time.Now().Unix() - taskStartTimes[theTaskID] >= int64(serviceHealthyRuntime.Seconds()) {
+		quickExits = 0
+	}
+	return map[string]interface{}{"quickExits": quickExits, "crashLooping": quickExits >= serviceCrashLoopExits}
+}
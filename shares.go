@@ -0,0 +1,177 @@
+package main
+// Share links - signed, expiring URLs, created via the admin API, that let someone view (or, optionally, run) one Task without knowing its
+// secret. Handy for sending a "watch this deployment" link to someone. A share link's token holds the Task ID, what it allows, when it
+// expires and when it was created, signed with the server's share key, so nothing needs storing server-side - any server with the same key (the
+// "sharekey" option, or the sharekey.txt file in the Tasks folder) will accept it, unless it has been revoked (see tokens.go).
+
+import (
+	// Standard libraries.
+	"time"
+	"errors"
+	"strings"
+	"strconv"
+	"net/url"
+	"io/ioutil"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/base64"
+)
+
+// Share link tokens start with this, so they can be told apart from ordinary tokens.
+const shareTokenPrefix = "share-"
+
+// How long a share link lasts if no expiry time is given, in seconds - one day.
+const defaultShareExpiry = 86400
+
+// The API calls a view-only token can make - everything that shows the Task and its output, but nothing that runs, stops or changes it.
+var viewOnlyAPICalls = []string{"/api/getToken", "/api/getTaskDetails", "/api/getTaskOutput", "/api/streamTaskOutput", "/api/getRunList", "/api/searchRuns", "/api/getPipelineStatus",
+	"/api/downloadTaskOutput", "/api/listFiles", "/api/downloadFile", "/api/getApprovalReason", "/api/getPendingRun", "/api/getTaskRunning", "/api/getTaskStatus", "/api/keepAlive",
+	"/api/taskFreshness"}
+
+// What a share link's token holds.
+type shareDetails struct {
+	taskID string
+	scope string
+	expires int64
+	issued int64
+}
+
+// Returns the key share links are signed with - the "sharekey" option if set, otherwise a random key kept in sharekey.txt in the Tasks folder
+// (created the first time it's needed).
+func getShareKey() ([]byte, error) {
+	if arguments["sharekey"] != "" {
+		return []byte(arguments["sharekey"]), nil
+	}
+	keyPath := arguments["taskroot"] + "/sharekey.txt"
+	if keyContents, readErr := ioutil.ReadFile(keyPath); readErr == nil && len(strings.TrimSpace(string(keyContents))) > 0 {
+		return []byte(strings.TrimSpace(string(keyContents))), nil
+	}
+	newKey := make([]byte, 32)
+	if _, randErr := rand.Read(newKey); randErr != nil {
+		return nil, randErr
+	}
+	if writeErr := ioutil.WriteFile(keyPath, []byte(hex.EncodeToString(newKey)), 0600); writeErr != nil {
+		return nil, errors.New("Can't write share key file " + keyPath + ".")
+	}
+	return []byte(hex.EncodeToString(newKey)), nil
+}
+
+// Returns the signature for the given share token payload.
+func signSharePayload(thePayload string) (string, error) {
+	shareKey, keyErr := getShareKey()
+	if keyErr != nil {
+		return "", keyErr
+	}
+	payloadMAC := hmac.New(sha256.New, shareKey)
+	payloadMAC.Write([]byte(thePayload))
+	return base64.RawURLEncoding.EncodeToString(payloadMAC.Sum(nil)), nil
+}
+
+// Create a share link token for the given Task, allowing the given scope ("view" or "run") until the given time.
+func createShareToken(theTaskID string, theScope string, theExpires time.Time) (string, error) {
+	sharePayload := base64.RawURLEncoding.EncodeToString([]byte(theTaskID + "\n" + theScope + "\n" + strconv.FormatInt(theExpires.Unix(), 10) + "\n" + strconv.FormatInt(time.Now().Unix(), 10)))
+	payloadSignature, signErr := signSharePayload(sharePayload)
+	if signErr != nil {
+		return "", signErr
+	}
+	return shareTokenPrefix + sharePayload + "." + payloadSignature, nil
+}
+
+// Check a share link token is genuine, and return what it holds. Share links created by older versions don't say when they were created, so
+// count as created at the start of time.
+func parseShareToken(theToken string) (shareDetails, error) {
+	tokenSplit := strings.SplitN(strings.TrimPrefix(theToken, shareTokenPrefix), ".", 2)
+	if len(tokenSplit) != 2 {
+		return shareDetails{}, errors.New("invalid share link")
+	}
+	expectedSignature, signErr := signSharePayload(tokenSplit[0])
+	if signErr != nil || !hmac.Equal([]byte(expectedSignature), []byte(tokenSplit[1])) {
+		return shareDetails{}, errors.New("invalid share link")
+	}
+	payloadBytes, decodeErr := base64.RawURLEncoding.DecodeString(tokenSplit[0])
+	payloadFields := strings.Split(string(payloadBytes), "\n")
+	if decodeErr != nil || len(payloadFields) < 3 || len(payloadFields) > 4 {
+		return shareDetails{}, errors.New("invalid share link")
+	}
+	shareExpires, expiresErr := strconv.ParseInt(payloadFields[2], 10, 64)
+	if expiresErr != nil {
+		return shareDetails{}, errors.New("invalid share link")
+	}
+	shareIssued := int64(0)
+	if len(payloadFields) == 4 {
+		var issuedErr error
+		if shareIssued, issuedErr = strconv.ParseInt(payloadFields[3], 10, 64); issuedErr != nil {
+			return shareDetails{}, errors.New("invalid share link")
+		}
+	}
+	return shareDetails{payloadFields[0], payloadFields[1], shareExpires, shareIssued}, nil
+}
+
+// Check a share link token is genuine, for the given Task, hasn't expired and hasn't been revoked. Returns the scope it allows.
+func checkShareToken(theToken string, theTaskID string) (string, error) {
+	share, parseErr := parseShareToken(theToken)
+	if parseErr != nil || share.taskID != theTaskID {
+		return "", errors.New("invalid share link")
+	}
+	if time.Now().Unix() > share.expires {
+		return "", errors.New("share link has expired")
+	}
+	if tokenRevoked(theToken, theTaskID, share.issued) {
+		return "", errors.New("share link has been revoked")
+	}
+	return share.scope, nil
+}
+
+// Create a share link for the given Task, allowing the given scope ("view", the default, or "run") for the given number of seconds (defaults to
+// one day). Returns the link - a full URL if the "baseurl" option is set, otherwise a path to add to the server's address. For a tenant's Task
+// (see tenants.go), the link is to the Task at the tenant's address.
+func createShareLink(theTaskID string, theScope string, theExpiry string, theTenant *tenant) (string, error) {
+	if _, taskErr := getTaskDetails(theTaskID); taskErr != nil {
+		return "", taskErr
+	}
+	if theScope == "" {
+		theScope = "view"
+	}
+	if theScope != "view" && theScope != "run" {
+		return "", errors.New("Invalid scope \"" + theScope + "\" - should be \"view\" or \"run\".")
+	}
+	shareExpiry := defaultShareExpiry
+	if theExpiry != "" {
+		var expiryErr error
+		shareExpiry, expiryErr = strconv.Atoi(theExpiry)
+		if expiryErr != nil || shareExpiry < 1 {
+			return "", errors.New("Invalid expiry \"" + theExpiry + "\" - should be a number of seconds.")
+		}
+	}
+	shareExpires := time.Now().Add(time.Duration(shareExpiry) * time.Second)
+	shareToken, tokenErr := createShareToken(theTaskID, theScope, shareExpires)
+	if tokenErr != nil {
+		return "", tokenErr
+	}
+	writeAuditLog(theTaskID, "Share link (" + theScope + ") created, expires " + shareExpires.Format("2006-01-02 15:04:05") + ".")
+	sharePath := "/view?taskID=" + url.QueryEscape(localTaskID(theTenant, theTaskID)) + "&share=" + shareToken
+	if theTenant != nil {
+		sharePath = theTenant.prefix + sharePath
+	}
+	// The base URL is the server's own address, so isn't used for tenants served at host names of their own.
+	if arguments["baseurl"] != "" && (theTenant == nil || len(theTenant.hosts) == 0) {
+		return strings.TrimRight(arguments["baseurl"], "/") + sharePath, nil
+	}
+	return arguments["pathprefix"] + sharePath, nil
+}
+
+// Returns true if a token with the given scope can make the given request.
+func scopeAllowsRequest(theScope string, theRequestPath string) bool {
+	// The plain view (see plainview.go) checks the scope itself before running or stopping anything.
+	if theScope != "view" || strings.HasPrefix(theRequestPath, "/view") || strings.HasPrefix(theRequestPath, "/run") || strings.HasPrefix(theRequestPath, "/plain") {
+		return true
+	}
+	for _, viewOnlyAPICall := range viewOnlyAPICalls {
+		if strings.HasPrefix(theRequestPath, viewOnlyAPICall) {
+			return true
+		}
+	}
+	return false
+}
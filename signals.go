@@ -0,0 +1,74 @@
+package main
+// Sending signals to running Tasks - many programs do something useful on a signal short of stopping: reload their config on SIGHUP, dump
+// their status on SIGUSR1 and so on. A Task's "signals" option lists the signals that can be sent to it with api/signalTask (e.g. "HUP,USR1"),
+// and none can be sent unless it's set. Signals go to the Task's own process (or, for a pipeline, each step that's running) rather than its
+// whole process group, as a signal is usually meant for the program the Task runs, not the shell wrapped round it. View-only tokens and share
+// links can't send signals. Windows doesn't have signals, so nothing can be sent there.
+
+import (
+	// Standard libraries.
+	"errors"
+	"strings"
+)
+
+// Returns the given signal name in the form used in platformSignals - upper case, without the "SIG" prefix.
+func normaliseSignalName(theSignalName string) string {
+	return strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(theSignalName)), "SIG")
+}
+
+// Returns the names of the signals the given Task allows to be sent to it.
+func getAllowedSignals(theTaskDetails map[string]string) []string {
+	var allowedSignals []string
+	for _, signalName := range strings.Split(theTaskDetails["signals"], ",") {
+		if normaliseSignalName(signalName) != "" {
+			allowedSignals = append(allowedSignals, normaliseSignalName(signalName))
+		}
+	}
+	return allowedSignals
+}
+
+// Check the given Task's "signals" option, returning a problem for each signal that can't be sent on this platform.
+func checkTaskSignals(theTaskDetails map[string]string) []string {
+	var problems []string
+	for _, signalName := range getAllowedSignals(theTaskDetails) {
+		if _, signalFound := platformSignals[signalName]; !signalFound {
+			problems = append(problems, "Unknown signal \"" + signalName + "\" in signals - it can't be sent on this platform.")
+		}
+	}
+	return problems
+}
+
+// Send the named signal to the given running Task. The signal has to be one of those listed in the Task's "signals" option.
+func signalTask(theTaskID string, theTaskDetails map[string]string, theSignalName string) error {
+	signalName := normaliseSignalName(theSignalName)
+	if signalName == "" {
+		return errors.New("Missing parameter signal.")
+	}
+	signalAllowed := false
+	for _, allowedSignal := range getAllowedSignals(theTaskDetails) {
+		if allowedSignal == signalName {
+			signalAllowed = true
+		}
+	}
+	if !signalAllowed {
+		return errors.New("SIG" + signalName + " can't be sent to this Task - see its \"signals\" option.")
+	}
+	taskSignal, signalFound := platformSignals[signalName]
+	if !signalFound {
+		return errors.New("SIG" + signalName + " can't be sent on this platform.")
+	}
+	if theTaskDetails["runner"] != "" {
+		return errors.New("Signals can't be sent to Tasks run on an agent.")
+	}
+	taskProcesses := getTaskProcesses(theTaskID)
+	if len(taskProcesses) == 0 {
+		return errors.New("Task isn't running.")
+	}
+	for _, taskProcess := range taskProcesses {
+		if signalErr := taskProcess.Process.Signal(taskSignal); signalErr != nil {
+			return errors.New("Couldn't send SIG" + signalName + " - " + signalErr.Error())
+		}
+	}
+	writeAuditLog(theTaskID, "Run " + taskRunIDs[theTaskID] + " sent SIG" + signalName + ".")
+	return nil
+}
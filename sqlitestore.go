@@ -0,0 +1,206 @@
+package main
+// A SQLite store for Task configs, run history and tokens - see store.go.
+
+import (
+	// Standard libraries.
+	"os"
+	"time"
+	"errors"
+	"strings"
+	"io/ioutil"
+	"database/sql"
+
+	// A pure-Go SQLite driver, so no C compiler is needed to build Web Console.
+	_ "modernc.org/sqlite"
+)
+
+// The tables used in the SQLite database.
+var sqliteSchema = []string{
+	"CREATE TABLE IF NOT EXISTS tasks (taskID TEXT PRIMARY KEY, config TEXT NOT NULL)",
+	"CREATE TABLE IF NOT EXISTS runs (taskID TEXT NOT NULL, runID TEXT NOT NULL, started INTEGER, finished INTEGER, result TEXT, PRIMARY KEY (taskID, runID))",
+	"CREATE TABLE IF NOT EXISTS tokens (token TEXT PRIMARY KEY, kind TEXT NOT NULL, name TEXT, lastUsed INTEGER NOT NULL)",
+}
+
+// Columns added to tables since they were first created, added to existing databases when opened.
+var sqliteAddedColumns = []string{
+	"ALTER TABLE tokens ADD COLUMN taskID TEXT",
+	"ALTER TABLE tokens ADD COLUMN issued INTEGER",
+	"ALTER TABLE tokens ADD COLUMN clientIP TEXT",
+}
+
+// Keeps Task configs, run history and tokens in a SQLite database. Each Task still has a folder in the Tasks folder for its files.
+type sqliteStore struct {
+	database *sql.DB
+	taskRoot string
+}
+
+// Open (creating if needed) the SQLite database at the given path. The config and run history of any Tasks in the Tasks folder that aren't in
+// the database yet are imported.
+func openSQLiteStore(thePath string) (*sqliteStore, error) {
+	sqliteDB, openErr := sql.Open("sqlite", thePath)
+	if openErr != nil {
+		return nil, errors.New("Can't open SQLite database - " + openErr.Error())
+	}
+	// SQLite only allows one writer at a time, so use a single connection rather than have requests fail with "database is locked".
+	sqliteDB.SetMaxOpenConns(1)
+	for _, schemaStatement := range sqliteSchema {
+		if _, schemaErr := sqliteDB.Exec(schemaStatement); schemaErr != nil {
+			sqliteDB.Close()
+			return nil, errors.New("Can't set up SQLite database - " + schemaErr.Error())
+		}
+	}
+	for _, columnStatement := range sqliteAddedColumns {
+		if _, columnErr := sqliteDB.Exec(columnStatement); columnErr != nil && !strings.Contains(columnErr.Error(), "duplicate column") {
+			sqliteDB.Close()
+			return nil, errors.New("Can't set up SQLite database - " + columnErr.Error())
+		}
+	}
+	databaseStore := &sqliteStore{sqliteDB, arguments["taskroot"]}
+	return databaseStore, databaseStore.importTaskFiles()
+}
+
+// Import the config and run history of any Tasks in the Tasks folder that aren't in the database yet.
+func (theStore *sqliteStore) importTaskFiles() error {
+	taskIDs, listErr := fileStore{theStore.taskRoot}.ListTaskIDs()
+	if listErr != nil {
+		return nil
+	}
+	for _, taskID := range taskIDs {
+		configContents, configErr := ioutil.ReadFile(theStore.taskRoot + "/" + taskID + "/config.txt")
+		if configErr != nil {
+			continue
+		}
+		importResult, importErr := theStore.database.Exec("INSERT OR IGNORE INTO tasks (taskID, config) VALUES (?, ?)", taskID, string(configContents))
+		if importErr != nil {
+			return errors.New("Can't import Task " + taskID + " - " + importErr.Error())
+		}
+		if rowsImported, _ := importResult.RowsAffected(); rowsImported == 0 {
+			continue
+		}
+		runFolders, _ := ioutil.ReadDir(theStore.taskRoot + "/" + taskID + "/runs")
+		for _, runFolder := range runFolders {
+			if runFolder.IsDir() && runIDRegexp.MatchString(runFolder.Name()) {
+				runStarted, _ := time.ParseInLocation(runIDFormat, runFolder.Name(), time.Local)
+				theStore.database.Exec("INSERT OR IGNORE INTO runs (taskID, runID, started, finished, result) VALUES (?, ?, ?, ?, '')", taskID, runFolder.Name(), runStarted.Unix(), runFolder.ModTime().Unix())
+			}
+		}
+		writeAuditLog(taskID, "Task imported into SQLite database.")
+	}
+	return nil
+}
+
+func (theStore *sqliteStore) ReadTaskConfig(theTaskID string) ([]byte, error) {
+	var taskConfig string
+	if queryErr := theStore.database.QueryRow("SELECT config FROM tasks WHERE taskID = ?", theTaskID).Scan(&taskConfig); queryErr != nil {
+		if queryErr == sql.ErrNoRows {
+			return nil, os.ErrNotExist
+		}
+		return nil, queryErr
+	}
+	return []byte(taskConfig), nil
+}
+
+// Also creates the Task's folder, if needed.
+func (theStore *sqliteStore) WriteTaskConfig(theTaskID string, theConfig []byte) error {
+	if mkdirErr := os.MkdirAll(theStore.taskRoot + "/" + theTaskID, os.ModePerm); mkdirErr != nil {
+		return mkdirErr
+	}
+	_, execErr := theStore.database.Exec("INSERT INTO tasks (taskID, config) VALUES (?, ?) ON CONFLICT (taskID) DO UPDATE SET config = excluded.config", theTaskID, string(theConfig))
+	return execErr
+}
+
+// Returns the strings in the first column of the results of the given query.
+func (theStore *sqliteStore) queryStrings(theQuery string, theArguments ...interface{}) ([]string, error) {
+	var queryStrings []string
+	queryRows, queryErr := theStore.database.Query(theQuery, theArguments...)
+	if queryErr != nil {
+		return queryStrings, queryErr
+	}
+	defer queryRows.Close()
+	for queryRows.Next() {
+		var queryString string
+		if scanErr := queryRows.Scan(&queryString); scanErr == nil {
+			queryStrings = append(queryStrings, queryString)
+		}
+	}
+	return queryStrings, queryRows.Err()
+}
+
+func (theStore *sqliteStore) ListTaskIDs() ([]string, error) {
+	return theStore.queryStrings("SELECT taskID FROM tasks ORDER BY taskID")
+}
+
+func (theStore *sqliteStore) DeleteTask(theTaskID string) error {
+	_, execErr := theStore.database.Exec("DELETE FROM tasks WHERE taskID = ?", theTaskID)
+	return execErr
+}
+
+func (theStore *sqliteStore) RecordRunStart(theTaskID string, theRunID string, theStarted int64) error {
+	_, execErr := theStore.database.Exec("INSERT OR REPLACE INTO runs (taskID, runID, started, finished, result) VALUES (?, ?, ?, 0, '')", theTaskID, theRunID, theStarted)
+	return execErr
+}
+
+func (theStore *sqliteStore) RecordRunFinish(theTaskID string, theRunID string, theFinished int64, theResult string) error {
+	_, execErr := theStore.database.Exec("UPDATE runs SET finished = ?, result = ? WHERE taskID = ? AND runID = ?", theFinished, theResult, theTaskID, theRunID)
+	return execErr
+}
+
+func (theStore *sqliteStore) GetRunFinish(theTaskID string, theRunID string) (int64, string, error) {
+	var runFinished int64
+	var runResult string
+	queryErr := theStore.database.QueryRow("SELECT finished, result FROM runs WHERE taskID = ? AND runID = ?", theTaskID, theRunID).Scan(&runFinished, &runResult)
+	if queryErr == sql.ErrNoRows {
+		return 0, "", nil
+	}
+	return runFinished, runResult, queryErr
+}
+
+func (theStore *sqliteStore) ListRunIDs(theTaskID string) ([]string, error) {
+	return theStore.queryStrings("SELECT runID FROM runs WHERE taskID = ? ORDER BY runID", theTaskID)
+}
+
+func (theStore *sqliteStore) DeleteRuns(theTaskID string) error {
+	_, execErr := theStore.database.Exec("DELETE FROM runs WHERE taskID = ?", theTaskID)
+	return execErr
+}
+
+func (theStore *sqliteStore) DeleteRun(theTaskID string, theRunID string) error {
+	_, execErr := theStore.database.Exec("DELETE FROM runs WHERE taskID = ? AND runID = ?", theTaskID, theRunID)
+	return execErr
+}
+
+func (theStore *sqliteStore) SaveToken(theToken savedToken) error {
+	_, execErr := theStore.database.Exec("INSERT INTO tokens (token, kind, name, lastUsed, taskID, issued, clientIP) VALUES (?, ?, ?, ?, ?, ?, ?) ON CONFLICT (token) DO UPDATE SET lastUsed = excluded.lastUsed",
+		theToken.token, theToken.kind, theToken.name, theToken.lastUsed, theToken.taskID, theToken.issued, theToken.clientIP)
+	return execErr
+}
+
+func (theStore *sqliteStore) DeleteToken(theToken string) error {
+	_, execErr := theStore.database.Exec("DELETE FROM tokens WHERE token = ?", theToken)
+	return execErr
+}
+
+func (theStore *sqliteStore) DeleteExpiredTokens(theCutoff int64) error {
+	_, execErr := theStore.database.Exec("DELETE FROM tokens WHERE lastUsed < ?", theCutoff)
+	return execErr
+}
+
+func (theStore *sqliteStore) LoadTokens() ([]savedToken, error) {
+	var savedTokens []savedToken
+	tokenRows, queryErr := theStore.database.Query("SELECT token, kind, name, lastUsed, taskID, issued, clientIP FROM tokens")
+	if queryErr != nil {
+		return savedTokens, queryErr
+	}
+	defer tokenRows.Close()
+	for tokenRows.Next() {
+		var loadedToken savedToken
+		var tokenName, tokenTaskID, tokenClientIP sql.NullString
+		var tokenIssued sql.NullInt64
+		if scanErr := tokenRows.Scan(&loadedToken.token, &loadedToken.kind, &tokenName, &loadedToken.lastUsed, &tokenTaskID, &tokenIssued, &tokenClientIP); scanErr == nil {
+			loadedToken.name = tokenName.String
+			loadedToken.taskID, loadedToken.issued, loadedToken.clientIP = tokenTaskID.String, tokenIssued.Int64, tokenClientIP.String
+			savedTokens = append(savedTokens, loadedToken)
+		}
+	}
+	return savedTokens, tokenRows.Err()
+}
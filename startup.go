@@ -0,0 +1,88 @@
+package main
+// Starting Tasks when the server starts - for Tasks that are really daemons (a small service wrapped in a Task) or warm-up jobs (filling a
+// cache, checking a mount), set "runOnStartup: Y" and the Task is run each time the server starts, once it's ready for requests. How the most
+// recent startup run went is kept (in memory - it's about this start of the server) and returned by api/getTaskStatus, so a monitoring check
+// can tell whether a server came up properly. If a startup run fails and is retried (see retries.go), the retries count as part of it.
+
+import (
+	// Standard libraries.
+	"fmt"
+)
+
+// A run started when the server started: its run ID (once it has one), whether it's running or waiting to be retried, and how it went.
+type startupRun struct {
+	runID string
+	running bool
+	retrying bool
+	result string
+}
+
+// The startup run of each Task with runOnStartup set, by Task ID.
+var startupRuns = map[string]*startupRun{}
+
+// Start every Task that has runOnStartup set, and every Task in service mode (see servicemode.go).
+func startStartupTasks() {
+	taskIDs, listErr := taskStore.ListTaskIDs()
+	if listErr != nil {
+		fmt.Println("ERROR: Can't list Tasks to run on startup - " + listErr.Error())
+		return
+	}
+	for _, taskID := range taskIDs {
+		taskDetails, taskErr := getTaskDetails(taskID)
+		if taskErr != nil || (taskDetails["runonstartup"] != "Y" && !taskIsService(taskDetails)) {
+			continue
+		}
+		run := &startupRun{running: true}
+		startupRuns[taskID] = run
+		writeAuditLog(taskID, "Run started on server startup.")
+		if startErr := startTask(taskID, taskDetails, map[string]string{}, runTrigger{Kind: "startup"}); startErr != nil {
+			run.running = false
+			run.result = startErr.Error()
+			fmt.Println("ERROR: Couldn't start Task " + taskID + " on startup - " + startErr.Error())
+		} else {
+			fmt.Println("Started Task " + taskID + " on startup.")
+		}
+	}
+}
+
+// Called as each run of the given Task starts, with its run ID and attempt number - if it's the Task's startup run (or a retry of it), record
+// its run ID.
+func noteStartupRun(theTaskID string, theRunID string, theAttempt int) {
+	run, runFound := startupRuns[theTaskID]
+	if !runFound {
+		return
+	}
+	if (run.running && run.runID == "") || (run.retrying && theAttempt > 1) {
+		run.runID = theRunID
+		run.running = true
+		run.retrying = false
+	}
+}
+
+// Called as each run of the given Task finishes, with its run ID, result (blank for success) and whether it's going to be retried - if it's the
+// Task's startup run, record how it went.
+func finishStartupRun(theTaskID string, theRunID string, theResult string, theRetrying bool) {
+	if run, runFound := startupRuns[theTaskID]; runFound && run.running && run.runID == theRunID {
+		run.running = false
+		run.retrying = theRetrying
+		run.result = theResult
+	}
+}
+
+// Returns the status of the given Task's startup run for api/getTaskStatus - "running", "retrying", "succeeded" or "failed", along with its
+// run ID and, if it failed, why - or nil if the Task wasn't run on startup.
+func getStartupRunStatus(theTaskID string) map[string]interface{} {
+	run, runFound := startupRuns[theTaskID]
+	if !runFound {
+		return nil
+	}
+	runStatus := "succeeded"
+	if run.running {
+		runStatus = "running"
+	} else if run.retrying && retryPending(theTaskID) {
+		runStatus = "retrying"
+	} else if run.result != "" {
+		runStatus = "failed"
+	}
+	return map[string]interface{}{"runID": run.runID, "status": runStatus, "error": run.result}
+}
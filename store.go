@@ -0,0 +1,286 @@
+package main
+// Storage for Task metadata, run history and tokens, behind three interfaces - TaskStore, RunStore and TokenStore - so other backends can be
+// added (or, in tests, replaced with something simple). By default everything is kept in text files in the Tasks folder (each Task's config.txt
+// and runs folder) and tokens are kept in memory only. For busier installs, "--store sqlite:webconsole.db" keeps all of these in a single SQLite
+// database instead (see sqlitestore.go). Either way, each Task still has its own folder in the Tasks folder for its scripts, uploads and logs.
+
+import (
+	// Standard libraries.
+	"os"
+	"sort"
+	"time"
+	"errors"
+	"strconv"
+	"strings"
+	"io/ioutil"
+	"path/filepath"
+)
+
+// Stores each Task's config, in the same "keyword: value" format as a config.txt file.
+type TaskStore interface {
+	// Returns the given Task's config. The error satisfies os.IsNotExist if there is no such Task.
+	ReadTaskConfig(theTaskID string) ([]byte, error)
+	// Writes the given Task's config, adding the Task if it doesn't exist yet.
+	WriteTaskConfig(theTaskID string, theConfig []byte) error
+	// Returns the IDs of all Tasks, sorted.
+	ListTaskIDs() ([]string, error)
+	// Removes the given Task's config. The Task's folder is dealt with by the caller.
+	DeleteTask(theTaskID string) error
+}
+
+// Stores the history of each Task's runs. The output of each run is always kept in log files in the run's folder.
+type RunStore interface {
+	// Records the start of a run.
+	RecordRunStart(theTaskID string, theRunID string, theStarted int64) error
+	// Records the end of a run, with its result - blank for success, otherwise the error.
+	RecordRunFinish(theTaskID string, theRunID string, theFinished int64, theResult string) error
+	// Returns when a run finished and its result, as recorded by RecordRunFinish - a finish time of 0 if that hasn't been recorded.
+	GetRunFinish(theTaskID string, theRunID string) (int64, string, error)
+	// Returns the run IDs of the given Task's runs, oldest first.
+	ListRunIDs(theTaskID string) ([]string, error)
+	// Removes the history of all the given Task's runs.
+	DeleteRuns(theTaskID string) error
+	// Removes the history of one run. The run's folder is dealt with by the caller.
+	DeleteRun(theTaskID string, theRunID string) error
+}
+
+// A token saved by a TokenStore: a "task", "admin" or "agent" token, with the token's scope for task tokens (see tokenScopes) or the agent's
+// name for agent tokens, and when it was last used. Task tokens also have the Task they were issued for, when and to which client (see
+// tokens.go).
+type savedToken struct {
+	kind string
+	token string
+	name string
+	lastUsed int64
+	taskID string
+	issued int64
+	clientIP string
+}
+
+// Stores issued tokens, so they can survive a restart.
+type TokenStore interface {
+	// Saves a token, or updates when it was last used.
+	SaveToken(theToken savedToken) error
+	// Removes tokens last used before the given time.
+	DeleteExpiredTokens(theCutoff int64) error
+	// Removes the given token, e.g. when it's revoked.
+	DeleteToken(theToken string) error
+	// Returns all saved tokens.
+	LoadTokens() ([]savedToken, error)
+}
+
+// The stores in use.
+var taskStore TaskStore
+var runStore RunStore
+var tokenStore TokenStore
+
+// A description of the stores in use, for the startup summary.
+var storeDescription = ""
+
+// The file, in each run's folder, a fileStore records the run's finish in.
+const runFinishFile = "finish.txt"
+
+// Keeps Task configs and run history in text files in the Tasks folder. Tokens are only kept in memory.
+type fileStore struct {
+	taskRoot string
+}
+
+func (theStore fileStore) ReadTaskConfig(theTaskID string) ([]byte, error) {
+	taskFolder, folderErr := getTaskFolderPath(theStore.taskRoot, theTaskID)
+	if folderErr != nil {
+		return nil, folderErr
+	}
+	return ioutil.ReadFile(filepath.Join(taskFolder, "config.txt"))
+}
+
+// The new file is written alongside the old one, then moved into place.
+func (theStore fileStore) WriteTaskConfig(theTaskID string, theConfig []byte) error {
+	taskFolder, folderErr := getTaskFolderPath(theStore.taskRoot, theTaskID)
+	if folderErr != nil {
+		return folderErr
+	}
+	configPath := filepath.Join(taskFolder, "config.txt")
+	if mkdirErr := os.MkdirAll(taskFolder, os.ModePerm); mkdirErr != nil {
+		return mkdirErr
+	}
+	if writeErr := ioutil.WriteFile(configPath + ".new", theConfig, 0644); writeErr != nil {
+		return writeErr
+	}
+	return os.Rename(configPath + ".new", configPath)
+}
+
+// Each subfolder of the Tasks folder is a Task. The Tasks folder can also hold files shared by all Tasks (formatting.js, favicon.png, the audit
+// log), those are skipped, as are folders whose names aren't valid Task IDs (see taskids.go). Subfolders that are tenants (see tenants.go) hold
+// Tasks of their own, listed as "tenant/taskID".
+func (theStore fileStore) ListTaskIDs() ([]string, error) {
+	var taskIDs []string
+	taskFolders, readDirErr := ioutil.ReadDir(theStore.taskRoot)
+	if readDirErr != nil {
+		return taskIDs, readDirErr
+	}
+	for _, taskFolder := range taskFolders {
+		if taskFolder.IsDir() && isTenantFolder(theStore.taskRoot + "/" + taskFolder.Name()) {
+			tenantFolders, tenantErr := ioutil.ReadDir(theStore.taskRoot + "/" + taskFolder.Name())
+			if tenantErr != nil {
+				return taskIDs, tenantErr
+			}
+			for _, tenantFolder := range tenantFolders {
+				if tenantFolder.IsDir() && checkTaskID(tenantFolder.Name()) == nil {
+					taskIDs = append(taskIDs, taskFolder.Name() + "/" + tenantFolder.Name())
+				}
+			}
+		} else if taskFolder.IsDir() && checkTaskID(taskFolder.Name()) == nil {
+			taskIDs = append(taskIDs, taskFolder.Name())
+		}
+	}
+	return taskIDs, nil
+}
+
+// The config file is in the Task's folder, so goes when the folder does.
+func (theStore fileStore) DeleteTask(theTaskID string) error {
+	return nil
+}
+
+// The run's folder (created by runTask) is the record of the run, so there's nothing more to do.
+func (theStore fileStore) RecordRunStart(theTaskID string, theRunID string, theStarted int64) error {
+	return nil
+}
+
+// A run's finish time and result are kept in its folder, in finish.txt - the time (as a Unix timestamp) on the first line, then the result.
+func (theStore fileStore) RecordRunFinish(theTaskID string, theRunID string, theFinished int64, theResult string) error {
+	return ioutil.WriteFile(theStore.taskRoot + "/" + theTaskID + "/runs/" + theRunID + "/" + runFinishFile, []byte(strconv.FormatInt(theFinished, 10) + "\n" + theResult), 0644)
+}
+
+// Runs from before finish.txt was written, or that never finished, have no finish time.
+func (theStore fileStore) GetRunFinish(theTaskID string, theRunID string) (int64, string, error) {
+	finishContents, readErr := readRunFile(theTaskID, theRunID, runFinishFile)
+	if os.IsNotExist(readErr) {
+		return 0, "", nil
+	} else if readErr != nil {
+		return 0, "", readErr
+	}
+	finishSplit := strings.SplitN(string(finishContents), "\n", 2)
+	runFinished, _ := strconv.ParseInt(finishSplit[0], 10, 64)
+	if len(finishSplit) < 2 {
+		return runFinished, "", nil
+	}
+	return runFinished, finishSplit[1], nil
+}
+
+func (theStore fileStore) ListRunIDs(theTaskID string) ([]string, error) {
+	var runList []string
+	runFolders, readDirErr := ioutil.ReadDir(theStore.taskRoot + "/" + theTaskID + "/runs")
+	if readDirErr != nil {
+		if os.IsNotExist(readDirErr) {
+			return runList, nil
+		}
+		return runList, readDirErr
+	}
+	for _, runFolder := range runFolders {
+		if runFolder.IsDir() && runIDRegexp.MatchString(runFolder.Name()) {
+			runList = append(runList, runFolder.Name())
+		}
+	}
+	sort.Strings(runList)
+	return runList, nil
+}
+
+// Run folders are in the Task's folder, so go when the folder does.
+func (theStore fileStore) DeleteRuns(theTaskID string) error {
+	return nil
+}
+
+// The run's folder is the record of the run, so once it's gone so is the run.
+func (theStore fileStore) DeleteRun(theTaskID string, theRunID string) error {
+	return nil
+}
+
+func (theStore fileStore) SaveToken(theToken savedToken) error {
+	return nil
+}
+
+func (theStore fileStore) DeleteExpiredTokens(theCutoff int64) error {
+	return nil
+}
+
+func (theStore fileStore) DeleteToken(theToken string) error {
+	return nil
+}
+
+func (theStore fileStore) LoadTokens() ([]savedToken, error) {
+	return nil, nil
+}
+
+// Set up the stores given by the "store" option - "files" (the default) or "sqlite:path" - and load any saved tokens back into memory.
+func openStore() error {
+	switch {
+		case arguments["store"] == "" || arguments["store"] == "files":
+			filesStore := fileStore{arguments["taskroot"]}
+			taskStore, runStore, tokenStore = filesStore, filesStore, filesStore
+			storeDescription = "text files in " + arguments["taskroot"]
+		case strings.HasPrefix(arguments["store"], "sqlite:") && arguments["store"] != "sqlite:":
+			databaseStore, openErr := openSQLiteStore(strings.TrimPrefix(arguments["store"], "sqlite:"))
+			if openErr != nil {
+				return openErr
+			}
+			taskStore, runStore, tokenStore = databaseStore, databaseStore, databaseStore
+			storeDescription = "SQLite database " + strings.TrimPrefix(arguments["store"], "sqlite:")
+		default:
+			return errors.New("Unknown store \"" + arguments["store"] + "\" - should be \"files\" or \"sqlite:path\".")
+	}
+	savedTokens, loadErr := tokenStore.LoadTokens()
+	if loadErr != nil {
+		return errors.New("Can't load saved tokens - " + loadErr.Error())
+	}
+	for _, loadedToken := range savedTokens {
+		switch loadedToken.kind {
+			case "task":
+				tokens[loadedToken.token] = loadedToken.lastUsed
+				if loadedToken.name != "" {
+					tokenScopes[loadedToken.token] = loadedToken.name
+				}
+				if loadedToken.taskID != "" {
+					taskTokenDetails[loadedToken.token] = tokenDetails{loadedToken.taskID, loadedToken.issued, loadedToken.clientIP}
+				}
+			case "admin":
+				adminTokens[loadedToken.token] = loadedToken.lastUsed
+			case "agent":
+				agentTokens[loadedToken.token] = loadedToken.name
+				if loadedToken.lastUsed > agentLastSeen[loadedToken.name] {
+					agentLastSeen[loadedToken.name] = loadedToken.lastUsed
+				}
+		}
+	}
+	return nil
+}
+
+// Returns true if a Task with the given ID exists (or there's a folder with that name in the Tasks folder, so the ID can't be used).
+func taskExists(theTaskID string) bool {
+	if _, statErr := os.Stat(arguments["taskroot"] + "/" + theTaskID); !os.IsNotExist(statErr) {
+		return true
+	}
+	_, readErr := taskStore.ReadTaskConfig(theTaskID)
+	return !os.IsNotExist(readErr)
+}
+
+// Issue a new admin token, generated with the system's secure random number generator so it can't be guessed, and save it.
+func issueAdminToken() (string, error) {
+	adminToken, randomErr := generateSecureRandomString()
+	if randomErr != nil {
+		return "", randomErr
+	}
+	adminTokens[adminToken] = time.Now().Unix()
+	saveToken("admin", adminToken, "", adminTokens[adminToken])
+	return adminToken, nil
+}
+
+// Save a token (a "task", "admin" or "agent" token - task tokens are also given their scope, agent tokens the agent's name) along with when it
+// was last used, and share it with other servers via Redis, if in use.
+func saveToken(theKind string, theToken string, theName string, theLastUsed int64) {
+	tokenToSave := savedToken{kind: theKind, token: theToken, name: theName, lastUsed: theLastUsed}
+	if details, detailsFound := taskTokenDetails[theToken]; detailsFound && theKind == "task" {
+		tokenToSave.taskID, tokenToSave.issued, tokenToSave.clientIP = details.taskID, details.issued, details.clientIP
+	}
+	tokenStore.SaveToken(tokenToSave)
+	saveSharedToken(tokenToSave)
+}
@@ -0,0 +1,53 @@
+package main
+// Strict arguments - with the "strictArguments" option set, the parameters a Task is run with (from webhooks, presets or api/runTask - see
+// presets.go and parameters.go) are added to the end of its command line as arguments of their own, "--name=value", in order of name. The
+// command is split into arguments before anything from outside is added to it (an uploaded file's name, given by <<UPLOAD>>, is put in
+// afterwards, and can only ever be part of the argument it's in), and no shell is involved in running it, so whatever a parameter's value is,
+// it reaches the Task as a single argument and nothing else - command injection can't happen, whether or not the Task has parameter rules. For
+// that to hold, a Task with strict arguments can't use the "shell" option, or be a batch file (which Windows runs with cmd, which reads its
+// arguments again). Parameters are still passed as WEBCONSOLE_PARAM_ environment variables as well.
+
+import (
+	// Standard libraries.
+	"sort"
+	"errors"
+	"strings"
+	"path/filepath"
+)
+
+// Returns true if the given Task's parameters are passed as arguments of their own.
+func taskUsesStrictArguments(theTaskDetails map[string]string) bool {
+	return theTaskDetails["strictarguments"] == "Y"
+}
+
+// Check the given command (split into arguments, but not yet changed for the platform) can be run with strict arguments.
+func checkStrictCommand(theCommandArray []string) error {
+	if len(theCommandArray) == 0 {
+		return nil
+	}
+	if commandExtension := strings.ToLower(filepath.Ext(theCommandArray[0])); commandExtension == ".bat" || commandExtension == ".cmd" {
+		return errors.New("Batch files can't be run with strictArguments - cmd reads their arguments again.")
+	}
+	return nil
+}
+
+// Returns the given command line with the given uploaded file's name filled in and, for a Task with strict arguments, the given parameters
+// added to the end.
+func addStrictArguments(theCommandArray []string, theTaskDetails map[string]string, theUpload string, theParameters map[string]string) []string {
+	if !taskUsesStrictArguments(theTaskDetails) || len(theCommandArray) == 0 {
+		return theCommandArray
+	}
+	var commandArray []string
+	for _, commandArgument := range theCommandArray {
+		commandArray = append(commandArray, strings.Replace(commandArgument, "<<UPLOAD>>", theUpload, -1))
+	}
+	var parameterNames []string
+	for parameterName := range theParameters {
+		parameterNames = append(parameterNames, parameterName)
+	}
+	sort.Strings(parameterNames)
+	for _, parameterName := range parameterNames {
+		commandArray = append(commandArray, "--" + parameterName + "=" + theParameters[parameterName])
+	}
+	return commandArray
+}
@@ -0,0 +1,74 @@
+package main
+// Task tags - a comma-separated list of labels in a Task's "tags" config value (e.g. "tags: Backups, Nightly"), used to pick out groups of Tasks:
+// filtering and grouping the public Task list on the landing page, the admin listTasks API call and bulkUpdate. Tags aren't case-sensitive, but
+// are shown as first written.
+
+import (
+	// Standard libraries.
+	"sort"
+	"strings"
+)
+
+// Returns the given Task's tags, in the order given.
+func getTaskTags(theTaskDetails map[string]string) []string {
+	var taskTags []string
+	for _, taskTag := range strings.Split(theTaskDetails["tags"], ",") {
+		if strings.TrimSpace(taskTag) != "" {
+			taskTags = append(taskTags, strings.TrimSpace(taskTag))
+		}
+	}
+	return taskTags
+}
+
+// Returns true if the given Task has the given tag. Every Task matches a blank tag.
+func taskHasTag(theTaskDetails map[string]string, theTag string) bool {
+	if strings.TrimSpace(theTag) == "" {
+		return true
+	}
+	for _, taskTag := range getTaskTags(theTaskDetails) {
+		if strings.EqualFold(taskTag, strings.TrimSpace(theTag)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the Tasks in the given list that have the given tag (or all of them, for a blank tag).
+func filterTasksByTag(theTaskList []map[string]string, theTag string) []map[string]string {
+	var filteredTasks []map[string]string
+	for _, task := range theTaskList {
+		if taskHasTag(task, theTag) {
+			filteredTasks = append(filteredTasks, task)
+		}
+	}
+	return filteredTasks
+}
+
+// Groups the given Tasks by tag, returning the tags found (sorted, with "" - for Tasks with no tags - first, if there are any) and the Tasks
+// with each tag. A Task with several tags is in several groups.
+func groupTasksByTag(theTaskList []map[string]string) ([]string, map[string][]map[string]string) {
+	taskGroups := map[string][]map[string]string{}
+	// The same tag may be written differently by different Tasks - the group takes the first spelling found.
+	groupNames := map[string]string{}
+	for _, task := range theTaskList {
+		taskTags := getTaskTags(task)
+		if len(taskTags) == 0 {
+			taskTags = []string{""}
+		}
+		for _, taskTag := range taskTags {
+			if _, groupFound := groupNames[strings.ToLower(taskTag)]; !groupFound {
+				groupNames[strings.ToLower(taskTag)] = taskTag
+			}
+			groupName := groupNames[strings.ToLower(taskTag)]
+			taskGroups[groupName] = append(taskGroups[groupName], task)
+		}
+	}
+	var groupList []string
+	for _, groupName := range groupNames {
+		groupList = append(groupList, groupName)
+	}
+	sort.Slice(groupList, func(i, j int) bool {
+		return strings.ToLower(groupList[i]) < strings.ToLower(groupList[j])
+	})
+	return groupList, taskGroups
+}
@@ -0,0 +1,58 @@
+package main
+// Task ID validation. Task IDs come from clients (in requests, webhook URLs and bundles) and each is the name of a folder in the Tasks folder,
+// so a Task ID can only be made of letters, digits, "-" and "_", and be at most 64 characters long - anything else, such as "../etc", is
+// refused before it gets anywhere near the filesystem. A Task belonging to a tenant (see tenants.go) has an internal ID of the form
+// "tenant/taskID", each part of which has to be valid. As a second line of defence, Task folder paths are checked to be inside the Tasks folder
+// once they've been made into absolute paths.
+
+import (
+	// Standard libraries.
+	"errors"
+	"regexp"
+	"strings"
+	"path/filepath"
+)
+
+// The longest a Task ID can be.
+const maxTaskIDLength = 64
+
+var taskIDRegexp = regexp.MustCompile("^[A-Za-z0-9_-]+$")
+
+// Check that the given Task ID (as a client gives it, not including any tenant) is valid.
+func checkTaskID(theTaskID string) error {
+	if len(theTaskID) > maxTaskIDLength {
+		return errors.New("Invalid Task ID - should be at most 64 characters long.")
+	}
+	if !taskIDRegexp.MatchString(theTaskID) {
+		return errors.New("Invalid Task ID - should only contain letters, digits, \"-\" and \"_\".")
+	}
+	return nil
+}
+
+// Check that the given internal Task ID - a Task ID, or "tenant/taskID" for a Task belonging to a tenant - is valid.
+func checkInternalTaskID(theTaskID string) error {
+	for _, taskIDPart := range strings.SplitN(theTaskID, "/", 2) {
+		if idErr := checkTaskID(taskIDPart); idErr != nil {
+			return idErr
+		}
+	}
+	return nil
+}
+
+// Returns the path of the given Task's folder inside the given Tasks folder, checking that the Task ID is valid and that the resulting path
+// really is inside the Tasks folder.
+func getTaskFolderPath(theTaskRoot string, theTaskID string) (string, error) {
+	if idErr := checkInternalTaskID(theTaskID); idErr != nil {
+		return "", idErr
+	}
+	taskRoot, rootErr := filepath.Abs(theTaskRoot)
+	if rootErr != nil {
+		return "", errors.New("Can't find Tasks folder.")
+	}
+	taskFolder := filepath.Join(taskRoot, filepath.FromSlash(theTaskID))
+	relativePath, relativeErr := filepath.Rel(taskRoot, taskFolder)
+	if relativeErr != nil || relativePath == "." || relativePath == ".." || strings.HasPrefix(relativePath, ".." + string(filepath.Separator)) {
+		return "", errors.New("Invalid Task ID.")
+	}
+	return taskFolder, nil
+}
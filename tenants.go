@@ -0,0 +1,287 @@
+package main
+// Tenants - one server can host several separate sets of Tasks (for instance, one per department), each with its own Tasks, admin secret,
+// branding and landing page. A tenant is a subfolder of the Tasks folder containing a "tenant.txt" file; the tenant's Tasks are the subfolders
+// of that folder, laid out just like the main Tasks folder. tenant.txt has the same "keyword: value" format as a Task's config file:
+//   hosts: finance.example.com, finance.example.org - host names the tenant is served at.
+//   prefix: /finance - a URL path the tenant is served under, e.g. http://example.com/finance/.
+//   adminSecret: a hash (as generated by "webconsole --hash") of the tenant's own admin secret.
+//   webroot: a folder (relative to the tenant's folder, if not absolute) of web files to use in place of the server's own - any file not found
+//            there is served from the server's webroot, so a tenant can replace just index.html or favicon.png.
+// Requests made at a tenant's host name or under its prefix only see that tenant's Tasks, and Task IDs given by clients are taken to be in the
+// tenant's namespace. Internally, a tenant's Tasks have IDs of the form "tenant/taskID", which matches where they're stored in the Tasks folder.
+// The server's own admin secret works for every tenant, a tenant's admin secret only for that tenant, and only for the admin API calls that
+// apply to its own Tasks. Tenants are read from the Tasks folder as needed, so can be added or changed without restarting the server.
+
+import (
+	// Standard libraries.
+	"os"
+	"net"
+	"bufio"
+	"bytes"
+	"errors"
+	"strings"
+	"net/http"
+	"io/ioutil"
+	"path/filepath"
+)
+
+// The name of the file marking a subfolder of the Tasks folder as a tenant.
+const tenantConfigFile = "tenant.txt"
+
+// A tenant's settings, as read from its tenant.txt file.
+type tenant struct {
+	name string
+	hosts []string
+	prefix string
+	adminSecret string
+	webroot string
+}
+
+// Admin API calls a tenant's admin secret can be used for - the rest apply to the whole server.
+var tenantAdminAPICalls = []string{"/api/admin/listTasks", "/api/admin/createShareLink", "/api/admin/bulkUpdate", "/api/admin/getSchedule", "/api/admin/listTokens",
+	"/api/admin/revokeToken", "/api/admin/revokeTaskTokens", "/api/admin/changeTaskSecret", "/api/admin/grantQuota",
+	"/api/admin/getHealth", "/api/admin/savePreset"}
+
+// Config values a tenant's admin secret can change with api/admin/bulkUpdate. Anything that decides what a Task runs or which files on the server
+// it uses (its command, shell, workdir, path, gitKey and so on) needs the server's admin secret, or a tenant's admin could run commands as the
+// server and reach other tenants' Tasks.
+var tenantBulkUpdateKeys = []string{"title", "tags", "public", "ratelimit", "progress", "timeout", "retries", "retrydelay"}
+
+// Returns true if the given config value can be changed with a tenant's admin secret.
+func isTenantBulkUpdateKey(theKey string) bool {
+	for _, tenantKey := range tenantBulkUpdateKeys {
+		if strings.ToLower(theKey) == tenantKey {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns true if the given folder (a subfolder of the Tasks folder) is a tenant.
+func isTenantFolder(theFolderPath string) bool {
+	_, statErr := os.Stat(theFolderPath + "/" + tenantConfigFile)
+	return statErr == nil
+}
+
+// Read the given tenant's settings from its tenant.txt file.
+func readTenant(theTenantName string) (*tenant, error) {
+	tenantContents, readErr := ioutil.ReadFile(arguments["taskroot"] + "/" + theTenantName + "/" + tenantConfigFile)
+	if readErr != nil {
+		return nil, errors.New("Can't open " + tenantConfigFile + " for tenant " + theTenantName + ".")
+	}
+	newTenant := &tenant{name: theTenantName}
+	scanner := bufio.NewScanner(bytes.NewReader(tenantContents))
+	for scanner.Scan() {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		itemSplit := strings.SplitN(scanner.Text(), ":", 2)
+		if len(itemSplit) < 2 {
+			return nil, errors.New("Invalid line \"" + scanner.Text() + "\" in " + tenantConfigFile + " for tenant " + theTenantName + " - should be \"keyword: value\".")
+		}
+		itemValue := strings.TrimSpace(itemSplit[1])
+		switch strings.ToLower(strings.TrimSpace(itemSplit[0])) {
+			case "hosts":
+				for _, tenantHost := range strings.Split(itemValue, ",") {
+					if strings.TrimSpace(tenantHost) != "" {
+						newTenant.hosts = append(newTenant.hosts, strings.ToLower(strings.TrimSpace(tenantHost)))
+					}
+				}
+			case "prefix":
+				if strings.Trim(itemValue, "/") != "" {
+					newTenant.prefix = "/" + strings.Trim(itemValue, "/")
+				}
+			case "adminsecret":
+				newTenant.adminSecret = itemValue
+			case "webroot":
+				newTenant.webroot = itemValue
+				if newTenant.webroot != "" && !filepath.IsAbs(newTenant.webroot) {
+					newTenant.webroot = arguments["taskroot"] + "/" + theTenantName + "/" + newTenant.webroot
+				}
+		}
+	}
+	return newTenant, nil
+}
+
+// Returns every tenant defined in the Tasks folder. Tenants with an invalid tenant.txt are skipped (they're reported at startup).
+func getTenants() []*tenant {
+	var tenantList []*tenant
+	taskFolders, readDirErr := ioutil.ReadDir(arguments["taskroot"])
+	if readDirErr != nil {
+		return tenantList
+	}
+	for _, taskFolder := range taskFolders {
+		if taskFolder.IsDir() && isTenantFolder(arguments["taskroot"] + "/" + taskFolder.Name()) {
+			if newTenant, tenantErr := readTenant(taskFolder.Name()); tenantErr == nil {
+				tenantList = append(tenantList, newTenant)
+			}
+		}
+	}
+	return tenantList
+}
+
+// Returns the tenant the given request was made to, or nil for the server's own Tasks, along with the request path with any tenant prefix
+// removed. Host names are matched first, then prefixes.
+func getRequestTenant(theRequest *http.Request, theRequestPath string) (*tenant, string) {
+	requestHost, _, splitErr := net.SplitHostPort(theRequest.Host)
+	if splitErr != nil {
+		requestHost = theRequest.Host
+	}
+	requestHost = strings.ToLower(requestHost)
+	tenantList := getTenants()
+	for _, requestTenant := range tenantList {
+		for _, tenantHost := range requestTenant.hosts {
+			if tenantHost == requestHost {
+				return requestTenant, theRequestPath
+			}
+		}
+	}
+	for _, requestTenant := range tenantList {
+		if requestTenant.prefix != "" && (theRequestPath == requestTenant.prefix || strings.HasPrefix(theRequestPath, requestTenant.prefix + "/")) {
+			return requestTenant, theRequestPath[len(requestTenant.prefix):]
+		}
+	}
+	return nil, theRequestPath
+}
+
+// Returns the internal ID of the given Task of the given tenant.
+func tenantTaskID(theTenant *tenant, theTaskID string) string {
+	if theTenant == nil {
+		return theTaskID
+	}
+	return theTenant.name + "/" + theTaskID
+}
+
+// Returns the ID the given tenant knows the given Task by - the reverse of tenantTaskID.
+func localTaskID(theTenant *tenant, theTaskID string) string {
+	if theTenant == nil {
+		return theTaskID
+	}
+	return strings.TrimPrefix(theTaskID, theTenant.name + "/")
+}
+
+// Returns true if the given Task (given by internal ID) belongs to the given tenant.
+func taskInTenant(theTenant *tenant, theTaskID string) bool {
+	if theTenant == nil {
+		return !strings.Contains(theTaskID, "/")
+	}
+	return strings.HasPrefix(theTaskID, theTenant.name + "/")
+}
+
+// Returns a list of task details for the given tenant's Tasks.
+func getTenantTaskList(theTenant *tenant) ([]map[string]string, error) {
+	var tenantTasks []map[string]string
+	taskList, taskErr := getTaskList()
+	for _, task := range taskList {
+		if taskInTenant(theTenant, task["taskID"]) {
+			tenantTasks = append(tenantTasks, task)
+		}
+	}
+	return tenantTasks, taskErr
+}
+
+// Take the "taskID" given with a request to be in the namespace of the tenant the request was made to, replacing it with the Task's internal ID.
+func setRequestTaskID(theRequest *http.Request, theTenant *tenant) error {
+	taskID := theRequest.Form.Get("taskID")
+	if taskID == "" {
+		return nil
+	}
+	if idErr := checkTaskID(taskID); idErr != nil {
+		return idErr
+	}
+	theRequest.Form.Set("taskID", tenantTaskID(theTenant, taskID))
+	return nil
+}
+
+// Returns the folder holding the given tenant's Tasks.
+func getTenantFolder(theTenant *tenant) string {
+	if theTenant == nil {
+		return arguments["taskroot"]
+	}
+	return arguments["taskroot"] + "/" + theTenant.name
+}
+
+// Returns the path of the given web file for the given tenant - from the tenant's webroot if it has one and the file is there, otherwise from
+// the server's webroot.
+func getWebrootPath(theTenant *tenant, theFilename string) string {
+	if theTenant != nil && theTenant.webroot != "" {
+		tenantPath := filepath.Join(theTenant.webroot, filepath.Clean("/" + theFilename))
+		if _, statErr := os.Stat(tenantPath); statErr == nil {
+			return tenantPath
+		}
+	}
+	return arguments["webroot"] + "/" + strings.TrimPrefix(theFilename, "/")
+}
+
+// Returns the URL path the given tenant is served at - the server's path prefix, followed by the tenant's prefix, if it has one.
+func getTenantPathPrefix(theTenant *tenant) string {
+	if theTenant == nil {
+		return arguments["pathprefix"]
+	}
+	return arguments["pathprefix"] + theTenant.prefix
+}
+
+// Returns "server" if the given request includes the server's admin secret (or an admin token), "tenant" if it includes the admin secret of
+// the given tenant, or "" if neither.
+func getAdminScope(theRequest *http.Request, theTenant *tenant) string {
+	if isAdminRequest(theRequest) {
+		return "server"
+	}
+	if theTenant != nil && theTenant.adminSecret != "" && checkPasswordHash(getRequestCredential(theRequest, "adminSecret", true), theTenant.adminSecret) {
+		return "tenant"
+	}
+	return ""
+}
+
+// Returns true if the given admin API call can be made with a tenant's admin secret.
+func isTenantAdminAPICall(theRequestPath string) bool {
+	for _, apiCall := range tenantAdminAPICalls {
+		if strings.HasPrefix(theRequestPath, apiCall) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check every tenant's tenant.txt, returning a problem for each that can't be read or clashes with another tenant.
+func checkTenants() []string {
+	var problems []string
+	taskFolders, readDirErr := ioutil.ReadDir(arguments["taskroot"])
+	if readDirErr != nil {
+		return problems
+	}
+	tenantHosts := map[string]string{}
+	tenantPrefixes := map[string]string{}
+	for _, taskFolder := range taskFolders {
+		if !taskFolder.IsDir() || !isTenantFolder(arguments["taskroot"] + "/" + taskFolder.Name()) {
+			continue
+		}
+		checkTenant, tenantErr := readTenant(taskFolder.Name())
+		if tenantErr != nil {
+			problems = append(problems, tenantErr.Error())
+			continue
+		}
+		if len(checkTenant.hosts) == 0 && checkTenant.prefix == "" {
+			problems = append(problems, "Tenant " + checkTenant.name + " has no hosts or prefix set, so can't be reached.")
+		}
+		if checkTenant.adminSecret != "" && !isPasswordHash(checkTenant.adminSecret) {
+			problems = append(problems, "adminSecret for tenant " + checkTenant.name + " should be a Bcrypt or Argon2id hash, as printed by \"webconsole --hash yoursecret\".")
+		}
+		for _, tenantHost := range checkTenant.hosts {
+			if otherTenant, hostFound := tenantHosts[tenantHost]; hostFound {
+				problems = append(problems, "Tenants " + otherTenant + " and " + checkTenant.name + " both use host " + tenantHost + ".")
+			}
+			tenantHosts[tenantHost] = checkTenant.name
+		}
+		if otherTenant, prefixFound := tenantPrefixes[checkTenant.prefix]; prefixFound && checkTenant.prefix != "" {
+			problems = append(problems, "Tenants " + otherTenant + " and " + checkTenant.name + " both use prefix " + checkTenant.prefix + ".")
+		}
+		tenantPrefixes[checkTenant.prefix] = checkTenant.name
+		if checkTenant.webroot != "" {
+			if _, statErr := os.Stat(checkTenant.webroot); statErr != nil {
+				problems = append(problems, "Can't find webroot \"" + checkTenant.webroot + "\" for tenant " + checkTenant.name + ".")
+			}
+		}
+	}
+	return problems
+}
@@ -0,0 +1,260 @@
+package main
+// Token management. Each token a Task's secret is exchanged for is recorded with the Task it was issued for, when and to which client IP
+// address, and is only accepted for that Task. The admin API can list the active tokens, and revoke them - a single token (or share link, see
+// shares.go), or every token and share link for a Task, e.g. after its secret has changed or a share link has leaked. Revocations are kept in
+// revocations.txt in the Tasks folder, one per line: "token", a token's ID and the time (as a Unix timestamp) until which it stays revoked,
+// or "task", a Task ID and the time before which its tokens and share links were issued. The file is read again whenever it changes, so with
+// several servers sharing the Tasks folder (see redis.go) a revocation made on one applies on all of them. Changing a Task's secret (from the
+// command line, "webconsole task secret abc123", or with the admin API) revokes its tokens and share links the same way, so a running server
+// stops accepting them as soon as the new secret is set.
+
+import (
+	// Standard libraries.
+	"os"
+	"sort"
+	"time"
+	"bufio"
+	"errors"
+	"strconv"
+	"strings"
+	"io/ioutil"
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// Where and when a task token was issued.
+type tokenDetails struct {
+	taskID string
+	issued int64
+	clientIP string
+}
+
+// An active token, as listed by the admin API. Tokens aren't given out, only their IDs - enough to revoke them.
+type tokenListEntry struct {
+	TokenID string `json:"tokenID"`
+	TaskID string `json:"taskID"`
+	Scope string `json:"scope"`
+	Issued int64 `json:"issued"`
+	LastUsed int64 `json:"lastUsed"`
+	ClientIP string `json:"clientIP"`
+}
+
+// The details of each task token. Tokens saved before details were recorded have none, and are accepted for any Task as before.
+var taskTokenDetails = map[string]tokenDetails{}
+
+// Revoked tokens (by token ID), with the time until which they stay revoked, and Tasks whose tokens issued before the given time are revoked.
+var revokedTokens = map[string]int64{}
+var revokedTaskTokens = map[string]int64{}
+
+// When revocations.txt was last changed, so it's only read again when it changes.
+var revocationsModTime time.Time
+
+// The name of the revocations file in the Tasks folder.
+const revocationsFile = "revocations.txt"
+
+// Returns the ID a token is listed and revoked by - a hash of the token, so listing tokens doesn't give them away.
+func getTokenID(theToken string) string {
+	tokenHash := sha256.Sum256([]byte(theToken))
+	return hex.EncodeToString(tokenHash[:8])
+}
+
+// Issue a new token for the given Task to the given client at the given time, generated with the system's secure random number generator so
+// it can't be guessed.
+func issueTaskToken(theTaskID string, theClientIP string, theIssued int64) (string, error) {
+	taskToken, randomErr := generateSecureRandomString()
+	if randomErr != nil {
+		return "", randomErr
+	}
+	recordTokenIssued(taskToken, theTaskID, theClientIP, theIssued)
+	return taskToken, nil
+}
+
+// Record that the given token was issued for the given Task to the given client at the given time.
+func recordTokenIssued(theToken string, theTaskID string, theClientIP string, theIssued int64) {
+	taskTokenDetails[theToken] = tokenDetails{theTaskID, theIssued, theClientIP}
+}
+
+// Read revocations.txt if it has changed since it was last read.
+func loadRevocations() {
+	revocationsPath := arguments["taskroot"] + "/" + revocationsFile
+	fileInfo, statErr := os.Stat(revocationsPath)
+	if statErr != nil || fileInfo.ModTime().Equal(revocationsModTime) {
+		return
+	}
+	revocationsContents, readErr := ioutil.ReadFile(revocationsPath)
+	if readErr != nil {
+		return
+	}
+	revocationsModTime = fileInfo.ModTime()
+	revokedTokens = map[string]int64{}
+	revokedTaskTokens = map[string]int64{}
+	scanner := bufio.NewScanner(strings.NewReader(string(revocationsContents)))
+	for scanner.Scan() {
+		lineFields := strings.Split(scanner.Text(), "\t")
+		if len(lineFields) != 3 {
+			continue
+		}
+		revocationTime, parseErr := strconv.ParseInt(lineFields[2], 10, 64)
+		if parseErr != nil {
+			continue
+		}
+		if lineFields[0] == "token" {
+			revokedTokens[lineFields[1]] = revocationTime
+		} else if lineFields[0] == "task" {
+			revokedTaskTokens[lineFields[1]] = revocationTime
+		}
+	}
+}
+
+// Write the current revocations to revocations.txt, leaving out tokens that no longer need to be revoked.
+func saveRevocations() error {
+	currentTimestamp := time.Now().Unix()
+	var revocationLines []string
+	for tokenID, revokedUntil := range revokedTokens {
+		if revokedUntil > currentTimestamp {
+			revocationLines = append(revocationLines, "token\t" + tokenID + "\t" + strconv.FormatInt(revokedUntil, 10))
+		}
+	}
+	for taskID, revokedBefore := range revokedTaskTokens {
+		revocationLines = append(revocationLines, "task\t" + taskID + "\t" + strconv.FormatInt(revokedBefore, 10))
+	}
+	sort.Strings(revocationLines)
+	revocationsPath := arguments["taskroot"] + "/" + revocationsFile
+	if writeErr := ioutil.WriteFile(revocationsPath + ".new", []byte(strings.Join(revocationLines, "\n") + "\n"), 0600); writeErr != nil {
+		return errors.New("Can't write " + revocationsFile + ".")
+	}
+	if renameErr := os.Rename(revocationsPath + ".new", revocationsPath); renameErr != nil {
+		return errors.New("Can't write " + revocationsFile + ".")
+	}
+	if fileInfo, statErr := os.Stat(revocationsPath); statErr == nil {
+		revocationsModTime = fileInfo.ModTime()
+	}
+	return nil
+}
+
+// Returns true if the given token (or share link token), issued for the given Task at the given time, has been revoked.
+func tokenRevoked(theToken string, theTaskID string, theIssued int64) bool {
+	loadRevocations()
+	if revokedUntil, tokenFound := revokedTokens[getTokenID(theToken)]; tokenFound && time.Now().Unix() < revokedUntil {
+		return true
+	}
+	revokedBefore, taskFound := revokedTaskTokens[theTaskID]
+	return taskFound && theIssued < revokedBefore
+}
+
+// Check the given (valid) task token can be used for the given Task - it was issued for that Task and hasn't been revoked. A revoked token
+// is forgotten.
+func checkTaskToken(theToken string, theTaskID string) error {
+	details, detailsFound := taskTokenDetails[theToken]
+	if detailsFound && details.taskID != theTaskID {
+		return errors.New("token issued for a different Task")
+	}
+	if tokenRevoked(theToken, theTaskID, details.issued) {
+		removeToken(theToken)
+		return errors.New("revoked token")
+	}
+	return nil
+}
+
+// Record that the given task token (with the given scope) has just been used, in memory, in the token store and in Redis, so it doesn't expire
+// while it's in use - even after a restart, when tokens are loaded back from the store.
+func touchTaskToken(theToken string, theScope string) {
+	tokens[theToken] = time.Now().Unix()
+	if theScope != "" {
+		tokenScopes[theToken] = theScope
+	}
+	saveToken("task", theToken, theScope, tokens[theToken])
+}
+
+// Forget the given task token, on this server, in the token store and in Redis.
+func removeToken(theToken string) {
+	delete(tokens, theToken)
+	delete(tokenScopes, theToken)
+	delete(taskTokenDetails, theToken)
+	tokenStore.DeleteToken(theToken)
+	deleteSharedToken(theToken)
+}
+
+// Returns the active task tokens for the given tenant's Tasks (or just the given Task, if one is given), oldest first. With several servers,
+// only tokens this server has issued or accepted are listed.
+func listTokens(theTenant *tenant, theTaskID string) []tokenListEntry {
+	tokenList := []tokenListEntry{}
+	for token, lastUsed := range tokens {
+		details := taskTokenDetails[token]
+		if details.taskID == "" && theTaskID == "" && theTenant == nil {
+			tokenList = append(tokenList, tokenListEntry{TokenID: getTokenID(token), Scope: tokenScopes[token], LastUsed: lastUsed})
+		} else if details.taskID != "" && taskInTenant(theTenant, details.taskID) && (theTaskID == "" || details.taskID == theTaskID) {
+			tokenList = append(tokenList, tokenListEntry{getTokenID(token), localTaskID(theTenant, details.taskID), tokenScopes[token], details.issued, lastUsed, details.clientIP})
+		}
+	}
+	sort.Slice(tokenList, func(first int, second int) bool {
+		return tokenList[first].Issued < tokenList[second].Issued
+	})
+	return tokenList
+}
+
+// Revoke a single token, given by its ID (as listed by listTokens) or the token itself, or a share link, given by its token. Only the given
+// tenant's tokens can be revoked. Returns the Task the token was for.
+func revokeToken(theTenant *tenant, theToken string) (string, error) {
+	if strings.HasPrefix(theToken, shareTokenPrefix) {
+		share, shareErr := parseShareToken(theToken)
+		if shareErr != nil || !taskInTenant(theTenant, share.taskID) {
+			return "", errors.New("Invalid share link.")
+		}
+		loadRevocations()
+		revokedTokens[getTokenID(theToken)] = share.expires
+		return share.taskID, saveRevocations()
+	}
+	for token := range tokens {
+		details := taskTokenDetails[token]
+		if (getTokenID(token) == theToken || token == theToken) && ((details.taskID == "" && theTenant == nil) || (details.taskID != "" && taskInTenant(theTenant, details.taskID))) {
+			removeToken(token)
+			// Other servers might have the token in memory, so it's listed as revoked for as long as it could last there unused.
+			loadRevocations()
+			revokedTokens[getTokenID(token)] = time.Now().Unix() + tokenTimeout
+			return details.taskID, saveRevocations()
+		}
+	}
+	return "", errors.New("No such token.")
+}
+
+// Revoke every token and share link issued for the given Task so far. Returns how many tokens this server had for the Task.
+func revokeTaskTokens(theTaskID string) (int, error) {
+	revokedCount := 0
+	for token := range tokens {
+		if details, detailsFound := taskTokenDetails[token]; !detailsFound || details.taskID == theTaskID {
+			if detailsFound {
+				revokedCount = revokedCount + 1
+			}
+			removeToken(token)
+		}
+	}
+	loadRevocations()
+	revokedTaskTokens[theTaskID] = time.Now().Unix()
+	return revokedCount, saveRevocations()
+}
+
+// Give the given Task a new secret - the one given, or a random one if none is given - revoking every token and share link issued for the Task
+// so far, and recording the change (made as described by theChangedBy, e.g. "from the command line") in the audit log. Returns the new secret.
+func changeTaskSecret(theTaskID string, theNewSecret string, theChangedBy string) (string, error) {
+	if _, taskErr := getTaskDetails(theTaskID); taskErr != nil {
+		return "", taskErr
+	}
+	if theNewSecret == "" {
+		randomSecret, randomErr := generateSecureRandomString()
+		if randomErr != nil {
+			return "", randomErr
+		}
+		theNewSecret = randomSecret
+	}
+	hashedSecret, hashErr := hashPassword(theNewSecret)
+	if hashErr != nil {
+		return "", errors.New("Problem hashing secret - " + hashErr.Error())
+	}
+	if setErr := setTaskConfigValues(theTaskID, map[string]string{"secret": hashedSecret}); setErr != nil {
+		return "", setErr
+	}
+	_, revokeErr := revokeTaskTokens(theTaskID)
+	writeAuditLog(theTaskID, "Secret changed " + theChangedBy + ", tokens and share links revoked.")
+	return theNewSecret, revokeErr
+}
@@ -0,0 +1,204 @@
+package main
+// Two-factor authentication with time-based one-time passwords (TOTP, RFC 6238) - the six-digit codes given by authenticator apps such as
+// Google Authenticator, Microsoft Authenticator or 1Password. A Task (a production deploy, say) with a "totpsecret" config value needs a code as
+// well as its secret before its secret is exchanged for a token, so running it takes something the user has as well as something they know.
+// Tokens, once issued, work as normal until they expire. Admin access can be protected the same way, the admin TOTP secret being kept in
+// admintotp.txt in the root of the Tasks folder - the admin secret then needs a code alongside it (passkey logins, see passkeys.go, don't).
+// Secrets are enrolled with "webconsole task totp" or the admin API, which give the secret (and an otpauth:// URI, for QR code generators) to
+// add to the app, then need a code from the app to confirm it before it's used. Codes from the previous and next 30 second periods are accepted,
+// to allow for clocks being a little out, but each code can only be used once.
+
+import (
+	// Standard libraries.
+	"os"
+	"sync"
+	"time"
+	"errors"
+	"strings"
+	"net/url"
+	"net/http"
+	"io/ioutil"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/binary"
+)
+
+// The length of each time period, in seconds, and the number of digits in each code - the values every authenticator app uses by default.
+const totpPeriod = 30
+const totpDigits = 6
+
+// How long an enrolment can wait for a code to confirm it, in seconds.
+const totpEnrolmentTimeout = 600
+
+// Secrets waiting for a code to confirm them, keyed by what they're for ("admin", or "task:" and a Task ID), with the time they were generated.
+type pendingTOTPSecret struct {
+	secret string
+	generated int64
+}
+var pendingTOTPSecrets = map[string]pendingTOTPSecret{}
+
+// The last time period a code was used in for each secret (keyed as above), so a code can't be used again.
+var lastTOTPSteps = map[string]int64{}
+
+// Guards pendingTOTPSecrets and lastTOTPSteps, as requests are handled concurrently.
+var totpLock sync.Mutex
+
+// TOTP secrets are base32-encoded, without padding, as authenticator apps expect.
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// Returns a new random TOTP secret.
+func generateTOTPSecret() (string, error) {
+	secretBytes := make([]byte, 20)
+	if _, randErr := rand.Read(secretBytes); randErr != nil {
+		return "", randErr
+	}
+	return totpEncoding.EncodeToString(secretBytes), nil
+}
+
+// Returns the code for the given secret (already decoded) in the given time period.
+func getTOTPCode(theSecret []byte, theStep int64) string {
+	stepBytes := make([]byte, 8)
+	binary.BigEndian.PutUint64(stepBytes, uint64(theStep))
+	codeMAC := hmac.New(sha1.New, theSecret)
+	codeMAC.Write(stepBytes)
+	codeHash := codeMAC.Sum(nil)
+	codeOffset := codeHash[len(codeHash) - 1] & 0x0f
+	codeValue := binary.BigEndian.Uint32(codeHash[codeOffset:codeOffset + 4]) & 0x7fffffff
+	codeString := ""
+	for digitPos := 0; digitPos < totpDigits; digitPos = digitPos + 1 {
+		codeString = string(rune('0' + codeValue % 10)) + codeString
+		codeValue = codeValue / 10
+	}
+	return codeString
+}
+
+// Check the given code against the given secret, refusing a code from a time period a code has already been used in for the same key. The check
+// and the update of the last period used are made together, so two requests can't both use the same code.
+func checkTOTPCode(theKey string, theSecret string, theCode string) bool {
+	secretBytes, decodeErr := totpEncoding.DecodeString(strings.ToUpper(strings.Replace(theSecret, " ", "", -1)))
+	theCode = strings.Replace(theCode, " ", "", -1)
+	if decodeErr != nil || len(theCode) != totpDigits {
+		return false
+	}
+	totpLock.Lock()
+	defer totpLock.Unlock()
+	currentStep := time.Now().Unix() / totpPeriod
+	for codeStep := currentStep - 1; codeStep <= currentStep + 1; codeStep = codeStep + 1 {
+		if codeStep > lastTOTPSteps[theKey] && hmac.Equal([]byte(getTOTPCode(secretBytes, codeStep)), []byte(theCode)) {
+			lastTOTPSteps[theKey] = codeStep
+			return true
+		}
+	}
+	return false
+}
+
+// Returns an otpauth:// URI for the given secret, which authenticator apps can import (usually from a QR code).
+func getTOTPURI(theAccount string, theSecret string) string {
+	return "otpauth://totp/" + url.PathEscape("Webconsole:" + theAccount) + "?secret=" + theSecret + "&issuer=Webconsole"
+}
+
+// Check the "totp" code given with a request for the given Task, if the Task has a TOTP secret. A wrong or missing code counts as a failed
+// authentication attempt (see ratelimit.go), and a client that has failed too often doesn't get its code checked at all, so codes can't be
+// guessed through calls that aren't otherwise rate limited.
+func checkTaskTOTP(theRequest *http.Request, theTaskID string, theTaskDetails map[string]string) error {
+	if theTaskDetails["totpsecret"] == "" {
+		return nil
+	}
+	if checkAuthFailures(getClientIP(theRequest)) > 0 {
+		return errors.New("too many failed attempts")
+	}
+	if theRequest.Form.Get("totp") == "" {
+		return errors.New("missing TOTP code")
+	}
+	if !checkTOTPCode(getTOTPKey(theTaskID), theTaskDetails["totpsecret"], theRequest.Form.Get("totp")) {
+		return errors.New("incorrect TOTP code")
+	}
+	return nil
+}
+
+// Returns the admin TOTP secret, or "" if there isn't one.
+func getAdminTOTPSecret() string {
+	secretContents, readErr := ioutil.ReadFile(arguments["taskroot"] + "/admintotp.txt")
+	if readErr != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(secretContents))
+}
+
+// Check the "totp" code given with an admin request, if admin access has a TOTP secret.
+func checkAdminTOTP(theRequest *http.Request) bool {
+	adminTOTPSecret := getAdminTOTPSecret()
+	return adminTOTPSecret == "" || checkTOTPCode("admin", adminTOTPSecret, theRequest.Form.Get("totp"))
+}
+
+// Returns the key secrets for the given Task (or for admin access, if no Task is given) are kept under.
+func getTOTPKey(theTaskID string) string {
+	if theTaskID == "" {
+		return "admin"
+	}
+	return "task:" + theTaskID
+}
+
+// Start enrolling a TOTP secret for the given Task, or for admin access if no Task is given. Returns the new secret, which isn't used until
+// confirmed with a code from it.
+func beginTOTPEnrolment(theTaskID string) (string, error) {
+	if theTaskID != "" {
+		if _, taskErr := getTaskDetails(theTaskID); taskErr != nil {
+			return "", taskErr
+		}
+	}
+	newSecret, secretErr := generateTOTPSecret()
+	if secretErr != nil {
+		return "", secretErr
+	}
+	totpLock.Lock()
+	pendingTOTPSecrets[getTOTPKey(theTaskID)] = pendingTOTPSecret{newSecret, time.Now().Unix()}
+	totpLock.Unlock()
+	return newSecret, nil
+}
+
+// Finish enrolling a TOTP secret for the given Task (or admin access) - if the given code is right for the secret, it's put to use.
+func confirmTOTPEnrolment(theTaskID string, theCode string) error {
+	enrolmentKey := getTOTPKey(theTaskID)
+	totpLock.Lock()
+	pendingSecret, pendingFound := pendingTOTPSecrets[enrolmentKey]
+	totpLock.Unlock()
+	if !pendingFound || time.Now().Unix() - pendingSecret.generated > totpEnrolmentTimeout {
+		return errors.New("No TOTP enrolment in progress - start again.")
+	}
+	if !checkTOTPCode(enrolmentKey, pendingSecret.secret, theCode) {
+		return errors.New("Incorrect code - check the authenticator app's clock, and try again with the next code.")
+	}
+	totpLock.Lock()
+	delete(pendingTOTPSecrets, enrolmentKey)
+	totpLock.Unlock()
+	return setTOTPSecret(theTaskID, pendingSecret.secret)
+}
+
+// Set (or, given "", remove) the TOTP secret for the given Task, or for admin access if no Task is given, recording the change in the audit log.
+func setTOTPSecret(theTaskID string, theSecret string) error {
+	adminTOTPPath := arguments["taskroot"] + "/admintotp.txt"
+	if theTaskID != "" {
+		if setErr := setTaskConfigValues(theTaskID, map[string]string{"totpsecret": theSecret}); setErr != nil {
+			return setErr
+		}
+	} else if theSecret == "" {
+		if removeErr := os.Remove(adminTOTPPath); removeErr != nil && !os.IsNotExist(removeErr) {
+			return errors.New("Can't remove admintotp.txt.")
+		}
+	} else if writeErr := ioutil.WriteFile(adminTOTPPath, []byte(theSecret + "\n"), 0600); writeErr != nil {
+		return errors.New("Can't write admintotp.txt.")
+	}
+	auditMessage := "Two-factor authentication"
+	if theTaskID == "" {
+		auditMessage = "Admin two-factor authentication"
+	}
+	if theSecret == "" {
+		writeAuditLog(theTaskID, auditMessage + " disabled.")
+	} else {
+		writeAuditLog(theTaskID, auditMessage + " enabled.")
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package main
+// Output transform scripts - a Task's "transform" option names a JavaScript file (relative to the Task's folder) that post-processes each line
+// of the Task's output before it's recorded and reaches clients, for filtering out noise, extracting values or reformatting. The script defines
+// a function, transform(line, stream), called with each line the Task outputs ("stream" is "stdout" or "stderr") - it returns the line to
+// record in its place, or null (or nothing) to drop the line. The script can also call event(text) to add an event line to the output, e.g.
+// for a value picked out of the line. Scripts are run by goja, a JavaScript engine written in Go, one instance per run, so a script can keep
+// state (counts and so on) between lines. Each call has a time limit - if the script fails or runs out of time, a warning is added to the output
+// and the rest of the run's output is recorded as it is.
+
+import (
+	// Standard libraries.
+	"time"
+	"errors"
+	"strings"
+	"io/ioutil"
+	"path/filepath"
+
+	// A JavaScript engine, written in pure Go.
+	"github.com/dop251/goja"
+)
+
+// How long a transform script has to deal with each line (or, when it's loaded, to run its top-level code).
+const transformTimeLimit = time.Second
+
+// A Task's transform script, loaded for a run.
+type outputTransformer struct {
+	runtime *goja.Runtime
+	transformFunction goja.Callable
+	events []string
+	failed bool
+}
+
+// Load the given Task's transform script, if it has one - returns nil if not.
+func newOutputTransformer(theTaskID string, theTaskDetails map[string]string) (*outputTransformer, error) {
+	if strings.TrimSpace(theTaskDetails["transform"]) == "" {
+		return nil, nil
+	}
+	scriptPath, pathErr := getTaskFilePath(theTaskID, strings.TrimSpace(theTaskDetails["transform"]))
+	if pathErr != nil {
+		return nil, errors.New("Can't find transform script \"" + theTaskDetails["transform"] + "\".")
+	}
+	scriptContents, readErr := ioutil.ReadFile(scriptPath)
+	if readErr != nil {
+		return nil, errors.New("Can't read transform script \"" + theTaskDetails["transform"] + "\".")
+	}
+	transformer := &outputTransformer{runtime: goja.New()}
+	transformer.runtime.Set("event", func(theText string) {
+		transformer.events = append(transformer.events, theText)
+	})
+	if _, scriptErr := transformer.callWithTimeLimit(func() (goja.Value, error) {
+		return transformer.runtime.RunScript(filepath.Base(scriptPath), string(scriptContents))
+	}); scriptErr != nil {
+		return nil, errors.New("Error in transform script \"" + theTaskDetails["transform"] + "\" - " + scriptErr.Error())
+	}
+	transformFunction, functionFound := goja.AssertFunction(transformer.runtime.Get("transform"))
+	if !functionFound {
+		return nil, errors.New("Transform script \"" + theTaskDetails["transform"] + "\" doesn't define a transform(line, stream) function.")
+	}
+	transformer.transformFunction = transformFunction
+	return transformer, nil
+}
+
+// Call the given function, interrupting the script if it takes longer than the time limit.
+func (theTransformer *outputTransformer) callWithTimeLimit(theFunction func() (goja.Value, error)) (goja.Value, error) {
+	interruptDone := make(chan bool)
+	limitTimer := time.AfterFunc(transformTimeLimit, func() {
+		theTransformer.runtime.Interrupt("took longer than " + transformTimeLimit.String())
+		close(interruptDone)
+	})
+	// The timer is stopped before any interrupt is cleared - if it has already gone off, once it has finished interrupting - so an interrupt
+	// can't be left waiting for the next call.
+	defer func() {
+		if !limitTimer.Stop() {
+			<-interruptDone
+		}
+		theTransformer.runtime.ClearInterrupt()
+	}()
+	return theFunction()
+}
+
+// Pass the given line of output through the transform script, returning the lines to record in its place - the transformed line (if it wasn't
+// dropped) followed by any events the script added.
+func (theTransformer *outputTransformer) transform(theStream string, theLine string) []taskOutputLine {
+	if theTransformer.failed {
+		return []taskOutputLine{{time.Now(), theStream, theLine}}
+	}
+	theTransformer.events = nil
+	transformResult, transformErr := theTransformer.callWithTimeLimit(func() (goja.Value, error) {
+		return theTransformer.transformFunction(goja.Undefined(), theTransformer.runtime.ToValue(theLine), theTransformer.runtime.ToValue(theStream))
+	})
+	if transformErr != nil {
+		theTransformer.failed = true
+		return []taskOutputLine{{time.Now(), "system", "WARNING: Transform script failed - " + transformErr.Error() + " - output is shown as it is from here on."}, {time.Now(), theStream, theLine}}
+	}
+	var outputLines []taskOutputLine
+	if transformResult != nil && !goja.IsNull(transformResult) && !goja.IsUndefined(transformResult) {
+		outputLines = append(outputLines, taskOutputLine{time.Now(), theStream, transformResult.String()})
+	}
+	for _, eventText := range theTransformer.events {
+		outputLines = append(outputLines, taskOutputLine{time.Now(), "event", eventText})
+	}
+	return outputLines
+}
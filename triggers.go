@@ -0,0 +1,99 @@
+package main
+// Run triggers - who or what started each run, so anyone looking at a Task's run history (handy when a team shares Tasks) can see why it ran.
+// Each run's trigger is saved in the run's folder as trigger.json, giving the kind of trigger ("user", "webhook", "retry" and so on), a
+// source describing it further (for a user, the ID of the token or share link they used - see tokens.go - for a webhook, the event that
+// called it), the client IP address the run was asked for from and any parameters the run was given, with secret parameters masked (see
+// redact.go). The trigger is given as the first line of the run's output, used as <<TRIGGER>> in notification templates and listed by
+// api/getRunList with "details=true". api/getRunTrigger returns the whole of a run's trigger.json.
+
+import (
+	// Standard libraries.
+	"os"
+	"errors"
+	"strings"
+	"os/user"
+	"net/http"
+	"io/ioutil"
+	"encoding/json"
+)
+
+// Who or what started a run.
+type runTrigger struct {
+	Kind string `json:"kind"`
+	Source string `json:"source,omitempty"`
+	ClientIP string `json:"clientIP,omitempty"`
+	Parameters map[string]string `json:"parameters,omitempty"`
+}
+
+// What started each running Task, set by startTask.
+var taskTriggers = map[string]runTrigger{}
+
+// The name of the file each run's trigger is saved in, in the run's folder.
+const runTriggerFile = "trigger.json"
+
+// Returns the trigger for a run asked for by a user with the given request, using the given token (or share link).
+func getRequestTrigger(theRequest *http.Request, theToken string) runTrigger {
+	triggerSource := "token " + getTokenID(theToken)
+	if strings.HasPrefix(theToken, shareTokenPrefix) {
+		triggerSource = "share link " + getTokenID(theToken)
+	}
+	return runTrigger{Kind: "user", Source: triggerSource, ClientIP: getClientIP(theRequest)}
+}
+
+// Returns the trigger for a run started from the command line (see "webconsole --run"), by the user running the command.
+func getCommandLineTrigger() runTrigger {
+	commandTrigger := runTrigger{Kind: "command line"}
+	if currentUser, userErr := user.Current(); userErr == nil {
+		commandTrigger.Source = currentUser.Username
+	}
+	return commandTrigger
+}
+
+// Returns a short description of the given trigger, e.g. "user (token 1a2b3c4d5e6f7a8b)".
+func describeTrigger(theTrigger runTrigger) string {
+	if theTrigger.Kind == "" {
+		return "unknown"
+	}
+	if theTrigger.Source == "" {
+		return theTrigger.Kind
+	}
+	return theTrigger.Kind + " (" + theTrigger.Source + ")"
+}
+
+// Returns the trigger for the run of the given Task that's starting, with the parameters it was started with - any secret ones masked.
+func getStartingTrigger(theTaskID string, theTaskDetails map[string]string) runTrigger {
+	startingTrigger := taskTriggers[theTaskID]
+	startingTrigger.Parameters = nil
+	if len(taskParameters[theTaskID]) > 0 {
+		redactor := newRedactor(theTaskDetails, taskParameters[theTaskID], "")
+		startingTrigger.Parameters = map[string]string{}
+		for parameterName, parameterValue := range taskParameters[theTaskID] {
+			startingTrigger.Parameters[parameterName] = redactor.Replace(parameterValue)
+		}
+	}
+	return startingTrigger
+}
+
+// Save the given trigger in the given run folder.
+func saveRunTrigger(theRunFolder string, theTrigger runTrigger) error {
+	triggerJSON, jsonErr := json.MarshalIndent(theTrigger, "", "\t")
+	if jsonErr != nil {
+		return jsonErr
+	}
+	return ioutil.WriteFile(theRunFolder + "/" + runTriggerFile, triggerJSON, 0644)
+}
+
+// Returns the trigger of the given run. Runs from before triggers were recorded have an empty one.
+func getRunTrigger(theTaskID string, theRunID string) (runTrigger, error) {
+	var savedTrigger runTrigger
+	triggerContents, readErr := readRunFile(theTaskID, theRunID, runTriggerFile)
+	if os.IsNotExist(readErr) {
+		return savedTrigger, nil
+	} else if readErr != nil {
+		return savedTrigger, errors.New("Can't read " + runTriggerFile + " for run " + theRunID + ".")
+	}
+	if jsonErr := json.Unmarshal(triggerContents, &savedTrigger); jsonErr != nil {
+		return savedTrigger, errors.New("Can't parse " + runTriggerFile + " for run " + theRunID + ".")
+	}
+	return savedTrigger, nil
+}
@@ -0,0 +1,234 @@
+package main
+// Zero-downtime upgrades - to upgrade Web Console without dropping requests or cutting short runs in progress, replace the webconsole
+// executable on disk and send the running server SIGUSR2 ("systemctl reload webconsole" does this for a server installed as a service). The
+// server starts the new executable, with the same options, passing it the listening socket (see upgrade_unix.go), so the new server takes
+// over new requests straight away. The old server stops taking requests, lets those in progress finish, then carries on running only until the
+// runs it was in the middle of have finished, when it exits. If the new server fails to start, the old one carries on as before.
+// While they overlap, the old server tells the new one (over a pipe, as JSON lines - see handoverMessage) which Tasks it's still running, so
+// they're shown as running and can't be started twice, and passes on anything it would have started itself: retries and restarts of service
+// Tasks (see retries.go and servicemode.go) and chained Tasks (see pipeline.go). Service Tasks are restarted in the new server right away, as
+// they would otherwise never finish. The output of runs left in the old server goes to their logs as normal, but isn't shown live by the new
+// server. "upgradeTimeout" (in the main config file) gives the most seconds to wait for runs to finish before the old server stops them -
+// by default, it waits as long as they take. Tasks running on agents can't be handed over, so the server won't upgrade while there are any.
+
+import (
+	// Standard libraries.
+	"os"
+	"fmt"
+	"sync"
+	"time"
+	"bufio"
+	"errors"
+	"strconv"
+	"encoding/json"
+)
+
+// The environment variable set for a new server started by an upgrade, which inherits its listening socket and a pipe from the old server.
+const upgradeEnvironmentVariable = "WEBCONSOLE_UPGRADE"
+
+// How long to wait for a new server to start before giving up on an upgrade, and for requests in progress to finish once it has.
+const upgradeStartTimeout = 60 * time.Second
+const upgradeShutdownTimeout = 30 * time.Second
+
+// A message from the old server to the new one during an upgrade. Event is "running" (the Task is still running in the old server),
+// "finished" (it has finished), "retry" (start the Task again at Due - an Attempt number above 1 is a retry), "start" (start the Task now) or
+// "handedOver" (everything that was running at the upgrade has been listed, so the new server can start taking requests).
+type handoverMessage struct {
+	Event string `json:"event"`
+	TaskID string `json:"taskID,omitempty"`
+	Due int64 `json:"due,omitempty"`
+	Attempt int `json:"attempt,omitempty"`
+	Parameters map[string]string `json:"parameters,omitempty"`
+	Trigger *runTrigger `json:"trigger,omitempty"`
+}
+
+// Old server: whether this server has handed over to a new one, the pipe to the new server and the parameters of service Tasks stopped at
+// the upgrade, to be restarted by the new server once they've finished.
+var upgradeHandedOver = false
+var upgradeInProgress = false
+var handoverPipe *os.File
+var handoverServices = map[string]map[string]string{}
+var handoverLock sync.Mutex
+
+// New server: the Tasks still running in the old server.
+var oldServerRuns = map[string]bool{}
+var oldServerRunsLock sync.Mutex
+
+// Returns the most seconds the old server waits for runs to finish after an upgrade - 0 for no limit.
+func getUpgradeTimeout() (int, error) {
+	if arguments["upgradetimeout"] == "" {
+		return 0, nil
+	}
+	upgradeTimeout, timeoutErr := strconv.Atoi(arguments["upgradetimeout"])
+	if timeoutErr != nil || upgradeTimeout < 0 {
+		return 0, fmt.Errorf("Invalid upgradetimeout \"%s\" - should be a whole number of seconds, or 0 for no limit.", arguments["upgradetimeout"])
+	}
+	return upgradeTimeout, nil
+}
+
+// Old server: send the given message to the new server.
+func sendHandoverMessage(theMessage handoverMessage) {
+	handoverLock.Lock()
+	defer handoverLock.Unlock()
+	if handoverPipe == nil {
+		return
+	}
+	messageJSON, _ := json.Marshal(theMessage)
+	if _, writeErr := handoverPipe.Write(append(messageJSON, '\n')); writeErr != nil {
+		fmt.Println("ERROR: Can't pass " + theMessage.Event + " of Task " + theMessage.TaskID + " to the upgraded server - " + writeErr.Error())
+	}
+}
+
+// New server: returns the trigger of a run handed over by the old server - an old server that doesn't pass triggers on gives none, so the
+// run is put down to the upgrade.
+func getHandoverTrigger(theMessage handoverMessage) runTrigger {
+	if theMessage.Trigger == nil {
+		return runTrigger{Kind: "upgrade"}
+	}
+	return *theMessage.Trigger
+}
+
+// Old server: check the server can be upgraded right now.
+func checkUpgradePossible() error {
+	if upgradeInProgress {
+		return errors.New("an upgrade is already in progress")
+	}
+	if len(agentRuns) > 0 {
+		return errors.New("Tasks are running on agents")
+	}
+	return nil
+}
+
+// Old server: once the new server is ready, tell it what's running here and hand over retries and service restarts waiting to start, then
+// stop service Tasks so the new server can restart them. From here on, Tasks that would have been started here are started by the new server.
+func handOverRuns(theHandoverPipe *os.File) {
+	handoverLock.Lock()
+	handoverPipe = theHandoverPipe
+	upgradeHandedOver = true
+	handoverLock.Unlock()
+	for taskID := range runningTasks {
+		sendHandoverMessage(handoverMessage{Event: "running", TaskID: taskID})
+	}
+	for taskID, retry := range pendingRetries {
+		if retry.timer != nil {
+			retry.timer.Stop()
+		}
+		sendHandoverMessage(handoverMessage{Event: "retry", TaskID: taskID, Due: retry.due.Unix(), Attempt: retry.attempt, Parameters: retry.parameters, Trigger: &retry.trigger})
+		delete(pendingRetries, taskID)
+	}
+	sendHandoverMessage(handoverMessage{Event: "handedOver"})
+	for taskID := range runningTasks {
+		if taskDetails, taskErr := getTaskDetails(taskID); taskErr == nil && taskIsService(taskDetails) {
+			handoverLock.Lock()
+			handoverServices[taskID] = taskParameters[taskID]
+			handoverLock.Unlock()
+			stopTask(taskID, "Server upgraded - restarting in the new server.")
+		}
+	}
+}
+
+// Old server: called as a run finishes, once the Task is no longer marked as running. Tells the new server, passing on the run's retry or
+// service restart (if it has one) for the new server to start.
+func handOverFinishedRun(theTaskID string) {
+	if !upgradeHandedOver {
+		return
+	}
+	sendHandoverMessage(handoverMessage{Event: "finished", TaskID: theTaskID})
+	if retry, retryFound := pendingRetries[theTaskID]; retryFound {
+		sendHandoverMessage(handoverMessage{Event: "retry", TaskID: theTaskID, Due: time.Now().Add(time.Duration(retry.delay) * time.Second).Unix(),
+			Attempt: retry.attempt, Parameters: retry.parameters, Trigger: &retry.trigger})
+		delete(pendingRetries, theTaskID)
+		return
+	}
+	handoverLock.Lock()
+	serviceParameters, serviceFound := handoverServices[theTaskID]
+	delete(handoverServices, theTaskID)
+	handoverLock.Unlock()
+	if serviceFound {
+		sendHandoverMessage(handoverMessage{Event: "start", TaskID: theTaskID, Parameters: serviceParameters, Trigger: &runTrigger{Kind: "upgrade"}})
+	}
+}
+
+// Old server: once the web server has stopped, wait for the runs still in progress to finish (stopping any still running after
+// "upgradeTimeout" seconds), then exit.
+func finishUpgrade() {
+	upgradeTimeout, _ := getUpgradeTimeout()
+	upgradeDeadline := time.Now().Add(time.Duration(upgradeTimeout) * time.Second)
+	if len(runningTasks) > 0 {
+		fmt.Printf("Waiting for %d running Tasks to finish before exiting.\n", len(runningTasks))
+	}
+	for len(runningTasks) > 0 {
+		if upgradeTimeout > 0 && time.Now().After(upgradeDeadline) {
+			for taskID := range runningTasks {
+				stopTask(taskID, "Server upgraded - upgradeTimeout reached.")
+			}
+			upgradeTimeout = 0
+		}
+		time.Sleep(time.Second)
+	}
+	handoverLock.Lock()
+	handoverPipe.Close()
+	handoverLock.Unlock()
+	fmt.Println("Handed over to the upgraded server - exiting.")
+	os.Exit(0)
+}
+
+// New server: returns true if the given Task is still running in the old server.
+func taskRunningInOldServer(theTaskID string) bool {
+	oldServerRunsLock.Lock()
+	defer oldServerRunsLock.Unlock()
+	return oldServerRuns[theTaskID]
+}
+
+// New server: read messages from the old server, returning once it has listed what it's running (or has gone away), then carrying on in the
+// background until the old server exits.
+func receiveHandover(theHandoverPipe *os.File) {
+	handoverReader := bufio.NewReader(theHandoverPipe)
+	handedOver := make(chan bool)
+	go func() {
+		defer close(handedOver)
+		for true {
+			messageJSON, readErr := handoverReader.ReadBytes('\n')
+			if readErr != nil {
+				// The old server has exited, so nothing is running there any more.
+				theHandoverPipe.Close()
+				oldServerRunsLock.Lock()
+				oldServerRuns = map[string]bool{}
+				oldServerRunsLock.Unlock()
+				return
+			}
+			var message handoverMessage
+			if json.Unmarshal(messageJSON, &message) != nil {
+				continue
+			}
+			switch message.Event {
+				case "handedOver":
+					handedOver <- true
+				case "running":
+					oldServerRunsLock.Lock()
+					oldServerRuns[message.TaskID] = true
+					oldServerRunsLock.Unlock()
+				case "finished":
+					oldServerRunsLock.Lock()
+					delete(oldServerRuns, message.TaskID)
+					oldServerRunsLock.Unlock()
+				case "retry":
+					retryDelay := int(message.Due - time.Now().Unix())
+					if retryDelay < 1 {
+						retryDelay = 1
+					}
+					pendingRetries[message.TaskID] = &pendingRetry{attempt: message.Attempt, delay: retryDelay, parameters: message.Parameters, trigger: getHandoverTrigger(message)}
+					startRetryTimer(message.TaskID)
+				case "start":
+					taskDetails, taskErr := getTaskDetails(message.TaskID)
+					if taskErr == nil {
+						taskErr = startTask(message.TaskID, taskDetails, message.Parameters, getHandoverTrigger(message))
+					}
+					if taskErr != nil {
+						writeAuditLog(message.TaskID, "Task handed over by the old server couldn't be started: " + taskErr.Error())
+					}
+			}
+		}
+	}()
+	<-handedOver
+}
@@ -0,0 +1,133 @@
+//go:build !windows
+// +build !windows
+
+package main
+// Zero-downtime upgrades on Linux, MacOS and other Unix-like systems (see upgrade.go). On SIGUSR2, the new executable is started with three
+// extra files: the listening socket (file descriptor 3), a pipe to say it's ready (4) and a pipe to receive handover messages on (5).
+
+import (
+	// Standard libraries.
+	"os"
+	"fmt"
+	"net"
+	"time"
+	"bufio"
+	"context"
+	"syscall"
+	"os/exec"
+	"net/http"
+	"os/signal"
+)
+
+// Returns the listening socket passed on by the server being upgraded, if this server was started by an upgrade.
+func inheritListener() (net.Listener, bool, error) {
+	if os.Getenv(upgradeEnvironmentVariable) == "" {
+		return nil, false, nil
+	}
+	os.Unsetenv(upgradeEnvironmentVariable)
+	listenerFile := os.NewFile(3, "listener")
+	defer listenerFile.Close()
+	webListener, listenerErr := net.FileListener(listenerFile)
+	return webListener, true, listenerErr
+}
+
+// New server: tell the old server we're ready, then wait for it to hand over what it's running before we start taking requests.
+func completeUpgradeStartup() {
+	readyPipe := os.NewFile(4, "ready")
+	fmt.Fprintln(readyPipe, "ready")
+	readyPipe.Close()
+	receiveHandover(os.NewFile(5, "handover"))
+	fmt.Printf("Upgrade complete - this server (process %d) has taken over.\n", os.Getpid())
+}
+
+// Upgrade the server each time it's sent SIGUSR2 - run in a separate thread (goroutine).
+func watchUpgradeSignal(theWebServer *http.Server, theWebListener net.Listener) {
+	upgradeSignals := make(chan os.Signal, 1)
+	signal.Notify(upgradeSignals, syscall.SIGUSR2)
+	for range upgradeSignals {
+		if upgradeErr := upgradeServer(theWebServer, theWebListener); upgradeErr != nil {
+			fmt.Println("ERROR: Can't upgrade - " + upgradeErr.Error() + ".")
+			upgradeInProgress = false
+		}
+	}
+}
+
+// Start the executable on disk as a new server, passing it our listening socket, and once it's ready hand over to it and stop taking requests.
+func upgradeServer(theWebServer *http.Server, theWebListener net.Listener) error {
+	if upgradeErr := checkUpgradePossible(); upgradeErr != nil {
+		return upgradeErr
+	}
+	upgradeInProgress = true
+	tcpListener, isTCP := theWebListener.(*net.TCPListener)
+	if !isTCP {
+		return fmt.Errorf("can't pass on the listening socket")
+	}
+	listenerFile, fileErr := tcpListener.File()
+	if fileErr != nil {
+		return fileErr
+	}
+	defer listenerFile.Close()
+	readyReader, readyWriter, readyErr := os.Pipe()
+	if readyErr != nil {
+		return readyErr
+	}
+	defer readyReader.Close()
+	handoverReader, handoverWriter, handoverErr := os.Pipe()
+	if handoverErr != nil {
+		readyWriter.Close()
+		return handoverErr
+	}
+	// The executable is looked up again, as it's the new one on disk we want to start.
+	executablePath, executableErr := os.Executable()
+	if executableErr != nil {
+		readyWriter.Close()
+		handoverReader.Close()
+		handoverWriter.Close()
+		return executableErr
+	}
+	fmt.Println("Upgrading - starting " + executablePath + "...")
+	upgradeCommand := exec.Command(executablePath, os.Args[1:]...)
+	upgradeCommand.Env = append(os.Environ(), upgradeEnvironmentVariable + "=true")
+	upgradeCommand.Stdout = os.Stdout
+	upgradeCommand.Stderr = os.Stderr
+	upgradeCommand.ExtraFiles = []*os.File{listenerFile, readyWriter, handoverReader}
+	startErr := upgradeCommand.Start()
+	readyWriter.Close()
+	handoverReader.Close()
+	if startErr != nil {
+		handoverWriter.Close()
+		return startErr
+	}
+	// Wait for the new server to say it's ready - if it exits or takes too long instead, carry on as we are.
+	readyLines := make(chan string, 1)
+	go func() {
+		readyLine, _ := bufio.NewReader(readyReader).ReadString('\n')
+		readyLines <- readyLine
+	}()
+	upgradeExited := make(chan error, 1)
+	go func() {
+		upgradeExited <- upgradeCommand.Wait()
+	}()
+	select {
+		case readyLine := <-readyLines:
+			if readyLine != "ready\n" {
+				handoverWriter.Close()
+				upgradeCommand.Process.Kill()
+				return fmt.Errorf("the new server didn't start")
+			}
+		case <-time.After(upgradeStartTimeout):
+			handoverWriter.Close()
+			upgradeCommand.Process.Kill()
+			return fmt.Errorf("the new server didn't start within %d seconds", int(upgradeStartTimeout.Seconds()))
+	}
+	notifyServiceMainPID(upgradeCommand.Process.Pid)
+	handOverRuns(handoverWriter)
+	// Stop taking requests - the new server is taking them now - and let those in progress finish. Serve then returns, and finishUpgrade
+	// waits for any runs in progress.
+	shutdownContext, cancelShutdown := context.WithTimeout(context.Background(), upgradeShutdownTimeout)
+	defer cancelShutdown()
+	if shutdownErr := theWebServer.Shutdown(shutdownContext); shutdownErr != nil {
+		theWebServer.Close()
+	}
+	return nil
+}
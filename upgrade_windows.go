@@ -0,0 +1,22 @@
+//go:build windows
+// +build windows
+
+package main
+// Zero-downtime upgrades (see upgrade.go) need a listening socket to be passed to a new process, which isn't supported on Windows - the
+// server has to be restarted to upgrade it.
+
+import (
+	// Standard libraries.
+	"net"
+	"net/http"
+)
+
+func inheritListener() (net.Listener, bool, error) {
+	return nil, false, nil
+}
+
+func completeUpgradeStartup() {
+}
+
+func watchUpgradeSignal(theWebServer *http.Server, theWebListener net.Listener) {
+}
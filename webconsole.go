@@ -10,7 +10,9 @@ import (
 	"log"
 	"sort"
 	"time"
+	"sync"
 	"bufio"
+	"bytes"
 	"regexp"
 	"errors"
 	"image"
@@ -18,11 +20,20 @@ import (
 	"image/color"
 	"strings"
 	"strconv"
+	"unicode"
 	"os/exec"
+	"os/signal"
+	"net"
+	"net/url"
+	"crypto/tls"
+	"crypto/subtle"
 	"net/http"
+	"path/filepath"
 	"math/rand"
 	"io/ioutil"
 	"encoding/csv"
+	"encoding/json"
+	"compress/gzip"
 	
 	// Image resizing library.
 	"github.com/nfnt/resize"
@@ -53,17 +64,72 @@ const tokenTimeout = 600
 const tokenCheckPeriod = 60
 // A map of current valid tokens.
 var tokens = map[string]int64{}
+// The scope of any tokens that are limited in what they can do - "view" for a view-only token (see scopeAllowsRequest). Tokens not listed here
+// can do anything.
+var tokenScopes = map[string]string{}
+// A map of current valid admin tokens, issued when an admin logs in with a passkey.
+var adminTokens = map[string]int64{}
 
 // A list of currently running Tasks.
 var runningTasks = map[string]*exec.Cmd{}
-// The outputs from Tasks.
-var taskOutputs = map[string][]string{}
+// The outputs from Tasks, one entry per line, shared by everyone viewing each Task - see outputbroadcast.go.
+var taskOutputs = map[string][]taskOutputLine{}
+// A single line of output from a Task, along with when it was produced and which stream ("stdout", "stderr", or "system" for messages from Web
+// Console itself) it came from.
+type taskOutputLine struct {
+	timestamp time.Time
+	stream string
+	line string
+}
+// A line of output as written to NDJSON logs and streams.
+type taskOutputEvent struct {
+	Timestamp string `json:"ts"`
+	Stream string `json:"stream"`
+	Line string `json:"line"`
+	RunID string `json:"runID"`
+}
 // We record the start time and an array of recent runtimes for each Task so we can guess at this run's liklely time and print a progress report if wanted.
 var taskStartTimes = map[string]int64{}
 var taskRunTimes = map[string][]int64{}
 var taskRuntimeGuesses = map[string]float64{}
 // We record the stop time for each Task so we can implement rate limiting.
 var taskStopTimes = map[string]int64{}
+// The result of each Task's most recent run - blank for success, otherwise the error.
+var taskRunResults = map[string]string{}
+// Tasks with the "approvals" option set get a pipe to their STDIN so a script can pause and wait for a user to approve a step. We record the
+// reason given for any approval currently being waited on.
+var taskStdins = map[string]io.WriteCloser{}
+var taskApprovalReasons = map[string]string{}
+// The marker a Task prints to ask for approval, followed by the reason approval is needed.
+const approvalMarker = "##AWAIT_APPROVAL"
+// If a running Task is stopped (by a user, or because it ran for too long), we record the reason so it can be added to the Task's output.
+var taskStopReasons = map[string]string{}
+// The path of the most recent file uploaded to each Task, substituted for "<<UPLOAD>>" in the Task's command.
+var taskUploads = map[string]string{}
+// Callbacks for running Tasks, keyed by Task and run ID (see runKey) - each run is given a token it can use to send events, progress and status
+// updates back to us while it runs, which are passed to runTask on the callback's channel.
+type taskCallback struct {
+	taskID string
+	token string
+	lines chan taskOutputLine
+}
+var taskCallbacks = map[string]*taskCallback{}
+// Parameters a Task has been started with (for instance, from a webhook's payload), passed to the Task as environment variables.
+var taskParameters = map[string]map[string]string{}
+// The ID of the current (or most recent) run of each Task. Each run's log is kept in its own folder in the Task's "runs" folder.
+var taskRunIDs = map[string]string{}
+
+// Run IDs are timestamps, so a simple sort of the "runs" folder gives the run history in order. A run started in the same second as an earlier
+// run of the same Task has its start time given to the millisecond - see newRunID. Go reads the fraction of a second with runIDFormat as well.
+const runIDFormat = "20060102-150405"
+const runIDMillisecondFormat = "20060102-150405.000"
+var runIDRegexp = regexp.MustCompile("^[0-9]{8}-[0-9]{6}(\\.[0-9]{3})?$")
+
+// Returns the key for the given run in maps of runs in progress - run IDs are only unique within a Task, as two Tasks can start in the same
+// second, so runs are keyed by Task ID and run ID together.
+func runKey(theTaskID string, theRunID string) string {
+	return theTaskID + "/" + theRunID
+}
 
 // Generate a new, random 16-character string, used for tokens and Task IDs.
 func generateRandomString() string {
@@ -75,21 +141,411 @@ func generateRandomString() string {
 	return string(result)
 }
 
-// Use the Bcrypt hashing algorithm to encode a password string.
+// Use the Bcrypt hashing algorithm (with the cost given by "bcryptcost") to encode a password string, or Argon2id if "passwordhash" is set to
+// "argon2id" - see passwords.go.
 func hashPassword(thePassword string) (string, error) {
-	bytes, cryptErr := bcrypt.GenerateFromPassword([]byte(thePassword), 14)
+	if arguments["passwordhash"] == "argon2id" {
+		return hashPasswordArgon2(thePassword)
+	}
+	bcryptCost, costErr := getBcryptCost()
+	if costErr != nil {
+		return "", costErr
+	}
+	bytes, cryptErr := bcrypt.GenerateFromPassword([]byte(thePassword), bcryptCost)
 	return string(bytes), cryptErr
 }
 
-// Check a plain text password with a Bcrypt-hashed string, returns true if they match.
+// Check a plain text password with a Bcrypt- or Argon2id-hashed string, returns true if they match.
 func checkPasswordHash(thePassword, theHash string) bool {
 	if thePassword == "" && theHash == "" {
 		return true
 	}
+	if strings.HasPrefix(theHash, "$argon2id$") {
+		passwordMatches, _ := checkPasswordArgon2(thePassword, theHash)
+		return passwordMatches
+	}
 	cryptErr := bcrypt.CompareHashAndPassword([]byte(theHash), []byte(thePassword))
 	return cryptErr == nil
 }
 
+// Returns true if the request includes the correct admin secret, or a valid admin token (as issued by a passkey login). Admin secret access is
+// disabled unless an "adminsecret" value (a Bcrypt hash, as generated by "webconsole --hash") is set in the config file.
+func isAdminRequest(theRequest *http.Request) bool {
+	adminCredential := getRequestCredential(theRequest, "adminSecret", true)
+	loadSharedToken("admin", adminCredential)
+	if adminTokens[adminCredential] != 0 {
+		adminTokens[adminCredential] = time.Now().Unix()
+		saveToken("admin", adminCredential, "", adminTokens[adminCredential])
+		return true
+	}
+	if arguments["adminsecret"] == "" {
+		return false
+	}
+	// With admin two-factor authentication enabled (see totp.go), the admin secret also needs a code.
+	return checkPasswordHash(adminCredential, arguments["adminsecret"]) && checkAdminTOTP(theRequest)
+}
+
+// Returns a credential (token, secret or admin secret) given with a request. If allowed, an "Authorization: Bearer" header is preferred, otherwise
+// the named form value is used - unless the "rejectquerytokens" option is set, in which case values passed in the URL's query string are ignored,
+// keeping credentials out of access logs.
+func getRequestCredential(theRequest *http.Request, theFormKey string, theBearerAllowed bool) string {
+	authorisationHeader := theRequest.Header.Get("Authorization")
+	if theBearerAllowed && strings.HasPrefix(authorisationHeader, "Bearer ") {
+		return strings.TrimSpace(authorisationHeader[len("Bearer "):])
+	}
+	if arguments["rejectquerytokens"] == "true" {
+		return theRequest.PostForm.Get(theFormKey)
+	}
+	return theRequest.Form.Get(theFormKey)
+}
+
+// Returns the IP address of the client that made the given request. If the request came via one of the proxies listed in the "trustedproxies"
+// option (e.g. nginx or Caddy running on the same server), the address the proxy passed on in the "X-Forwarded-For" or "X-Real-IP" header is
+// used instead - those headers are ignored from anyone else, as clients could set them to anything.
+func getClientIP(theRequest *http.Request) string {
+	clientIP, _, splitErr := net.SplitHostPort(theRequest.RemoteAddr)
+	if splitErr != nil {
+		clientIP = theRequest.RemoteAddr
+	}
+	if arguments["trustedproxies"] == "" {
+		return clientIP
+	}
+	if fromProxy, _ := ipInList(clientIP, arguments["trustedproxies"]); !fromProxy {
+		return clientIP
+	}
+	// X-Forwarded-For lists each address the request passed through, so work back from the end (the address our proxy saw) until we find
+	// an address that isn't one of our proxies.
+	forwardedFor := strings.Split(strings.Join(theRequest.Header.Values("X-Forwarded-For"), ","), ",")
+	for pl := len(forwardedFor) - 1; pl >= 0; pl = pl - 1 {
+		forwardedIP := strings.TrimSpace(forwardedFor[pl])
+		if net.ParseIP(forwardedIP) == nil {
+			break
+		}
+		clientIP = forwardedIP
+		if isProxy, _ := ipInList(forwardedIP, arguments["trustedproxies"]); !isProxy {
+			return clientIP
+		}
+	}
+	if realIP := strings.TrimSpace(theRequest.Header.Get("X-Real-IP")); net.ParseIP(realIP) != nil {
+		return realIP
+	}
+	return clientIP
+}
+
+// Returns true if the given IP address is in the given comma-separated list of IP addresses and CIDR ranges (e.g. "192.168.1.0/24, 10.0.0.5").
+// An invalid entry in the list is an error, so a typo can't silently open up access.
+func ipInList(theIP string, theList string) (bool, error) {
+	clientIP := net.ParseIP(theIP)
+	for _, listEntry := range strings.Split(theList, ",") {
+		listEntry = strings.TrimSpace(listEntry)
+		if listEntry == "" {
+			continue
+		}
+		if !strings.Contains(listEntry, "/") {
+			entryIP := net.ParseIP(listEntry)
+			if entryIP == nil {
+				return false, errors.New("invalid IP address \"" + listEntry + "\"")
+			}
+			if clientIP != nil && entryIP.Equal(clientIP) {
+				return true, nil
+			}
+			continue
+		}
+		_, entryNetwork, cidrErr := net.ParseCIDR(listEntry)
+		if cidrErr != nil {
+			return false, errors.New("invalid CIDR range \"" + listEntry + "\"")
+		}
+		if clientIP != nil && entryNetwork.Contains(clientIP) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Check the given client IP address is allowed to access the given Task, according to the Task's "allowedips" and "deniedips" options.
+// Denied addresses take priority.
+func checkClientIPAllowed(theClientIP string, theTaskDetails map[string]string) error {
+	if theTaskDetails["deniedips"] != "" {
+		ipDenied, listErr := ipInList(theClientIP, theTaskDetails["deniedips"])
+		if listErr != nil {
+			return errors.New("deniedips setting has an " + listErr.Error())
+		}
+		if ipDenied {
+			return errors.New("access from " + theClientIP + " is not allowed")
+		}
+	}
+	if theTaskDetails["allowedips"] != "" {
+		ipAllowed, listErr := ipInList(theClientIP, theTaskDetails["allowedips"])
+		if listErr != nil {
+			return errors.New("allowedips setting has an " + listErr.Error())
+		}
+		if !ipAllowed {
+			return errors.New("access from " + theClientIP + " is not allowed")
+		}
+	}
+	return nil
+}
+
+// Returns an HTTP client for talking to an outbound integration (webhooks, notifications and so on). By default, the standard HTTP_PROXY,
+// HTTPS_PROXY and NO_PROXY environment variables are honoured. A "proxy" setting overrides those for all integrations, and a setting named after
+// the integration (e.g. "webhookproxy") overrides that for one integration. A setting of "none" means connect directly.
+func getHTTPClient(theIntegration string) *http.Client {
+	proxySetting := arguments[theIntegration + "proxy"]
+	if proxySetting == "" {
+		proxySetting = arguments["proxy"]
+	}
+	httpTransport := http.DefaultTransport.(*http.Transport).Clone()
+	// Outbound calls are infrequent, so we don't bother keeping connections open between them.
+	httpTransport.DisableKeepAlives = true
+	if proxySetting == "none" {
+		httpTransport.Proxy = nil
+	} else if proxySetting != "" {
+		proxyURL, proxyErr := url.Parse(proxySetting)
+		if proxyErr == nil {
+			httpTransport.Proxy = http.ProxyURL(proxyURL)
+		} else {
+			fmt.Println("ERROR: Invalid proxy setting for " + theIntegration + ": " + proxySetting)
+		}
+	}
+	return &http.Client{Transport: httpTransport, Timeout: 30 * time.Second}
+}
+
+// Returns a list of the outbound endpoints the server is configured to talk to, each as a description, the integration name (as used by
+// getHTTPClient) and a URL. Used by the self-test admin API.
+func getIntegrationEndpoints() [][]string {
+	var endpoints [][]string
+	taskList, _ := getTaskList()
+	for _, task := range taskList {
+		if task["approvalwebhook"] != "" {
+			endpoints = append(endpoints, []string{"Approval webhook for Task " + task["taskID"], "webhook", task["approvalwebhook"]})
+		}
+		if task["slackwebhook"] != "" {
+			endpoints = append(endpoints, []string{"Slack webhook for Task " + task["taskID"], "slack", task["slackwebhook"]})
+		}
+		if task["teamswebhook"] != "" {
+			endpoints = append(endpoints, []string{"Teams webhook for Task " + task["taskID"], "teams", task["teamswebhook"]})
+		}
+		if task["loki"] != "" {
+			endpoints = append(endpoints, []string{"Loki for Task " + task["taskID"], "loki", task["loki"]})
+		}
+		if task["elasticsearch"] != "" {
+			endpoints = append(endpoints, []string{"Elasticsearch for Task " + task["taskID"], "elasticsearch", task["elasticsearch"]})
+		}
+		if task["pingurl"] != "" {
+			endpoints = append(endpoints, []string{"Dead man's switch for Task " + task["taskID"], "ping", task["pingurl"]})
+		}
+	}
+	if arguments["slackwebhook"] != "" {
+		endpoints = append(endpoints, []string{"Slack webhook", "slack", arguments["slackwebhook"]})
+	}
+	if arguments["teamswebhook"] != "" {
+		endpoints = append(endpoints, []string{"Teams webhook", "teams", arguments["teamswebhook"]})
+	}
+	if arguments["smtphost"] != "" {
+		smtpPort := arguments["smtpport"]
+		if smtpPort == "" {
+			smtpPort = "587"
+		}
+		endpoints = append(endpoints, []string{"SMTP server", "smtp", "smtp://" + net.JoinHostPort(arguments["smtphost"], smtpPort)})
+	}
+	if arguments["agent"] != "" {
+		endpoints = append(endpoints, []string{"Agent coordinator", "agent", arguments["agent"]})
+	}
+	if arguments["influxdb"] != "" {
+		endpoints = append(endpoints, []string{"InfluxDB metrics", "metrics", arguments["influxdb"]})
+	}
+	if arguments["archive"] != "" {
+		endpoints = append(endpoints, []string{"Run archive", "archive", getArchiveEndpoint()})
+	}
+	if arguments["loki"] != "" {
+		endpoints = append(endpoints, []string{"Loki", "loki", arguments["loki"]})
+	}
+	if arguments["elasticsearch"] != "" {
+		endpoints = append(endpoints, []string{"Elasticsearch", "elasticsearch", arguments["elasticsearch"]})
+	}
+	return endpoints
+}
+
+// Test connectivity to an outbound endpoint - resolve the host name, open a connection and, for HTTPS, check the TLS handshake. If a proxy is
+// in use for the endpoint's integration, the proxy is tested instead. Returns a line of text describing the result, starting "OK" or "ERROR".
+func testEndpoint(theDescription string, theIntegration string, theURL string) string {
+	endpointURL, urlErr := url.Parse(theURL)
+	if urlErr != nil || endpointURL.Host == "" {
+		return "ERROR: " + theDescription + " - \"" + theURL + "\" isn't a valid URL, check the setting."
+	}
+	testURL := endpointURL
+	viaProxy := ""
+	if endpointURL.Scheme == "http" || endpointURL.Scheme == "https" {
+		proxyFunc := getHTTPClient(theIntegration).Transport.(*http.Transport).Proxy
+		if proxyFunc != nil {
+			testRequest, _ := http.NewRequest("GET", theURL, nil)
+			if proxyURL, proxyErr := proxyFunc(testRequest); proxyErr == nil && proxyURL != nil {
+				testURL = proxyURL
+				viaProxy = " via proxy " + proxyURL.Host
+			}
+		}
+	}
+	testHost := testURL.Hostname()
+	testPort := testURL.Port()
+	if testPort == "" {
+		testPort = map[string]string{"http":"80", "https":"443", "smtp":"25", "smtps":"465"}[testURL.Scheme]
+	}
+	testAddresses, lookupErr := net.LookupHost(testHost)
+	if lookupErr != nil {
+		return "ERROR: " + theDescription + viaProxy + " - can't resolve host name \"" + testHost + "\" (" + lookupErr.Error() + "). Check the host name is spelt correctly and that this server's DNS settings are correct."
+	}
+	startTime := time.Now()
+	testConnection, dialErr := net.DialTimeout("tcp", net.JoinHostPort(testHost, testPort), 10 * time.Second)
+	if dialErr != nil {
+		return "ERROR: " + theDescription + viaProxy + " - resolved " + testHost + " to " + strings.Join(testAddresses, ", ") + " but can't connect to port " + testPort + " (" + dialErr.Error() + "). Check for firewalls blocking outbound connections, or set a proxy."
+	}
+	defer testConnection.Close()
+	if testURL.Scheme == "https" && viaProxy == "" {
+		tlsConnection := tls.Client(testConnection, &tls.Config{ServerName: testHost})
+		tlsConnection.SetDeadline(time.Now().Add(10 * time.Second))
+		if tlsErr := tlsConnection.Handshake(); tlsErr != nil {
+			return "ERROR: " + theDescription + " - connected to " + testHost + " but the TLS handshake failed (" + tlsErr.Error() + "). Check the server's certificate and this server's clock."
+		}
+	}
+	return fmt.Sprintf("OK: %s%s - connected to %s:%s in %dms.", theDescription, viaProxy, testHost, testPort, time.Since(startTime).Milliseconds())
+}
+
+// Append an entry to the audit log, a simple tab-separated text file in the Tasks folder.
+func writeAuditLog(theTaskID string, theEvent string) {
+	auditFile, auditFileErr := os.OpenFile(arguments["taskroot"] + "/audit.txt", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if auditFileErr == nil {
+		auditFile.WriteString(time.Now().Format("2006-01-02 15:04:05") + "\t" + theTaskID + "\t" + theEvent + "\n")
+		auditFile.Close()
+	}
+}
+
+// The current broadcast message, shown as a banner on every page, is stored in broadcast.txt in the Tasks folder as a single tab-separated line:
+// an ID (so clients can remember which message they've dismissed), the time the message expires (0 for never) and the message itself. Returns the
+// message as JSON, or "{}" if there isn't a current message.
+func getBroadcast() string {
+	broadcastContents, readErr := ioutil.ReadFile(arguments["taskroot"] + "/broadcast.txt")
+	if readErr == nil {
+		broadcastFields := strings.SplitN(strings.TrimSpace(string(broadcastContents)), "\t", 3)
+		if len(broadcastFields) == 3 {
+			broadcastExpires, _ := strconv.ParseInt(broadcastFields[1], 10, 64)
+			if broadcastExpires == 0 || broadcastExpires > time.Now().Unix() {
+				broadcastJSON, _ := json.Marshal(map[string]interface{}{"id":broadcastFields[0], "expires":broadcastExpires, "message":broadcastFields[2]})
+				return string(broadcastJSON)
+			}
+		}
+	}
+	return "{}"
+}
+
+// Set the broadcast message, expiring after the given number of minutes (0 for never). A blank message clears the broadcast.
+func setBroadcast(theMessage string, theMinutes int64) error {
+	broadcastPath := arguments["taskroot"] + "/broadcast.txt"
+	theMessage = strings.TrimSpace(strings.NewReplacer("\t", " ", "\r", " ", "\n", " ").Replace(theMessage))
+	if theMessage == "" {
+		if removeErr := os.Remove(broadcastPath); removeErr != nil && !os.IsNotExist(removeErr) {
+			return removeErr
+		}
+		return nil
+	}
+	broadcastExpires := int64(0)
+	if theMinutes > 0 {
+		broadcastExpires = time.Now().Unix() + (theMinutes * 60)
+	}
+	return ioutil.WriteFile(broadcastPath, []byte(generateRandomString() + "\t" + strconv.FormatInt(broadcastExpires, 10) + "\t" + theMessage + "\n"), 0644)
+}
+
+// Remove any lines matching the given regular expression from a text file, returning the number of lines removed.
+func purgeMatchingLines(thePath string, theRegexp *regexp.Regexp) (int, error) {
+	fileContents, readErr := ioutil.ReadFile(thePath)
+	if readErr != nil {
+		return 0, readErr
+	}
+	removed := 0
+	var keptLines []string
+	for _, fileLine := range strings.Split(string(fileContents), "\n") {
+		if theRegexp.MatchString(fileLine) {
+			removed = removed + 1
+		} else {
+			keptLines = append(keptLines, fileLine)
+		}
+	}
+	if removed > 0 {
+		return removed, ioutil.WriteFile(thePath, []byte(strings.Join(keptLines, "\n")), 0644)
+	}
+	return 0, nil
+}
+
+// The files a run's own record is kept in - a run's logs, trigger and result are always purged line by line, never deleted.
+var runRecordFiles = map[string]bool{"log.txt": true, "log.ndjson": true, runFinishFile: true, runTriggerFile: true}
+
+// Remove all stored output, run artifacts and audit log entries matching the given regular expression (for instance, a customer identifier) from
+// every Task, returning a report of what was removed. Run artifacts with a matching filename are deleted outright, other files (Task and run logs,
+// the audit log) only ever have matching lines removed, so a broad pattern can't wipe out a Task's logs or the audit trail.
+func purgeData(theRegexp *regexp.Regexp) ([]string, error) {
+	var report []string
+	totalRemoved := 0
+	purgeFile := func(thePath string, theArtifact bool) {
+		if theArtifact && theRegexp.MatchString(filepath.Base(thePath)) {
+			if removeErr := os.Remove(thePath); removeErr == nil {
+				report = append(report, thePath + ": deleted")
+			} else {
+				report = append(report, thePath + ": ERROR - couldn't delete")
+			}
+		} else {
+			removed, purgeErr := purgeMatchingLines(thePath, theRegexp)
+			if purgeErr != nil && !os.IsNotExist(purgeErr) {
+				report = append(report, thePath + ": ERROR - couldn't purge")
+			} else if removed > 0 {
+				report = append(report, fmt.Sprintf("%s: %d lines removed", thePath, removed))
+				totalRemoved = totalRemoved + removed
+			}
+		}
+	}
+	taskList, taskErr := getTaskList()
+	if taskErr != nil {
+		return report, taskErr
+	}
+	for _, task := range taskList {
+		taskID := task["taskID"]
+		purgeFile(arguments["taskroot"] + "/" + taskID + "/log.txt", false)
+		runList, _ := getRunList(taskID)
+		for _, runID := range runList {
+			runFolder := arguments["taskroot"] + "/" + taskID + "/runs/" + runID
+			// An archived run is fetched back from the archive to be purged, then archived again - see archive.go.
+			runArchived, restoreErr := restoreArchivedRun(taskID, runID)
+			if restoreErr != nil {
+				report = append(report, runFolder + ": ERROR - couldn't fetch from archive - " + restoreErr.Error())
+				continue
+			}
+			filepath.Walk(runFolder, func(thePath string, theInfo os.FileInfo, theErr error) error {
+				if theErr == nil && !theInfo.IsDir() && theInfo.Name() != archiveManifest {
+					purgeFile(thePath, !runRecordFiles[theInfo.Name()])
+				}
+				return nil
+			})
+			if runArchived {
+				if archiveErr := archiveRun(taskID, runID); archiveErr != nil {
+					report = append(report, runFolder + ": ERROR - couldn't archive again - " + archiveErr.Error())
+				}
+			}
+		}
+		if arguments["archive"] != "" {
+			offloadArchivedRuns(taskID)
+		}
+		// Also remove any matching lines from the output held in memory.
+		var keptOutput []taskOutputLine
+		for _, outputLine := range getTaskOutputLines(taskID, 0) {
+			if !theRegexp.MatchString(outputLine.line) {
+				keptOutput = append(keptOutput, outputLine)
+			}
+		}
+		setTaskOutput(taskID, keptOutput)
+	}
+	purgeFile(arguments["taskroot"] + "/audit.txt", false)
+	report = append(report, fmt.Sprintf("Total: %d lines removed", totalRemoved))
+	return report, nil
+}
+
 // Clear any expired tokens from memory.
 func clearExpiredTokens() {
 	// This is a periodic task, it runs in a separate thread (goroutine) - the time period is set by the tokenCheckPeriod constant set at the top of the script.
@@ -98,189 +554,1496 @@ func clearExpiredTokens() {
 		for token, timestamp := range tokens { 
 			if currentTimestamp - tokenTimeout > timestamp {
 				delete(tokens, token)
+				delete(tokenScopes, token)
+				delete(taskTokenDetails, token)
+			}
+		}
+		for adminToken, timestamp := range adminTokens {
+			if currentTimestamp - tokenTimeout > timestamp {
+				delete(adminTokens, adminToken)
 			}
 		}
+		for issuedAgentToken, agentName := range agentTokens {
+			if currentTimestamp - tokenTimeout > agentLastSeen[agentName] {
+				delete(agentTokens, issuedAgentToken)
+			}
+		}
+		tokenStore.DeleteExpiredTokens(currentTimestamp - tokenTimeout)
+		clearIdleClientBuckets()
+		clearExpiredPasskeyChallenges(currentTimestamp - tokenTimeout)
 		time.Sleep(tokenCheckPeriod * time.Second)
 	}
-}
-
-// Split a string representing a command line with paramaters, possibly with quoted sections, into an array of strings.
-func parseCommandString(theString string) []string {
-	var result []string
-	var stringSplit []string
-	for theString != "" {
-		theString = strings.TrimSpace(theString)
-		if strings.HasPrefix(theString, "\"") {
-			stringSplit = strings.SplitN(theString[1:], "\"", 2)
+}
+
+// Split a string representing a command line with parameters into an array of strings, following (most of) the quoting rules of a Unix shell.
+// Arguments are separated by spaces or tabs, and can be quoted - or partly quoted, as in --name="Some Name" - with double or single quotes.
+// Inside single quotes everything is taken as written, inside double quotes \" stands for a double quote, and outside quotes a backslash before
+// a quote, space or tab stands for that character. Any other backslash is left as it is, so Windows paths (C:\Scripts\build.bat) work without
+// quoting. Returns an error if a quote isn't closed.
+func parseCommandString(theString string) ([]string, error) {
+	result := []string{}
+	var currentArgument strings.Builder
+	inArgument := false
+	var quoteChar rune
+	commandChars := []rune(theString)
+	for charPos := 0; charPos < len(commandChars); charPos = charPos + 1 {
+		commandChar := commandChars[charPos]
+		var nextChar rune
+		if charPos + 1 < len(commandChars) {
+			nextChar = commandChars[charPos+1]
+		}
+		if quoteChar == '\'' {
+			if commandChar == '\'' {
+				quoteChar = 0
+			} else {
+				currentArgument.WriteRune(commandChar)
+			}
+		} else if quoteChar == '"' {
+			if commandChar == '\\' && nextChar == '"' {
+				currentArgument.WriteRune(nextChar)
+				charPos = charPos + 1
+			} else if commandChar == '"' {
+				quoteChar = 0
+			} else {
+				currentArgument.WriteRune(commandChar)
+			}
+		} else if commandChar == '\\' && nextChar != 0 && strings.ContainsRune("\"' \t", nextChar) {
+			currentArgument.WriteRune(nextChar)
+			charPos = charPos + 1
+			inArgument = true
+		} else if commandChar == '"' || commandChar == '\'' {
+			quoteChar = commandChar
+			inArgument = true
+		} else if strings.ContainsRune(" \t\r\n", commandChar) {
+			if inArgument {
+				result = append(result, currentArgument.String())
+				currentArgument.Reset()
+				inArgument = false
+			}
+		} else {
+			currentArgument.WriteRune(commandChar)
+			inArgument = true
+		}
+	}
+	if quoteChar != 0 {
+		return result, fmt.Errorf("Unclosed %c quote in command - to use a quote character as it is, put a backslash before it.", quoteChar)
+	}
+	if inArgument {
+		result = append(result, currentArgument.String())
+	}
+	return result, nil
+}
+
+// Returns the given command (the Task's command, or one of its pipeline's steps) split into the command and its arguments. If the Task has the
+// "shell" option set, the command is instead handed to the shell as it is - /bin/sh, or cmd on Windows - so pipes, redirection and so on work.
+func getCommandArray(theCommand string, theTaskDetails map[string]string) ([]string, error) {
+	if theTaskDetails["shell"] == "Y" {
+		if strings.TrimSpace(theCommand) == "" {
+			return []string{}, nil
+		}
+		// A Task's parameters can't be kept apart from a command the shell reads - see strictargs.go.
+		if taskUsesStrictArguments(theTaskDetails) {
+			return []string{}, errors.New("The shell option can't be used with strictArguments.")
+		}
+		// An uploaded file's name comes from the client, so can't be put in a command the shell reads either.
+		if theTaskDetails["uploads"] == "Y" {
+			return []string{}, errors.New("The shell option can't be used with uploads.")
+		}
+		return getShellCommand(strings.TrimSpace(theCommand)), nil
+	}
+	commandArray, parseErr := parseCommandString(theCommand)
+	if parseErr == nil && taskUsesStrictArguments(theTaskDetails) {
+		parseErr = checkStrictCommand(commandArray)
+	}
+	if parseErr == nil && len(commandArray) > 0 && theTaskDetails["runner"] == "" {
+		commandArray[0] = findTaskCommand(theTaskDetails["taskID"], theTaskDetails, commandArray[0])
+		commandArray = getPlatformCommand(commandArray, getTaskWorkDir(theTaskDetails["taskID"], theTaskDetails))
+	}
+	return commandArray, parseErr
+}
+
+// Returns the command line to run for the given Task, started with the given parameters, split into the command and its arguments. The
+// uploaded file's name is filled in once the command is split, so it can only ever be part of the argument it's in, and for a Task with strict
+// arguments the parameters are added - see strictargs.go. A Task run by the shell never has an uploaded file's name filled in.
+func getTaskCommand(theTaskID string, theTaskDetails map[string]string, theParameters map[string]string) ([]string, error) {
+	commandArray, commandErr := getCommandArray(theTaskDetails["command"], theTaskDetails)
+	if commandErr != nil || theTaskDetails["shell"] == "Y" {
+		return commandArray, commandErr
+	}
+	if taskUsesStrictArguments(theTaskDetails) {
+		return addStrictArguments(commandArray, theTaskDetails, taskUploads[theTaskID], theParameters), nil
+	}
+	for argumentIndex, commandArgument := range commandArray {
+		commandArray[argumentIndex] = strings.Replace(commandArgument, "<<UPLOAD>>", taskUploads[theTaskID], -1)
+	}
+	return commandArray, nil
+}
+
+// Returns the environment variables (on top of the server's own environment) a run of the given Task is given: who it is, how to reach its
+// callback and any parameters it was started with, as WEBCONSOLE_PARAM_ variables - plus, if the Task has a "path" option, its PATH.
+func getTaskEnvironment(theTaskID string, theTaskDetails map[string]string, theRunID string, theCallbackToken string, theParameters map[string]string) []string {
+	callbackURL := arguments["callbackurl"]
+	if callbackURL == "" {
+		callbackURL = "http://localhost:" + arguments["port"] + arguments["pathprefix"]
+	}
+	taskEnvironment := []string{"WEBCONSOLE_TASK_ID=" + theTaskID, "WEBCONSOLE_RUN_ID=" + theRunID,
+		"WEBCONSOLE_CALLBACK_URL=" + strings.TrimRight(callbackURL, "/") + "/api/taskCallback/" + theRunID + "?taskID=" + url.QueryEscape(theTaskID), "WEBCONSOLE_CALLBACK_TOKEN=" + theCallbackToken}
+	var parameterNames []string
+	for parameterName := range theParameters {
+		parameterNames = append(parameterNames, parameterName)
+	}
+	sort.Strings(parameterNames)
+	for _, parameterName := range parameterNames {
+		taskEnvironment = append(taskEnvironment, "WEBCONSOLE_PARAM_" + strings.ToUpper(parameterName) + "=" + theParameters[parameterName])
+	}
+	if pathVariable := getTaskPathVariable(theTaskID, theTaskDetails); pathVariable != "" {
+		taskEnvironment = append(taskEnvironment, pathVariable)
+	}
+	return taskEnvironment
+}
+
+// Start the given command in its own process group (so that stopping it also stops any processes it has started), reading its STDOUT and
+// STDERR at the same time, each in its own goroutine. Complete lines are passed back on the returned channel in the order they arrive, and the
+// channel is closed once both streams have finished.
+func startTaskProcess(theCommand *exec.Cmd) (chan taskOutputLine, error) {
+	taskStdout, taskStdoutErr := theCommand.StdoutPipe()
+	if taskStdoutErr != nil {
+		return nil, taskStdoutErr
+	}
+	taskStderr, taskStderrErr := theCommand.StderrPipe()
+	if taskStderrErr != nil {
+		return nil, taskStderrErr
+	}
+	setProcessGroup(theCommand)
+	if startErr := theCommand.Start(); startErr != nil {
+		return nil, startErr
+	}
+	trackProcessTree(theCommand)
+	outputLines := make(chan taskOutputLine)
+	var streamsRunning sync.WaitGroup
+	readStream := func(theReader io.Reader, theStream string) {
+		streamReader := bufio.NewReader(theReader)
+		for {
+			streamLine, readErr := streamReader.ReadString('\n')
+			if streamLine != "" {
+				outputLines <- taskOutputLine{time.Now(), theStream, strings.TrimRight(streamLine, "\r\n")}
+			}
+			if readErr != nil {
+				break
+			}
+		}
+		streamsRunning.Done()
+	}
+	streamsRunning.Add(2)
+	go readStream(taskStdout, "stdout")
+	go readStream(taskStderr, "stderr")
+	go func() {
+		streamsRunning.Wait()
+		close(outputLines)
+	}()
+	return outputLines, nil
+}
+
+// Start the given Task running in the background, passing it the given parameters (if any) as environment variables, and recording who or
+// what started it (see triggers.go). If the Task is already running, does nothing.
+func startTask(theTaskID string, theTaskDetails map[string]string, theParameters map[string]string, theTrigger runTrigger) error {
+	if taskIsRunning(theTaskID) {
+		return nil
+	}
+	// A server that has handed over to an upgraded one (see upgrade.go) leaves starting Tasks to the new server.
+	if upgradeHandedOver {
+		sendHandoverMessage(handoverMessage{Event: "start", TaskID: theTaskID, Parameters: theParameters, Trigger: &theTrigger})
+		return nil
+	}
+	// Check to see if there's any rate limit set for this task, and don't run the Task if we're still
+	// within the rate limited time.
+	currentTimestamp := time.Now().Unix()
+	rateLimit, rateLimitErr := strconv.Atoi(theTaskDetails["ratelimit"])
+	if rateLimitErr == nil && currentTimestamp - taskStopTimes[theTaskID] < int64(rateLimit) {
+		return fmt.Errorf("Rate limit (%d seconds) exceeded - try again in %d seconds.", rateLimit, int64(rateLimit) - (currentTimestamp - taskStopTimes[theTaskID]))
+	}
+	// However the Task was started, don't run it with parameters that break their rules - see parameters.go.
+	if parametersErr := checkTaskParameters(theTaskDetails, theParameters); parametersErr != nil {
+		return parametersErr
+	}
+	// Or more often than its quotas allow - see quotas.go.
+	if quotaErr := checkRunQuotas(theTaskID, theTaskDetails, theTrigger, true); quotaErr != nil {
+		return quotaErr
+	}
+	// Get ready to run the Task - set up the Task's details...
+	commandArray, commandErr := getTaskCommand(theTaskID, theTaskDetails, theParameters)
+	if commandErr != nil {
+		return commandErr
+	}
+	pipelineSteps, stepsErr := getPipelineSteps(theTaskID)
+	if stepsErr != nil {
+		return stepsErr
+	}
+	if len(commandArray) == 0 && len(pipelineSteps) == 0 {
+		return errors.New("No command set for this Task.")
+	}
+	if len(pipelineSteps) > 0 && theTaskDetails["runner"] != "" {
+		return errors.New("Pipelines can't be run on an agent.")
+	}
+	if dependencyErr := checkTaskDependencies(theTaskID, nil); dependencyErr != nil {
+		return dependencyErr
+	}
+	if !claimSharedRun(theTaskID) {
+		return nil
+	}
+	if len(pipelineSteps) > 0 {
+		// A pipeline's steps each have their own command (see pipeline.go) - this one is never started, it just marks the Task as running.
+		commandArray = []string{"pipeline"}
+	}
+	runningTasks[theTaskID] = newTaskCommand(commandArray)
+	runningTasks[theTaskID].Dir = getTaskWorkDir(theTaskID, theTaskDetails)
+	taskParameters[theTaskID] = theParameters
+	taskTriggers[theTaskID] = theTrigger
+	
+	// ...get a list (if available) of recent run times...
+	taskRunTimes[theTaskID] = make([]int64, 0)
+	runTimesBytes, fileErr := ioutil.ReadFile(arguments["taskroot"] + "/" + theTaskID + "/runTimes.txt")
+	if fileErr == nil {
+		runTimeSplit := strings.Split(string(runTimesBytes), "\n")
+		for pl := 0; pl < len(runTimeSplit); pl = pl + 1 {
+			runTimeVal, runTimeErr := strconv.Atoi(runTimeSplit[pl])
+			if runTimeErr == nil {
+				taskRunTimes[theTaskID] = append(taskRunTimes[theTaskID], int64(runTimeVal))
+			}
+		}
+	}
+	
+	// ...use those to guess the run time for this time (just use a simple mean of the
+	// existing runtimes)...
+	var totalRunTime int64
+	totalRunTime = 0
+	for pl := 0; pl < len(taskRunTimes[theTaskID]); pl = pl + 1 {
+		totalRunTime = totalRunTime + taskRunTimes[theTaskID][pl]
+	}
+	if len(taskRunTimes[theTaskID]) == 0 {
+		taskRuntimeGuesses[theTaskID] = float64(10)
+	} else {
+		taskRuntimeGuesses[theTaskID] = float64(totalRunTime / int64(len(taskRunTimes[theTaskID])))
+	}
+	taskStartTimes[theTaskID] = currentTimestamp
+	
+	// ...then run the Task as a goroutine (thread) in the background.
+	go runTask(theTaskID)
+	return nil
+}
+
+// The most times newRunID tries a millisecond run ID before settling for the last one tried.
+const maxRunIDAttempts = 100
+
+// Returns the ID for a new run of the given Task - the time it started, to the millisecond if the Task already has a run folder for this second
+// (after a quick stop and restart, or a retry), so the earlier run's logs aren't overwritten. If the runs folder can't be checked, the ID is used
+// as it is - creating the run's folder will fail the same way.
+func newRunID(theTaskID string) string {
+	runID := time.Now().Format(runIDFormat)
+	for runIDAttempt := 0; runIDAttempt < maxRunIDAttempts; runIDAttempt = runIDAttempt + 1 {
+		if _, statErr := os.Stat(arguments["taskroot"] + "/" + theTaskID + "/runs/" + runID); statErr != nil {
+			return runID
+		}
+		time.Sleep(time.Millisecond)
+		runID = time.Now().Format(runIDMillisecondFormat)
+	}
+	return runID
+}
+
+// Runs a task, capturing output from stdout and stderr and placing it in a buffer. Designed to be run as a goroutine, so a task can be run in the
+// background and output captured while the user does other stuff.
+func runTask(theTaskID string) {
+	setTaskOutput(theTaskID, make([]taskOutputLine, 0))
+	taskDetails, _ := getTaskDetails(theTaskID)
+	// The run's callback token lets whoever has it add to the run's output, so it's generated with the system's secure random number generator.
+	callbackToken, callbackTokenErr := generateSecureRandomString()
+	if callbackTokenErr != nil {
+		fmt.Println("ERROR: Can't start Task " + theTaskID + " - " + callbackTokenErr.Error())
+		delete(runningTasks, theTaskID)
+		releaseSharedRun(theTaskID)
+		return
+	}
+	logfileOutput, logFileErr := os.Create(arguments["taskroot"] + "/" + theTaskID + "/log.txt")
+	if logFileErr != nil {
+		delete(runningTasks, theTaskID)
+		releaseSharedRun(theTaskID)
+		return
+	}
+	// As well as the Task's log.txt (which always holds the most recent run's output), write a copy of the log to this run's
+	// own folder so previous runs can be downloaded later, along with a copy in NDJSON format (one JSON event per line).
+	var logWriter io.Writer = logfileOutput
+	runID := newRunID(theTaskID)
+	taskRunIDs[theTaskID] = runID
+	runStore.RecordRunStart(theTaskID, runID, time.Now().Unix())
+	publishOutput, finishSharedRun := startSharedRun(theTaskID, taskDetails, runID)
+	startingTrigger := getStartingTrigger(theTaskID, taskDetails)
+	writeAuditLog(theTaskID, "Run " + runID + " started.")
+	publishTaskEvent(taskEvent{eventType: eventTaskStarted, taskID: theTaskID, runID: runID, taskDetails: taskDetails, trigger: startingTrigger})
+	runFolder := arguments["taskroot"] + "/" + theTaskID + "/runs/" + runID
+	var runLogOutput *os.File
+	var runNDJSONOutput *os.File
+	if mkdirErr := os.MkdirAll(runFolder, os.ModePerm); mkdirErr == nil {
+		var runLogErr error
+		runLogOutput, runLogErr = os.Create(runFolder + "/log.txt")
+		if runLogErr == nil {
+			logWriter = io.MultiWriter(logfileOutput, runLogOutput)
+		}
+		runNDJSONOutput, _ = os.Create(runFolder + "/log.ndjson")
+		saveRunTrigger(runFolder, startingTrigger)
+	}
+	// Set up the callback the Task can use to talk back to us.
+	callback := &taskCallback{theTaskID, callbackToken, make(chan taskOutputLine)}
+	taskCallbacks[runKey(theTaskID, runID)] = callback
+	// Mask any secrets before output goes anywhere - see redact.go.
+	redactor := newRedactor(taskDetails, taskParameters[theTaskID], callback.token)
+	// Record a line of output - write it to the log files and add it to the output buffer ready for the web interface. The log files get
+	// everything, the output buffer only as much as the Task's output limits allow - see outputlimits.go.
+	outputLimits := newOutputLimiter(taskDetails)
+	recordOutput := func(theStream string, theLine string) {
+		// Web Console's own messages are translated for the server's locale - see locale.go.
+		if theStream == "system" {
+			theLine = localiseMessage(getDefaultLocale(), theLine)
+		}
+		theLine = redactor.Replace(theLine)
+		outputLine := taskOutputLine{time.Now(), theStream, theLine}
+		logWriter.Write([]byte(theLine + "\n"))
+		if runNDJSONOutput != nil {
+			runNDJSONOutput.Write(append(formatOutputEvent(outputLine, runID), '\n'))
+		}
+		publishTaskEvent(taskEvent{eventType: eventOutputLine, taskID: theTaskID, runID: runID, time: outputLine.timestamp, outputLine: outputLine})
+		if strings.TrimSpace(theLine) != "" {
+			for _, keptLine := range outputLimits.addLine(outputLine) {
+				appendTaskOutput(theTaskID, keptLine)
+				publishOutput(keptLine)
+			}
+		}
+	}
+	// Say who or what started the run, and if it's a retry of a failed run, which attempt it is - see retries.go.
+	recordOutput("system", "Triggered by: " + describeTrigger(startingTrigger) + ".")
+	runAttempt := startRunAttempt(theTaskID)
+	noteStartupRun(theTaskID, runID, runAttempt)
+	if runAttempt > 1 {
+		taskRetries, _ := getRetryPolicy(taskDetails)
+		recordOutput("system", fmt.Sprintf("Attempt %d of %d.", runAttempt, taskRetries + 1))
+	}
+	// If the Task is a pipeline (or has dependencies to run first) keep track of it, so it can be stopped - see pipeline.go.
+	pipelineSteps, taskErr := getPipelineSteps(theTaskID)
+	if len(pipelineSteps) > 0 || len(getTaskDependencies(taskDetails)) > 0 {
+		pipelineRuns[theTaskID] = &pipelineRun{}
+	}
+	if taskErr == nil {
+		taskErr = runTaskDependencies(theTaskID, taskDetails, recordOutput)
+	}
+	if len(pipelineSteps) == 0 {
+		delete(pipelineRuns, theTaskID)
+	}
+	// Tell the Task (via environment variables) who it is and how to reach its callback.
+	taskEnvironment := append(os.Environ(), getTaskEnvironment(theTaskID, taskDetails, runID, callback.token, taskParameters[theTaskID])...)
+	// Bring the Task's git checkout up to date, if it has one - see gitcheckout.go.
+	if taskErr == nil && taskUsesGit(taskDetails) {
+		var gitCommit string
+		if gitCommit, taskErr = checkoutTaskRepo(theTaskID, taskDetails, recordOutput); taskErr == nil {
+			taskEnvironment = append(taskEnvironment, "WEBCONSOLE_GIT_COMMIT=" + gitCommit)
+		}
+	}
+	// Run the Task's pre-run hook, if it has one - see hookscripts.go.
+	if taskErr == nil {
+		taskErr = runHookScript(theTaskID, taskDetails, "pre-run", taskEnvironment, map[string]interface{}{"taskID": theTaskID, "runID": runID, "title": taskDetails["title"]}, redactor)
+	}
+	// Start the Task (unless a dependency failed) - either here, as a pipeline of steps, or on the agent given by the Task's "runner" option.
+	var outputLines chan taskOutputLine
+	var waitForTask func() error
+	if taskErr == nil && len(pipelineSteps) > 0 {
+		outputLines, waitForTask = startPipelineSteps(theTaskID, runFolder, pipelineSteps, taskEnvironment, taskDetails)
+	} else if taskErr == nil && taskDetails["runner"] != "" {
+		outputLines, waitForTask, taskErr = startAgentRun(theTaskID, runID, taskDetails["runner"])
+	} else if taskErr == nil {
+		if taskDetails["approvals"] == "Y" {
+			taskStdin, taskStdinErr := runningTasks[theTaskID].StdinPipe()
+			if taskStdinErr == nil {
+				taskStdins[theTaskID] = taskStdin
+			}
+		}
+		runningTasks[theTaskID].Env = taskEnvironment
+		outputLines, taskErr = startTaskProcess(runningTasks[theTaskID])
+		waitForTask = runningTasks[theTaskID].Wait
+		if taskErr == nil {
+			// Apply any CPU, memory or niceness limits set for the Task.
+			if limitsErr := applyProcessLimits(runningTasks[theTaskID], taskDetails); limitsErr != nil {
+				recordOutput("system", "WARNING: " + limitsErr.Error())
+			}
+		}
+	}
+	// If the Task doesn't succeed, the reason why, and whether it's worth retrying - it started, and wasn't stopped by a user.
+	runError := ""
+	runRetryable := false
+	runTimedOut := false
+	runStoppedByUser := false
+	// Some Tasks always exit with a status of 0, so their output can be checked against patterns to decide whether they really succeeded.
+	var successRegexp *regexp.Regexp
+	var failureRegexp *regexp.Regexp
+	successMatched := false
+	failureMatch := ""
+	for patternName, patternRegexp := range map[string]**regexp.Regexp{"successpattern":&successRegexp, "failurepattern":&failureRegexp} {
+		if taskDetails[patternName] != "" {
+			compiledRegexp, regexpErr := regexp.Compile(taskDetails[patternName])
+			if regexpErr == nil {
+				*patternRegexp = compiledRegexp
+			} else {
+				recordOutput("system", "WARNING: Ignoring invalid " + patternName + " - " + regexpErr.Error())
+			}
+		}
+	}
+	// Load the Task's transform script, if it has one - see transform.go.
+	outputTransform, transformErr := newOutputTransformer(theTaskID, taskDetails)
+	if transformErr != nil {
+		recordOutput("system", "WARNING: " + transformErr.Error() + " Output is shown as it is.")
+	}
+	if taskErr == nil {
+		// Keep an eye on the Task's CPU and memory use while it runs - see resourceusage.go.
+		stopUsageSampling := startUsageSampling(theTaskID, taskDetails, callback.lines)
+		// If the Task has a timeout set, stop it if it's still running after that many seconds.
+		taskTimeout, timeoutErr := strconv.Atoi(taskDetails["timeout"])
+		if timeoutErr == nil && taskTimeout > 0 {
+			taskCommand := runningTasks[theTaskID]
+			time.AfterFunc(time.Duration(taskTimeout) * time.Second, func() {
+				if runningTasks[theTaskID] == taskCommand {
+					runTimedOut = true
+					stopTask(theTaskID, fmt.Sprintf("Task timed out after %d seconds.", taskTimeout))
+				}
+			})
+		}
+		// Loop until the Task (an external executable) has finished, recording its output and anything sent to its callback.
+		for outputLines != nil {
+			var outputLine taskOutputLine
+			var outputOK bool
+			select {
+				case outputLine, outputOK = <-outputLines:
+					if !outputOK {
+						outputLines = nil
+						continue
+					}
+				case callbackLine := <-callback.lines:
+					recordOutput(callbackLine.stream, callbackLine.line)
+					continue
+			}
+			outputLine.line = redactor.Replace(outputLine.line)
+			if outputTransform == nil {
+				recordOutput(outputLine.stream, outputLine.line)
+			} else {
+				for _, transformedLine := range outputTransform.transform(outputLine.stream, outputLine.line) {
+					recordOutput(transformedLine.stream, transformedLine.line)
+				}
+			}
+			if successRegexp != nil && successRegexp.MatchString(outputLine.line) {
+				successMatched = true
+			}
+			if failureRegexp != nil && failureMatch == "" && failureRegexp.MatchString(outputLine.line) {
+				failureMatch = outputLine.line
+			}
+			// If the Task is asking for approval to continue, record the reason given and let anyone interested know.
+			if _, stdinFound := taskStdins[theTaskID]; stdinFound && strings.HasPrefix(strings.TrimSpace(outputLine.line), approvalMarker) {
+				approvalReason := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(outputLine.line), approvalMarker))
+				taskApprovalReasons[theTaskID] = approvalReason
+				writeAuditLog(theTaskID, "Run " + runID + " waiting for approval: " + approvalReason)
+				if taskDetails["approvalwebhook"] != "" {
+					go getHTTPClient("webhook").PostForm(taskDetails["approvalwebhook"], url.Values{"taskID": {theTaskID}, "runID": {runID}, "reason": {approvalReason}})
+				}
+			}
+		}
+		// Get the exit status of the running Task. If non-zero, pass the error message back to the user.
+		exitErr := waitForTask()
+		stopUsageSampling()
+		// The Task can't be approved or rejected once it has exited.
+		delete(taskApprovalReasons, theTaskID)
+		runRetryable = true
+		if stopReason, stopReasonFound := taskStopReasons[theTaskID]; stopReasonFound {
+			runError = stopReason
+			runRetryable = runTimedOut
+			runStoppedByUser = !runTimedOut
+			delete(taskStopReasons, theTaskID)
+		} else if limitMessage := describeLimitExit(exitErr, taskDetails); limitMessage != "" {
+			runError = limitMessage
+		} else if exitErr != nil {
+			runError = exitErr.Error()
+		} else if failureMatch != "" {
+			runError = "Output matched failure pattern: " + strings.TrimSpace(failureMatch)
+		} else if successRegexp != nil && !successMatched {
+			runError = "Output didn't match success pattern."
+		}
+		runError = redactor.Replace(runError)
+		if runError != "" {
+			recordOutput("system", "ERROR: " + runError)
+		}
+		// When we get here, the Task has finished running. We record the finish time and work out the total run time for this run
+		// and update (or create) the list of recent run times for this Task.
+		taskStopTimes[theTaskID] = time.Now().Unix()
+		runTime := taskStopTimes[theTaskID] - taskStartTimes[theTaskID]
+		taskRunTimes[theTaskID] = append(taskRunTimes[theTaskID], runTime)
+		// We don't just record every runtime, we sort the times and trim them to a set of 10 at most, that way we get a reasonable
+		// guess at an average run time, assuming run times are similar each time.
+		sort.Slice(taskRunTimes[theTaskID], func(i, j int) bool { return taskRunTimes[theTaskID][i] < taskRunTimes[theTaskID][j] })
+		for len(taskRunTimes[theTaskID]) >= 10 {
+			taskRunTimes[theTaskID] = taskRunTimes[theTaskID][1:len(taskRunTimes[theTaskID])-2]
+		}
+		// Write the runTimes.txt file for this Task.
+		outputString := ""
+		for pl := 0; pl < len(taskRunTimes[theTaskID]); pl = pl + 1 {
+			outputString = outputString + strconv.FormatInt(taskRunTimes[theTaskID][pl], 10)
+			if pl < len(taskRunTimes[theTaskID])-1 {
+				outputString = outputString + "\n"
+			}
+		}
+		ioutil.WriteFile("tasks/" + theTaskID + "/runTimes.txt", []byte(outputString), 0644)
+	} else {
+		runError = redactor.Replace(taskErr.Error())
+		recordOutput("system", "ERROR: " + runError)
+	}
+	runStore.RecordRunFinish(theTaskID, runID, time.Now().Unix(), runError)
+	taskRunResults[theTaskID] = runError
+	// If the run failed and the Task has retries left, try again. Tasks chained on to this one (see pipeline.go) wait for the last attempt. A
+	// Task in service mode is started again whenever it exits, unless a user stopped it - see servicemode.go.
+	retryScheduled := false
+	if taskIsService(taskDetails) && runStoppedByUser {
+		resetServiceState(theTaskID)
+	} else if taskIsService(taskDetails) {
+		scheduleServiceRestart(theTaskID, taskParameters[theTaskID], time.Duration(time.Now().Unix() - taskStartTimes[theTaskID]) * time.Second, recordOutput)
+	} else {
+		retryScheduled = runError != "" && runRetryable && scheduleRetry(theTaskID, taskDetails, taskParameters[theTaskID], runAttempt, recordOutput)
+	}
+	finishStartupRun(theTaskID, runID, runError, retryScheduled)
+	if !retryScheduled {
+		startChainedTasks(theTaskID, taskDetails, runError, recordOutput)
+	}
+	// If the output was over the limit, add the end of it to the output buffer.
+	for _, keptLine := range outputLimits.finish() {
+		appendTaskOutput(theTaskID, keptLine)
+		publishOutput(keptLine)
+	}
+	// Let anyone who wants to know how the run went - see events.go.
+	publishTaskEvent(taskEvent{eventType: eventTaskFinished, taskID: theTaskID, runID: runID, taskDetails: taskDetails, runError: runError, retryScheduled: retryScheduled, trigger: startingTrigger})
+	// Remove this Task from the runnings Tasks list. We don't remove the output right away - client-side code might
+	// still not have received all the output yet.
+	delete(taskCallbacks, runKey(theTaskID, runID))
+	delete(taskStopReasons, theTaskID)
+	delete(pipelineRuns, theTaskID)
+	delete(taskParameters, theTaskID)
+	delete(taskTriggers, theTaskID)
+	delete(runningTasks, theTaskID)
+	delete(taskStdins, theTaskID)
+	delete(taskApprovalReasons, theTaskID)
+	finishSharedRun()
+	logfileOutput.Close()
+	if runLogOutput != nil {
+		runLogOutput.Close()
+	}
+	if runNDJSONOutput != nil {
+		runNDJSONOutput.Close()
+	}
+	handOverFinishedRun(theTaskID)
+	startRetryTimer(theTaskID)
+}
+
+// Stop a running Task, along with any processes it has started. The given reason is added to the Task's output.
+func stopTask(theTaskID string, theReason string) error {
+	runningTask, taskFound := runningTasks[theTaskID]
+	if !taskFound {
+		return errors.New("Task isn't running.")
+	}
+	taskStopReasons[theTaskID] = theReason
+	writeAuditLog(theTaskID, "Run " + taskRunIDs[theTaskID] + " stopped: " + theReason)
+	if stopAgentRun(theTaskID) || stopPipelineRun(theTaskID) {
+		return nil
+	}
+	return killProcessTree(runningTask)
+}
+
+// Returns true if the given Task is currently running (on this server or, if sharing state via Redis, another one), false otherwise.
+func taskIsRunning(theTaskID string) bool {
+	if taskIDValue, taskIDFound := runningTasks[theTaskID]; taskIDFound {
+		taskIDValue = taskIDValue
+		return true
+	}
+	return taskRunningElsewhere(theTaskID) || taskRunningInOldServer(theTaskID)
+}
+
+// Returns a list of the run IDs for the given Task, oldest first.
+func getRunList(theTaskID string) ([]string, error) {
+	runList, listErr := runStore.ListRunIDs(theTaskID)
+	if listErr != nil {
+		return runList, errors.New("Can't read run history.")
+	}
+	return runList, nil
+}
+
+// Read the output of the Task's most recent run back into the Task's output buffer. Uses the run's NDJSON log if there is one, so each line keeps
+// its original timestamp and stream, otherwise falls back to the plain log.txt file. A run whose output the buffer already holds isn't read
+// again, so viewers polling a finished Task don't each re-read its log.
+func loadTaskOutput(theTaskID string) {
+	taskDetails, _ := getTaskDetails(theTaskID)
+	runList, _ := getRunList(theTaskID)
+	if len(runList) > 0 {
+		runID := runList[len(runList)-1]
+		taskOutputsLock.RLock()
+		_, outputFound := taskOutputs[theTaskID]
+		taskOutputsLock.RUnlock()
+		if outputFound && taskRunIDs[theTaskID] == runID {
+			return
+		}
+		ndjsonFile, ndjsonErr := openRunFile(theTaskID, runID, "log.ndjson")
+		if ndjsonErr == nil {
+			defer ndjsonFile.Close()
+			loadedOutput := make([]taskOutputLine, 0)
+			outputLimits := newOutputLimiter(taskDetails)
+			ndjsonScanner := bufio.NewScanner(ndjsonFile)
+			ndjsonScanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+			for ndjsonScanner.Scan() {
+				var outputEvent taskOutputEvent
+				if json.Unmarshal(ndjsonScanner.Bytes(), &outputEvent) == nil && strings.TrimSpace(outputEvent.Line) != "" {
+					eventTime, _ := time.Parse(time.RFC3339Nano, outputEvent.Timestamp)
+					loadedOutput = append(loadedOutput, outputLimits.addLine(taskOutputLine{eventTime, outputEvent.Stream, outputEvent.Line})...)
+				}
+			}
+			taskRunIDs[theTaskID] = runID
+			setTaskOutput(theTaskID, append(loadedOutput, outputLimits.finish()...))
+			return
+		}
+	}
+	logPath := arguments["taskroot"] + "/" + theTaskID + "/log.txt"
+	logContents, logContentsErr := ioutil.ReadFile(logPath)
+	if logContentsErr == nil {
+		logTime := time.Now()
+		if logInfo, logInfoErr := os.Stat(logPath); logInfoErr == nil {
+			logTime = logInfo.ModTime()
+		}
+		loadedOutput := make([]taskOutputLine, 0)
+		outputLimits := newOutputLimiter(taskDetails)
+		for _, logLine := range strings.Split(string(logContents), "\n") {
+			if strings.TrimSpace(logLine) != "" {
+				loadedOutput = append(loadedOutput, outputLimits.addLine(taskOutputLine{logTime, "stdout", logLine})...)
+			}
+		}
+		setTaskOutput(theTaskID, append(loadedOutput, outputLimits.finish()...))
+	}
+}
+
+// Format a line of Task output as a single JSON event.
+func formatOutputEvent(theOutputLine taskOutputLine, theRunID string) []byte {
+	eventJSON, _ := json.Marshal(taskOutputEvent{theOutputLine.timestamp.Format(time.RFC3339Nano), theOutputLine.stream, theOutputLine.line, theRunID})
+	return eventJSON
+}
+
+// The format of the timestamps added to plain text output lines when asked for.
+const outputTimestampFormat = "2006-01-02 15:04:05.000"
+
+// Write the given Task's output to the client, from the given line number onwards, either as plain text or (if theFormat is "ndjson") as one JSON
+// event per line. If theTimestamps is true, each plain text line starts with the time it was output and a tab (NDJSON events always include
+// the time). Returns the line number to carry on from next time.
+func writeTaskOutput(theResponseWriter http.ResponseWriter, theTaskID string, theLineNumber int, theFormat string, theTimestamps bool) int {
+	outputLines := getTaskOutputLines(theTaskID, theLineNumber)
+	writeOutputLines(theResponseWriter, theTaskID, outputLines, theFormat, theTimestamps)
+	return theLineNumber + len(outputLines)
+}
+
+// Write the given lines of the given Task's output to the client, formatted as for writeTaskOutput.
+func writeOutputLines(theResponseWriter http.ResponseWriter, theTaskID string, theOutputLines []taskOutputLine, theFormat string, theTimestamps bool) {
+	for _, outputLine := range theOutputLines {
+		if theFormat == "ndjson" {
+			fmt.Fprintln(theResponseWriter, string(formatOutputEvent(outputLine, taskRunIDs[theTaskID])))
+		} else if theTimestamps {
+			fmt.Fprintln(theResponseWriter, outputLine.timestamp.Format(outputTimestampFormat) + "\t" + outputLine.line)
+		} else {
+			fmt.Fprintln(theResponseWriter, outputLine.line)
+		}
+	}
+}
+
+// Work out which line of output to send a client from, letting clients that have lost their connection carry on from where they left off. The
+// current run ID is passed back in an "X-Run-ID" header - if the client says it was following a different run (the Task has finished and been run
+// again in the meantime), the output is sent from the start of the current run instead.
+func resumeOutputLine(theResponseWriter http.ResponseWriter, theTaskID string, theRunID string, theLineNumber int) int {
+	theResponseWriter.Header().Set("X-Run-ID", taskRunIDs[theTaskID])
+	if theRunID != "" && theRunID != taskRunIDs[theTaskID] {
+		return 0
+	}
+	return theLineNumber
+}
+
+// Tell the client that the Task has finished and there's no more output to come.
+func writeTaskOutputEOF(theResponseWriter http.ResponseWriter, theTaskID string, theFormat string) {
+	if theFormat == "ndjson" {
+		fmt.Fprintln(theResponseWriter, string(formatOutputEvent(taskOutputLine{time.Now(), "eof", ""}, taskRunIDs[theTaskID])))
+	} else {
+		fmt.Fprintf(theResponseWriter, "ERROR: EOF")
+	}
+}
+
+// Resolve a user-supplied path (relative to the given Task's folder) to a path on disk, making sure it can't be used to escape the Task's folder
+// (with "..", absolute paths or symbolic links) or to read the Task's config file (which holds the Task's secret).
+func getTaskFilePath(theTaskID string, thePath string) (string, error) {
+	taskFolder, taskFolderErr := filepath.Abs(arguments["taskroot"] + "/" + theTaskID)
+	if taskFolderErr == nil {
+		taskFolder, taskFolderErr = filepath.EvalSymlinks(taskFolder)
+	}
+	if taskFolderErr != nil {
+		return "", errors.New("Can't find Task folder.")
+	}
+	filePath, filePathErr := filepath.EvalSymlinks(filepath.Join(taskFolder, filepath.Clean("/" + thePath)))
+	if filePathErr != nil {
+		return "", errors.New("File not found.")
+	}
+	relativePath, relativePathErr := filepath.Rel(taskFolder, filePath)
+	if relativePathErr != nil || relativePath == ".." || strings.HasPrefix(relativePath, ".." + string(filepath.Separator)) {
+		return "", errors.New("File not found.")
+	}
+	if relativePath == "config.txt" {
+		return "", errors.New("File not available.")
+	}
+	return filePath, nil
+}
+
+// Read the Task's details from its config file.
+func getTaskDetails(theTaskID string) (map[string]string, error) {
+	taskDetails := make(map[string]string)
+	// Task IDs come from clients, so are checked before being used to find the Task's config - see taskids.go.
+	if idErr := checkInternalTaskID(theTaskID); idErr != nil {
+		return taskDetails, idErr
+	}
+	// Check to see if we have a valid task ID.
+	if configContents, readErr := taskStore.ReadTaskConfig(theTaskID); !os.IsNotExist(readErr) {
+		if readErr != nil {
+			return taskDetails, errors.New("Can't open Task config file.")
+		} else {
+			// Read the Task's details from its config file.
+			taskDetails["taskID"] = theTaskID
+			taskDetails["title"] = ""
+			taskDetails["description"] = ""
+			taskDetails["secret"] = ""
+			taskDetails["viewersecret"] = ""
+			taskDetails["public"] = "N"
+			taskDetails["ratelimit"] = "0"
+			taskDetails["progress"] = "N"
+			taskDetails["uploads"] = "N"
+			taskDetails["uploadmaxsize"] = "10"
+			taskDetails["uploadextensions"] = ""
+			taskDetails["filebrowser"] = "N"
+			taskDetails["timeout"] = "0"
+			taskDetails["retries"] = "0"
+			taskDetails["retrydelay"] = "0"
+			taskDetails["command"] = ""
+			scanner := bufio.NewScanner(bytes.NewReader(configContents))
+			lineNumber := 0
+			for scanner.Scan() {
+				lineNumber = lineNumber + 1
+				if strings.TrimSpace(scanner.Text()) == "" {
+					continue
+				}
+				itemSplit := strings.SplitN(scanner.Text(), ":", 2)
+				if len(itemSplit) < 2 {
+					return taskDetails, fmt.Errorf("Invalid line %d in Task config file - should be \"keyword: value\".", lineNumber)
+				}
+				// Keywords aren't case-sensitive, so "allowedIPs" and "allowedips" both work.
+				taskDetails[strings.ToLower(strings.TrimSpace(itemSplit[0]))] = strings.TrimSpace(itemSplit[1])
+			}
+			descriptionContents, descriptionContentsErr := ioutil.ReadFile(arguments["taskroot"] + "/" + theTaskID + "/description.txt")
+			if descriptionContentsErr == nil {
+				taskDetails["description"] = string(descriptionContents)
+			}
+		}
+	} else {
+		return taskDetails, errors.New("Invalid taskID")
+	}
+	return taskDetails, nil
+}
+
+// Update the given values in a Task's config file, leaving any other lines (and the order of existing lines) as they are. New values are added at
+// the end of the file, and a value of "" removes that line. Keys and values can't contain line breaks, which would add lines of their own.
+func setTaskConfigValues(theTaskID string, theValues map[string]string) error {
+	for configKey, newValue := range theValues {
+		if strings.ContainsAny(configKey + newValue, "\r\n") {
+			return errors.New("Config values can't contain line breaks.")
+		}
+	}
+	configContents, configErr := taskStore.ReadTaskConfig(theTaskID)
+	if configErr != nil {
+		return errors.New("Can't read Task config file.")
+	}
+	valuesWritten := map[string]bool{}
+	var configLines []string
+	for _, configLine := range strings.Split(strings.TrimRight(string(configContents), "\n"), "\n") {
+		configKey := strings.ToLower(strings.TrimSpace(strings.SplitN(configLine, ":", 2)[0]))
+		if newValue, valueFound := theValues[configKey]; valueFound {
+			valuesWritten[configKey] = true
+			if newValue == "" {
+				continue
+			}
+			configLine = configKey + ": " + newValue
+		}
+		configLines = append(configLines, configLine)
+	}
+	var newKeys []string
+	for configKey, newValue := range theValues {
+		if !valuesWritten[configKey] && newValue != "" {
+			newKeys = append(newKeys, configKey)
+		}
+	}
+	sort.Strings(newKeys)
+	for _, configKey := range newKeys {
+		configLines = append(configLines, configKey + ": " + theValues[configKey])
+	}
+	if writeErr := taskStore.WriteTaskConfig(theTaskID, []byte(strings.Join(configLines, "\n") + "\n")); writeErr != nil {
+		return errors.New("Couldn't write config for Task " + theTaskID + ".")
+	}
+	return nil
+}
+
+// Returns a list of task details.
+func getTaskList() ([]map[string]string, error) {
+	var taskList []map[string]string
+	taskIDs, listErr := taskStore.ListTaskIDs()
+	if listErr == nil {
+		for _, taskID := range taskIDs {
+			// Tasks with an invalid config file are skipped (they're reported at startup), so one broken Task doesn't affect the others.
+			taskDetails, taskErr := getTaskDetails(taskID)
+			if taskErr == nil {
+				taskList = append(taskList, taskDetails)
+			}
+		}
+	} else {
+		return taskList, errors.New("Can't read Tasks folder.")
+	}
+	return taskList, nil
+}
+
+// Copy a file, creating any folders needed for the destination.
+func copyFile(theSourcePath string, theDestinationPath string) error {
+	sourceFile, sourceErr := os.Open(theSourcePath)
+	if sourceErr != nil {
+		return sourceErr
+	}
+	defer sourceFile.Close()
+	os.MkdirAll(filepath.Dir(theDestinationPath), os.ModePerm)
+	destinationFile, destinationErr := os.Create(theDestinationPath)
+	if destinationErr != nil {
+		return destinationErr
+	}
+	_, copyErr := io.Copy(destinationFile, sourceFile)
+	destinationFile.Close()
+	return copyErr
+}
+
+// The credentials a cloned Task is given new, random values of, so it doesn't share any with the Task it was copied from, and whether each is
+// kept as a hash. A Task's TOTP secret isn't copied at all - the new Task's has to be enrolled with an authenticator app of its own.
+var clonedCredentialKeys = map[string]bool{"secret": true, "viewersecret": true, "approversecret": true, "hooktoken": true, "hooksecret": false}
+
+// The order a cloned Task's new credentials are listed in.
+var clonedCredentialOrder = []string{"secret", "viewersecret", "approversecret", "hooksecret", "hooktoken"}
+
+// Create a new Task as a copy of an existing one. If no new Task ID is given, a random one is generated. The config is copied, except that the
+// existing Task's secret and other credentials (see clonedCredentialKeys) are replaced with fresh, random ones, which are returned by keyword (as
+// plain text - this is the only chance to see them). If wanted, other files in the Task's folder (scripts, favicons and so on) are copied too, but not its logs, run history or uploads. The new Task
+// is created in the given tenant's namespace (see tenants.go), and its ID returned as the tenant knows it.
+func cloneTask(theSourceTaskID string, theNewTaskID string, theCopyFiles bool, theTenant *tenant) (string, map[string]string, error) {
+	if _, taskErr := getTaskDetails(theSourceTaskID); taskErr != nil {
+		return "", nil, taskErr
+	}
+	newTaskID := strings.ToLower(theNewTaskID)
+	if newTaskID == "" {
+		for {
+			randomID, randomErr := generateSecureRandomString()
+			if randomErr != nil {
+				return "", nil, randomErr
+			}
+			newTaskID = randomID
+			if !taskExists(tenantTaskID(theTenant, newTaskID)) {
+				break
+			}
+		}
+	}
+	if idErr := checkTaskID(newTaskID); idErr != nil {
+		return "", nil, idErr
+	}
+	newTaskName := newTaskID
+	newTaskID = tenantTaskID(theTenant, newTaskID)
+	if taskExists(newTaskID) {
+		return "", nil, errors.New("A task with ID " + newTaskID + " already exists.")
+	}
+	sourceFolder := arguments["taskroot"] + "/" + theSourceTaskID
+	newFolder := arguments["taskroot"] + "/" + newTaskID
+	configContents, configErr := taskStore.ReadTaskConfig(theSourceTaskID)
+	if configErr != nil {
+		return "", nil, errors.New("Can't read Task config file.")
+	}
+	// Copy the config, giving the new Task new credentials of its own - see clonedCredentialKeys.
+	newCredentials := map[string]string{}
+	var configLines []string
+	for _, configLine := range strings.Split(string(configContents), "\n") {
+		configSplit := strings.SplitN(configLine, ":", 2)
+		configKey := strings.ToLower(strings.TrimSpace(configSplit[0]))
+		if configKey == "totpsecret" {
+			continue
+		}
+		if credentialHashed, isCredential := clonedCredentialKeys[configKey]; isCredential && len(configSplit) == 2 && strings.TrimSpace(configSplit[1]) != "" {
+			newCredential, randomErr := generateSecureRandomString()
+			if randomErr != nil {
+				return "", nil, randomErr
+			}
+			newCredentials[configKey] = newCredential
+			if credentialHashed {
+				hashedCredential, hashErr := hashPassword(newCredential)
+				if hashErr != nil {
+					return "", nil, errors.New("Problem hashing " + configKey + " - " + hashErr.Error())
+				}
+				newCredential = hashedCredential
+			}
+			configLine = configKey + ": " + newCredential
+		}
+		configLines = append(configLines, configLine)
+	}
+	if writeErr := taskStore.WriteTaskConfig(newTaskID, []byte(strings.Join(configLines, "\n"))); writeErr != nil {
+		return "", nil, errors.New("Couldn't write config for Task " + newTaskID + ".")
+	}
+	if theCopyFiles {
+		walkErr := filepath.Walk(sourceFolder, func(thePath string, theInfo os.FileInfo, theErr error) error {
+			if theErr != nil {
+				return theErr
+			}
+			relativePath, _ := filepath.Rel(sourceFolder, thePath)
+			if theInfo.IsDir() {
+				if relativePath == "runs" || relativePath == "uploads" || relativePath == gitCheckoutFolder {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if relativePath == "config.txt" || relativePath == "log.txt" || relativePath == "runTimes.txt" || relativePath == budgetFile {
+				return nil
+			}
+			return copyFile(thePath, filepath.Join(newFolder, relativePath))
+		})
+		if walkErr != nil {
+			return newTaskName, newCredentials, errors.New("Problem copying Task files - " + walkErr.Error())
+		}
+	}
+	writeAuditLog(newTaskID, "Task cloned from " + theSourceTaskID + ".")
+	return newTaskName, newCredentials, nil
+}
+
+// Returns the folder deleted Tasks are archived in - the "archiveroot" option if set, otherwise a folder called "archive" alongside the Tasks
+// folder (not inside it, where it would look like a Task).
+func getArchiveRoot() string {
+	if arguments["archiveroot"] != "" {
+		return arguments["archiveroot"]
+	}
+	return filepath.Join(filepath.Dir(filepath.Clean(arguments["taskroot"])), "archive")
+}
+
+// Delete a Task, or (if theArchive is true) move its folder, including its run history, to the archive folder. A Task's config is always
+// written to config.txt in the archived folder (even if it's kept in a database), so the folder can simply be moved back to restore the Task.
+// Returns the path of the archived folder.
+func deleteTask(theTaskID string, theArchive bool) (string, error) {
+	configContents, configErr := taskStore.ReadTaskConfig(theTaskID)
+	if configErr != nil {
+		return "", errors.New("Invalid taskID")
+	}
+	taskFolder := arguments["taskroot"] + "/" + theTaskID
+	archivePath := ""
+	if theArchive {
+		archivePath = filepath.Join(getArchiveRoot(), theTaskID + "-" + time.Now().Format(runIDFormat))
+		if mkdirErr := os.MkdirAll(getArchiveRoot(), os.ModePerm); mkdirErr != nil {
+			return "", errors.New("Can't create archive folder " + getArchiveRoot() + ".")
+		}
+		if renameErr := os.Rename(taskFolder, archivePath); renameErr != nil {
+			return "", errors.New("Can't move Task folder to archive - " + renameErr.Error())
+		}
+		if writeErr := ioutil.WriteFile(archivePath + "/config.txt", configContents, 0644); writeErr != nil {
+			return archivePath, errors.New("Couldn't write config.txt in archive folder.")
+		}
+	} else if removeErr := os.RemoveAll(taskFolder); removeErr != nil {
+		return "", errors.New("Can't delete Task folder - " + removeErr.Error())
+	}
+	if deleteErr := taskStore.DeleteTask(theTaskID); deleteErr != nil {
+		return archivePath, errors.New("Couldn't remove Task config - " + deleteErr.Error())
+	}
+	if deleteErr := runStore.DeleteRuns(theTaskID); deleteErr != nil {
+		return archivePath, errors.New("Couldn't remove run history - " + deleteErr.Error())
+	}
+	if theArchive {
+		writeAuditLog(theTaskID, "Task archived to " + archivePath + ".")
+	} else {
+		writeAuditLog(theTaskID, "Task deleted.")
+	}
+	return archivePath, nil
+}
+
+// Input typed by the user - one reader for all prompts, so input typed (or piped in) ahead of a prompt isn't lost.
+var stdinReader = bufio.NewReader(os.Stdin)
+
+// Get an input string from the user via stdin.
+func getUserInput(argumentsKey, defaultValue string, messageString string) string {
+	if argument, argumentExists := arguments[argumentsKey]; argumentExists {
+		return argument
+	}
+	fmt.Printf(messageString + ": ")
+	result, _ := stdinReader.ReadString('\n')
+	result = strings.TrimSpace(result)
+	if result == "" {
+		return defaultValue
+	}
+	return result
+}
+
+func setArgumentIfPathExists(theArgument string, thePaths []string) {
+	for _, path := range thePaths {
+		if _, existsErr := os.Stat(path); !os.IsNotExist(existsErr) {
+			arguments[theArgument] = path
+			return
+		}
+	}
+}
+
+// Exit codes used if we refuse to start because of a problem with the configuration.
+const exitConfigError = 2
+const exitWebrootError = 3
+const exitTaskrootError = 4
+
+// Web server limits, each of which can be set in the main config file: how long (in seconds) a client has to send a request's headers, the
+// whole request (including any upload) and to receive the response, how long an idle keep-alive connection is kept open, the most a
+// request's headers and body (not including uploads, which have their own limit) can add up to (in bytes), and how many form values (from
+// both the URL and the body) a request can have. A value of 0 means no limit.
+var webServerLimits = map[string]int{
+	"readheadertimeout": 10,
+	"readtimeout": 300,
+	"writetimeout": 300,
+	"idletimeout": 120,
+	"maxheaderbytes": 1 << 20,
+	"maxrequestbytes": 1 << 20,
+	"maxformvalues": 1000,
+}
+
+// Returns the value of the given web server limit - the value from the config file if set, otherwise the default above.
+func getWebServerLimit(theLimit string) (int, error) {
+	if arguments[theLimit] == "" {
+		return webServerLimits[theLimit], nil
+	}
+	limitValue, atoiErr := strconv.Atoi(arguments[theLimit])
+	if atoiErr != nil || limitValue < 0 {
+		return 0, errors.New("Invalid value \"" + arguments[theLimit] + "\" for \"" + theLimit + "\" - should be a whole number, 0 or more.")
+	}
+	return limitValue, nil
+}
+
+// Returns the web server, listening on the given address, with the limits above. HTTP/2 is enabled both for HTTPS connections and, for
+// reverse proxies that support it, unencrypted connections - set "http2" to "false" in the config file to only use HTTP/1.1.
+func newWebServer(theAddress string) *http.Server {
+	webServer := &http.Server{Addr: theAddress}
+	readHeaderTimeout, _ := getWebServerLimit("readheadertimeout")
+	readTimeout, _ := getWebServerLimit("readtimeout")
+	writeTimeout, _ := getWebServerLimit("writetimeout")
+	idleTimeout, _ := getWebServerLimit("idletimeout")
+	webServer.ReadHeaderTimeout = time.Duration(readHeaderTimeout) * time.Second
+	webServer.ReadTimeout = time.Duration(readTimeout) * time.Second
+	webServer.WriteTimeout = time.Duration(writeTimeout) * time.Second
+	webServer.IdleTimeout = time.Duration(idleTimeout) * time.Second
+	webServer.MaxHeaderBytes, _ = getWebServerLimit("maxheaderbytes")
+	webServer.Protocols = new(http.Protocols)
+	webServer.Protocols.SetHTTP1(true)
+	if arguments["http2"] != "false" {
+		webServer.Protocols.SetHTTP2(true)
+		webServer.Protocols.SetUnencryptedHTTP2(true)
+	}
+	return webServer
+}
+
+// Parse the given request's form values, within the "maxrequestbytes" and "maxformvalues" limits. Uploads are read later, with the Task's own
+// size limit, and agents send output in batches that can be larger, so are only held to Go's own limit on form data (10MB). The request path
+// is checked before any path prefix or tenant is stripped from it, so is matched anywhere in the path.
+func parseRequestForm(theResponseWriter http.ResponseWriter, theRequest *http.Request, theRequestPath string) (int, error) {
+	maxRequestBytes, _ := getWebServerLimit("maxrequestbytes")
+	if maxRequestBytes > 0 && !strings.Contains(theRequestPath, "/api/uploadFile") && !strings.Contains(theRequestPath, "/api/agent/") {
+		theRequest.Body = http.MaxBytesReader(theResponseWriter, theRequest.Body, int64(maxRequestBytes))
+	}
+	if parseErr := theRequest.ParseForm(); parseErr != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(parseErr, &maxBytesErr) {
+			return http.StatusRequestEntityTooLarge, fmt.Errorf("Request too large - the limit is %d bytes.", maxRequestBytes)
+		}
+		return http.StatusBadRequest, errors.New("Can't read request - " + parseErr.Error() + ".")
+	}
+	maxFormValues, _ := getWebServerLimit("maxformvalues")
+	formValueCount := 0
+	for _, formValues := range theRequest.Form {
+		formValueCount = formValueCount + len(formValues)
+	}
+	if maxFormValues > 0 && formValueCount > maxFormValues {
+		return http.StatusRequestEntityTooLarge, fmt.Errorf("Too many form values - the limit is %d.", maxFormValues)
+	}
+	return http.StatusOK, nil
+}
+
+// Parse a "line" parameter, giving the line of a Task's output to start from - a whole number, 0 or more. An empty value means 0.
+func parseOutputLineNumber(theValue string) (int, error) {
+	if theValue == "" {
+		return 0, nil
+	}
+	lineNumber, atoiErr := strconv.Atoi(theValue)
+	if atoiErr != nil || lineNumber < 0 {
+		return 0, errors.New("Line number not parsable.")
+	}
+	return lineNumber, nil
+}
+
+// Check the configuration before starting the web server. Returns a summary of the configuration - listen address, storage, Tasks loaded (and
+// any skipped because of errors in their config files) and integrations enabled - along with an exit code: 0 if all is well, otherwise one of
+// the exit codes above, with the problem described in the summary.
+func checkStartupConfig() ([]string, int) {
+	var summary []string
+	exitCode := 0
+	fatalError := func(theExitCode int, theMessage string) {
+		summary = append(summary, "  ERROR: " + theMessage)
+		if exitCode == 0 {
+			exitCode = theExitCode
+		}
+	}
+	summary = append(summary, "Web Console startup summary:")
+	
+	// Listen address.
+	listenAddress := ":" + arguments["port"]
+	if arguments["localonly"] == "true" {
+		listenAddress = "localhost:" + arguments["port"] + " (local only)"
+	}
+	summary = append(summary, "  Listen address: " + listenAddress)
+	if arguments["pathprefix"] != "" {
+		summary = append(summary, "  Path prefix: " + arguments["pathprefix"])
+	}
+	if environmentArguments, _ := getEnvironmentArguments(); len(environmentArguments) > 0 {
+		var environmentNames []string
+		for argumentName := range environmentArguments {
+			environmentNames = append(environmentNames, argumentName)
+		}
+		sort.Strings(environmentNames)
+		summary = append(summary, "  Set from environment: " + strings.Join(environmentNames, ", "))
+	}
+	if portNumber, portErr := strconv.Atoi(arguments["port"]); portErr != nil || portNumber < 1 || portNumber > 65535 {
+		fatalError(exitConfigError, "Invalid port number \"" + arguments["port"] + "\".")
+	}
+	for _, limitName := range []string{"readheadertimeout", "readtimeout", "writetimeout", "idletimeout", "maxheaderbytes", "maxrequestbytes", "maxformvalues"} {
+		if _, limitErr := getWebServerLimit(limitName); limitErr != nil {
+			fatalError(exitConfigError, limitErr.Error())
+		}
+	}
+	if arguments["tlscert"] != "" || arguments["tlskey"] != "" {
+		if arguments["tlscert"] == "" || arguments["tlskey"] == "" {
+			fatalError(exitConfigError, "To serve HTTPS, set both \"tlscert\" and \"tlskey\".")
+		} else if _, certErr := tls.LoadX509KeyPair(arguments["tlscert"], arguments["tlskey"]); certErr != nil {
+			fatalError(exitConfigError, "Can't load TLS certificate - " + certErr.Error())
+		} else {
+			summary = append(summary, "  HTTPS certificate: " + arguments["tlscert"])
+		}
+	}
+	
+	// Web root - we need at least the main page and the Task page.
+	summary = append(summary, "  Webroot: " + arguments["webroot"])
+	for _, webFile := range []string{"index.html", "webconsole.html"} {
+		if _, statErr := os.Stat(arguments["webroot"] + "/" + webFile); statErr != nil {
+			fatalError(exitWebrootError, "Can't find " + webFile + " in webroot \"" + arguments["webroot"] + "\" - set --webroot.")
+		}
+	}
+	
+	// Translations of server-generated messages - see locale.go.
+	if locales, localesErr := loadMessageCatalogues(); localesErr != nil {
+		fatalError(exitWebrootError, localesErr.Error())
+	} else if len(locales) > 0 {
+		summary = append(summary, "  Translations: " + strings.Join(locales, ", ") + ", default " + getDefaultLocale())
+	}
+	
+	// Go plugins subscribing to events - see events.go.
+	if pluginPaths, pluginErr := loadPlugins(); pluginErr != nil {
+		fatalError(exitConfigError, pluginErr.Error())
+	} else if len(pluginPaths) > 0 {
+		summary = append(summary, "  Plugins: " + strings.Join(pluginPaths, ", "))
+	}
+	
+	// Storage, and the Tasks stored there.
+	summary = append(summary, "  Storage: " + storeDescription)
+	taskIDs, listErr := taskStore.ListTaskIDs()
+	if _, statErr := os.Stat(arguments["taskroot"]); listErr != nil || statErr != nil {
+		fatalError(exitTaskrootError, "Can't read Tasks folder \"" + arguments["taskroot"] + "\" - set --taskroot.")
+	} else {
+		var taskErrors []string
+		tasksLoaded := 0
+		for _, taskID := range taskIDs {
+			if _, taskErr := getTaskDetails(taskID); taskErr == nil {
+				tasksLoaded = tasksLoaded + 1
+			} else {
+				taskErrors = append(taskErrors, "    " + taskID + ": " + taskErr.Error())
+			}
+		}
+		summary = append(summary, "  Tasks loaded: " + strconv.Itoa(tasksLoaded))
+		if len(taskErrors) > 0 {
+			summary = append(summary, "  Tasks skipped because of config errors: " + strconv.Itoa(len(taskErrors)))
+			summary = append(summary, taskErrors...)
+		}
+		if tenantList := getTenants(); len(tenantList) > 0 {
+			var tenantNames []string
+			for _, summaryTenant := range tenantList {
+				tenantNames = append(tenantNames, summaryTenant.name)
+			}
+			summary = append(summary, "  Tenants: " + strings.Join(tenantNames, ", "))
+		}
+		for _, tenantProblem := range checkTenants() {
+			summary = append(summary, "    " + tenantProblem)
+		}
+	}
+	
+	// Secrets given in the config file should be Bcrypt or Argon2id hashes - a plain secret would never match.
+	for _, secretName := range []string{"adminsecret", "agentsecret"} {
+		if arguments[secretName] != "" && !isPasswordHash(arguments[secretName]) {
+			fatalError(exitConfigError, "\"" + secretName + "\" should be a Bcrypt or Argon2id hash, as printed by \"webconsole --hash yoursecret\".")
+		}
+	}
+	if _, costErr := getBcryptCost(); costErr != nil {
+		fatalError(exitConfigError, costErr.Error())
+	}
+	if arguments["passwordhash"] != "" && arguments["passwordhash"] != "bcrypt" && arguments["passwordhash"] != "argon2id" {
+		fatalError(exitConfigError, "Invalid passwordhash \"" + arguments["passwordhash"] + "\" - should be \"bcrypt\" or \"argon2id\".")
+	}
+	for argumentName, argumentValue := range arguments {
+		if (argumentName == "proxy" || strings.HasSuffix(argumentName, "proxy")) && argumentValue != "" && argumentValue != "none" {
+			if proxyURL, proxyErr := url.Parse(argumentValue); proxyErr != nil || proxyURL.Host == "" {
+				fatalError(exitConfigError, "Invalid proxy URL \"" + argumentValue + "\" for \"" + argumentName + "\".")
+			}
+		}
+	}
+	var retentionLimits []string
+	for _, retentionSetting := range retentionSettings {
+		if limitValue, limitErr := getRetentionLimit(map[string]string{}, retentionSetting); limitErr != nil {
+			fatalError(exitConfigError, limitErr.Error())
+		} else if limitValue > 0 {
+			retentionLimits = append(retentionLimits, retentionSetting + " " + arguments[retentionSetting])
+		}
+	}
+	if len(retentionLimits) > 0 {
+		summary = append(summary, "  Run retention: " + strings.Join(retentionLimits, ", "))
+	}
+	var outputLimits []string
+	for _, outputLimitSetting := range outputLimitSettings {
+		if limitValue, limitErr := getOutputLimit(map[string]string{}, outputLimitSetting); limitErr != nil {
+			fatalError(exitConfigError, limitErr.Error())
+		} else if limitValue > 0 {
+			outputLimits = append(outputLimits, outputLimitSetting + " " + arguments[outputLimitSetting])
+		}
+	}
+	if len(outputLimits) > 0 {
+		summary = append(summary, "  Output limits: " + strings.Join(outputLimits, ", "))
+	}
+	if usageInterval, intervalErr := getUsageInterval(map[string]string{}); intervalErr != nil {
+		fatalError(exitConfigError, intervalErr.Error())
+	} else if usageInterval > 0 {
+		summary = append(summary, "  Resource usage shown in output every " + strconv.Itoa(usageInterval) + " seconds")
+	}
+	if landingErr := checkLandingConfig(); landingErr != nil {
+		fatalError(exitConfigError, landingErr.Error())
+	}
+	if upgradeTimeout, timeoutErr := getUpgradeTimeout(); timeoutErr != nil {
+		fatalError(exitConfigError, timeoutErr.Error())
+	} else if upgradeTimeout > 0 {
+		summary = append(summary, "  Upgrade timeout: " + strconv.Itoa(upgradeTimeout) + " seconds")
+	}
+	if arguments["trustedproxies"] != "" {
+		if _, listErr := ipInList("", arguments["trustedproxies"]); listErr != nil {
+			fatalError(exitConfigError, "\"trustedproxies\" has an " + listErr.Error() + ".")
 		} else {
-			stringSplit = strings.SplitN(theString, " ", 2)
+			summary = append(summary, "  Trusted proxies: " + arguments["trustedproxies"])
 		}
-		result = append(result, stringSplit[0])
-		if len(stringSplit) > 1 {
-			theString = stringSplit[1]
-		} else {
-			theString = ""
+	}
+	
+	// Integrations enabled.
+	var integrations []string
+	if arguments["adminsecret"] != "" {
+		integrations = append(integrations, "admin API")
+	}
+	if passkeyList, _ := readPasskeys(); len(passkeyList) > 0 {
+		integrations = append(integrations, fmt.Sprintf("passkeys (%d registered)", len(passkeyList)))
+	}
+	if arguments["agentsecret"] != "" {
+		integrations = append(integrations, "agents")
+	}
+	if sharedRedis != nil {
+		integrations = append(integrations, "shared state in Redis")
+	}
+	if arguments["proxy"] != "" {
+		integrations = append(integrations, "outbound proxy")
+	}
+	if metricsEnabled() {
+		if _, intervalErr := getMetricsInterval(); intervalErr != nil {
+			fatalError(exitConfigError, intervalErr.Error())
+		}
+		if arguments["statsd"] != "" {
+			integrations = append(integrations, "metrics to StatsD at " + arguments["statsd"])
+		}
+		if arguments["influxdb"] != "" {
+			integrations = append(integrations, "metrics to InfluxDB")
 		}
 	}
-	return result
-}
-
-// Runs a task, capturing output from stdout and placing it in a buffer. Designed to be run as a goroutine, so a task can be run in the background
-// and output captured while the user does other stuff.
-func runTask(theTaskID string) {
-	readBuffer := make([]byte, 10240)
-	taskOutputs[theTaskID] = make([]string, 0)
-	taskStdout, taskStdoutErr := runningTasks[theTaskID].StdoutPipe()
-	if taskStdoutErr == nil {
-		taskStderr, taskStderrErr := runningTasks[theTaskID].StderrPipe()
-		if taskStderrErr == nil {
-			taskOutput := io.MultiReader(taskStdout, taskStderr)
-			logfileOutput, logFileErr := os.Create(arguments["taskroot"] + "/" + theTaskID + "/log.txt")
-			if logFileErr == nil {
-				taskErr := runningTasks[theTaskID].Start()
-				if taskErr == nil {
-					taskRunning := true
-					// Loop until the Task (an external executable) has finished.
-					for taskRunning {
-						// Read both STDERR and STDIN.
-						readOutputSize, readErr := taskOutput.Read(readBuffer)
-						if readErr == nil {
-							// Append the output to the log file for the current Task.
-							logfileOutput.Write(readBuffer[0:readOutputSize])
-							// Append the output as lines of text to the array-of-strings ready for output to the web interface.
-							bufferSplit := strings.Split(string(readBuffer[0:readOutputSize]), "\n")
-							for pl := 0; pl < len(bufferSplit); pl++ {
-								if strings.TrimSpace(bufferSplit[pl]) != "" {
-									taskOutputs[theTaskID] = append(taskOutputs[theTaskID], bufferSplit[pl])
-								}
-							}
-						} else {
-							taskRunning = false
-						}
-					}
-					// Get the exit status of the running Task. If non-zero, pass the error message back to the user.
-					exitErr := runningTasks[theTaskID].Wait()
-					if exitErr != nil {
-						errorString := "ERROR: " + exitErr.Error() + "\n"
-						logfileOutput.Write([]byte(errorString))
-						taskOutputs[theTaskID] = append(taskOutputs[theTaskID], errorString)
-					}
-					// When we get here, the Task has finished running. We record the finish time and work out the total run time for this run
-					// and update (or create) the list of recent run times for this Task.
-					taskStopTimes[theTaskID] = time.Now().Unix()
-					runTime := taskStopTimes[theTaskID] - taskStartTimes[theTaskID]
-					taskRunTimes[theTaskID] = append(taskRunTimes[theTaskID], runTime)
-					// We don't just record every runtime, we sort the times and trim them to a set of 10 at most, that way we get a reasonable
-					// guess at an average run time, assuming run times are similar each time.
-					sort.Slice(taskRunTimes[theTaskID], func(i, j int) bool { return taskRunTimes[theTaskID][i] < taskRunTimes[theTaskID][j] })
-					for len(taskRunTimes[theTaskID]) >= 10 {
-						taskRunTimes[theTaskID] = taskRunTimes[theTaskID][1:len(taskRunTimes[theTaskID])-2]
-					}
-					// Write the runTimes.txt file for this Task.
-					outputString := ""
-					for pl := 0; pl < len(taskRunTimes[theTaskID]); pl = pl + 1 {
-						outputString = outputString + strconv.FormatInt(taskRunTimes[theTaskID][pl], 10)
-						if pl < len(taskRunTimes[theTaskID])-1 {
-							outputString = outputString + "\n"
-						}
-					}
-					ioutil.WriteFile("tasks/" + theTaskID + "/runTimes.txt", []byte(outputString), 0644)
-					// Remove this Task from the runnings Tasks list. We don't remove the output right away - client-side code might
-					// still not have received all the output yet.
-					delete(runningTasks, theTaskID)
-				}
-				logfileOutput.Close()
-			}
+	if arguments["syslog"] != "" {
+		integrations = append(integrations, "output to syslog at " + arguments["syslog"])
+	}
+	if arguments["archive"] != "" {
+		if archiveErr := checkArchiveConfig(); archiveErr != nil {
+			fatalError(exitConfigError, archiveErr.Error())
 		}
+		integrations = append(integrations, "run archive at " + arguments["archive"])
 	}
-}
-
-// Returns true if the given Task is currently running, false otherwise.
-func taskIsRunning(theTaskID string) bool {
-	if taskIDValue, taskIDFound := runningTasks[theTaskID]; taskIDFound {
-		taskIDValue = taskIDValue
-		return true
+	if endpointCount := len(getIntegrationEndpoints()); endpointCount > 0 {
+		integrations = append(integrations, fmt.Sprintf("outbound integrations (%d)", endpointCount))
+	}
+	if len(integrations) == 0 {
+		integrations = append(integrations, "none")
 	}
-	return false
+	summary = append(summary, "  Integrations: " + strings.Join(integrations, ", "))
+	return summary, exitCode
 }
 
-// Read the Task's details from its config file.
-func getTaskDetails(theTaskID string) (map[string]string, error) {
-	taskDetails := make(map[string]string)
-	configPath := arguments["taskroot"] + "/" + theTaskID + "/config.txt"
-	// Check to see if we have a valid task ID.
-	if _, err := os.Stat(configPath); !os.IsNotExist(err) {
-		inFile, inFileErr := os.Open(configPath)
-		if inFileErr != nil {
-			return taskDetails, errors.New("Can't open Task config file.")
-		} else {
-			// Read the Task's details from its config file.
-			taskDetails["taskID"] = theTaskID
-			taskDetails["title"] = ""
-			taskDetails["description"] = ""
-			taskDetails["secret"] = ""
-			taskDetails["public"] = "N"
-			taskDetails["ratelimit"] = "0"
-			taskDetails["progress"] = "N"
-			taskDetails["command"] = ""
-			scanner := bufio.NewScanner(inFile)
-			for scanner.Scan() {
-				itemSplit := strings.SplitN(scanner.Text(), ":", 2)
-				taskDetails[strings.TrimSpace(itemSplit[0])] = strings.TrimSpace(itemSplit[1])
-			}
-			inFile.Close()
-			descriptionContents, descriptionContentsErr := ioutil.ReadFile(arguments["taskroot"] + "/" + theTaskID + "/description.txt")
-			if descriptionContentsErr == nil {
-				taskDetails["description"] = string(descriptionContents)
+// Check the given Task's config in more depth than getTaskDetails does, returning a list of any problems found: that it has a command that can
+// be found and run (unless it's run by an agent, which might have different commands available), that any patterns are valid regular
+// expressions and that numeric and Y/N options have sensible values.
+func checkTaskConfig(theTaskID string) []string {
+	var problems []string
+	taskDetails, taskErr := getTaskDetails(theTaskID)
+	if taskErr != nil {
+		return append(problems, taskErr.Error())
+	}
+	// Tasks are run from their own folder (or their "workdir"), so a relative path to a command is relative to that.
+	checkCommand := func(theCommand string) {
+		commandArray, commandErr := getCommandArray(theCommand, taskDetails)
+		if commandErr != nil {
+			problems = append(problems, commandErr.Error())
+			return
+		}
+		if len(commandArray) == 0 || taskDetails["runner"] != "" || strings.Contains(commandArray[0], "<<UPLOAD>>") {
+			return
+		}
+		commandPath := commandArray[0]
+		if strings.ContainsAny(commandPath, "/\\") && !filepath.IsAbs(commandPath) {
+			// A script in a git checkout (see gitcheckout.go) isn't there until the Task's first run.
+			if taskUsesGit(taskDetails) {
+				return
 			}
+			commandPath = filepath.Join(getTaskWorkDir(theTaskID, taskDetails), commandPath)
+		}
+		if _, lookErr := exec.LookPath(commandPath); lookErr != nil {
+			problems = append(problems, "Command \"" + commandArray[0] + "\" can't be run - " + lookErr.Error())
 		}
-	} else {
-		return taskDetails, errors.New("Invalid taskID")
 	}
-	return taskDetails, nil
-}
-
-// Returns a list of task details.
-func getTaskList() ([]map[string]string, error) {
-	var taskList []map[string]string
-	taskIDs, readDirErr := ioutil.ReadDir(arguments["taskroot"])
-	if readDirErr == nil {
-		for _, taskID := range taskIDs {
-			taskDetails, taskErr := getTaskDetails(taskID.Name())
-			if taskErr == nil {
-				taskList = append(taskList, taskDetails)
-			} else {
-				return taskList, taskErr
-			}
+	pipelineSteps, stepsErr := getPipelineSteps(theTaskID)
+	if stepsErr != nil {
+		problems = append(problems, stepsErr.Error())
+	} else if len(pipelineSteps) > 0 && taskDetails["runner"] != "" {
+		problems = append(problems, "Pipelines can't be run on an agent.")
+	} else if len(pipelineSteps) > 0 {
+		for _, step := range pipelineSteps {
+			checkCommand(step.command)
 		}
+	} else if strings.TrimSpace(taskDetails["command"]) == "" {
+		problems = append(problems, "No command set.")
 	} else {
-		return taskList, errors.New("Can't read Tasks folder.")
+		checkCommand(taskDetails["command"])
 	}
-	return taskList, nil
-}
-
-// Get an input string from the user via stdin.
-func getUserInput(argumentsKey, defaultValue string, messageString string) string {
-	if argument, argumentExists := arguments[argumentsKey]; argumentExists {
-		return argument
+	problems = append(problems, checkTaskFolders(theTaskID, taskDetails)...)
+	problems = append(problems, checkTaskGitConfig(theTaskID, taskDetails)...)
+	if dependencyErr := checkTaskDependencies(theTaskID, nil); dependencyErr != nil {
+		problems = append(problems, dependencyErr.Error())
 	}
-	inputReader := bufio.NewReader(os.Stdin)
-	fmt.Printf(messageString + ": ")
-	result, _ := inputReader.ReadString('\n')
-	result = strings.TrimSpace(result)
-	if result == "" {
-		return defaultValue
+	if triggerErr := checkTaskTriggers(theTaskID, nil); triggerErr != nil {
+		problems = append(problems, triggerErr.Error())
 	}
-	return result
-}
-
-func setArgumentIfPathExists(theArgument string, thePaths []string) {
-	for _, path := range thePaths {
-		if _, existsErr := os.Stat(path); !os.IsNotExist(existsErr) {
-			arguments[theArgument] = path
-			return
+	for _, nextTaskID := range splitTaskIDs(taskDetails["onsuccess"] + "," + taskDetails["onfailure"]) {
+		if _, nextTaskErr := getTaskDetails(nextTaskID); nextTaskErr != nil {
+			problems = append(problems, "Chained Task \"" + nextTaskID + "\" doesn't exist.")
+		}
+	}
+	problems = append(problems, checkTaskSignals(taskDetails)...)
+	if strings.TrimSpace(taskDetails["mode"]) != "" && !taskIsService(taskDetails) {
+		problems = append(problems, "Invalid mode \"" + taskDetails["mode"] + "\" - should be \"service\", or not set.")
+	}
+	for _, patternName := range []string{"successpattern", "failurepattern", "resultpattern"} {
+		if _, regexpErr := regexp.Compile(taskDetails[patternName]); regexpErr != nil {
+			problems = append(problems, "Invalid " + patternName + " - " + regexpErr.Error())
+		}
+	}
+	if taskDetails["pingurl"] != "" {
+		if pingErr := checkPingURL(taskDetails["pingurl"]); pingErr != nil {
+			problems = append(problems, pingErr.Error())
+		}
+	}
+	if _, transformErr := newOutputTransformer(theTaskID, taskDetails); transformErr != nil {
+		problems = append(problems, transformErr.Error())
+	}
+	for _, numberName := range []string{"ratelimit", "timeout", "uploadmaxsize", "retries", "retrydelay"} {
+		if numberValue, numberErr := strconv.Atoi(taskDetails[numberName]); numberErr != nil || numberValue < 0 {
+			problems = append(problems, "Invalid " + numberName + " \"" + taskDetails[numberName] + "\" - should be a whole number, 0 or more.")
+		}
+	}
+	for _, quotaName := range []string{"quota", "userquota"} {
+		if _, quotaErr := parseRunQuota(taskDetails[quotaName]); quotaErr != nil {
+			problems = append(problems, quotaErr.Error())
+		}
+	}
+	if _, budgetErr := getRuntimeBudget(taskDetails); budgetErr != nil {
+		problems = append(problems, budgetErr.Error())
+	}
+	if taskDetails["budgetaction"] != "" && taskDetails["budgetaction"] != "alert" && taskDetails["budgetaction"] != "refuse" {
+		problems = append(problems, "Invalid budgetaction \"" + taskDetails["budgetaction"] + "\" - should be alert or refuse.")
+	}
+	if warningPercent, percentErr := strconv.Atoi(taskDetails["budgetwarning"]); taskDetails["budgetwarning"] != "" && (percentErr != nil || warningPercent < 1 || warningPercent > 100) {
+		problems = append(problems, "Invalid budgetwarning \"" + taskDetails["budgetwarning"] + "\" - should be a percentage, 1 to 100.")
+	}
+	if grantedRuns, grantErr := strconv.Atoi(taskDetails["quotagrant"]); taskDetails["quotagrant"] != "" && (grantErr != nil || grantedRuns < 0) {
+		problems = append(problems, "Invalid quotagrant \"" + taskDetails["quotagrant"] + "\" - should be a whole number, 0 or more.")
+	}
+	for _, retentionSetting := range retentionSettings {
+		if _, limitErr := getRetentionLimit(taskDetails, retentionSetting); limitErr != nil {
+			problems = append(problems, limitErr.Error())
+		}
+	}
+	for _, outputLimitSetting := range outputLimitSettings {
+		if _, limitErr := getOutputLimit(taskDetails, outputLimitSetting); limitErr != nil {
+			problems = append(problems, limitErr.Error())
 		}
 	}
+	if _, intervalErr := getUsageInterval(taskDetails); intervalErr != nil {
+		problems = append(problems, intervalErr.Error())
+	}
+	if taskDetails["viewersecret"] != "" && !isPasswordHash(taskDetails["viewersecret"]) {
+		problems = append(problems, "Invalid viewersecret - should be a Bcrypt or Argon2id hash, as printed by \"webconsole hash yoursecret\".")
+	}
+	if taskDetails["approversecret"] != "" && !isPasswordHash(taskDetails["approversecret"]) {
+		problems = append(problems, "Invalid approversecret - should be a Bcrypt or Argon2id hash, as printed by \"webconsole hash yoursecret\".")
+	} else if runNeedsApproval(taskDetails) && taskDetails["approversecret"] == "" {
+		problems = append(problems, "Missing approversecret - needed for runs to be approved when approval is set.")
+	}
+	if _, decodeErr := totpEncoding.DecodeString(taskDetails["totpsecret"]); decodeErr != nil {
+		problems = append(problems, "Invalid totpsecret - should be a base32 secret, as set up by \"webconsole task totp\".")
+	}
+	if _, rulesErr := getParameterRules(taskDetails); rulesErr != nil {
+		problems = append(problems, rulesErr.Error())
+	}
+	for configKey, configValue := range taskDetails {
+		if !strings.HasPrefix(configKey, "preset ") {
+			continue
+		}
+		if presetName := strings.TrimSpace(strings.TrimPrefix(configKey, "preset ")); !presetNameRegexp.MatchString(presetName) {
+			problems = append(problems, "Invalid preset name \"" + presetName + "\" - use letters, numbers, dashes and underscores.")
+		} else if _, parseErr := parsePresetValues(configValue); parseErr != nil {
+			problems = append(problems, parseErr.Error())
+		}
+	}
+	for _, flagName := range []string{"public", "progress", "uploads", "filebrowser", "approvals", "approval", "shell", "runonstartup", "strictarguments"} {
+		if taskDetails[flagName] != "" && taskDetails[flagName] != "Y" && taskDetails[flagName] != "N" {
+			problems = append(problems, "Invalid " + flagName + " \"" + taskDetails[flagName] + "\" - should be Y or N.")
+		}
+	}
+	return problems
 }
 
 // The main body of the program - parse user-provided command-line paramaters, or start the main web server process.
@@ -293,35 +2056,30 @@ func main() {
 	arguments["start"] = "true"
 	arguments["list"] = "false"
 	arguments["new"] = "false"
+	arguments["hash"] = ""
+	arguments["agent"] = ""
 	arguments["port"] = "8090"
-	arguments["localOnly"] = "true"
+	arguments["localonly"] = "true"
+	arguments["rejectquerytokens"] = "false"
 	setArgumentIfPathExists("config", []string {"config.csv", "/etc/webconsole/config.csv", "C:\\Program Files\\WebConsole\\config.csv"})
 	setArgumentIfPathExists("webroot", []string {"www", "/etc/webconsole/www", "C:\\Program Files\\WebConsole\\www", ""})
 	setArgumentIfPathExists("taskroot", []string {"tasks", "/etc/webconsole/tasks", "C:\\Program Files\\WebConsole\\tasks", ""})
-	arguments["pathPrefix"] = ""
+	arguments["pathprefix"] = ""
 	if len(os.Args) == 1 {
 		fmt.Println("Webconsole - starting webserver. \"webconsole --help\" for more details.")
 	} else {
 		arguments["start"] = "false"
 	}
 	
-	// Parse any command line arguments.
-	currentArgKey := ""
-	for _, argVal := range os.Args {
-		if strings.HasPrefix(argVal, "--") {
-			if currentArgKey != "" {
-				arguments[strings.ToLower(currentArgKey[2:])] = "true"
-			}
-			currentArgKey = argVal
-		} else {
-			if currentArgKey != "" {
-				arguments[strings.ToLower(currentArgKey[2:])] = argVal
-			}
-			currentArgKey = ""
-		}
+	// Parse any command line arguments (see cli.go), and apply them (and any set by environment variables) over the defaults.
+	commandLineArguments, parseErr := parseCommandLine(os.Args[1:])
+	if parseErr != nil {
+		fmt.Println("ERROR: " + parseErr.Error())
+		os.Exit(1)
 	}
-	if currentArgKey != "" {
-		arguments[strings.ToLower(currentArgKey[2:])] = "true"
+	if overrideErr := applyArgumentOverrides(commandLineArguments); overrideErr != nil {
+		fmt.Println("ERROR: " + overrideErr.Error())
+		os.Exit(exitConfigError)
 	}
 	
 	// Print the help / usage documentation if the user wanted.
@@ -337,26 +2095,132 @@ func main() {
 		fmt.Println("access. Both options can be installed via the install.bat / install.sh")
 		fmt.Println("scripts.")
 		fmt.Println("")
-		fmt.Println("Usage: webconsole [--new] [--list] [--start] [--localOnly true/false] [--port int] [--config path] [--webroot path] [--taskroot path]")
+		fmt.Println("Usage: webconsole [command] [--option value]...")
+		fmt.Println("Commands:")
+		fmt.Println("  serve                          run the web server (the default with no options)")
+		fmt.Println("  task new                       create a new Task")
+		fmt.Println("  task list                      list existing Tasks")
+		fmt.Println("  task edit taskID               change a Task's settings")
+		fmt.Println("  task secret taskID             change a Task's secret, revoking its tokens")
+		fmt.Println("  task totp [taskID]             set up two-factor authentication")
+		fmt.Println("  task preset taskID [name ...]  list or save a Task's parameter presets")
+		fmt.Println("  task quota taskID              show (or, with --grant, go past) a Task's run quotas")
+		fmt.Println("  task delete taskID             delete (or, with --archive, archive) a Task")
+		fmt.Println("  task clone taskID [newTaskID]  copy a Task")
+		fmt.Println("  task run taskID                run a Task, printing its output")
+		fmt.Println("  task export file               write all Tasks to a zip file")
+		fmt.Println("  task import file               load Tasks from a zip file")
+		fmt.Println("  task prune [taskID]            remove old runs, as set by keepRuns and so on")
+		fmt.Println("  check                          check the server's and Tasks' configs")
+		fmt.Println("  hash secret                    print the hash of a secret")
+		fmt.Println("  agent url                      run as an agent for the given coordinator")
+		fmt.Println("  remote run [taskID]            run a Task on another server, printing its output")
+		fmt.Println("  install-service                install (and start) as a systemd / Windows service")
+		fmt.Println("  uninstall-service              stop and remove the service")
+		fmt.Println("  help                           print this help")
+		fmt.Println("Options are given as \"--name value\" or \"--name=value\". Each option can also be")
+		fmt.Println("set with an environment variable, e.g. WEBCONSOLE_PORT=8080 for --port. The")
+		fmt.Println("command line takes priority over environment variables, which take priority")
+		fmt.Println("over the config file. Each command can also be given as an option, as below.")
+		fmt.Println("")
+		fmt.Println("Options: webconsole [--new] [--edit taskID] [--secret taskID [--newSecret secret]] [--totp taskID/--admin [--remove]] [--delete taskID [--archive] [--yes]] [--clone taskID [newTaskID]] [--presets taskID [name [values]] [--remove]] [--run taskID [--preset name] [--timestamps true]] [--export file [--excludeSecrets]] [--import file [--overwrite]] [--prune [taskID]] [--check] [--list [--tag tag] [--search text] [--limit int] [--offset int] [--after taskID]] [--start] [--hash secret] [--agent url] [--agentName name] [--agentSecret secret] [--remoteRun --server url --task taskID --secret secret [--preset name] [--timestamps true]] [--trustedProxies list] [--plugins list] [--proxy url] [--rejectQueryTokens true/false] [--localOnly true/false] [--pathPrefix path] [--store files/sqlite:path] [--port int] [--config path] [--webroot path] [--taskroot path]")
 		fmt.Println("--new: creates a new Task. Each Task has a unique 16-character ID which can be")
 		fmt.Println("  passed as part of the URL or via a POST request, so for basic security you")
 		fmt.Println("  can give a user a URL with an embedded ID. Use an external authentication")
 		fmt.Println("  service for better security.")
-		fmt.Println("--list: prints a list of existing Tasks.")
+		fmt.Println("--edit: changes an existing Task's title, secret, public setting, command,")
+		fmt.Println("  timeout and rate limit, prompting with the current values. Any other settings")
+		fmt.Println("  in the Task's config are left as they are.")
+		fmt.Println("--secret: changes a Task's secret to the one given by --newSecret (or typed in,")
+		fmt.Println("  or a random one, which is printed), revoking every token and share link for")
+		fmt.Println("  the Task - a running server stops accepting them straight away.")
+		fmt.Println("--totp: sets up two-factor authentication for a Task (or, with --admin, for the")
+		fmt.Println("  admin secret), printing a secret to add to an authenticator app then asking")
+		fmt.Println("  for a code from the app to confirm it. --remove turns it off again.")
+		fmt.Println("--delete: deletes a Task, including its files and run history, after asking")
+		fmt.Println("  for confirmation (or straight away with --yes). With --archive, the Task's")
+		fmt.Println("  folder is moved to the archive folder (by default, \"archive\" alongside the")
+		fmt.Println("  Tasks folder) instead of being deleted.")
+		fmt.Println("--clone: creates a new Task as a copy of an existing one, including its scripts")
+		fmt.Println("  and other files (but not its logs, run history or uploads - use \"--copyFiles")
+		fmt.Println("  false\" to copy just the config). Give a new Task ID after the existing one, or")
+		fmt.Println("  a random ID is used. A Task with a secret is given a new random secret.")
+		fmt.Println("--run: runs a Task, just as if started from its web page (recording its logs")
+		fmt.Println("  and run history), printing its output as it runs. Exits with a status of 0 if")
+		fmt.Println("  the Task succeeds, 1 otherwise. Ctrl-C stops the Task. With \"--timestamps true\",")
+		fmt.Println("  each line starts with the time it was output. --preset runs the Task with one")
+		fmt.Println("  of its parameter presets.")
+		fmt.Println("--presets: lists a Task's parameter presets or, given a preset's name and values")
+		fmt.Println("  (e.g. \"environment=staging, region=eu-west-1\"), saves it. --remove removes")
+		fmt.Println("  the named preset.")
+		fmt.Println("--export: writes all Tasks (their configs, scripts and other files, but not their")
+		fmt.Println("  logs, run history or uploads) to a single zip file. Add --excludeSecrets to")
+		fmt.Println("  leave out any secrets.")
+		fmt.Println("--import: loads the Tasks in a zip file made by --export. Existing Tasks are")
+		fmt.Println("  skipped unless --overwrite is given.")
+		fmt.Println("--prune: removes runs (their logs and any other files) outside the retention")
+		fmt.Println("  limits set by keepRuns, keepDays and keepMB, for the given Task or all Tasks.")
+		fmt.Println("  The same is done every hour while the server is running.")
+		fmt.Println("--check: checks the server's config and every Task's config (that the command")
+		fmt.Println("  can be found, patterns are valid and so on) without starting the server,")
+		fmt.Println("  printing any problems. Exits with a non-zero status if any are found.")
+		fmt.Println("--list: prints a list of existing Tasks. --tag lists only Tasks with the given")
+		fmt.Println("  tag, --search only those whose title or description contains the given text.")
+		fmt.Println("  --limit, --offset and --after page through a long list.")
+		fmt.Println("--plugins: a comma-separated list of Go plugins to load, to be told about Tasks")
+		fmt.Println("  starting, output and finishing - see \"Plugins\" in the README.")
+		fmt.Println("--proxy: the proxy server to use for outbound connections (webhooks and so on),")
+		fmt.Println("  overriding the HTTP_PROXY / HTTPS_PROXY environment variables. Use \"none\" to")
+		fmt.Println("  connect directly.")
+		fmt.Println("--hash: prints the hash of the given secret, for use as the \"adminsecret\"")
+		fmt.Println("  value in the config file. Bcrypt is used unless --passwordHash is \"argon2id\".")
+		fmt.Println("--bcryptCost: the Bcrypt cost for newly-hashed secrets, 4 to 31. Defaults to 14 -")
+		fmt.Println("  each step down halves the time taken to check a secret.")
+		fmt.Println("--passwordHash: \"bcrypt\" (the default) or \"argon2id\", the algorithm used to")
+		fmt.Println("  hash new secrets. Existing hashes of either kind always work.")
+		fmt.Println("--agent: runs as an agent for the Web Console server (the \"coordinator\") at the")
+		fmt.Println("  given URL, running any Tasks with a \"runner\" option set to this agent's name.")
+		fmt.Println("--agentName: the name to register with the coordinator as. Defaults to the")
+		fmt.Println("  host name.")
+		fmt.Println("--agentSecret: the secret to register with the coordinator with. On the")
+		fmt.Println("  coordinator, set \"agentsecret\" to the Bcrypt hash of this (see --hash).")
+		fmt.Println("--remoteRun: runs the Task given by --task on the Web Console server at the URL")
+		fmt.Println("  given by --server, printing its output as it runs. --secret is the Task's")
+		fmt.Println("  secret or a token for it. Exits with the Task's exit status (1 if it failed")
+		fmt.Println("  without one, or couldn't be run). Ctrl-C stops the Task. --preset runs the Task")
+		fmt.Println("  with one of its parameter presets.")
 		fmt.Println("--start: runs as a web server, waiting for requests. Logs are printed straight to")
 		fmt.Println("  stdout - hit Ctrl-C to quit. By itself, the start command can be handy for")
 		fmt.Println("  quickly debugging. Run install.bat / install.sh to create a Windows service or")
 		fmt.Println("  Linux / MacOS deamon.")
 		fmt.Println("--localOnly: default is \"true\", in which case the built-in webserver will only")
 		fmt.Println("  respond to requests from the local server.")
+		fmt.Println("--trustedProxies: a comma-separated list of the IP addresses / CIDR ranges of")
+		fmt.Println("  reverse proxies in front of Webconsole. The client address given by those")
+		fmt.Println("  proxies in the X-Forwarded-For or X-Real-IP header is used for rate limiting,")
+		fmt.Println("  IP allow / deny lists and the audit log.")
+		fmt.Println("--rejectQueryTokens: default is \"false\". If \"true\", tokens and secrets passed in")
+		fmt.Println("  the URL's query string are ignored - use an \"Authorization: Bearer\" header")
+		fmt.Println("  or a POST request instead.")
 		fmt.Println("--port: the port number the web server should listen out on. Defaults to 8090.")
+		fmt.Println("--tlsCert, --tlsKey: the certificate and private key files (PEM format) to serve")
+		fmt.Println("  HTTPS with. By default, Webconsole serves plain HTTP.")
+		fmt.Println("--pathPrefix: the URL path Webconsole is served under, e.g. \"/console\" if a")
+		fmt.Println("  reverse proxy passes https://example.com/console/ on to Webconsole.")
 		fmt.Println("--config: where to find the config file. By default, on Linux this is")
 		fmt.Println("  /etc/webconsole/config.csv.")
+		fmt.Println("--store: where to keep Task configs, run history and tokens. Default is \"files\"")
+		fmt.Println("  (text files in the Tasks folder), or \"sqlite:path\" for a SQLite database.")
 		fmt.Println("--webroot: the folder to use for the web root.")
 		fmt.Println("--taskroot: the folder to use to store Tasks.")
 		os.Exit(0)
 	}
 	
+	// Run a Task on another server (see remote.go) - this server's own config isn't needed, and nothing but the Task's output should be printed.
+	if arguments["remoterun"] != "" {
+		os.Exit(runRemoteTask())
+	}
+	
 	// If we have an arument called "config", try and load the given config file (either an Excel or CSV file).
 	if configPath, configFound := arguments["config"]; configFound {
 		fmt.Println("Using config file: " + configPath)
@@ -367,7 +2231,11 @@ func main() {
 				excelSheetName := excelFile.GetSheetName(0)
 				excelCells, cellErr := excelFile.GetRows(excelSheetName)
 				if cellErr == nil {
-					fmt.Println(excelCells)
+					for _, excelRow := range excelCells {
+						if len(excelRow) > 1 {
+							arguments[strings.ToLower(excelRow[0])] = excelRow[1]
+						}
+					}
 				} else {
 					fmt.Println("ERROR: " + cellErr.Error())
 				}
@@ -385,8 +2253,8 @@ func main() {
 					}
 					if csvDataErr != nil {
 						fmt.Println("ERROR: " + csvDataErr.Error())
-					} else {
-						arguments[csvDataRecord[0]] = csvDataRecord[1]
+					} else if len(csvDataRecord) > 1 {
+						arguments[strings.ToLower(csvDataRecord[0])] = csvDataRecord[1]
 					}
 				}
 			} else {
@@ -395,48 +2263,622 @@ func main() {
 		}
 	}
 	
+	// Settings from the environment and command line take priority over those in the config file.
+	if overrideErr := applyArgumentOverrides(commandLineArguments); overrideErr != nil {
+		fmt.Println("ERROR: " + overrideErr.Error())
+		os.Exit(exitConfigError)
+	}
+	
+	// The path prefix should start with, but not end with, a slash - "console/" becomes "/console", "/" becomes "".
+	if arguments["pathprefix"] != "" {
+		arguments["pathprefix"] = "/" + strings.Trim(arguments["pathprefix"], "/")
+		if arguments["pathprefix"] == "/" {
+			arguments["pathprefix"] = ""
+		}
+	}
+	
+	// Open the store for Task metadata, run history and tokens, and connect to Redis if we're sharing state with other servers.
+	if storeErr := openStore(); storeErr != nil {
+		fmt.Println("ERROR: " + storeErr.Error())
+		os.Exit(exitConfigError)
+	}
+	if sharedErr := openSharedState(); sharedErr != nil {
+		fmt.Println("ERROR: " + sharedErr.Error())
+		os.Exit(exitConfigError)
+	}
+	
 	if arguments["start"] == "true" {
+		// Check the configuration before we start, printing a summary and refusing to start if there's anything we can't work with.
+		startupSummary, startupExitCode := checkStartupConfig()
+		for _, summaryLine := range startupSummary {
+			fmt.Println(summaryLine)
+		}
+		if startupExitCode != 0 {
+			fmt.Println("Not starting - fix the errors above and try again.")
+			os.Exit(startupExitCode)
+		}
 		// Start the thread that checks for and clears expired tokens.
 		go clearExpiredTokens()
+		// Start the thread that removes old runs - see retention.go.
+		go runJanitor()
+		// If we're running as PID 1 (e.g. in a container), start the thread that reaps orphaned processes.
+		go reapZombies()
+		// Start the thread that sends queue depths to StatsD / InfluxDB, if either is set - see metrics.go.
+		go pushQueueMetrics()
 		
 		// Handle the request URL.
 		http.HandleFunc("/", func (theResponseWriter http.ResponseWriter, theRequest *http.Request) {
-			// Make sure submitted form values are parsed.
-			theRequest.ParseForm()
+			// gRPC calls (see grpc.go) are made as the matching API calls, which come back through here.
+			if isGRPCRequest(theRequest) {
+				handleGRPCRequest(theResponseWriter, theRequest)
+				return
+			}
+			// Compress the response, if the client accepts it and it's worth it - see compression.go.
+			if compressingWriter := newCompressingResponseWriter(theResponseWriter, theRequest); compressingWriter != nil {
+				defer compressingWriter.Close()
+				theResponseWriter = compressingWriter
+			}
+			// Webhook calls need the raw request body to check signatures, so read it before the form is parsed.
+			var requestBody []byte
+			if strings.Contains(theRequest.URL.Path, "/hooks/") {
+				requestBody, _ = ioutil.ReadAll(io.LimitReader(theRequest.Body, maxHookBodySize))
+				theRequest.Body = ioutil.NopCloser(bytes.NewReader(requestBody))
+			}
+			// Make sure submitted form values are parsed, refusing requests too large to handle.
+			if formStatus, formErr := parseRequestForm(theResponseWriter, theRequest, theRequest.URL.Path); formErr != nil {
+				if formStatus == http.StatusRequestEntityTooLarge {
+					writeErrorResponse(theResponseWriter, formStatus, errorCodeTooLarge, formErr.Error())
+				} else {
+					writeErrorResponse(theResponseWriter, formStatus, errorCodeInvalidRequest, formErr.Error())
+				}
+				return
+			}
 			
-			// The default root - serve index.html.
+			// If we're served under a path prefix, strip it from the request path. The prefix on its own is redirected to the prefix with a
+			// trailing slash so relative links in our pages work. Requests without the prefix are handled as-is, for reverse proxies that strip
+			// the prefix themselves.
 			requestPath := theRequest.URL.Path
-			if strings.HasPrefix(requestPath, arguments["pathPrefix"]) {
-				requestPath = requestPath[len(arguments["pathPrefix"]):]
+			if arguments["pathprefix"] != "" {
+				if requestPath == arguments["pathprefix"] {
+					http.Redirect(theResponseWriter, theRequest, arguments["pathprefix"] + "/", http.StatusMovedPermanently)
+					return
+				}
+				if strings.HasPrefix(requestPath, arguments["pathprefix"] + "/") {
+					requestPath = requestPath[len(arguments["pathprefix"]):]
+				}
+			}
+			
+			// Work out which tenant (see tenants.go), if any, the request is for - Task IDs given by the client are in that tenant's namespace.
+			// Agents and Task callbacks are given internal Task IDs, so are left as they are.
+			requestTenant, requestPath := getRequestTenant(theRequest, requestPath)
+			if requestTenant != nil && requestPath == "" {
+				http.Redirect(theResponseWriter, theRequest, getTenantPathPrefix(requestTenant) + "/", http.StatusMovedPermanently)
+				return
+			}
+			if !strings.HasPrefix(requestPath, "/api/agent/") && !strings.HasPrefix(requestPath, "/api/taskCallback/") {
+				// Error messages are translated for the client's language - see locale.go.
+				theResponseWriter = newLocalisingResponseWriter(theResponseWriter, theRequest)
+				if taskIDErr := setRequestTaskID(theRequest, requestTenant); taskIDErr != nil {
+					writeErrorResponse(theResponseWriter, http.StatusBadRequest, errorCodeInvalidRequest, taskIDErr.Error())
+					return
+				}
+			}
+			
+			// Add security headers to every response, and refuse POST requests made from other sites, and calls that change something made
+			// without a POST (webhooks and agents aren't browsers, so aren't checked).
+			setSecurityHeaders(theResponseWriter, theRequest)
+			if !strings.HasPrefix(requestPath, "/hooks/") && !strings.HasPrefix(requestPath, "/api/agent/") && !strings.HasPrefix(requestPath, "/api/taskCallback/") {
+				if originErr := checkRequestOrigin(theRequest, requestPath); originErr != nil {
+					writeErrorResponse(theResponseWriter, http.StatusForbidden, errorCodeForbidden, "Not authorised - " + originErr.Error() + ".")
+					return
+				}
+			}
+			
+			// Rate limit requests that check credentials or start Tasks, per client - and refuse any request from a client that has failed to
+			// authenticate too often.
+			retryAfter := checkAuthFailures(getClientIP(theRequest))
+			if retryAfter == 0 && isRateLimitedPath(requestPath) {
+				retryAfter = takeClientToken(getClientIP(theRequest))
+			}
+			if retryAfter > 0 {
+				theResponseWriter.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+				writeErrorResponse(theResponseWriter, http.StatusTooManyRequests, errorCodeTooManyRequests, fmt.Sprintf("Too many requests - try again in %d seconds.", retryAfter))
+				return
+			}
+			
+			// Every API call is listed in apidocs.go - anything else under /api/ is refused here, so calls can't go undocumented.
+			if strings.HasPrefix(requestPath, "/api/") && !isDocumentedAPICall(requestPath) {
+				writeErrorResponse(theResponseWriter, 0, errorCodeNotFound, "Unknown API call: " + requestPath)
+				return
 			}
 			
 			serveFile := false
-			if requestPath == "/" {
-				http.ServeFile(theResponseWriter, theRequest, arguments["webroot"] + "/index.html")
-			// Handle the getPublicTaskList API call (the one API call that doesn't require authentication).
+			// The landing page is a template, filled in with the public Tasks - see landing.go.
+			if requestPath == "/" || requestPath == "/index.html" {
+				serveLandingPage(theResponseWriter, theRequest, requestTenant)
+			// Return the current broadcast message (if any) as JSON - like getPublicTaskList, doesn't require authentication, so the
+			// message can be shown on every page.
+			} else if strings.HasPrefix(requestPath, "/api/getBroadcast") {
+				fmt.Fprint(theResponseWriter, getBroadcast())
+			// API documentation (see apidocs.go) - a page listing the API calls, and the OpenAPI document it's generated from. Neither needs
+			// authentication.
+			} else if requestPath == "/api/docs" {
+				serveWebrootFile(theResponseWriter, theRequest, "/apidocs.html", getWebrootPath(requestTenant, "apidocs.html"))
+			} else if requestPath == "/api/docs/openapi.json" {
+				theResponseWriter.Header().Set("Content-Type", "application/json")
+				theResponseWriter.Write(getOpenAPIDocument(getTenantPathPrefix(requestTenant)))
+			} else if requestPath == "/api/docs/webconsole.proto" {
+				theResponseWriter.Header().Set("Content-Type", "text/plain; charset=utf-8")
+				http.ServeFile(theResponseWriter, theRequest, getWebrootPath(requestTenant, "webconsole.proto"))
+			// Handle the getPublicTaskList API call (the one API call that doesn't require authentication). Takes an optional "tag" parameter to
+			// list only Tasks with that tag, and an optional "groupBy" parameter - if "tag", the Tasks are grouped by tag (see tags.go). Can also
+			// be searched and paged through with the "q", "limit", "offset" and "after" parameters (see listing.go).
 			} else if strings.HasPrefix(requestPath, "/api/getPublicTaskList") {
-				taskList, taskErr := getTaskList()
+				taskList, taskErr := getTenantTaskList(requestTenant)
+				var publicTasks []map[string]string
+				if taskErr == nil {
+					for _, task := range searchTasks(filterTasksByTag(taskList, theRequest.Form.Get("tag")), theRequest.Form.Get("q")) {
+						if task["public"]  == "Y" {
+							publicTasks = append(publicTasks, task)
+						}
+					}
+					publicTasks, taskErr = getTaskListPage(theResponseWriter, theRequest, publicTasks)
+				}
 				if taskErr == nil {
 					// We return the list of public tasks in JSON format. Note that public tasks might still need a secret to run, "public"
 					// here just means that they are listed by this API call for display on the landing page.
-					taskListString := "{"
-					for _, task := range taskList {
-						if task["public"]  == "Y" {
-							taskListString = taskListString + "\"" + task["taskID"] + "\":\"" + task["title"] + "\","
+					// Returns an object of Task IDs and titles.
+					taskTitles := func(theTasks []map[string]string) map[string]string {
+						titles := map[string]string{}
+						for _, task := range theTasks {
+							titles[localTaskID(requestTenant, task["taskID"])] = task["title"]
+						}
+						return titles
+					}
+					if theRequest.Form.Get("groupBy") == "tag" {
+						// Grouped, the Tasks are returned as a list of groups, in order, each with its tag and Tasks - Tasks with no tags
+						// come first, with a blank tag.
+						groupList, taskGroups := groupTasksByTag(publicTasks)
+						taskGroupList := []map[string]interface{}{}
+						for _, groupName := range groupList {
+							taskGroupList = append(taskGroupList, map[string]interface{}{"tag":groupName, "tasks":taskTitles(taskGroups[groupName])})
+						}
+						taskListJSON, _ := json.Marshal(taskGroupList)
+						theResponseWriter.Write(taskListJSON)
+					} else {
+						taskListJSON, _ := json.Marshal(taskTitles(publicTasks))
+						theResponseWriter.Write(taskListJSON)
+					}
+				} else {
+					writeInternalError(theResponseWriter, theRequest, taskErr)
+				}
+			// Handle admin API calls - these apply across all Tasks (of the tenant the request was made to, if any), so don't take a taskID, but
+			// do need the admin secret. A tenant's admin secret only works for some calls - see tenants.go.
+			} else if strings.HasPrefix(requestPath, "/api/admin/") {
+				adminScope := getAdminScope(theRequest, requestTenant)
+				if adminScope == "" {
+					publishTaskEvent(taskEvent{eventType: eventAuthFailed, clientIP: getClientIP(theRequest), requestPath: requestPath, reason: "incorrect admin secret"})
+					writeNotAuthorised(theResponseWriter, theRequest, 0, "incorrect admin secret")
+				} else if adminScope == "tenant" && !isTenantAdminAPICall(requestPath) {
+					writeErrorResponse(theResponseWriter, 0, errorCodeForbidden, "Not authorised - this call needs the server's admin secret.")
+				// Admin API - Purge all stored output, run artifacts and audit log entries matching the given "pattern" (a regular expression),
+				// for instance to satisfy a data deletion request. Returns a report of what was removed, one item per line.
+				} else if strings.HasPrefix(requestPath, "/api/admin/purgeData") {
+					purgePattern := theRequest.Form.Get("pattern")
+					purgeRegexp, regexpErr := regexp.Compile(purgePattern)
+					if purgePattern == "" {
+						fmt.Fprintf(theResponseWriter, "ERROR: Missing parameter pattern.")
+					} else if regexpErr != nil {
+						fmt.Fprintf(theResponseWriter, "ERROR: Invalid pattern - %s", regexpErr.Error())
+					} else {
+						purgeReport, purgeErr := purgeData(purgeRegexp)
+						for _, reportLine := range purgeReport {
+							fmt.Fprintln(theResponseWriter, reportLine)
+						}
+						if purgeErr != nil {
+							fmt.Fprintf(theResponseWriter, "ERROR: %s", purgeErr.Error())
+						}
+						writeAuditLog("", fmt.Sprintf("Data purge run, %d items affected.", len(purgeReport)-1))
+					}
+				// Admin API - Create a share link for the Task given by "taskID", letting whoever has the link view the Task (or run it, if "scope" is
+				// "run") without its secret. The link expires after "expires" seconds (one day by default).
+				} else if strings.HasPrefix(requestPath, "/api/admin/createShareLink") {
+					if shareLink, shareErr := createShareLink(theRequest.Form.Get("taskID"), theRequest.Form.Get("scope"), theRequest.Form.Get("expires"), requestTenant); shareErr == nil {
+						fmt.Fprint(theResponseWriter, shareLink)
+					} else {
+						fmt.Fprintf(theResponseWriter, "ERROR: %s", shareErr.Error())
+					}
+				// Admin API - List the active task tokens (for the Task given by "taskID", or all Tasks), as JSON - see tokens.go.
+				} else if strings.HasPrefix(requestPath, "/api/admin/listTokens") {
+					theResponseWriter.Header().Set("Content-Type", "application/json")
+					tokensJSON, _ := json.Marshal(listTokens(requestTenant, theRequest.Form.Get("taskID")))
+					fmt.Fprint(theResponseWriter, string(tokensJSON))
+				// Admin API - Revoke the token given by "token" - a token ID (as listed by listTokens), a token or a share link's token.
+				} else if strings.HasPrefix(requestPath, "/api/admin/revokeToken") {
+					if theRequest.Form.Get("token") == "" {
+						writeErrorResponse(theResponseWriter, 0, errorCodeInvalidRequest, "Missing parameter token.")
+					} else if revokedTaskID, revokeErr := revokeToken(requestTenant, theRequest.Form.Get("token")); revokeErr == nil {
+						writeAuditLog(revokedTaskID, "Token " + getTokenID(theRequest.Form.Get("token")) + " revoked.")
+						fmt.Fprint(theResponseWriter, "OK")
+					} else {
+						fmt.Fprintf(theResponseWriter, "ERROR: %s", revokeErr.Error())
+					}
+				// Admin API - Revoke every token and share link issued so far for the Task given by "taskID". Returns how many tokens were revoked.
+				} else if strings.HasPrefix(requestPath, "/api/admin/revokeTaskTokens") {
+					revokeTaskID := theRequest.Form.Get("taskID")
+					if revokeTaskID == "" {
+						writeErrorResponse(theResponseWriter, 0, errorCodeInvalidRequest, "Missing parameter taskID.")
+					} else if _, taskErr := getTaskDetails(revokeTaskID); taskErr != nil {
+						fmt.Fprintf(theResponseWriter, "ERROR: %s", taskErr.Error())
+					} else if revokedCount, revokeErr := revokeTaskTokens(revokeTaskID); revokeErr == nil {
+						writeAuditLog(revokeTaskID, "All tokens and share links revoked.")
+						fmt.Fprint(theResponseWriter, revokedCount)
+					} else {
+						fmt.Fprintf(theResponseWriter, "ERROR: %s", revokeErr.Error())
+					}
+				// Admin API - Change the secret of the Task given by "taskID" to "newSecret" (a random secret if not given), revoking its tokens and
+				// share links. Returns the new secret.
+				} else if strings.HasPrefix(requestPath, "/api/admin/changeTaskSecret") {
+					if theRequest.Form.Get("taskID") == "" {
+						writeErrorResponse(theResponseWriter, 0, errorCodeInvalidRequest, "Missing parameter taskID.")
+					} else if newSecret, secretErr := changeTaskSecret(theRequest.Form.Get("taskID"), theRequest.Form.Get("newSecret"), "via the admin API"); secretErr == nil {
+						fmt.Fprint(theResponseWriter, newSecret)
+					} else {
+						fmt.Fprintf(theResponseWriter, "ERROR: %s", secretErr.Error())
+					}
+				// Admin API - Let the Task given by "taskID" be run "runs" (default 1) more times than its quotas allow - see quotas.go. Returns
+				// the number of runs past its quotas the Task now has.
+				} else if strings.HasPrefix(requestPath, "/api/admin/grantQuota") {
+					grantRuns := theRequest.Form.Get("runs")
+					if grantRuns == "" {
+						grantRuns = "1"
+					}
+					if theRequest.Form.Get("taskID") == "" {
+						writeErrorResponse(theResponseWriter, 0, errorCodeInvalidRequest, "Missing parameter taskID.")
+					} else if grantedRuns, grantErr := grantQuota(theRequest.Form.Get("taskID"), grantRuns, "via the admin API"); grantErr == nil {
+						fmt.Fprint(theResponseWriter, grantedRuns)
+					} else {
+						fmt.Fprintf(theResponseWriter, "ERROR: %s", grantErr.Error())
+					}
+				// Admin API - Save a parameter preset for the Task given by "taskID", given as "name" and "values" ("NAME=value, NAME=value") -
+				// blank values remove the preset. See presets.go.
+				} else if strings.HasPrefix(requestPath, "/api/admin/savePreset") {
+					if theRequest.Form.Get("taskID") == "" {
+						writeErrorResponse(theResponseWriter, 0, errorCodeInvalidRequest, "Missing parameter taskID.")
+					} else if saveErr := savePreset(theRequest.Form.Get("taskID"), theRequest.Form.Get("name"), theRequest.Form.Get("values"), "via the admin API"); saveErr == nil {
+						fmt.Fprintf(theResponseWriter, "OK")
+					} else {
+						writeParametersError(theResponseWriter, saveErr)
+					}
+				// Admin API - Exchange the admin secret (and, with two-factor authentication enabled, a code) for an admin token, as a passkey login gives.
+				} else if strings.HasPrefix(requestPath, "/api/admin/getToken") {
+					if adminToken, tokenErr := issueAdminToken(); tokenErr == nil {
+						fmt.Fprint(theResponseWriter, adminToken)
+					} else {
+						writeInternalError(theResponseWriter, theRequest, tokenErr)
+					}
+				// Admin API - Start enrolling a TOTP secret for two-factor authentication, for the Task given by "taskID" or, if none is given, for
+				// admin access. Returns the new secret and an otpauth:// URI for it, as JSON - see totp.go.
+				} else if strings.HasPrefix(requestPath, "/api/admin/enrolTOTP") {
+					if newSecret, enrolErr := beginTOTPEnrolment(theRequest.Form.Get("taskID")); enrolErr == nil {
+						totpAccount := localTaskID(requestTenant, theRequest.Form.Get("taskID"))
+						if totpAccount == "" {
+							totpAccount = "admin"
+						}
+						theResponseWriter.Header().Set("Content-Type", "application/json")
+						enrolJSON, _ := json.Marshal(map[string]string{"secret":newSecret, "uri":getTOTPURI(totpAccount, newSecret)})
+						fmt.Fprint(theResponseWriter, string(enrolJSON))
+					} else {
+						fmt.Fprintf(theResponseWriter, "ERROR: %s", enrolErr.Error())
+					}
+				// Admin API - Finish enrolling a TOTP secret, given a code ("totpCode") from the authenticator app it was added to.
+				} else if strings.HasPrefix(requestPath, "/api/admin/confirmTOTP") {
+					if confirmErr := confirmTOTPEnrolment(theRequest.Form.Get("taskID"), theRequest.Form.Get("totpCode")); confirmErr == nil {
+						fmt.Fprint(theResponseWriter, "OK")
+					} else {
+						fmt.Fprintf(theResponseWriter, "ERROR: %s", confirmErr.Error())
+					}
+				// Admin API - Turn off two-factor authentication for the Task given by "taskID" or, if none is given, for admin access.
+				} else if strings.HasPrefix(requestPath, "/api/admin/removeTOTP") {
+					removeTaskID := theRequest.Form.Get("taskID")
+					var taskErr error
+					if removeTaskID != "" {
+						_, taskErr = getTaskDetails(removeTaskID)
+					}
+					if taskErr != nil {
+						fmt.Fprintf(theResponseWriter, "ERROR: %s", taskErr.Error())
+					} else if removeErr := setTOTPSecret(removeTaskID, ""); removeErr == nil {
+						fmt.Fprint(theResponseWriter, "OK")
+					} else {
+						fmt.Fprintf(theResponseWriter, "ERROR: %s", removeErr.Error())
+					}
+				// Admin API - Create a new Task as a copy of the one given by "taskID". Takes an optional "newTaskID" parameter (a random ID is
+				// generated if not given) and an optional "copyFiles" parameter - if "true", the Task's other files are copied too. Returns the
+				// new Task ID and, if the Task has a secret, the new Task's freshly-generated secret, one per line, followed by any of the new Task's
+				// other freshly-generated credentials, as "keyword: value".
+				} else if strings.HasPrefix(requestPath, "/api/admin/cloneTask") {
+					newTaskID, newCredentials, cloneErr := cloneTask(theRequest.Form.Get("taskID"), theRequest.Form.Get("newTaskID"), theRequest.Form.Get("copyFiles") == "true", requestTenant)
+					if cloneErr == nil {
+						fmt.Fprintln(theResponseWriter, newTaskID)
+						fmt.Fprintln(theResponseWriter, newCredentials["secret"])
+						for _, credentialKey := range clonedCredentialOrder[1:] {
+							if newCredentials[credentialKey] != "" {
+								fmt.Fprintln(theResponseWriter, credentialKey + ": " + newCredentials[credentialKey])
+							}
+						}
+					} else {
+						fmt.Fprintf(theResponseWriter, "ERROR: %s", cloneErr.Error())
+					}
+				// Admin API - Apply a change to many Tasks at once. Tasks are selected by the "tag" parameter (matching a value in the Task's "tags"
+				// config value) or the "taskIDs" parameter (a comma-separated list), or all Tasks if neither is given. One or more "set" parameters
+				// ("key=value", an empty value removes the key) give the changes to make, and "rotateSecrets" set to "true" gives every selected Task
+				// a new random secret. Returns a list of changes - nothing is changed unless "apply" is set to "true", so the list can be checked first.
+				} else if strings.HasPrefix(requestPath, "/api/admin/bulkUpdate") {
+					newValues := map[string]string{}
+					var setErr error
+					for _, setValue := range theRequest.Form["set"] {
+						setSplit := strings.SplitN(setValue, "=", 2)
+						setKey := strings.TrimSpace(setSplit[0])
+						if len(setSplit) != 2 || setKey == "" || strings.ContainsAny(setKey, ":\n") || strings.Contains(setSplit[1], "\n") {
+							setErr = errors.New("Invalid set value: " + setValue)
+						} else if strings.ToLower(setKey) == "secret" {
+							setErr = errors.New("Secrets can't be set directly, use rotateSecrets.")
+						} else if adminScope == "tenant" && !isTenantBulkUpdateKey(setKey) {
+							setErr = errors.New("Not authorised - " + setKey + " can only be set with the server's admin secret.")
+						} else {
+							newValues[setKey] = strings.TrimSpace(setSplit[1])
+						}
+					}
+					rotateSecrets := theRequest.Form.Get("rotateSecrets") == "true"
+					applyChanges := theRequest.Form.Get("apply") == "true"
+					selectedTaskIDs := map[string]bool{}
+					for _, selectedTaskID := range strings.Split(theRequest.Form.Get("taskIDs"), ",") {
+						if strings.TrimSpace(selectedTaskID) != "" {
+							selectedTaskIDs[strings.TrimSpace(selectedTaskID)] = true
+						}
+					}
+					taskList, taskErr := getTenantTaskList(requestTenant)
+					if setErr != nil {
+						fmt.Fprintf(theResponseWriter, "ERROR: %s", setErr.Error())
+					} else if len(newValues) == 0 && !rotateSecrets {
+						fmt.Fprintf(theResponseWriter, "ERROR: Nothing to change - give one or more set parameters, or rotateSecrets.")
+					} else if taskErr != nil {
+						fmt.Fprintf(theResponseWriter, "ERROR: %s", taskErr.Error())
+					} else {
+						if !applyChanges {
+							fmt.Fprintln(theResponseWriter, "Dry run - no changes made. Set apply=true to make these changes.")
+						}
+						for _, task := range taskList {
+							taskName := localTaskID(requestTenant, task["taskID"])
+							if (len(selectedTaskIDs) > 0 && !selectedTaskIDs[taskName]) || !taskHasTag(task, theRequest.Form.Get("tag")) {
+								continue
+							}
+							taskValues := map[string]string{}
+							for setKey, setValue := range newValues {
+								if task[setKey] != setValue {
+									taskValues[setKey] = setValue
+									fmt.Fprintf(theResponseWriter, "%s: %s: \"%s\" -> \"%s\"\n", taskName, setKey, task[setKey], setValue)
+								}
+							}
+							newSecret := ""
+							if rotateSecrets {
+								fmt.Fprintf(theResponseWriter, "%s: secret: rotated\n", taskName)
+								if applyChanges {
+									randomSecret, randomErr := generateSecureRandomString()
+									if randomErr != nil {
+										fmt.Fprintf(theResponseWriter, "ERROR: %s: %s\n", taskName, randomErr.Error())
+										continue
+									}
+									newSecret = randomSecret
+									hashedSecret, hashErr := hashPassword(newSecret)
+									if hashErr != nil {
+										fmt.Fprintf(theResponseWriter, "ERROR: %s: Problem hashing secret - %s\n", taskName, hashErr.Error())
+										continue
+									}
+									taskValues["secret"] = hashedSecret
+								}
+							}
+							if applyChanges && len(taskValues) > 0 {
+								if updateErr := setTaskConfigValues(task["taskID"], taskValues); updateErr == nil {
+									if newSecret != "" {
+										fmt.Fprintf(theResponseWriter, "%s: new secret: %s\n", taskName, newSecret)
+										// The old secret's tokens and share links go with it - see tokens.go.
+										if _, revokeErr := revokeTaskTokens(task["taskID"]); revokeErr != nil {
+											fmt.Fprintf(theResponseWriter, "ERROR: %s: %s\n", taskName, revokeErr.Error())
+										}
+									}
+									writeAuditLog(task["taskID"], fmt.Sprintf("Config updated by bulk update (%d values changed).", len(taskValues)))
+								} else {
+									fmt.Fprintf(theResponseWriter, "ERROR: %s: %s\n", taskName, updateErr.Error())
+								}
+							}
+						}
+					}
+				// Admin API - Start registering a new passkey for admin login. Returns a JSON object with the challenge and relying party ID the
+				// client-side code needs to create the passkey.
+				} else if strings.HasPrefix(requestPath, "/api/admin/passkeyRegisterBegin") {
+					if challengeJSON, challengeErr := newPasskeyChallenge(theRequest); challengeErr == nil {
+						fmt.Fprint(theResponseWriter, challengeJSON)
+					} else {
+						writeInternalError(theResponseWriter, theRequest, challengeErr)
+					}
+				// Admin API - Finish registering a new passkey, given the "clientDataJSON" and "attestationObject" values (base64url-encoded)
+				// returned by the browser.
+				} else if strings.HasPrefix(requestPath, "/api/admin/passkeyRegisterFinish") {
+					if registerErr := registerPasskey(theRequest, theRequest.Form.Get("clientDataJSON"), theRequest.Form.Get("attestationObject")); registerErr == nil {
+						writeAuditLog("", "Admin passkey registered.")
+						fmt.Fprintf(theResponseWriter, "OK")
+					} else {
+						fmt.Fprintf(theResponseWriter, "ERROR: %s", registerErr.Error())
+					}
+				// Admin API - Set a broadcast message, shown as a banner on every page until dismissed. Takes the "message" to show and
+				// an optional "expires" value, the number of minutes until the message goes away. A blank message clears the broadcast.
+				} else if strings.HasPrefix(requestPath, "/api/admin/setBroadcast") {
+					broadcastMinutes, _ := strconv.ParseInt(theRequest.Form.Get("expires"), 10, 64)
+					if broadcastErr := setBroadcast(theRequest.Form.Get("message"), broadcastMinutes); broadcastErr == nil {
+						writeAuditLog("", "Broadcast message set: " + theRequest.Form.Get("message"))
+						fmt.Fprint(theResponseWriter, "OK")
+					} else {
+						fmt.Fprintf(theResponseWriter, "ERROR: %s", broadcastErr.Error())
+					}
+				// Admin API - List all Tasks, one per line, as tab-separated ID, title, tags and whether the Task is public. Takes an optional "tag"
+				// parameter to list only Tasks with that tag, and an optional "groupBy" parameter - if "tag", the Tasks are grouped by tag, with the
+				// tag added at the start of each line (a Task with several tags is listed once for each). Can also be searched and paged through
+				// with the "q", "limit", "offset" and "after" parameters (see listing.go).
+				} else if strings.HasPrefix(requestPath, "/api/admin/listTasks") {
+					taskList, taskErr := getTenantTaskList(requestTenant)
+					if taskErr == nil {
+						taskList, taskErr = getTaskListPage(theResponseWriter, theRequest, searchTasks(filterTasksByTag(taskList, theRequest.Form.Get("tag")), theRequest.Form.Get("q")))
+					}
+					if taskErr == nil {
+						if theRequest.Form.Get("groupBy") == "tag" {
+							groupList, taskGroups := groupTasksByTag(taskList)
+							for _, groupName := range groupList {
+								for _, task := range taskGroups[groupName] {
+									fmt.Fprintf(theResponseWriter, "%s\t%s\t%s\t%s\t%s\n", groupName, localTaskID(requestTenant, task["taskID"]), task["title"], strings.Join(getTaskTags(task), ","), task["public"])
+								}
+							}
+						} else {
+							for _, task := range taskList {
+								fmt.Fprintf(theResponseWriter, "%s\t%s\t%s\t%s\n", localTaskID(requestTenant, task["taskID"]), task["title"], strings.Join(getTaskTags(task), ","), task["public"])
+							}
+						}
+					} else {
+						writeInternalError(theResponseWriter, theRequest, taskErr)
+					}
+				// Admin API - List the agents that have registered with this server, one per line, as tab-separated name, time last seen and
+				// the IDs of any Tasks currently running on that agent.
+				} else if strings.HasPrefix(requestPath, "/api/admin/listAgents") {
+					for _, agentLine := range listAgents() {
+						fmt.Fprintln(theResponseWriter, agentLine)
+					}
+				// Admin API - Returns upcoming runs (retries and service restarts waiting to start) and runs from the last "days" days (7 by
+				// default), as JSON, or as an iCalendar feed if "format" is "ics" - see schedule.go.
+				} else if strings.HasPrefix(requestPath, "/api/admin/getSchedule") {
+					upcomingRuns, recentRuns, scheduleErr := getSchedule(requestTenant, theRequest.Form.Get("days"))
+					if scheduleErr != nil {
+						fmt.Fprintf(theResponseWriter, "ERROR: %s", scheduleErr.Error())
+					} else if theRequest.Form.Get("format") == "ics" {
+						theResponseWriter.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+						fmt.Fprint(theResponseWriter, formatScheduleICal(upcomingRuns, recentRuns))
+					} else {
+						theResponseWriter.Header().Set("Content-Type", "application/json")
+						scheduleJSON, _ := json.Marshal(map[string]interface{}{"upcoming":upcomingRuns, "recent":recentRuns})
+						fmt.Fprint(theResponseWriter, string(scheduleJSON))
+					}
+				// Admin API - Returns a summary of how each Task is doing, as JSON - see health.go. If "check" is "true", the status is "503 Service
+				// Unavailable" when any Task's last run failed.
+				} else if strings.HasPrefix(requestPath, "/api/admin/getHealth") {
+					if healthSummary, healthErr := getHealthSummary(requestTenant); healthErr != nil {
+						fmt.Fprintf(theResponseWriter, "ERROR: %s", healthErr.Error())
+					} else {
+						theResponseWriter.Header().Set("Content-Type", "application/json")
+						if theRequest.Form.Get("check") == "true" {
+							for _, health := range healthSummary {
+								if health.Status == "failed" {
+									theResponseWriter.WriteHeader(http.StatusServiceUnavailable)
+									break
+								}
+							}
+						}
+						healthJSON, _ := json.Marshal(healthSummary)
+						fmt.Fprint(theResponseWriter, string(healthJSON))
+					}
+				// Admin API - Test connectivity to every outbound integration the server is configured to use (webhooks and so on),
+				// returning one line per integration describing the result.
+				} else if strings.HasPrefix(requestPath, "/api/admin/selfTest") {
+					integrationEndpoints := getIntegrationEndpoints()
+					if len(integrationEndpoints) == 0 {
+						fmt.Fprintln(theResponseWriter, "No outbound integrations configured.")
+					}
+					for _, endpoint := range integrationEndpoints {
+						fmt.Fprintln(theResponseWriter, testEndpoint(endpoint[0], endpoint[1], endpoint[2]))
+					}
+				} else {
+					fmt.Fprintf(theResponseWriter, "ERROR: Unknown API call: %s", requestPath)
+				}
+			// Webhook triggers for Tasks - see hooks.go.
+			} else if strings.HasPrefix(requestPath, "/hooks/") {
+				handleHookRequest(theResponseWriter, theRequest, requestPath, requestBody, requestTenant)
+			// Callbacks from a running Task, with the run ID given in the URL, the Task ID as a "taskID" parameter (run IDs are only unique
+			// within a Task) and the token the run was given (in the WEBCONSOLE_CALLBACK_TOKEN environment variable) as a "token" parameter
+			// or Bearer token. Takes any of: "event", a line of text (such as a JSON object) to add to the Task's output as an event;
+			// "progress", a percentage to show on the Task's progress bar (with an optional "progressLabel"); and "status", a short status
+			// message to show on the Task's page.
+			} else if strings.HasPrefix(requestPath, "/api/taskCallback/") {
+				callback, callbackFound := taskCallbacks[runKey(theRequest.Form.Get("taskID"), strings.TrimPrefix(requestPath, "/api/taskCallback/"))]
+				if !callbackFound || subtle.ConstantTimeCompare([]byte(getRequestCredential(theRequest, "token", true)), []byte(callback.token)) != 1 {
+					publishTaskEvent(taskEvent{eventType: eventAuthFailed, runID: strings.TrimPrefix(requestPath, "/api/taskCallback/"), clientIP: getClientIP(theRequest), requestPath: requestPath, reason: "unknown run or incorrect token"})
+					writeNotAuthorised(theResponseWriter, theRequest, 0, "unknown run or incorrect token")
+				} else {
+					var callbackLines []taskOutputLine
+					if theRequest.Form.Get("event") != "" {
+						callbackLines = append(callbackLines, taskOutputLine{time.Now(), "event", theRequest.Form.Get("event")})
+					}
+					if theRequest.Form.Get("progress") != "" {
+						progressValue, progressErr := strconv.Atoi(strings.TrimSuffix(theRequest.Form.Get("progress"), "%"))
+						if progressErr != nil || progressValue < 0 || progressValue > 100 {
+							fmt.Fprintf(theResponseWriter, "ERROR: Progress should be a number from 0 to 100.")
+							return
+						}
+						progressLabel := theRequest.Form.Get("progressLabel")
+						if progressLabel == "" {
+							progressLabel = "Progress"
+						}
+						callbackLines = append(callbackLines, taskOutputLine{time.Now(), "event", fmt.Sprintf("Progress: %s %d%%", progressLabel, progressValue)})
+					}
+					if theRequest.Form.Get("status") != "" {
+						callbackLines = append(callbackLines, taskOutputLine{time.Now(), "event", "Status: " + theRequest.Form.Get("status")})
+					}
+					if len(callbackLines) == 0 {
+						fmt.Fprintf(theResponseWriter, "ERROR: Nothing to do - give an event, progress or status.")
+						return
+					}
+					for _, callbackLine := range callbackLines {
+						select {
+							case callback.lines <- callbackLine:
+							case <-time.After(5 * time.Second):
+								fmt.Fprintf(theResponseWriter, "ERROR: Run has finished.")
+								return
 						}
 					}
-					if taskListString == "{" {
-						fmt.Fprintf(theResponseWriter, "{}")
+					fmt.Fprint(theResponseWriter, "OK")
+				}
+			// Calls from agents running Tasks for this server - see agents.go.
+			} else if strings.HasPrefix(requestPath, "/api/agent/") {
+				handleAgentRequest(theResponseWriter, theRequest, requestPath)
+			// Passkey login for admins. The "begin" call returns a JSON object with the challenge and relying party ID the client-side code
+			// needs, the "finish" call checks the passkey's response ("credentialID", "clientDataJSON", "authenticatorData" and "signature",
+			// all base64url-encoded) and, if valid, returns an admin token that can be used in place of the admin secret.
+			} else if strings.HasPrefix(requestPath, "/api/passkeyLoginBegin") {
+				if challengeJSON, challengeErr := newPasskeyChallenge(theRequest); challengeErr == nil {
+					fmt.Fprint(theResponseWriter, challengeJSON)
+				} else {
+					writeInternalError(theResponseWriter, theRequest, challengeErr)
+				}
+			} else if strings.HasPrefix(requestPath, "/api/passkeyLoginFinish") {
+				assertionErr := checkPasskeyAssertion(theRequest, theRequest.Form.Get("credentialID"), theRequest.Form.Get("clientDataJSON"), theRequest.Form.Get("authenticatorData"), theRequest.Form.Get("signature"))
+				if assertionErr == nil {
+					if adminToken, tokenErr := issueAdminToken(); tokenErr == nil {
+						writeAuditLog("", "Admin logged in with passkey from " + getClientIP(theRequest) + ".")
+						fmt.Fprint(theResponseWriter, adminToken)
 					} else {
-						fmt.Fprintf(theResponseWriter, taskListString[:len(taskListString)-1] + "}")
+						writeInternalError(theResponseWriter, theRequest, tokenErr)
 					}
 				} else {
-					fmt.Fprintf(theResponseWriter, "ERROR: " + taskErr.Error())
+					writeAuditLog("", "Failed admin passkey login from " + getClientIP(theRequest) + ": " + assertionErr.Error())
+					writeNotAuthorised(theResponseWriter, theRequest, 0, "passkey login failed - " + assertionErr.Error())
 				}
-			// Handle a view, run or API request. taskID needs to be provided as a parameter, either via GET or POST.
-			} else if strings.HasPrefix(requestPath, "/view") || strings.HasPrefix(requestPath, "/run") || strings.HasPrefix(requestPath, "/api/") {
+			// Handle a view, run, plain view or API request. taskID needs to be provided as a parameter, either via GET or POST.
+			} else if strings.HasPrefix(requestPath, "/view") || strings.HasPrefix(requestPath, "/run") || strings.HasPrefix(requestPath, "/plain") || strings.HasPrefix(requestPath, "/api/") {
 				taskID := theRequest.Form.Get("taskID")
-				token := theRequest.Form.Get("token")
+				token := getRequestCredential(theRequest, "token", true)
+				// Share links (see shares.go) carry their token in the URL, so it's always read from there.
+				if token == "" && theRequest.Form.Get("share") != "" {
+					token = theRequest.Form.Get("share")
+				}
+				// What the request is allowed to do - "view" for a view-only token, otherwise anything.
+				tokenScope := ""
 				if taskID == "" {
 					fmt.Fprintf(theResponseWriter, "ERROR: Missing parameter taskID.")
 				} else {
@@ -445,52 +2887,104 @@ func main() {
 					if taskErr == nil {
 						authorised := false
 						authorisationError := "unknown error"
+						// Set if the client is who they say they are, but their token doesn't allow the request - they're told why.
+						scopeRefused := false
+						// Set if the secret is right, but the Task needs a two-factor code that wasn't given or was wrong - see totp.go.
+						totpRefused := false
 						currentTimestamp := time.Now().Unix()
-						rateLimit, rateLimitErr := strconv.Atoi(taskDetails["ratelimit"])
-						if rateLimitErr != nil {
-							rateLimit = 0
-						}
-						if token != "" {
+						if ipErr := checkClientIPAllowed(getClientIP(theRequest), taskDetails); ipErr != nil {
+							authorisationError = ipErr.Error()
+							writeAuditLog(taskID, "Refused request: " + ipErr.Error())
+						} else if strings.HasPrefix(token, shareTokenPrefix) {
+							if shareScope, shareErr := checkShareToken(token, taskID); shareErr != nil {
+								authorisationError = shareErr.Error()
+							} else if !scopeAllowsRequest(shareScope, requestPath) {
+								authorisationError = "this share link only allows viewing the Task"
+								scopeRefused = true
+							} else {
+								authorised = true
+								tokenScope = shareScope
+							}
+						} else if token != "" {
+							loadSharedToken("task", token)
 							if tokens[token] == 0 {
 								authorisationError = "invalid or expired token"
+							} else if tokenErr := checkTaskToken(token, taskID); tokenErr != nil {
+								authorisationError = tokenErr.Error()
+							} else if !scopeAllowsRequest(tokenScopes[token], requestPath) {
+								authorisationError = "view-only token"
+								scopeRefused = true
+							} else {
+								authorised = true
+								tokenScope = tokenScopes[token]
+							}
+						} else if checkPasswordHash(getRequestCredential(theRequest, "secret", false), taskDetails["secret"]) {
+							if totpErr := checkTaskTOTP(theRequest, taskID, taskDetails); totpErr != nil {
+								authorisationError = totpErr.Error()
+								totpRefused = true
 							} else {
 								authorised = true
 							}
-						} else if checkPasswordHash(theRequest.Form.Get("secret"), taskDetails["secret"]) {
-							authorised = true
+						} else if taskDetails["viewersecret"] != "" && checkPasswordHash(getRequestCredential(theRequest, "secret", false), taskDetails["viewersecret"]) {
+							// The viewer secret gives a view-only token, for people who should be able to watch the Task but not run it.
+							if scopeAllowsRequest("view", requestPath) {
+								authorised = true
+								tokenScope = "view"
+							} else {
+								authorisationError = "the viewer secret only allows viewing the Task"
+								scopeRefused = true
+							}
 						} else {
 							authorisationError = "incorrect secret"
 						}
 						if authorised {
 							// If we get this far, we know the user is authorised for this Task - they've either provided a valid
 							// secret or no secret is set.
+							var tokenErr error
 							if token == "" {
-								token = generateRandomString()
+								token, tokenErr = issueTaskToken(taskID, getClientIP(theRequest), currentTimestamp)
+							}
+							// A getToken call with "scope" set to "view" gets a new, view-only token, to pass on to someone who should only watch.
+							if tokenErr == nil && strings.HasPrefix(requestPath, "/api/getToken") && theRequest.Form.Get("scope") == "view" && tokenScope == "" {
+								token, tokenErr = issueTaskToken(taskID, getClientIP(theRequest), currentTimestamp)
+								tokenScope = "view"
+							}
+							if tokenErr != nil {
+								writeInternalError(theResponseWriter, theRequest, tokenErr)
+								return
+							}
+							// Share link tokens are checked by their signature, so aren't stored.
+							if !strings.HasPrefix(token, shareTokenPrefix) {
+								touchTaskToken(token, tokenScope)
 							}
-							tokens[token] = currentTimestamp
 							// Handle view and run requests - no difference server-side, only the client-side treates the URLs differently
 							// (the "runTask" method gets called by the client-side code if the URL contains "run" rather than "view").
 							if strings.HasPrefix(requestPath, "/view") || strings.HasPrefix(requestPath, "/run") {
 								// Serve the webconsole.html file, first adding in the Task ID and token values to be used client-side, as well
 								// as including the appropriate formatting.js file.
-								webconsoleBuffer, fileReadErr := ioutil.ReadFile(arguments["webroot"] + "/webconsole.html")
+								webconsoleBuffer, fileReadErr := ioutil.ReadFile(getWebrootPath(requestTenant, "webconsole.html"))
 								if fileReadErr == nil {
 									formattingJSBuffer, fileReadErr := ioutil.ReadFile(arguments["taskroot"] + "/" + taskID + "/formatting.js")
 									if fileReadErr != nil {
-										formattingJSBuffer, fileReadErr = ioutil.ReadFile(arguments["taskroot"] + "/formatting.js")
+										formattingJSBuffer, fileReadErr = ioutil.ReadFile(getTenantFolder(requestTenant) + "/formatting.js")
 										if fileReadErr != nil {
-											formattingJSBuffer, fileReadErr = ioutil.ReadFile(arguments["webroot"] + "/formatting.js")
+											formattingJSBuffer, fileReadErr = ioutil.ReadFile(getWebrootPath(requestTenant, "formatting.js"))
 										}
 									}
 									if fileReadErr == nil {
 										formattingJSString := string(formattingJSBuffer)
 										webconsoleString := string(webconsoleBuffer)
-										webconsoleString = strings.Replace(webconsoleString, "<<TASKID>>", taskID, -1)
+										webconsoleString = strings.Replace(webconsoleString, "<<TASKID>>", localTaskID(requestTenant, taskID), -1)
 										webconsoleString = strings.Replace(webconsoleString, "<<TOKEN>>", token, -1)
 										webconsoleString = strings.Replace(webconsoleString, "<<TITLE>>", taskDetails["title"], -1)
 										webconsoleString = strings.Replace(webconsoleString, "<<DESCRIPTION>>", taskDetails["description"], -1)
-										webconsoleString = strings.Replace(webconsoleString, "<<FAVICONPATH>>", taskID + "/", -1)
+										webconsoleString = strings.Replace(webconsoleString, "<<FAVICONPATH>>", localTaskID(requestTenant, taskID) + "/", -1)
+										webconsoleString = strings.Replace(webconsoleString, "<<UPLOADS>>", taskDetails["uploads"], -1)
+										webconsoleString = strings.Replace(webconsoleString, "<<FILEBROWSER>>", taskDetails["filebrowser"], -1)
+										webconsoleString = strings.Replace(webconsoleString, "<<SCOPE>>", tokenScope, -1)
 										webconsoleString = strings.Replace(webconsoleString, "// Include formatting.js.", formattingJSString, -1)
+										// The page includes the Task's token, so isn't kept in any cache.
+										theResponseWriter.Header().Set("Cache-Control", "no-store")
 										http.ServeContent(theResponseWriter, theRequest, "webconsole.html", time.Now(), strings.NewReader(webconsoleString))
 									} else {
 										fmt.Fprintf(theResponseWriter, "ERROR: Couldn't read formatting.js")
@@ -498,109 +2992,455 @@ func main() {
 								} else {
 									fmt.Fprintf(theResponseWriter, "ERROR: Couldn't read webconsole.html")
 								}
+							// The plain HTML view of the Task, for browsers without JavaScript - see plainview.go.
+							} else if strings.HasPrefix(requestPath, "/plain") {
+								servePlainView(theResponseWriter, theRequest, requestTenant, taskID, taskDetails, token, tokenScope)
 							// API - Exchange the secret for a token.
 							} else if strings.HasPrefix(requestPath, "/api/getToken") {
 								fmt.Fprintf(theResponseWriter, token)
 							// API - Return the Task's title.
 							} else if strings.HasPrefix(requestPath, "/api/getTaskDetails") {
 								fmt.Fprintf(theResponseWriter, taskDetails["title"] + "\n" + taskDetails["description"])
-							// API - Run a given Task.
+							// API - Run a given Task. Takes an optional "preset" parameter, the name of one of the Task's parameter presets to run
+							// it with (see presets.go), and any parameters the Task has rules for, as "param_" and the parameter's name (see
+							// parameters.go).
 							} else if strings.HasPrefix(requestPath, "/api/runTask") {
+								// If the Task needs approval to run (see approvalgates.go), record the request and return "PENDING" instead.
 								// If the Task is already running, simply return "OK".
-								if taskIsRunning(taskID) {
-									fmt.Fprintf(theResponseWriter, "OK")
-								} else {
-									// Check to see if there's any rate limit set for this task, and don't run the Task if we're still
-									// within the rate limited time.
-									if currentTimestamp - taskStopTimes[taskID] < int64(rateLimit) {
-										fmt.Fprintf(theResponseWriter, "ERROR: Rate limit (%d seconds) exceeded - try again in %d seconds.", rateLimit, int64(rateLimit) - (currentTimestamp - taskStopTimes[taskID]))
+								runParameters, parametersErr := getPresetParameters(taskDetails, theRequest.Form.Get("preset"))
+								if parametersErr == nil {
+									runParameters, parametersErr = getRequestParameters(taskDetails, theRequest.Form, runParameters)
+								}
+								if parametersErr == nil {
+									parametersErr = checkTaskParameters(taskDetails, runParameters)
+								}
+								if parametersErr != nil {
+									writeParametersError(theResponseWriter, parametersErr)
+								} else if runNeedsApproval(taskDetails) && !taskIsRunning(taskID) {
+									// A run over its quotas is refused now rather than once approved - the quotas are checked again then.
+									if quotaErr := checkRunQuotas(taskID, taskDetails, getRequestTrigger(theRequest, token), false); quotaErr != nil {
+										writeStartError(theResponseWriter, quotaErr)
 									} else {
-										// Get ready to run the Task - set up the Task's details...
-										commandArray := parseCommandString(taskDetails["command"])
-										var commandArgs []string
-										if len(commandArray) > 0 {
-											commandArgs = commandArray[1:]
-										}
-										runningTasks[taskID] = exec.Command(commandArray[0], commandArgs...)
-										runningTasks[taskID].Dir = arguments["taskroot"] + "/" + taskID
-										
-										// ...get a list (if available) of recent run times...
-										taskRunTimes[taskID] = make([]int64, 0)
-										runTimesBytes, fileErr := ioutil.ReadFile(arguments["taskroot"] + "/" + taskID + "/runTimes.txt")
-										if fileErr == nil {
-											runTimeSplit := strings.Split(string(runTimesBytes), "\n")
-											for pl := 0; pl < len(runTimeSplit); pl = pl + 1 {
-												runTimeVal, runTimeErr := strconv.Atoi(runTimeSplit[pl])
-												if runTimeErr == nil {
-													taskRunTimes[taskID] = append(taskRunTimes[taskID], int64(runTimeVal))
-												}
-											}
-										}
-										
-										// ...use those to guess the run time for this time (just use a simple mean of the
-										// existing runtimes)...
-										var totalRunTime int64
-										totalRunTime = 0
-										for pl := 0; pl < len(taskRunTimes[taskID]); pl = pl + 1 {
-											totalRunTime = totalRunTime + taskRunTimes[taskID][pl]
-										}
-										if len(taskRunTimes[taskID]) == 0 {
-											taskRuntimeGuesses[taskID] = float64(10)
-										} else {
-											taskRuntimeGuesses[taskID] = float64(totalRunTime / int64(len(taskRunTimes[taskID])))
-										}
-										taskStartTimes[taskID] = time.Now().Unix()
-										
-										// ...then run the Task as a goroutine (thread) in the background.
-										go runTask(taskID)
-										// Respond to the front-end code that all is okay.
-										fmt.Fprintf(theResponseWriter, "OK")
+										requestRun(taskID, token, runParameters, getRequestTrigger(theRequest, token))
+										fmt.Fprintf(theResponseWriter, "PENDING")
 									}
+								} else if startErr := startTask(taskID, taskDetails, runParameters, getRequestTrigger(theRequest, token)); startErr == nil {
+									fmt.Fprintf(theResponseWriter, "OK")
+								} else {
+									writeStartError(theResponseWriter, startErr)
 								}
 							// Designed to be called periodically, will return the given Tasks' output as a simple string,
 							// with lines separated by newlines. Takes one parameter, "line", indicating which output line
 							// it should return output from, to save the client-side code having to be sent all of the output each time.
+							// If "format" is set to "ndjson", each line is instead returned as a JSON event. An optional "runID" parameter
+							// gives the run the client was following, so a client resuming after losing its connection isn't sent output
+							// from a different run starting part-way through.
 							} else if strings.HasPrefix(requestPath, "/api/getTaskOutput") {
-								var atoiErr error
 								// Parse the "line" parameter - defaults to 0, so if not set this method will simply return
 								// all current output.
-								outputLineNumber := 0
-								if theRequest.Form.Get("line") != "" {
-									outputLineNumber, atoiErr = strconv.Atoi(theRequest.Form.Get("line"))
-									if atoiErr != nil {
-										fmt.Fprintf(theResponseWriter, "ERROR: Line number not parsable.")
-									}
+								outputLineNumber, lineErr := parseOutputLineNumber(theRequest.Form.Get("line"))
+								if lineErr != nil {
+									fmt.Fprintf(theResponseWriter, "ERROR: %s", lineErr.Error())
+									return
 								}
-								if _, runningTaskFound := runningTasks[taskID]; !runningTaskFound {
-									// If the Task isn't currently running, load the previous run's log file (if it exists)
-									// into the Task's output buffer.
-									logContents, logContentsErr := ioutil.ReadFile(arguments["taskroot"] + "/" + taskID + "/log.txt")
-									if logContentsErr == nil {
-										taskOutputs[taskID] = strings.Split(string(logContents), "\n")
+								_, runningTaskFound := runningTasks[taskID]
+								runningElsewhere := false
+								if !runningTaskFound {
+									// If the Task isn't currently running here, get its output from the server running it (if sharing
+									// state via Redis), otherwise load the previous run's log file (if it exists) into the Task's output buffer.
+									sharedOutputFound := false
+									sharedOutputFound, runningElsewhere = loadSharedTaskOutput(taskID)
+									if !sharedOutputFound {
+										loadTaskOutput(taskID)
 									}
 								} else if taskDetails["progress"] == "Y" {
-									// If the job details have the "progress" option set to "Y", output a (best guess, using previous
-									// run times) progresss report line.
+									// If the job details have the "progress" option set to "Y", send a (best guess, using previous
+									// run times) progress estimate in a header - it isn't added to the output, which is shared by
+									// every viewer of the Task.
 									currentTime := time.Now().Unix()
 									percentage := int((float64(currentTime - taskStartTimes[taskID]) / taskRuntimeGuesses[taskID]) * 100)
 									if percentage > 100 {
 										percentage = 100
 									}
-									taskOutputs[taskID] = append(taskOutputs[taskID], fmt.Sprintf("Progress: Progress %d%%", percentage))
+									theResponseWriter.Header().Set("X-Progress", strconv.Itoa(percentage))
 								}
 								// Return to the user all the output lines from the given starting point.
-								for outputLineNumber < len(taskOutputs[taskID]) {
-									fmt.Fprintln(theResponseWriter, taskOutputs[taskID][outputLineNumber])
-									outputLineNumber = outputLineNumber + 1
-								}
+								outputLineNumber = resumeOutputLine(theResponseWriter, taskID, theRequest.Form.Get("runID"), outputLineNumber)
+								outputFormat := theRequest.Form.Get("format")
+								writeTaskOutput(theResponseWriter, taskID, outputLineNumber, outputFormat, theRequest.Form.Get("timestamps") == "true")
 								// If the Task is no longer running, make sure we tell the client-side code that.
-								if _, runningTaskFound := runningTasks[taskID]; !runningTaskFound {
-									if taskDetails["progress"] == "Y" {
+								if _, runningTaskFound := runningTasks[taskID]; !runningTaskFound && !runningElsewhere {
+									if taskDetails["progress"] == "Y" && outputFormat != "ndjson" {
 										fmt.Fprintf(theResponseWriter, "Progress: Progress 100%%\n")
 									}
-									fmt.Fprintf(theResponseWriter, "ERROR: EOF")
+									writeTaskOutputEOF(theResponseWriter, taskID, outputFormat)
 									//delete(taskOutputs, taskID)
 								}
+							// API - Stream the given Task's output, holding the connection open and sending new lines as they arrive until the
+							// Task finishes. Takes the same "line", "format" and "runID" parameters as getTaskOutput.
+							} else if strings.HasPrefix(requestPath, "/api/streamTaskOutput") {
+								outputLineNumber, lineErr := parseOutputLineNumber(theRequest.Form.Get("line"))
+								if lineErr != nil {
+									fmt.Fprintf(theResponseWriter, "ERROR: %s", lineErr.Error())
+									return
+								}
+								outputFormat := theRequest.Form.Get("format")
+								if outputFormat == "ndjson" {
+									theResponseWriter.Header().Set("Content-Type", "application/x-ndjson")
+								} else {
+									theResponseWriter.Header().Set("Content-Type", "text/plain; charset=utf-8")
+								}
+								if _, runningTaskFound := runningTasks[taskID]; !runningTaskFound {
+									if sharedOutputFound, _ := loadSharedTaskOutput(taskID); !sharedOutputFound {
+										loadTaskOutput(taskID)
+									}
+								}
+								outputLineNumber = resumeOutputLine(theResponseWriter, taskID, theRequest.Form.Get("runID"), outputLineNumber)
+								outputFlusher, _ := theResponseWriter.(http.Flusher)
+								// The stream lasts as long as the Task runs, so isn't subject to the web server's write timeout.
+								http.NewResponseController(theResponseWriter).SetWriteDeadline(time.Time{})
+								// Follow the Task's output from the line asked for, woken as soon as new lines arrive (see outputbroadcast.go).
+								outputSubscriber := newOutputSubscriber(taskID, outputLineNumber)
+								tokenTouched := time.Now()
+								for {
+									// The token was only checked as the stream started, so is kept from expiring while the stream is open.
+									if time.Since(tokenTouched) > tokenCheckPeriod * time.Second && tokens[token] != 0 {
+										touchTaskToken(token, tokenScope)
+										tokenTouched = time.Now()
+									}
+									// Check whether the Task is still running before sending output, so no output written just before it
+									// finished gets missed.
+									_, runningTaskFound := runningTasks[taskID]
+									if !runningTaskFound {
+										_, runningTaskFound = loadSharedTaskOutput(taskID)
+									}
+									writeOutputLines(theResponseWriter, taskID, outputSubscriber.next(), outputFormat, theRequest.Form.Get("timestamps") == "true")
+									if !runningTaskFound {
+										writeTaskOutputEOF(theResponseWriter, taskID, outputFormat)
+										break
+									}
+									if outputFlusher != nil {
+										outputFlusher.Flush()
+									}
+									// Output from another server (see redis.go) doesn't wake the stream, so it's checked for every second.
+									if !outputSubscriber.wait(time.Second, theRequest.Context().Done()) {
+										return
+									}
+								}
+							// API - Return a list of the IDs of previous runs of this Task, oldest first (or, if "order" is "newest", newest first), one
+							// per line. Can be paged through with the "limit", "offset" and "after" parameters (see listing.go). With "details" set to
+							// "true", each run ID is followed by a tab and who or what triggered the run (see triggers.go).
+							} else if strings.HasPrefix(requestPath, "/api/getRunList") {
+								runList, runListErr := getRunList(taskID)
+								newestFirst := theRequest.Form.Get("order") == "newest"
+								if runListErr == nil && newestFirst {
+									sort.Sort(sort.Reverse(sort.StringSlice(runList)))
+								}
+								pageStart, pageEnd, nextCursor := 0, 0, ""
+								if runListErr == nil {
+									pageStart, pageEnd, nextCursor, runListErr = getListPage(runList, newestFirst, theRequest.Form.Get("limit"), theRequest.Form.Get("offset"), theRequest.Form.Get("after"))
+								}
+								if runListErr == nil {
+									setListPageHeaders(theResponseWriter, len(runList), nextCursor)
+									for _, runID := range runList[pageStart:pageEnd] {
+										if theRequest.Form.Get("details") == "true" {
+											savedTrigger, _ := getRunTrigger(taskID, runID)
+											fmt.Fprintln(theResponseWriter, runID + "\t" + describeTrigger(savedTrigger))
+										} else {
+											fmt.Fprintln(theResponseWriter, runID)
+										}
+									}
+								} else {
+									fmt.Fprintf(theResponseWriter, "ERROR: %s", runListErr.Error())
+								}
+							// API - Return the Task's parameter presets as a JSON object, each preset's parameters by name - see presets.go. The
+							// values of secret parameters are masked.
+							} else if strings.HasPrefix(requestPath, "/api/getPresets") {
+								presetsJSON, _ := json.Marshal(listTaskPresets(taskDetails))
+								theResponseWriter.Header().Set("Content-Type", "application/json")
+								theResponseWriter.Write(presetsJSON)
+							// API - Return who or what triggered a run, with the client IP address it was asked for from and the parameters it was
+							// given, as JSON - see triggers.go. Takes an optional "runID" parameter (defaults to the most recent run).
+							} else if strings.HasPrefix(requestPath, "/api/getRunTrigger") {
+								runID := theRequest.Form.Get("runID")
+								if runID == "" {
+									runList, _ := getRunList(taskID)
+									if len(runList) > 0 {
+										runID = runList[len(runList)-1]
+									}
+								}
+								if !runIDRegexp.MatchString(runID) {
+									fmt.Fprintf(theResponseWriter, "ERROR: Invalid runID.")
+								} else if savedTrigger, triggerErr := getRunTrigger(taskID, runID); triggerErr == nil {
+									triggerJSON, _ := json.Marshal(savedTrigger)
+									theResponseWriter.Header().Set("Content-Type", "application/json")
+									theResponseWriter.Write(triggerJSON)
+								} else {
+									fmt.Fprintf(theResponseWriter, "ERROR: %s", triggerErr.Error())
+								}
+							// API - Search the logs of the Task's previous runs - see search.go. Takes the text to search for as "q", with optional
+							// "regex" ("true" to treat q as a regular expression), "context" (lines to show either side of each match) and "order"
+							// parameters. Sets the X-Search-Truncated header if there were too many matches to return.
+							} else if strings.HasPrefix(requestPath, "/api/searchRuns") {
+								searchContext := 0
+								if theRequest.Form.Get("context") != "" {
+									var contextErr error
+									if searchContext, contextErr = strconv.Atoi(theRequest.Form.Get("context")); contextErr != nil {
+										searchContext = -1
+									}
+								}
+								searchResults, searchTruncated, searchErr := searchRuns(taskID, theRequest.Form.Get("q"), theRequest.Form.Get("regex") == "true", searchContext, theRequest.Form.Get("order") == "newest")
+								if searchErr == nil {
+									if searchTruncated {
+										theResponseWriter.Header().Set("X-Search-Truncated", "true")
+									}
+									for _, searchResult := range searchResults {
+										fmt.Fprintln(theResponseWriter, searchResult)
+									}
+								} else {
+									fmt.Fprintf(theResponseWriter, "ERROR: %s", searchErr.Error())
+								}
+							// API - Return the status of each step of a pipeline's run (see pipeline.go), one per line, as tab-separated stage, step name,
+							// status ("waiting", "running", "succeeded", "failed" or "skipped") and, for a failed step, the error. Takes an optional "runID"
+							// parameter (defaults to the most recent run).
+							} else if strings.HasPrefix(requestPath, "/api/getPipelineStatus") {
+								runID := theRequest.Form.Get("runID")
+								if runID == "" {
+									runList, _ := getRunList(taskID)
+									if len(runList) > 0 {
+										runID = runList[len(runList)-1]
+									}
+								}
+								if !runIDRegexp.MatchString(runID) {
+									fmt.Fprintf(theResponseWriter, "ERROR: Invalid runID.")
+								} else if stepsContents, stepsErr := readRunFile(taskID, runID, "steps.txt"); stepsErr == nil {
+									theResponseWriter.Write(stepsContents)
+								} else {
+									fmt.Fprintf(theResponseWriter, "ERROR: No pipeline status for run %s.", runID)
+								}
+							// API - Return the complete log of a run as a text file attachment, so users can save it without copying and pasting from
+							// the browser. Takes an optional "runID" parameter (defaults to the most recent run), an optional "gzip" parameter and, for a
+							// pipeline, an optional "step" parameter.
+							} else if strings.HasPrefix(requestPath, "/api/downloadTaskOutput") {
+								runID := theRequest.Form.Get("runID")
+								logPath := arguments["taskroot"] + "/" + taskID + "/log.txt"
+								if runID == "" {
+									runList, _ := getRunList(taskID)
+									if len(runList) > 0 {
+										runID = runList[len(runList)-1]
+									}
+								}
+								stepName := theRequest.Form.Get("step")
+								if runID != "" && !runIDRegexp.MatchString(runID) {
+									fmt.Fprintf(theResponseWriter, "ERROR: Invalid runID.")
+								} else if stepName != "" && (runID == "" || !stepNameRegexp.MatchString(stepName)) {
+									fmt.Fprintf(theResponseWriter, "ERROR: Invalid step.")
+								} else {
+									downloadName := taskID + "-log"
+									runFile := "log.txt"
+									if runID != "" {
+										downloadName = taskID + "-" + runID
+									}
+									// For a pipeline, a "step" parameter gives just that step's output.
+									if stepName != "" {
+										runFile = "steps/" + stepName + ".log"
+										downloadName = taskID + "-" + runID + "-" + stepName
+									}
+									// A run's log might be in the archive - see archive.go.
+									var logFile io.ReadCloser
+									var logFileErr error
+									if runID != "" {
+										logFile, logFileErr = openRunFile(taskID, runID, runFile)
+									} else {
+										logFile, logFileErr = os.Open(logPath)
+									}
+									if logFileErr == nil {
+										if theRequest.Form.Get("gzip") == "true" {
+											theResponseWriter.Header().Set("Content-Type", "application/gzip")
+											theResponseWriter.Header().Set("Content-Disposition", "attachment; filename=\"" + downloadName + ".txt.gz\"")
+											gzipWriter := gzip.NewWriter(theResponseWriter)
+											io.Copy(gzipWriter, logFile)
+											gzipWriter.Close()
+										} else {
+											theResponseWriter.Header().Set("Content-Type", "text/plain; charset=utf-8")
+											theResponseWriter.Header().Set("Content-Disposition", "attachment; filename=\"" + downloadName + ".txt\"")
+											io.Copy(theResponseWriter, logFile)
+										}
+										logFile.Close()
+									} else {
+										fmt.Fprintf(theResponseWriter, "ERROR: No log found for this run.")
+									}
+								}
+							// API - Upload a file for the Task to use. The file is stored in the Task's "uploads" folder, and its path is substituted for
+							// "<<UPLOAD>>" in the Task's command the next time it runs. Size and extension limits are set in the Task's config. The
+							// taskID and token need to be passed in the URL, as the form body isn't parsed until after authorisation.
+							} else if strings.HasPrefix(requestPath, "/api/uploadFile") {
+								uploadMaxSize, uploadMaxSizeErr := strconv.Atoi(taskDetails["uploadmaxsize"])
+								if uploadMaxSizeErr != nil {
+									uploadMaxSize = 10
+								}
+								if taskDetails["uploads"] != "Y" {
+									fmt.Fprintf(theResponseWriter, "ERROR: Uploads not enabled for this Task.")
+								} else {
+									theRequest.Body = http.MaxBytesReader(theResponseWriter, theRequest.Body, int64(uploadMaxSize) * 1024 * 1024)
+									uploadFile, uploadHeader, uploadErr := theRequest.FormFile("file")
+									if uploadErr != nil {
+										fmt.Fprintf(theResponseWriter, "ERROR: Couldn't read uploaded file (maximum size %dMB).", uploadMaxSize)
+									} else {
+										uploadName := filepath.Base(uploadHeader.Filename)
+										uploadExtension := strings.ToLower(strings.TrimPrefix(filepath.Ext(uploadName), "."))
+										extensionAllowed := taskDetails["uploadextensions"] == ""
+										for _, allowedExtension := range strings.Split(taskDetails["uploadextensions"], ",") {
+											if strings.ToLower(strings.TrimSpace(allowedExtension)) == uploadExtension {
+												extensionAllowed = true
+											}
+										}
+										// The file's name is given to the Task as part of its command line, so can't contain anything that might be read as
+										// more than a name - spaces, quotes or control characters.
+										if strings.HasPrefix(uploadName, ".") || uploadName == string(filepath.Separator) || strings.IndexFunc(uploadName, func(theRune rune) bool {
+											return unicode.IsSpace(theRune) || unicode.IsControl(theRune) || strings.ContainsRune("\"'`", theRune)
+										}) != -1 {
+											fmt.Fprintf(theResponseWriter, "ERROR: Invalid filename.")
+										} else if !extensionAllowed {
+											fmt.Fprintf(theResponseWriter, "ERROR: Files of type \"%s\" can't be uploaded to this Task.", uploadExtension)
+										} else {
+											uploadFolder := arguments["taskroot"] + "/" + taskID + "/uploads"
+											os.MkdirAll(uploadFolder, os.ModePerm)
+											uploadPath, _ := filepath.Abs(uploadFolder + "/" + uploadName)
+											outputFile, outputFileErr := os.Create(uploadPath)
+											if outputFileErr == nil {
+												_, copyErr := io.Copy(outputFile, uploadFile)
+												outputFile.Close()
+												if copyErr == nil {
+													taskUploads[taskID] = uploadPath
+													writeAuditLog(taskID, "File uploaded: " + uploadName)
+													fmt.Fprintf(theResponseWriter, "OK")
+												} else {
+													os.Remove(uploadPath)
+													fmt.Fprintf(theResponseWriter, "ERROR: Couldn't save uploaded file.")
+												}
+											} else {
+												fmt.Fprintf(theResponseWriter, "ERROR: Couldn't save uploaded file.")
+											}
+										}
+										uploadFile.Close()
+									}
+								}
+							// API - List the files in the Task's folder, or a sub-folder given by the "path" parameter, one per line. Sub-folder names
+							// end with "/". Only available if the Task has the "filebrowser" option set.
+							} else if strings.HasPrefix(requestPath, "/api/listFiles") {
+								if taskDetails["filebrowser"] != "Y" {
+									fmt.Fprintf(theResponseWriter, "ERROR: File browser not enabled for this Task.")
+								} else {
+									folderPath, folderPathErr := getTaskFilePath(taskID, theRequest.Form.Get("path"))
+									if folderPathErr == nil {
+										folderItems, readDirErr := ioutil.ReadDir(folderPath)
+										if readDirErr == nil {
+											for _, folderItem := range folderItems {
+												// Only list items that could actually be fetched (i.e. not the config file or links to outside the Task's folder).
+												if _, itemPathErr := getTaskFilePath(taskID, theRequest.Form.Get("path") + "/" + folderItem.Name()); itemPathErr == nil {
+													if folderItem.IsDir() {
+														fmt.Fprintln(theResponseWriter, folderItem.Name() + "/")
+													} else {
+														fmt.Fprintln(theResponseWriter, folderItem.Name())
+													}
+												}
+											}
+										} else {
+											fmt.Fprintf(theResponseWriter, "ERROR: Not a folder.")
+										}
+									} else {
+										fmt.Fprintf(theResponseWriter, "ERROR: %s", folderPathErr.Error())
+									}
+								}
+							// API - Download a file, given by the "path" parameter, from the Task's folder. Only available if the Task has the
+							// "filebrowser" option set.
+							} else if strings.HasPrefix(requestPath, "/api/downloadFile") {
+								if taskDetails["filebrowser"] != "Y" {
+									fmt.Fprintf(theResponseWriter, "ERROR: File browser not enabled for this Task.")
+								} else {
+									filePath, filePathErr := getTaskFilePath(taskID, theRequest.Form.Get("path"))
+									if filePathErr == nil {
+										if fileInfo, statErr := os.Stat(filePath); statErr == nil && !fileInfo.IsDir() {
+											theResponseWriter.Header().Set("Content-Disposition", "attachment; filename=\"" + filepath.Base(filePath) + "\"")
+											http.ServeFile(theResponseWriter, theRequest, filePath)
+										} else {
+											fmt.Fprintf(theResponseWriter, "ERROR: Not a file.")
+										}
+									} else {
+										fmt.Fprintf(theResponseWriter, "ERROR: %s", filePathErr.Error())
+									}
+								}
+							// API - Return what a run of the Task would execute, without running it - see preview.go. Takes the same parameters
+							// as the Task's webhook, for Tasks that are given parameters.
+							} else if strings.HasPrefix(requestPath, "/api/previewTask") {
+								if preview, previewErr := previewTask(taskID, taskDetails, getHookParameters(theRequest, requestBody, taskDetails)); previewErr == nil {
+									fmt.Fprint(theResponseWriter, preview)
+								} else {
+									fmt.Fprintf(theResponseWriter, "ERROR: %s", previewErr.Error())
+								}
+							// API - Return the reason given by a running Task that is waiting for approval to continue, or an empty string if the Task
+							// isn't waiting for approval.
+							} else if strings.HasPrefix(requestPath, "/api/getApprovalReason") {
+								fmt.Fprint(theResponseWriter, taskApprovalReasons[taskID])
+							// API - Approve or reject the step a running Task is waiting on. The Task is sent the line "approved" or "rejected"
+							// on STDIN, it's up to the Task to decide what to do next.
+							} else if strings.HasPrefix(requestPath, "/api/approveTask") || strings.HasPrefix(requestPath, "/api/rejectTask") {
+								approvalReason, approvalFound := taskApprovalReasons[taskID]
+								taskStdin, stdinFound := taskStdins[taskID]
+								if !stdinFound {
+									fmt.Fprintf(theResponseWriter, "ERROR: Task isn't running.")
+								} else if !approvalFound {
+									fmt.Fprintf(theResponseWriter, "ERROR: Task isn't waiting for approval.")
+								} else {
+									approvalResponse := "approved"
+									if strings.HasPrefix(requestPath, "/api/rejectTask") {
+										approvalResponse = "rejected"
+									}
+									delete(taskApprovalReasons, taskID)
+									taskStdin.Write([]byte(approvalResponse + "\n"))
+									writeAuditLog(taskID, "Run " + taskRunIDs[taskID] + " " + approvalResponse + ": " + approvalReason)
+									fmt.Fprintf(theResponseWriter, "OK")
+								}
+							// API - Return a description of the Task's run request waiting for approval, or an empty string if there isn't one.
+							} else if strings.HasPrefix(requestPath, "/api/getPendingRun") {
+								fmt.Fprint(theResponseWriter, getPendingRun(taskID))
+							// API - Approve or reject the Task's run request waiting for approval. Has to be called with a different token to the
+							// one that asked for the run, and with the "approverSecret" parameter if the Task has an approver secret.
+							} else if strings.HasPrefix(requestPath, "/api/approveRun") || strings.HasPrefix(requestPath, "/api/rejectRun") {
+								approverSecret := getRequestCredential(theRequest, "approverSecret", false)
+								var approvalErr error
+								if strings.HasPrefix(requestPath, "/api/approveRun") {
+									approvalErr = approveRun(taskID, taskDetails, token, approverSecret)
+								} else {
+									approvalErr = rejectRun(taskID, taskDetails, token, approverSecret)
+								}
+								if approvalErr == nil {
+									fmt.Fprintf(theResponseWriter, "OK")
+								} else {
+									fmt.Fprintf(theResponseWriter, "ERROR: %s", approvalErr.Error())
+								}
+							// API - Stop the Task if it's running, along with any processes it has started. A run request waiting for
+							// approval, or a retry waiting to start, is cancelled.
+							} else if strings.HasPrefix(requestPath, "/api/stopTask") {
+								if cancelPendingRun(taskID) {
+									fmt.Fprintf(theResponseWriter, "OK")
+								} else if cancelRetry(taskID) {
+									resetServiceState(taskID)
+									writeAuditLog(taskID, "Retry cancelled.")
+									fmt.Fprintf(theResponseWriter, "OK")
+								} else if stopErr := stopTask(taskID, "Task stopped by user."); stopErr == nil {
+									fmt.Fprintf(theResponseWriter, "OK")
+								} else {
+									fmt.Fprintf(theResponseWriter, "ERROR: %s", stopErr.Error())
+								}
+							// API - Send a signal (given as "signal", e.g. "HUP" or "SIGUSR1") to the running Task - see signals.go.
+							} else if strings.HasPrefix(requestPath, "/api/signalTask") {
+								if signalErr := signalTask(taskID, taskDetails, theRequest.Form.Get("signal")); signalErr == nil {
+									fmt.Fprintf(theResponseWriter, "OK")
+								} else {
+									fmt.Fprintf(theResponseWriter, "ERROR: %s", signalErr.Error())
+								}
 							// Simply returns "YES" if a given Task is running, "NO" otherwise.
 							} else if strings.HasPrefix(requestPath, "/api/getTaskRunning") {
 								if taskIsRunning(taskID) {
@@ -608,36 +3448,88 @@ func main() {
 								} else {
 									fmt.Fprintf(theResponseWriter, "NO")
 								}
+							// Returns a JSON object giving whether the Task is running and, if it is, the current run's ID, when it started and the
+							// latest sample of its resource usage (see resourceusage.go) - "usage" is null until the first sample is taken. For a
+							// Task run when the server started, "startupRun" gives how that run went (see startup.go). "nextRun" is when a retry or
+							// service restart waiting to start is due, and "service" is the restart history of a Task in service mode (see
+							// servicemode.go). "results" are the values picked out of the current (or most recent) run's output - see results.go.
+							} else if strings.HasPrefix(requestPath, "/api/getTaskStatus") {
+								taskStatus := map[string]interface{}{"running":taskIsRunning(taskID), "runID":nil, "started":nil, "usage":nil, "nextRun":nil, "startupRun":getStartupRunStatus(taskID), "service":getServiceStatus(taskID, taskDetails), "results":getTaskResults(taskID)}
+								if retryDue, retryFound := getRetryDue(taskID); retryFound {
+									taskStatus["nextRun"] = retryDue.Unix()
+								}
+								// How the most recent run since the server started went - blank "error" for success. Only given between runs, as
+								// once a new run starts its ID replaces the last one's.
+								taskStatus["lastRun"] = nil
+								if runResult, resultFound := taskRunResults[taskID]; resultFound && !taskIsRunning(taskID) {
+									taskStatus["lastRun"] = map[string]interface{}{"runID":taskRunIDs[taskID], "succeeded":runResult == "", "error":runResult}
+								}
+								if _, runningTaskFound := runningTasks[taskID]; runningTaskFound {
+									taskStatus["runID"] = taskRunIDs[taskID]
+									taskStatus["started"] = taskStartTimes[taskID]
+									if taskUsage, usageFound := getTaskResourceUsage(taskID); usageFound {
+										taskStatus["usage"] = map[string]interface{}{"sampled":taskUsage.sampled.Unix(), "cpuSeconds":taskUsage.cpuSeconds, "memoryBytes":taskUsage.memoryBytes, "processes":taskUsage.processes}
+									}
+								}
+								statusJSON, _ := json.Marshal(taskStatus)
+								fmt.Fprint(theResponseWriter, string(statusJSON))
+							// API - Check the Task has finished a run successfully within the last "maxAge" seconds, for HTTP monitoring tools - returns
+							// "OK" if it has, otherwise an error with a "503 Service Unavailable" status. See health.go.
+							} else if strings.HasPrefix(requestPath, "/api/taskFreshness") {
+								maxAge, maxAgeErr := strconv.Atoi(theRequest.Form.Get("maxAge"))
+								if theRequest.Form.Get("maxAge") == "" {
+									writeErrorResponse(theResponseWriter, 0, errorCodeInvalidRequest, "Missing parameter maxAge.")
+								} else if maxAgeErr != nil || maxAge < 1 {
+									writeErrorResponse(theResponseWriter, 0, errorCodeInvalidRequest, "Invalid maxAge \"" + theRequest.Form.Get("maxAge") + "\" - should be a number of seconds, 1 or more.")
+								} else if lastRunID, lastSuccess, successErr := getLastSuccess(taskID); successErr != nil {
+									writeInternalError(theResponseWriter, theRequest, successErr)
+								} else if lastRunID == "" {
+									writeErrorResponse(theResponseWriter, http.StatusServiceUnavailable, errorCodeStale, "No successful run yet.")
+								} else if successAge := int(time.Since(lastSuccess).Seconds()); successAge > maxAge {
+									writeErrorResponse(theResponseWriter, http.StatusServiceUnavailable, errorCodeStale, fmt.Sprintf("Last successful run (%s) finished %d seconds ago, more than %d.", lastRunID, successAge, maxAge))
+								} else {
+									fmt.Fprintf(theResponseWriter, "OK - last successful run (%s) finished %d seconds ago.", lastRunID, successAge)
+								}
 							// A simple call that doesn't do anything except serve to keep the timestamp for the given Task up-to-date.
 							} else if strings.HasPrefix(requestPath, "/api/keepAlive") {
 								fmt.Fprintf(theResponseWriter, "OK")
-							// To do: return API documentation here.
+							// Calls listed in apidocs.go that don't have a handler here.
 							} else if strings.HasPrefix(requestPath, "/api/") {
-								fmt.Fprintf(theResponseWriter, "ERROR: Unknown API call: %s", requestPath)
+								writeErrorResponse(theResponseWriter, 0, errorCodeNotFound, "Unknown API call: " + requestPath)
 							}
 						} else {
-							fmt.Fprintf(theResponseWriter, "ERROR: Not authorised - %s.", authorisationError)
+							publishTaskEvent(taskEvent{eventType: eventAuthFailed, taskID: taskID, clientIP: getClientIP(theRequest), requestPath: requestPath, reason: authorisationError})
+							if scopeRefused {
+								writeErrorResponse(theResponseWriter, 0, errorCodeForbidden, "Not authorised - " + authorisationError + ".")
+							} else if totpRefused {
+								fmt.Println("Not authorised: " + requestPath + " from " + getClientIP(theRequest) + " - " + authorisationError + ".")
+								recordAuthFailure(getClientIP(theRequest))
+								writeErrorResponse(theResponseWriter, 0, errorCodeTOTPRequired, "A code from your authenticator app is needed.")
+							} else {
+								writeNotAuthorised(theResponseWriter, theRequest, 0, authorisationError)
+							}
 						}
 					} else {
-						fmt.Fprintf(theResponseWriter, "ERROR: %s", taskErr.Error())
+						// An unknown Task is refused in the same way as a wrong secret, so Task IDs can't be guessed - see errors.go.
+						writeNotAuthorised(theResponseWriter, theRequest, 0, taskErr.Error())
 					}
 				}
 			} else if strings.HasSuffix(requestPath, "/site.webmanifest") {
 				taskID := ""
-				taskList, taskErr := getTaskList()
+				taskList, taskErr := getTenantTaskList(requestTenant)
 				if taskErr == nil {
 					for _, task := range taskList {
-						if strings.HasPrefix(requestPath, "/" + task["taskID"]) {
-							taskID = task["taskID"] + "/"
+						if strings.HasPrefix(requestPath, "/" + localTaskID(requestTenant, task["taskID"])) {
+							taskID = localTaskID(requestTenant, task["taskID"]) + "/"
 						}
 					}
 				} else {
-					fmt.Fprintf(theResponseWriter, "ERROR: " + taskErr.Error())
+					writeInternalError(theResponseWriter, theRequest, taskErr)
 				}
-				webmanifestBuffer, fileReadErr := ioutil.ReadFile(arguments["webroot"] + "/" + "site.webmanifest")
+				webmanifestBuffer, fileReadErr := ioutil.ReadFile(getWebrootPath(requestTenant, "site.webmanifest"))
 				if fileReadErr == nil {
 					webmanifestString := string(webmanifestBuffer)
-					webmanifestString = strings.Replace(webmanifestString, "<<TASKID>>", arguments["pathPrefix"] + "/" + taskID, -1)
+					webmanifestString = strings.Replace(webmanifestString, "<<TASKID>>", getTenantPathPrefix(requestTenant) + "/" + taskID, -1)
 					http.ServeContent(theResponseWriter, theRequest, "site.webmanifest", time.Now(), strings.NewReader(webmanifestString))
 				} else {
 					fmt.Fprintf(theResponseWriter, "ERROR: Couldn't read site.webmanifest.")
@@ -656,25 +3548,25 @@ func main() {
 				}
 				// If the request was for a favicon, serve something suitible.
 				if faviconTitle != "" {
-					faviconPath := arguments["webroot"] + "/" + "favicon.png"
-					taskList, taskErr := getTaskList()
+					faviconPath := getWebrootPath(requestTenant, "favicon.png")
+					taskList, taskErr := getTenantTaskList(requestTenant)
 					if taskErr == nil {
 						for _, task := range taskList {
-							if strings.HasPrefix(requestPath, "/" + task["taskID"]) {
+							if strings.HasPrefix(requestPath, "/" + localTaskID(requestTenant, task["taskID"])) {
 								// Does this Task have a custom favicon?
 								faviconPath = arguments["taskroot"] + "/" + task["taskID"] + "/" + "favicon.png"
 								if _, fileExistsErr := os.Stat(faviconPath); os.IsNotExist(fileExistsErr) {
 									// Does all Tasks have a custom favicon?
-									faviconPath = arguments["taskroot"] + "/" + "favicon.png"
+									faviconPath = getTenantFolder(requestTenant) + "/" + "favicon.png"
 									if _, fileExistsErr := os.Stat(faviconPath); os.IsNotExist(fileExistsErr) {
 										// If there is no custom favicon set for this Task, use the default.
-										faviconPath = arguments["webroot"] + "/" + "favicon.png"
+										faviconPath = getWebrootPath(requestTenant, "favicon.png")
 									}
 								}
 							}
 						}
 					} else {
-						fmt.Fprintf(theResponseWriter, "ERROR: " + taskErr.Error())
+						writeInternalError(theResponseWriter, theRequest, taskErr)
 					}
 					faviconFile, faviconFileErr := os.Open(faviconPath)
 					if faviconFileErr == nil {
@@ -760,32 +3652,504 @@ func main() {
 				}
 			}
 			if serveFile == true {
-				http.ServeFile(theResponseWriter, theRequest,  arguments["webroot"] + requestPath)
+				serveWebrootFile(theResponseWriter, theRequest, requestPath, getWebrootPath(requestTenant, requestPath))
 			}
 		})
 		// Run the main web server loop.
 		hostname := ""
-		if (arguments["localOnly"] == "true") {
-			fmt.Println("Web server limited to localhost only.")
+		if (arguments["localonly"] == "true") {
 			hostname = "localhost"
 		}
-		fmt.Println("Web server using webroot " + arguments["webroot"] + ", taskroot " + arguments["taskroot"] + ".")
-		fmt.Println("Web server available at: http://localhost:" + arguments["port"] + "/")
-		log.Fatal(http.ListenAndServe(hostname + ":" + arguments["port"], nil))
+		webServer := newWebServer(hostname + ":" + arguments["port"])
+		// A server started by an upgrade takes over the old server's listening socket - see upgrade.go.
+		webListener, listenerInherited, listenErr := inheritListener()
+		if !listenerInherited {
+			webListener, listenErr = net.Listen("tcp", webServer.Addr)
+		}
+		if listenErr != nil {
+			log.Fatal(listenErr)
+		}
+		// Now we're listening, let systemd know we're ready (if it started us), and start any Tasks set to run on startup - see startup.go.
+		// After an upgrade, the server hasn't really restarted, so the old server's service Tasks are handed over instead.
+		notifyServiceReady()
+		if listenerInherited {
+			completeUpgradeStartup()
+		} else {
+			go startStartupTasks()
+		}
+		go watchUpgradeSignal(webServer, webListener)
+		// Serve HTTPS directly if given a certificate, otherwise plain HTTP (e.g. behind a reverse proxy that handles HTTPS). Once the server
+		// has handed over to an upgraded one, it stops serving and waits for its runs to finish.
+		var serveErr error
+		if arguments["tlscert"] != "" {
+			fmt.Println("Web server available at: https://localhost:" + arguments["port"] + arguments["pathprefix"] + "/")
+			serveErr = webServer.ServeTLS(webListener, arguments["tlscert"], arguments["tlskey"])
+		} else {
+			fmt.Println("Web server available at: http://localhost:" + arguments["port"] + arguments["pathprefix"] + "/")
+			serveErr = webServer.Serve(webListener)
+		}
+		if serveErr == http.ErrServerClosed && upgradeHandedOver {
+			finishUpgrade()
+		}
+		log.Fatal(serveErr)
 	// Command-line option to print a list of all Tasks.
 	} else if arguments["list"] == "true" {
 		fmt.Println("Reading Tasks from " + arguments["taskroot"])
 		taskList, taskErr := getTaskList()
 		if taskErr == nil {
+			// The list can be filtered and paged through just like the listing API calls - see listing.go.
+			taskList = searchTasks(filterTasksByTag(taskList, arguments["tag"]), arguments["search"])
+			var taskIDs []string
 			for _, task := range taskList {
+				taskIDs = append(taskIDs, task["taskID"])
+			}
+			pageStart, pageEnd, nextCursor, pageErr := getListPage(taskIDs, false, arguments["limit"], arguments["offset"], arguments["after"])
+			if pageErr != nil {
+				fmt.Println("ERROR: " + pageErr.Error())
+				os.Exit(1)
+			}
+			for _, task := range taskList[pageStart:pageEnd] {
 				secret := "Y"
 				if task["secret"] == "" {
 					secret = "N"
 				}
 				fmt.Println(task["taskID"] + ": " + task["title"] + ", Secret: " + secret + ", Public: " + task["public"] + ", Command: " + task["command"])
 			}
+			if nextCursor != "" {
+				fmt.Printf("Listed %d of %d Tasks - for the next page, add \"--after %s\".\n", pageEnd - pageStart, len(taskList), nextCursor)
+			}
+		} else {
+			fmt.Println("ERROR: " + taskErr.Error())
+		}
+	// Command-line option to print the hash of a given secret.
+	} else if arguments["hash"] != "" {
+		hashedSecret, hashErr := hashPassword(arguments["hash"])
+		if hashErr == nil {
+			fmt.Println(hashedSecret)
+		} else {
+			fmt.Println("ERROR: Problem hashing secret - " + hashErr.Error())
+		}
+	// Run as an agent, running Tasks for the coordinator server at the given URL.
+	} else if arguments["agent"] != "" {
+		go reapZombies()
+		runAgent()
+	// Edit an existing Task, prompting for each value with the current value as the default. Values can also be given on the command line
+	// ("--taskTitle", "--taskSecret", "--taskPublic", "--taskCommand", "--taskTimeout" and "--taskRateLimit") to skip the prompts.
+	} else if arguments["edit"] != "" {
+		editTaskID := arguments["edit"]
+		taskDetails, taskErr := getTaskDetails(editTaskID)
+		if editTaskID == "true" {
+			fmt.Println("ERROR: Give the ID of the Task to edit, e.g. \"webconsole --edit abc123\".")
+			os.Exit(1)
+		} else if taskErr != nil {
+			fmt.Println("ERROR: " + taskErr.Error())
+			os.Exit(1)
+		}
+		fmt.Println("Editing Task: " + editTaskID)
+		newValues := map[string]string{}
+		newValues["title"] = getUserInput("tasktitle", taskDetails["title"], "Enter a title (hit enter for \"" + taskDetails["title"] + "\")")
+		
+		// The secret is only stored as a hash, so we can't show it - hitting enter keeps the current one.
+		secretPrompt := "Set secret (type secret, or hit enter to skip)"
+		if taskDetails["secret"] != "" {
+			secretPrompt = "Set secret (type a new secret, \"-\" to remove the secret, or hit enter to keep the current one)"
+		}
+		editTaskSecret := getUserInput("tasksecret", "", secretPrompt)
+		if editTaskSecret == "-" {
+			newValues["secret"] = ""
+		} else if editTaskSecret != "" {
+			hashedPassword, hashErr := hashPassword(editTaskSecret)
+			if hashErr != nil {
+				fmt.Println("ERROR: Problem hashing password - " + hashErr.Error())
+				os.Exit(1)
+			}
+			newValues["secret"] = hashedPassword
+		}
+		
+		for {
+			newValues["public"] = strings.ToUpper(getUserInput("taskpublic", taskDetails["public"], "Make this task public (\"Y\" or \"N\", hit enter for \"" + taskDetails["public"] + "\")"))
+			if newValues["public"] == "Y" || newValues["public"] == "N" {
+				break
+			}
+			delete(arguments, "taskpublic")
+		}
+		newValues["command"] = getUserInput("taskcommand", taskDetails["command"], "Set command (hit enter for \"" + taskDetails["command"] + "\")")
+		for _, numberValue := range [][]string{{"timeout", "tasktimeout", "Set timeout in seconds, 0 for none"}, {"ratelimit", "taskratelimit", "Set rate limit in seconds, 0 for none"}} {
+			for {
+				newValues[numberValue[0]] = getUserInput(numberValue[1], taskDetails[numberValue[0]], numberValue[2] + " (hit enter for \"" + taskDetails[numberValue[0]] + "\")")
+				if _, atoiErr := strconv.Atoi(newValues[numberValue[0]]); atoiErr == nil {
+					break
+				}
+				delete(arguments, numberValue[1])
+			}
+			// Zero is the default, so there's no need to keep it in the config.
+			if newValues[numberValue[0]] == "0" {
+				newValues[numberValue[0]] = ""
+			}
+		}
+		
+		// Only change values that have actually changed, so we don't add lines for default values the config didn't have.
+		for valueName, newValue := range newValues {
+			if newValue == taskDetails[valueName] && valueName != "secret" {
+				delete(newValues, valueName)
+			}
+		}
+		if setErr := setTaskConfigValues(editTaskID, newValues); setErr != nil {
+			fmt.Println("ERROR: " + setErr.Error())
+			os.Exit(1)
+		}
+		writeAuditLog(editTaskID, "Task edited from the command line.")
+		// A changed secret revokes the Task's tokens and share links, as "--secret" does.
+		if _, secretChanged := newValues["secret"]; secretChanged {
+			if _, revokeErr := revokeTaskTokens(editTaskID); revokeErr != nil {
+				fmt.Println("ERROR: " + revokeErr.Error())
+				os.Exit(1)
+			}
+		}
+		fmt.Println("Task " + editTaskID + " updated.")
+	// Change a Task's secret, revoking any tokens and share links for it. The new secret can be given with "--newSecret", otherwise the user is
+	// asked for one (hitting enter generates a random secret).
+	} else if arguments["secret"] != "" {
+		secretTaskID := arguments["secret"]
+		if secretTaskID == "true" {
+			fmt.Println("ERROR: Give the ID of the Task to change the secret of, e.g. \"webconsole --secret abc123\".")
+			os.Exit(1)
+		} else if _, taskErr := getTaskDetails(secretTaskID); taskErr != nil {
+			fmt.Println("ERROR: " + taskErr.Error())
+			os.Exit(1)
+		}
+		givenSecret := getUserInput("newsecret", "", "Enter a new secret for Task " + secretTaskID + " (hit enter to generate one)")
+		newSecret, secretErr := changeTaskSecret(secretTaskID, givenSecret, "from the command line")
+		if secretErr != nil {
+			fmt.Println("ERROR: " + secretErr.Error())
+			os.Exit(1)
+		}
+		fmt.Println("Secret for Task " + secretTaskID + " changed - its tokens and share links have been revoked.")
+		if givenSecret == "" {
+			fmt.Println("New secret: " + newSecret)
+		}
+	// Enrol a TOTP secret for two-factor authentication (see totp.go) for a Task, or for admin access with "--admin", printing the secret to add
+	// to an authenticator app then asking for a code from the app to confirm it. With "--remove", two-factor authentication is turned off.
+	} else if arguments["totp"] != "" {
+		totpTaskID := arguments["totp"]
+		if totpTaskID == "true" {
+			totpTaskID = ""
+		}
+		if totpTaskID == "" && arguments["admin"] != "true" {
+			fmt.Println("ERROR: Give the ID of the Task to set up two-factor authentication for, e.g. \"webconsole --totp abc123\", or \"--admin\".")
+			os.Exit(1)
+		}
+		if totpTaskID != "" {
+			if _, taskErr := getTaskDetails(totpTaskID); taskErr != nil {
+				fmt.Println("ERROR: " + taskErr.Error())
+				os.Exit(1)
+			}
+		}
+		totpAccount := totpTaskID
+		if totpAccount == "" {
+			totpAccount = "admin"
+		}
+		if arguments["remove"] == "true" {
+			if removeErr := setTOTPSecret(totpTaskID, ""); removeErr != nil {
+				fmt.Println("ERROR: " + removeErr.Error())
+				os.Exit(1)
+			}
+			fmt.Println("Two-factor authentication turned off for " + totpAccount + ".")
+			os.Exit(0)
+		}
+		newSecret, secretErr := generateTOTPSecret()
+		if secretErr != nil {
+			fmt.Println("ERROR: " + secretErr.Error())
+			os.Exit(1)
+		}
+		fmt.Println("Add this secret to your authenticator app: " + newSecret)
+		fmt.Println("Or make a QR code of: " + getTOTPURI(totpAccount, newSecret))
+		if !checkTOTPCode(getTOTPKey(totpTaskID), newSecret, getUserInput("totpcode", "", "Enter the code the app shows, to confirm")) {
+			fmt.Println("ERROR: Incorrect code - check the authenticator app's clock, and try again.")
+			os.Exit(1)
+		}
+		if setErr := setTOTPSecret(totpTaskID, newSecret); setErr != nil {
+			fmt.Println("ERROR: " + setErr.Error())
+			os.Exit(1)
+		}
+		fmt.Println("Two-factor authentication turned on for " + totpAccount + ".")
+	// List a Task's parameter presets or, given a preset's name and values, save it - see presets.go.
+	} else if arguments["presets"] != "" {
+		presetsTaskID := arguments["presets"]
+		taskDetails, taskErr := getTaskDetails(presetsTaskID)
+		if presetsTaskID == "true" {
+			fmt.Println("ERROR: Give the ID of the Task, e.g. \"webconsole --presets abc123\".")
+			os.Exit(1)
+		} else if taskErr != nil {
+			fmt.Println("ERROR: " + taskErr.Error())
+			os.Exit(1)
+		}
+		if arguments["presetname"] == "" {
+			taskPresets := getTaskPresets(taskDetails)
+			var presetNames []string
+			for presetName := range taskPresets {
+				presetNames = append(presetNames, presetName)
+			}
+			sort.Strings(presetNames)
+			for _, presetName := range presetNames {
+				fmt.Println(presetName + "\t" + formatPresetValues(taskPresets[presetName]))
+			}
+			os.Exit(0)
+		}
+		if arguments["presetvalues"] == "" && arguments["remove"] != "true" {
+			fmt.Println("ERROR: Give the preset's values, e.g. \"environment=staging, region=eu-west-1\", or --remove.")
+			os.Exit(1)
+		}
+		if saveErr := savePreset(presetsTaskID, arguments["presetname"], arguments["presetvalues"], "from the command line"); saveErr != nil {
+			fmt.Println("ERROR: " + saveErr.Error())
+			os.Exit(1)
+		}
+		if arguments["remove"] == "true" {
+			fmt.Println("Preset " + arguments["presetname"] + " removed.")
+		} else {
+			fmt.Println("Preset " + arguments["presetname"] + " saved.")
+		}
+	// Show how much of a Task's run quotas (see quotas.go) has been used or, with "--grant", let the Task be run that many more times than
+	// its quotas allow.
+	} else if arguments["quota"] != "" {
+		quotaTaskID := arguments["quota"]
+		if quotaTaskID == "true" {
+			fmt.Println("ERROR: Give the ID of the Task, e.g. \"webconsole task quota abc123\".")
+			os.Exit(1)
+		}
+		if arguments["grant"] != "" {
+			grantedRuns, grantErr := grantQuota(quotaTaskID, arguments["grant"], "from the command line")
+			if grantErr != nil {
+				fmt.Println("ERROR: " + grantErr.Error())
+				os.Exit(1)
+			}
+			fmt.Printf("Task %s can now be run %d times past its quotas.\n", quotaTaskID, grantedRuns)
+			os.Exit(0)
+		}
+		taskDetails, taskErr := getTaskDetails(quotaTaskID)
+		if taskErr != nil {
+			fmt.Println("ERROR: " + taskErr.Error())
+			os.Exit(1)
+		}
+		usageLines, usageErr := describeQuotaUsage(quotaTaskID, taskDetails)
+		for _, usageLine := range usageLines {
+			fmt.Println(usageLine)
+		}
+		if usageErr != nil {
+			fmt.Println("ERROR: " + usageErr.Error())
+			os.Exit(1)
+		}
+	// Run a Task, printing its output to the terminal as it goes. The Task is run the same way as one started from the web interface, so its
+	// logs and run history are recorded as normal.
+	} else if arguments["run"] != "" {
+		runTaskID := arguments["run"]
+		taskDetails, taskErr := getTaskDetails(runTaskID)
+		if runTaskID == "true" {
+			fmt.Println("ERROR: Give the ID of the Task to run, e.g. \"webconsole --run abc123\".")
+			os.Exit(1)
+		} else if taskErr != nil {
+			fmt.Println("ERROR: " + taskErr.Error())
+			os.Exit(1)
+		}
+		runParameters, presetErr := getPresetParameters(taskDetails, arguments["preset"])
+		if presetErr != nil {
+			fmt.Println("ERROR: " + presetErr.Error())
+			os.Exit(1)
+		}
+		// Web Console's own output lines are translated just as they would be by the server - see locale.go.
+		loadMessageCatalogues()
+		if startErr := startTask(runTaskID, taskDetails, runParameters, getCommandLineTrigger()); startErr != nil {
+			fmt.Println("ERROR: " + startErr.Error())
+			os.Exit(1)
+		}
+		if !taskIsRunning(runTaskID) {
+			fmt.Println("ERROR: Task " + runTaskID + " is already running.")
+			os.Exit(1)
+		}
+		// Stop the Task (and any processes it has started) if the user hits Ctrl-C.
+		interruptSignals := make(chan os.Signal, 1)
+		signal.Notify(interruptSignals, os.Interrupt)
+		go func() {
+			<-interruptSignals
+			if cancelRetry(runTaskID) {
+				resetServiceState(runTaskID)
+			}
+			stopTask(runTaskID, "Stopped from the command line.")
+		}()
+		// Print the Task's output as it arrives, checking for new lines the same way the web interface does. If a run fails and is retried
+		// (see retries.go), carry on with the output of each attempt in turn.
+		linesPrinted := 0
+		printingRunID := taskRunIDs[runTaskID]
+		for taskRunning := true; taskRunning; {
+			_, taskRunning = runningTasks[runTaskID]
+			taskRunning = taskRunning || retryPending(runTaskID)
+			if taskRunIDs[runTaskID] != printingRunID {
+				printingRunID = taskRunIDs[runTaskID]
+				linesPrinted = 0
+			}
+			for _, newLine := range getTaskOutputLines(runTaskID, linesPrinted) {
+				linesPrinted = linesPrinted + 1
+				outputLine := newLine.line
+				if arguments["timestamps"] == "true" {
+					outputLine = newLine.timestamp.Format(outputTimestampFormat) + "\t" + outputLine
+				}
+				if newLine.stream == "stderr" {
+					fmt.Fprintln(os.Stderr, outputLine)
+				} else {
+					fmt.Println(outputLine)
+				}
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		if taskRunResults[runTaskID] != "" {
+			os.Exit(1)
+		}
+	// Check the server's and every Task's config, e.g. as part of a deployment pipeline. Exits with the same status the server would refuse to
+	// start with if there's a problem with the server's config, or 1 if there's a problem with a Task.
+	} else if arguments["check"] == "true" {
+		startupSummary, checkExitCode := checkStartupConfig()
+		for _, summaryLine := range startupSummary {
+			fmt.Println(summaryLine)
+		}
+		taskIDs, _ := taskStore.ListTaskIDs()
+		tasksWithProblems := 0
+		for _, taskID := range taskIDs {
+			if taskProblems := checkTaskConfig(taskID); len(taskProblems) > 0 {
+				tasksWithProblems = tasksWithProblems + 1
+				fmt.Println("Task " + taskID + ":")
+				for _, taskProblem := range taskProblems {
+					fmt.Println("  ERROR: " + taskProblem)
+				}
+			}
+		}
+		if checkExitCode == 0 && tasksWithProblems > 0 {
+			checkExitCode = 1
+		}
+		if checkExitCode == 0 {
+			fmt.Printf("Checked %d Tasks - no problems found.\n", len(taskIDs))
 		} else {
+			fmt.Printf("Checked %d Tasks - problems found with %d.\n", len(taskIDs), tasksWithProblems)
+		}
+		os.Exit(checkExitCode)
+	// Remove old runs from the given Task, or all Tasks, as the janitor does (see retention.go).
+	} else if arguments["prune"] != "" {
+		var report []string
+		var pruneErr error
+		if arguments["prune"] == "true" {
+			report, pruneErr = pruneAllRuns()
+		} else {
+			prunedRunIDs, taskPruneErr := pruneTaskRuns(arguments["prune"])
+			report = append(report, fmt.Sprintf("Task %s: %d runs removed.", arguments["prune"], len(prunedRunIDs)))
+			if taskPruneErr != nil {
+				report = append(report, "ERROR: " + taskPruneErr.Error())
+				pruneErr = taskPruneErr
+			}
+		}
+		for _, reportLine := range report {
+			fmt.Println(reportLine)
+		}
+		if pruneErr != nil {
+			os.Exit(1)
+		}
+		if len(report) == 0 {
+			fmt.Println("No runs removed.")
+		}
+	// Install (or uninstall) Web Console as a service - see service.go.
+	} else if arguments["installservice"] == "true" {
+		if installErr := installService(commandLineArguments); installErr != nil {
+			fmt.Println("ERROR: " + installErr.Error())
+			os.Exit(1)
+		}
+		fmt.Println("Web Console installed as a service and started.")
+	} else if arguments["uninstallservice"] == "true" {
+		if uninstallErr := uninstallService(); uninstallErr != nil {
+			fmt.Println("ERROR: " + uninstallErr.Error())
+			os.Exit(1)
+		}
+		fmt.Println("Web Console service stopped and removed.")
+	// Export all Tasks to a zip bundle.
+	} else if arguments["export"] != "" {
+		if arguments["export"] == "true" {
+			fmt.Println("ERROR: Give the path of the file to export to, e.g. \"webconsole --export tasks.zip\".")
+			os.Exit(1)
+		}
+		exportedIDs, exportErr := exportTasks(arguments["export"], arguments["excludesecrets"] == "true")
+		if exportErr != nil {
+			fmt.Println("ERROR: " + exportErr.Error())
+			os.Exit(1)
+		}
+		fmt.Printf("Exported %d Tasks to %s.\n", len(exportedIDs), arguments["export"])
+	// Import the Tasks in a zip bundle.
+	} else if arguments["import"] != "" {
+		if arguments["import"] == "true" {
+			fmt.Println("ERROR: Give the path of the file to import, e.g. \"webconsole --import tasks.zip\".")
+			os.Exit(1)
+		}
+		importedIDs, skippedIDs, importErr := importTasks(arguments["import"], arguments["overwrite"] == "true")
+		for _, importedID := range importedIDs {
+			fmt.Println("Imported Task " + importedID + ".")
+		}
+		for _, skippedID := range skippedIDs {
+			fmt.Println("Skipped Task " + skippedID + " - it already exists (use --overwrite to replace it).")
+		}
+		if importErr != nil {
+			fmt.Println("ERROR: " + importErr.Error())
+			os.Exit(1)
+		}
+	// Clone a Task. The new Task's ID can be given after the source Task's ID ("--clone abc123 def456") or with "--newTaskID".
+	} else if arguments["clone"] != "" {
+		if arguments["clone"] == "true" {
+			fmt.Println("ERROR: Give the ID of the Task to clone, e.g. \"webconsole --clone abc123 def456\".")
+			os.Exit(1)
+		}
+		newTaskID := arguments["newtaskid"]
+		for argPos, argVal := range os.Args {
+			if strings.ToLower(strings.TrimLeft(argVal, "-")) == "clone" && argPos + 2 < len(os.Args) && !strings.HasPrefix(os.Args[argPos + 2], "--") {
+				newTaskID = os.Args[argPos + 2]
+			}
+		}
+		newTaskID, newCredentials, cloneErr := cloneTask(arguments["clone"], newTaskID, arguments["copyfiles"] != "false", nil)
+		if cloneErr != nil {
+			fmt.Println("ERROR: " + cloneErr.Error())
+			os.Exit(1)
+		}
+		fmt.Println("New Task " + newTaskID + " created as a copy of " + arguments["clone"] + ".")
+		for _, credentialKey := range clonedCredentialOrder {
+			if newCredentials[credentialKey] != "" {
+				fmt.Println("New Task's " + credentialKey + ": " + newCredentials[credentialKey])
+			}
+		}
+	// Delete (or archive) a Task, after asking the user to confirm.
+	} else if arguments["delete"] != "" {
+		deleteTaskID := arguments["delete"]
+		taskDetails, taskErr := getTaskDetails(deleteTaskID)
+		if deleteTaskID == "true" {
+			fmt.Println("ERROR: Give the ID of the Task to delete, e.g. \"webconsole --delete abc123\".")
+			os.Exit(1)
+		} else if taskErr != nil {
 			fmt.Println("ERROR: " + taskErr.Error())
+			os.Exit(1)
+		}
+		archiveTask := arguments["archive"] == "true"
+		if arguments["yes"] != "true" {
+			confirmPrompt := "Delete Task " + deleteTaskID + " (" + taskDetails["title"] + "), including its files and run history? This can't be undone. Type \"yes\" to confirm"
+			if archiveTask {
+				confirmPrompt = "Archive Task " + deleteTaskID + " (" + taskDetails["title"] + ") to " + getArchiveRoot() + "? Type \"yes\" to confirm"
+			}
+			if strings.ToLower(getUserInput("confirmdelete", "", confirmPrompt)) != "yes" {
+				fmt.Println("Task not deleted.")
+				os.Exit(1)
+			}
+		}
+		archivePath, deleteErr := deleteTask(deleteTaskID, archiveTask)
+		if deleteErr != nil {
+			fmt.Println("ERROR: " + deleteErr.Error())
+			os.Exit(1)
+		}
+		if archiveTask {
+			fmt.Println("Task " + deleteTaskID + " archived to " + archivePath + ".")
+		} else {
+			fmt.Println("Task " + deleteTaskID + " deleted.")
 		}
 	// Generate a new Task.
 	} else if arguments["new"] == "true" {
@@ -796,13 +4160,17 @@ func main() {
 		if newTaskID, newTaskIDExists = arguments["newtaskid"]; !newTaskIDExists {
 			for {
 				newTaskID = generateRandomString()
-				if _, err := os.Stat(arguments["taskroot"] + "/" + newTaskID); os.IsNotExist(err) {
+				if !taskExists(newTaskID) {
 					break
 				}
 			}
 			newTaskID = getUserInput("newtaskid", newTaskID, "Enter a new Task ID (hit enter to generate an ID)")
 		}
-		if _, err := os.Stat(arguments["taskroot"] + "/" + newTaskID); os.IsNotExist(err) {
+		if idErr := checkTaskID(newTaskID); idErr != nil {
+			fmt.Println("ERROR: " + idErr.Error())
+			os.Exit(1)
+		}
+		if !taskExists(newTaskID) {
 			// We use simple text files in folders for data storage, rather than a database. It seemed the most logical choice - you can stick
 			// any resources associated with a Task in that Task's folder, and editing options can be done with a basic text editor.
 			os.Mkdir(arguments["taskroot"], os.ModePerm)
@@ -845,7 +4213,7 @@ func main() {
 			
 			// Write the config file - a simple text file, one value per line.
 			outputString = outputString + "title: " + newTaskTitle + "\npublic: " + newTaskPublic + "\ncommand: " + newTaskCommand
-			writeFileErr := ioutil.WriteFile(arguments["taskroot"] + "/" + newTaskID + "/config.txt", []byte(outputString), 0644)
+			writeFileErr := taskStore.WriteTaskConfig(newTaskID, []byte(outputString))
 			if writeFileErr != nil {
 				fmt.Println("ERROR: Couldn't write config for Task " + newTaskID + ".")
 			}
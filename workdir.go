@@ -0,0 +1,96 @@
+package main
+// Working folders and search paths - by default a Task runs in its own folder (tasks/ID), with the server's PATH. A Task's "workdir" option
+// runs it somewhere else instead (e.g. a checkout of the code it builds), and its "path" option gives folders to search for commands before the
+// server's PATH (e.g. a particular toolchain's bin folder), so neither needs a wrapper script. Relative folders are relative to the Task's own
+// folder. Both apply to a Task's command and its pipeline steps, but not to Tasks run on an agent, which always run in the agent's own folder
+// for the Task.
+
+import (
+	// Standard libraries.
+	"os"
+	"strings"
+	"os/exec"
+	"path/filepath"
+)
+
+// Returns the full path of the given folder, taking a relative folder to be relative to the given Task's own folder. The path returned is
+// always absolute, as it may be used from a different working folder.
+func getTaskRelativePath(theTaskID string, theFolder string) string {
+	if filepath.IsAbs(theFolder) {
+		return theFolder
+	}
+	if absolutePath, absErr := filepath.Abs(filepath.Join(arguments["taskroot"], theTaskID, theFolder)); absErr == nil {
+		return absolutePath
+	}
+	return filepath.Join(arguments["taskroot"], theTaskID, theFolder)
+}
+
+// Returns the folder the given Task runs in. A Task checked out from git (see gitcheckout.go) runs in its checkout.
+func getTaskWorkDir(theTaskID string, theTaskDetails map[string]string) string {
+	if strings.TrimSpace(theTaskDetails["workdir"]) == "" && taskUsesGit(theTaskDetails) {
+		return getTaskRelativePath(theTaskID, gitCheckoutFolder)
+	}
+	if strings.TrimSpace(theTaskDetails["workdir"]) == "" {
+		return arguments["taskroot"] + "/" + theTaskID
+	}
+	return getTaskRelativePath(theTaskID, strings.TrimSpace(theTaskDetails["workdir"]))
+}
+
+// Returns the folders listed in the given Task's "path" option (separated in the same way as the PATH environment variable - ":", or ";" on
+// Windows), in order.
+func getTaskPathFolders(theTaskID string, theTaskDetails map[string]string) []string {
+	var pathFolders []string
+	for _, pathFolder := range filepath.SplitList(theTaskDetails["path"]) {
+		if strings.TrimSpace(pathFolder) != "" {
+			pathFolders = append(pathFolders, getTaskRelativePath(theTaskID, strings.TrimSpace(pathFolder)))
+		}
+	}
+	return pathFolders
+}
+
+// Returns the PATH environment variable for the given Task - the folders in its "path" option followed by the server's own PATH - or a blank
+// string if the Task doesn't add anything to the PATH.
+func getTaskPathVariable(theTaskID string, theTaskDetails map[string]string) string {
+	pathFolders := getTaskPathFolders(theTaskID, theTaskDetails)
+	if len(pathFolders) == 0 {
+		return ""
+	}
+	return "PATH=" + strings.Join(append(pathFolders, os.Getenv("PATH")), string(os.PathListSeparator))
+}
+
+// Returns the full path of the given command if it's found in one of the given Task's "path" folders, otherwise the command as given (to be
+// found in the server's PATH as usual). Commands given with a path of their own are left alone.
+func findTaskCommand(theTaskID string, theTaskDetails map[string]string, theCommand string) string {
+	if strings.ContainsAny(theCommand, "/\\") {
+		return theCommand
+	}
+	for _, pathFolder := range getTaskPathFolders(theTaskID, theTaskDetails) {
+		if commandPath, lookErr := exec.LookPath(filepath.Join(pathFolder, theCommand)); lookErr == nil {
+			return commandPath
+		}
+	}
+	return theCommand
+}
+
+// Check that the given Task's working folder and "path" folders exist.
+func checkTaskFolders(theTaskID string, theTaskDetails map[string]string) []string {
+	var problems []string
+	checkFolder := func(theDescription string, theFolder string) {
+		if folderInfo, statErr := os.Stat(theFolder); statErr != nil {
+			problems = append(problems, theDescription + " \"" + theFolder + "\" can't be found.")
+		} else if !folderInfo.IsDir() {
+			problems = append(problems, theDescription + " \"" + theFolder + "\" isn't a folder.")
+		}
+	}
+	if theTaskDetails["runner"] != "" {
+		return problems
+	}
+	// A Task checked out from git has its working folder created when it's first cloned.
+	if strings.TrimSpace(theTaskDetails["workdir"]) != "" && !taskUsesGit(theTaskDetails) {
+		checkFolder("Working folder", getTaskWorkDir(theTaskID, theTaskDetails))
+	}
+	for _, pathFolder := range getTaskPathFolders(theTaskID, theTaskDetails) {
+		checkFolder("Path folder", pathFolder)
+	}
+	return problems
+}
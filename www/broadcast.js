@@ -0,0 +1,25 @@
+// Shows the current broadcast message (set by an admin via the api/admin/setBroadcast API call) as a banner at the top of the page. We check for a
+// new message every 30 seconds, so pages that are already open get the message too. Once the user dismisses a message it isn't shown again.
+function updateBroadcast() {
+	$.post("api/getBroadcast", {}, function(result) {
+		broadcast = JSON.parse(result);
+		if (broadcast.message == undefined || localStorage.getItem("dismissedBroadcast") == broadcast.id) {
+			$("#broadcastBanner").remove();
+		} else if ($("#broadcastBanner").attr("name") != broadcast.id) {
+			$("#broadcastBanner").remove();
+			broadcastBanner = $("<div class='alert alert-warning alert-dismissible m-3' role='alert' id='broadcastBanner'><span></span><button type='button' class='btn-close' aria-label='Close'></button></div>");
+			broadcastBanner.attr("name", broadcast.id);
+			broadcastBanner.find("span").text(broadcast.message);
+			broadcastBanner.find("button").click(function() {
+				localStorage.setItem("dismissedBroadcast", broadcast.id);
+				$("#broadcastBanner").remove();
+			});
+			$("body").prepend(broadcastBanner);
+		}
+	});
+}
+
+$(document).ready(function() {
+	updateBroadcast();
+	setInterval(updateBroadcast, 30000);
+});